@@ -13,6 +13,11 @@ type Cache interface {
 	// Store the session under id key.
 	Set(key string, session Session)
 
+	// SetIfAbsent stores the session under id key only if there
+	// is no session with that id yet, and reports whether it did.
+	// The check and the store are atomic.
+	SetIfAbsent(key string, session Session) bool
+
 	// Get fetches the session correspoding to the session id key,
 	// and returns (point to the session, true) if the id exsits.
 	// Otherwise, Get returns (nil, false).
@@ -20,49 +25,111 @@ type Cache interface {
 
 	// Delete the entry if the key exists.
 	Delete(key string)
+
+	// Len returns the number of sessions in the cache.
+	Len() int
+
+	// Range calls f for every session in the cache, without
+	// changing their order. f may modify the cache.
+	Range(f func(key string, session Session))
 }
 
 type cache struct {
-	sync.RWMutex
-
+	sync.Mutex
 	capacity int
-	queue    *list.List // back of the queue is the oldest
+	queue    *list.List // back of the queue is the least recently used
 	items    map[string]*list.Element
+	onEvict  func(key string, session Session)
+}
+
+type cacheEntry struct {
+	key     string
+	session Session
 }
 
 // NewSimpleLRUCache generates a simple cache with capacity, and
-// implements a simple LRU eviction policy.
+// implements a simple LRU eviction policy. Sessions are kept in a
+// list ordered by their last use, so eviction always removes the
+// least recently used session in constant time.
 func NewSimpleLRUCache(capacity int) Cache {
+	return newLRUCache(capacity, nil)
+}
+
+// newLRUCache creates an LRU cache which calls onEvict (if not nil)
+// whenever it evicts a session to make room. onEvict is called by the
+// Set or SetIfAbsent that caused the eviction, once the session is out
+// of the cache and the lock is released, so it may use the cache.
+func newLRUCache(capacity int, onEvict func(key string, session Session)) *cache {
 	c := &cache{
 		capacity: capacity,
 		queue:    list.New(),
 		items:    make(map[string]*list.Element),
+		onEvict:  onEvict,
 	}
 	return c
 }
 
 func (c *cache) Set(key string, session Session) {
 	c.Lock()
-	defer c.Unlock()
-	elem := c.queue.PushFront(session)
-	c.items[key] = elem
 
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*cacheEntry).session = session
+		c.queue.MoveToFront(elem)
+		c.Unlock()
+		return
+	}
+	evicted := c.insert(key, session)
+	c.Unlock()
+	c.evicted(evicted)
+}
+
+func (c *cache) SetIfAbsent(key string, session Session) bool {
+	c.Lock()
+	if _, ok := c.items[key]; ok {
+		c.Unlock()
+		return false
+	}
+	evicted := c.insert(key, session)
+	c.Unlock()
+	c.evicted(evicted)
+	return true
+}
+
+// insert adds a new entry for key, and evicts the least recently used
+// session if the cache is over capacity. It returns the evicted entry,
+// if any. The lock must be held.
+func (c *cache) insert(key string, session Session) *cacheEntry {
+	c.items[key] = c.queue.PushFront(&cacheEntry{key: key, session: session})
 	// -1 indicates infinite capacity
 	if c.queue.Len() > c.capacity && c.capacity != -1 {
-		delete(c.items, c.queue.Back().Value.(Session).Id())
-		c.queue.Remove(c.queue.Back())
+		oldest := c.queue.Back()
+		entry := oldest.Value.(*cacheEntry)
+		delete(c.items, entry.key)
+		c.queue.Remove(oldest)
+		return entry
+	}
+	return nil
+}
+
+// evicted calls onEvict for the entry evicted by insert. The lock must
+// not be held.
+func (c *cache) evicted(entry *cacheEntry) {
+	if entry != nil && c.onEvict != nil {
+		c.onEvict(entry.key, entry.session)
 	}
 }
 
 func (c *cache) Get(key string) (Session, bool) {
-	c.RLock()
-	defer c.RUnlock()
+	// Get changes the order of the queue, so it needs the write
+	// lock.
+	c.Lock()
+	defer c.Unlock()
 	elem, ok := c.items[key]
 	if !ok {
 		return nil, ok
 	}
 	c.queue.MoveToFront(elem)
-	return elem.Value.(Session), true
+	return elem.Value.(*cacheEntry).session, true
 }
 
 func (c *cache) Delete(key string) {
@@ -72,7 +139,25 @@ func (c *cache) Delete(key string) {
 	if !ok { // if key's not in the cache, no problem
 		return
 	}
-
 	c.queue.Remove(elem)
 	delete(c.items, key)
 }
+
+func (c *cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.queue.Len()
+}
+
+func (c *cache) Range(f func(key string, session Session)) {
+	c.Lock()
+	entries := make([]*cacheEntry, 0, c.queue.Len())
+	for e := c.queue.Front(); e != nil; e = e.Next() {
+		entries = append(entries, e.Value.(*cacheEntry))
+	}
+	c.Unlock()
+
+	for _, entry := range entries {
+		f(entry.key, entry.session)
+	}
+}
@@ -1,9 +1,15 @@
 package sgx_server
 
-import "testing"
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func nilSession(id string) Session {
-	return NewSession(id, 0, nil, nil, nil, nil)
+	return NewSession(id, false, -1, nil, nil, nil, nil, nil, 0, 0)
 }
 
 func TestLRUCache(t *testing.T) {
@@ -28,3 +34,124 @@ func TestLRUCache(t *testing.T) {
 		t.Fatal("The first element should have been evicted.")
 	}
 }
+
+func TestLRUCacheUpdate(t *testing.T) {
+	cache := NewSimpleLRUCache(2)
+	cache.Set("0", nilSession("0"))
+	cache.Set("1", nilSession("1"))
+	// Setting an existing key counts as using it.
+	cache.Set("0", nilSession("0"))
+	cache.Set("2", nilSession("2"))
+
+	if _, ok := cache.Get("1"); ok {
+		t.Fatal("The least recently used element should have been evicted.")
+	}
+	if _, ok := cache.Get("0"); !ok {
+		t.Fatal("The updated element should not have been evicted.")
+	}
+}
+
+func TestLRUCacheRange(t *testing.T) {
+	cache := NewSimpleLRUCache(3)
+	for _, key := range []string{"0", "1", "2"} {
+		cache.Set(key, nilSession(key))
+	}
+
+	var keys []string
+	cache.Range(func(key string, session Session) {
+		keys = append(keys, key)
+		// Deleting while ranging must not deadlock.
+		cache.Delete(key)
+	})
+	if strings.Join(keys, "") != "210" {
+		t.Fatal("Range should visit the most recently used first, got:", keys)
+	}
+	if cache.Len() != 0 {
+		t.Fatal("All sessions should have been deleted.")
+	}
+}
+
+// mapScanCache is the naive alternative to the list based LRU cache:
+// it finds the least recently used session by scanning every entry.
+type mapScanCache struct {
+	capacity int
+	items    map[string]mapScanEntry
+}
+
+type mapScanEntry struct {
+	session  Session
+	lastUsed time.Time
+}
+
+func (c *mapScanCache) Set(key string, session Session) {
+	c.items[key] = mapScanEntry{session, time.Now()}
+	if len(c.items) > c.capacity {
+		var oldest string
+		var oldestTime time.Time
+		for k, entry := range c.items {
+			if oldest == "" || entry.lastUsed.Before(oldestTime) {
+				oldest, oldestTime = k, entry.lastUsed
+			}
+		}
+		delete(c.items, oldest)
+	}
+}
+
+const benchmarkCapacity = 10000
+
+func benchmarkCacheSet(b *testing.B, cache interface{ Set(string, Session) }) {
+	session := nilSession("0")
+	keys := make([]string, benchmarkCapacity+b.N)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	for _, key := range keys[:benchmarkCapacity] {
+		cache.Set(key, session)
+	}
+
+	b.ResetTimer()
+	for _, key := range keys[benchmarkCapacity:] {
+		cache.Set(key, session)
+	}
+}
+
+func BenchmarkLRUCacheEviction(b *testing.B) {
+	benchmarkCacheSet(b, NewSimpleLRUCache(benchmarkCapacity))
+}
+
+func BenchmarkMapScanEviction(b *testing.B) {
+	benchmarkCacheSet(b, &mapScanCache{
+		capacity: benchmarkCapacity,
+		items:    make(map[string]mapScanEntry),
+	})
+}
+
+func TestLRUCacheSetIfAbsent(t *testing.T) {
+	cache := NewSimpleLRUCache(-1)
+
+	const workers = 32
+	stored := make(chan bool, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stored <- cache.SetIfAbsent("0", nilSession("0"))
+		}()
+	}
+	wg.Wait()
+	close(stored)
+
+	count := 0
+	for ok := range stored {
+		if ok {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatal("Exactly one session should be stored under an id, got", count)
+	}
+	if cache.Len() != 1 {
+		t.Fatal("Expected one session, got", cache.Len())
+	}
+}
@@ -1,13 +1,25 @@
 package sgx_server
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Configuration struct {
@@ -15,42 +27,98 @@ type Configuration struct {
 	// meaning it will connect to the production version of IAS.
 	Release bool
 
+	// Environment optionally declares where this server runs,
+	// either ENV_PRODUCTION or ENV_DEVELOPMENT. If it is set, the
+	// session manager refuses to start unless Release matches it
+	// (i.e., release mode in production and development mode in
+	// development), which catches a production server pointed at
+	// the development IAS and vice versa. Note that debug enclaves
+	// cannot be told apart by their MREnclave, so they are caught
+	// by the DEBUG attribute of their quotes in release mode.
+	Environment string
+
 	// The subscription key for IAS API. This can be found at
 	// https://api.portal.trustedservices.intel.com
 	Subscription string
 
 	// The directory that contains all the MREnclave files
-	// that are acceptable for this session manager.
+	// that are acceptable for this session manager. Each file
+	// holds one measurement, either hex or base64 encoded.
 	Mrenclaves string
 
 	// The directory that contains all the MRSigner files
 	// that are acceptable for this session manager.
 	Mrsigners string
 
-	// Hex encoded SPID for IAS API. This can be found at
-	// https://api.portal.trustedservices.intel.com
+	// If MeasurementsFS is set, Mrenclaves and Mrsigners are
+	// directories in it rather than on the local filesystem. This
+	// lets a single binary carry its trusted measurements, e.g.,
+	// in an embed.FS. It can only be set in code.
+	MeasurementsFS fs.FS `json:"-"`
+
+	// MeasurementPolicy decides whether an enclave must match
+	// Mrenclaves, Mrsigners, or both. See the MEASUREMENT_*
+	// constants for the rule of each mode. The directory of a
+	// list the policy does not use may be left empty. In every
+	// mode, the enclave must also match ProdID and be at least
+	// ProdSVN.
+	MeasurementPolicy MeasurementPolicy
+
+	// If MaxMeasurementAge is set, the session manager refuses to
+	// start if none of the MR files in Mrenclaves and Mrsigners
+	// was modified in the past MaxMeasurementAge hours, which
+	// catches trusted measurements that were never rotated. Files
+	// without a modification time, such as those of an embed.FS,
+	// count as old. It is 0 (off) by default.
+	MaxMeasurementAge int
+
+	// Hex (or base64) encoded SPID for IAS API. This can be
+	// found at https://api.portal.trustedservices.intel.com
 	Spid string
 
+	// LinkableSignatures must be true if the SPID is provisioned
+	// for linkable EPID signatures, and false (the default) if it
+	// is for unlinkable ones. Message 2 asks the enclave for a
+	// quote of that type, and quotes of the other type are
+	// rejected with ErrSignTypeMismatch before reaching IAS.
+	LinkableSignatures bool
+
 	// The file that contains a PEM encoded long-term ECDSA P-256
 	// (SECP256R1) private key for establishing the session. The
 	// public key component of this key should be built-in to the
 	// client enclave.
 	LongTermKey string
 
-	// If True, then it will either prompt the user to type in the
-	// password, or use LongTermKeyPassword field to decrypt the
-	// long term key.
+	// Files that contain additional long-term keys, in the same
+	// format as LongTermKey. During a key rotation, clients built
+	// with an older key can select it by sending the hash of its
+	// public key in message 1. Clients that do not send a hash
+	// are always served using LongTermKey.
+	SecondaryLongTermKeys []string
+
+	// If True, then it will either read the password using
+	// PasswordReader, or use LongTermKeyPassword field to decrypt
+	// the long term key (and the secondary keys).
 	LongTermKeyEncrypted bool
 
 	// If LongTermKeyEncrypted is true, and this password is set
-	// to an empty string, the program will prompt user for
-	// input. Otherwise, LongTermKeyPassword is used as the
-	// password.
+	// to an empty string, the password is read using
+	// PasswordReader. Otherwise, LongTermKeyPassword is used as
+	// the password.
 	LongTermKeyPassword string
 
+	// PasswordReader reads the password of the encrypted long
+	// term key if LongTermKeyPassword is empty. If nil, the user
+	// is prompted on the terminal (see TerminalPasswordReader).
+	// It can only be set in code.
+	PasswordReader PasswordReader `json:"-"`
+
 	// AllowedAdvisories maps an error during quote verification
 	// to which advisories we are allowed to ignore. Current valid
 	// keys are: ["CONFIGURATION_NEEDED", "GROUP_OUT_OF_DATE"].
+	// A quote with one of these statuses is only accepted if all
+	// of the advisories IAS returns are in the list for that
+	// status; if even one is not, the quote is rejected.
 	// Be careful to not set this too liberally.
 	AllowedAdvisories map[string][]string
 
@@ -64,19 +132,326 @@ type Configuration struct {
 	// with higher SVN is accepted. It must be a 16-bit int.
 	ProdSVN int
 
+	// ProdSVNs maps the production IDs of other enclaves from the
+	// same signer to their own minimum security version numbers,
+	// for signers that ship several products with independent
+	// security baselines. Enclaves with a ProdID in ProdSVNs are
+	// accepted alongside ProdID, and need at least the SVN it
+	// maps to. If ProdID itself is in ProdSVNs, its entry takes
+	// precedence over ProdSVN. In the configuration file, the keys
+	// are strings, e.g., {"3": 2, "7": 5}. Both the keys and the
+	// values must be 16-bit ints.
+	ProdSVNs map[int]int
+
 	// The maximum number of concurrent sessions the session
 	// manager will keep alive. If MaxSessions is -1, then we
-	// allow unlimited number of sessions.
+	// allow unlimited number of sessions. -1 is the only
+	// negative value allowed, and 0 is refused, since every new
+	// session would be evicted right away. Defaults to
+	// DEFAULT_MAX_SESSIONS.
 	MaxSessions int
 
+	// The maximum number of handshakes whose message 3 is being
+	// verified at the same time, which is when IAS is contacted.
+	// Unlike MaxSessions, this bounds the work in progress rather
+	// than the sessions kept. A message 3 over the limit fails
+	// right away with ErrBusy instead of waiting, so that a load
+	// balancer in front can send the client elsewhere. If
+	// MaxInFlightHandshakes is 0, there is no limit.
+	MaxInFlightHandshakes int
+
 	// A session times out after Timeout minutes.
 	// If there is no activity for this session within the past
 	// Timeout minutes, the manager will remove the session,
 	// and the client will have to reauthenticate itself.
 	// If Timeout is -1, then a session will never expire.
 	// except if there are more than MaxSessions sessions,
-	// then the oldest ones will be removed.
+	// then the oldest ones will be removed. -1 is the only
+	// negative value allowed, and 0 is refused, since every
+	// session would expire right away. Defaults to
+	// DEFAULT_TIMEOUT.
 	Timeout int
+
+	// MaxSessionTimeout bounds the timeout, in minutes, that
+	// Session.SetTimeout can give a single session. If it is 0,
+	// sessions can only be given a timeout up to Timeout, i.e.,
+	// only shortened. If it is -1, there is no bound.
+	MaxSessionTimeout int
+
+	// The signature revocation list for the client's EPID group
+	// is fetched from IAS and sent in message 2, unless SkipSigRL
+	// is true. Deployments that do not use a SigRL (e.g., private
+	// EPID groups) can set it to always send an empty list and
+	// save a round trip to IAS.
+	SkipSigRL bool
+
+	// PEM encoded TLS client certificate and private key files
+	// used to authenticate to IAS. These are only needed if the
+	// IAS traffic goes through a gateway that requires mutual
+	// TLS, and are ignored if IASClientCert is empty.
+	IASClientCert string
+	IASClientKey  string
+
+	// A file with the PEM encoded root CA certificates the IAS
+	// report signing certificate must chain up to, for the IAS
+	// selected by Release, e.g., the root of an IAS emulator. If
+	// IASReportSigningRoot is empty, the reports must be signed
+	// under the Intel report signing CA, which is built in.
+	IASReportSigningRoot string
+
+	// The maximum number of quotes the session manager will send
+	// to IAS for verification per day (reset at midnight UTC).
+	// Once the limit is reached, message 3 is rejected without
+	// contacting IAS. If MaxIASCallsPerDay is 0, there is no
+	// limit.
+	MaxIASCallsPerDay int
+
+	// The maximum number of requests (quote verifications and
+	// SigRL fetches) the session manager sends to IAS at the
+	// same time. Requests over the limit wait in line rather
+	// than open more connections to IAS, which would eventually
+	// get rate limited. A request that waits for more than
+	// IASQueueTimeout seconds fails with ErrIASBusy; if
+	// IASQueueTimeout is 0, it waits as long as it takes. If
+	// IASMaxConcurrent is 0, there is no limit.
+	IASMaxConcurrent int
+	IASQueueTimeout  int
+
+	// Each request to IAS fails if it does not complete within
+	// IASTimeout seconds. If IASTimeout is 0, the default of
+	// DEFAULT_IAS_TIMEOUT is used.
+	IASTimeout int
+
+	// IASEndpoints, if not empty, replaces the Intel endpoint for
+	// the release mode (e.g., with a proxy and a backup proxy).
+	// The endpoints are tried in order, and a request only fails
+	// over to the next one if the previous one is unreachable or
+	// answers with a server error (5xx). See WithEndpoints.
+	IASEndpoints []string
+
+	// If IASInsecureSkipTLSVerify is true, the TLS certificate of
+	// the IAS endpoints is not verified, e.g., for a local IAS
+	// emulator with a self-signed certificate. It is only allowed
+	// in development mode, with the root of the emulator in
+	// IASReportSigningRoot: the session manager refuses to start
+	// if Release is also true or IASReportSigningRoot is empty,
+	// and warns at startup otherwise. NEVER set it outside of
+	// development.
+	IASInsecureSkipTLSVerify bool
+
+	// The session manager never sends the same nonce to IAS twice
+	// among the last IASNonceCacheSize nonces, sent within the
+	// last IASNonceCacheTTL seconds. If 0, DEFAULT_NONCE_CACHE_SIZE
+	// and DEFAULT_NONCE_CACHE_TTL are used. See WithNonceCache.
+	IASNonceCacheSize int
+	IASNonceCacheTTL  int
+
+	// IASUserAgent is the User-Agent of the requests to IAS. If
+	// empty, DEFAULT_IAS_USER_AGENT is used.
+	IASUserAgent string
+
+	// If TraceHandshake is true, the session manager logs the
+	// interesting fields of each attestation message (e.g., the
+	// EPID group id, the SigRL length, whether the message 3 MAC
+	// verified, and the quote status from IAS). Key material is
+	// never logged. This is meant for debugging a new client
+	// enclave, and is very verbose.
+	TraceHandshake bool
+
+	// LogRedaction is what is left out of the logs, see the
+	// REDACT_* levels. Secrets are never logged, whatever the
+	// level. If LogRedaction is empty, REDACT_SECRETS is used.
+	LogRedaction RedactionLevel
+
+	// The minimum TCB evaluation data number IAS must have used
+	// to verify a quote. This is only reported by version 4 (or
+	// later) of the IAS API. If MinTCBEvaluationDataNumber is 0,
+	// any number is accepted.
+	MinTCBEvaluationDataNumber int
+
+	// If AllowCachedOnIASOutage is true and IAS cannot be reached
+	// (i.e., a network error or a server error, not a rejection),
+	// a quote is accepted if the exact same quote was successfully
+	// verified within the past MaxCachedReportAge minutes. Since
+	// the report data of a quote binds the keys of its handshake,
+	// this only covers a message 3 that was already verified, e.g.,
+	// by Session.ProbeMsg3, and never a new handshake. Sessions
+	// are not verified again from the cache, see ReverifyInterval.
+	// This trades strictness for availability, and should only be
+	// used in low-assurance deployments. Off by default.
+	AllowCachedOnIASOutage bool
+	MaxCachedReportAge     int
+
+	// Hex encoded EPID group ids, as they appear in the IAS SigRL
+	// URL, whose SigRLs are pre-fetched by SessionManager.Warm.
+	// These are usually the groups of the platforms expected to
+	// connect to this server.
+	SigRLGroups []string
+
+	// A fetched SigRL is reused for SigRLCacheTime minutes before
+	// it is fetched from IAS again. If SigRLCacheTime is 0, the
+	// SigRL is fetched for every message 2, and Warm only
+	// establishes the connection to IAS.
+	SigRLCacheTime int
+
+	// The enclave ATTRIBUTES (flags and XFRM) and MISCSELECT in
+	// the quote must match the expected values in the bits set in
+	// the corresponding mask, e.g., setting SGX_FLAGS_KSS in
+	// AttributesFlagsMask but not in AttributesFlags forbids KSS
+	// enclaves. All masks are 0 by default, which only enforces
+	// that the DEBUG flag is not set in release mode (which is
+	// always enforced).
+	AttributesFlagsMask uint64
+	AttributesFlags     uint64
+	XFRMMask            uint64
+	XFRM                uint64
+	MiscSelectMask      uint32
+	MiscSelect          uint32
+
+	// The number of random bytes in the challenge sent to the
+	// client along with the session id. It must be at least
+	// MIN_CHALLENGE_LENGTH. If ChallengeLength is 0, the default
+	// of DEFAULT_CHALLENGE_LENGTH bytes is used.
+	ChallengeLength int
+
+	// The maximum number of messages (sealed and opened combined)
+	// a session can handle before Seal and Open fail, and the
+	// client has to attest again to re-key. If
+	// MaxMessagesPerSession is 0, there is no limit.
+	MaxMessagesPerSession int
+
+	// An optional TCB baseline checked against the quote, on top
+	// of the quote status from IAS. MinCPUSVN is the hex encoded
+	// 16 byte CPUSVN; each of its components must be at least the
+	// corresponding byte of MinCPUSVN. The quoting enclave and
+	// provisioning certification enclave SVNs must be at least
+	// MinQESVN and MinPCESVN. Empty or 0 values are not checked.
+	MinCPUSVN string
+	MinQESVN  int
+	MinPCESVN int
+
+	// For enclaves using Key Separation and Sharing (KSS), the
+	// quote must carry the hex encoded 16 byte ISVFamilyID and 64
+	// byte ConfigID, and a config SVN of at least MinConfigSVN.
+	// Empty or 0 values are not checked, which is the default,
+	// since these fields are all 0 for enclaves without KSS.
+	ISVFamilyID  string
+	ConfigID     string
+	MinConfigSVN int
+
+	// If InvalidateOnSVNRaise is true, raising ProdSVN with
+	// SessionManager.ReloadProdSVN closes the authenticated
+	// sessions whose enclave SVN is below the new minimum, and
+	// the sessions still in the middle of the handshake (since
+	// they were started under the old minimum). This stops
+	// enclaves with a known vulnerability right away, at the cost
+	// of making every affected client attest again. If false
+	// (the default), existing sessions keep running under the
+	// minimum they were started with, and only new sessions use
+	// the new minimum.
+	InvalidateOnSVNRaise bool
+
+	// If ReverifyInterval is not 0, the quote of every
+	// authenticated session is sent to IAS again every
+	// ReverifyInterval minutes, and the session is closed if IAS
+	// no longer accepts it, e.g., because its group went out of
+	// date or a new advisory is not allowed. This catches
+	// platforms that became untrusted while their session is
+	// alive, at the cost of an IAS call per session and interval.
+	// If IAS cannot be reached, the session is kept and tried
+	// again at the next interval, without falling back to cached
+	// reports. It is 0 (off) by default.
+	ReverifyInterval int
+
+	// If RequireClientNonce is true, every message 1 must carry a
+	// random client nonce of MIN_CLIENT_NONCE_SIZE to
+	// MAX_CLIENT_NONCE_SIZE bytes, and a nonce already sent in
+	// the last ClientNonceWindow seconds, for any session, fails
+	// with ErrReplayedNonce. Together with the challenge, both
+	// sides then contribute to the freshness of the handshake. If
+	// ClientNonceWindow is 0, DEFAULT_CLIENT_NONCE_WINDOW is
+	// used. It is off by default, since older clients do not send
+	// a nonce.
+	RequireClientNonce bool
+	ClientNonceWindow  int
+
+	// Msg4Payload is application data (e.g., a service endpoint
+	// or a capability token) sent to every enclave that passes
+	// attestation, sealed with SK in the payload of message 4. In
+	// the configuration file, it is base64 encoded. It can be at
+	// most MAX_MSG4_PAYLOAD_SIZE bytes. A payload returned by the
+	// callback set with WithOnVerified replaces it.
+	Msg4Payload []byte
+}
+
+// The largest Configuration.Msg4Payload, before it is sealed.
+const MAX_MSG4_PAYLOAD_SIZE = 4096
+
+// Values for Configuration.Environment.
+const (
+	ENV_PRODUCTION  = "production"
+	ENV_DEVELOPMENT = "development"
+)
+
+// MeasurementPolicy is how the MREnclaves and the MRSigners that a
+// session manager accepts are combined.
+type MeasurementPolicy string
+
+// Values for Configuration.MeasurementPolicy.
+const (
+	// The MREnclave of the enclave must be one of Mrenclaves, and
+	// its MRSigner must be one of Mrsigners. This is the default.
+	MEASUREMENT_BOTH MeasurementPolicy = "both"
+	// The MREnclave of the enclave must be one of Mrenclaves. The
+	// MRSigner is not checked. This pins exact builds of the
+	// enclave.
+	MEASUREMENT_MRENCLAVE_ONLY MeasurementPolicy = "mrenclave"
+	// The MRSigner of the enclave must be one of Mrsigners. The
+	// MREnclave is not checked, so any enclave signed by a
+	// trusted key with the right ProdID and ProdSVN is accepted.
+	MEASUREMENT_MRSIGNER_ONLY MeasurementPolicy = "mrsigner"
+	// Either the MREnclave of the enclave must be one of
+	// Mrenclaves, or its MRSigner must be one of Mrsigners.
+	MEASUREMENT_EITHER MeasurementPolicy = "either"
+)
+
+// Bounds for the client nonce in message 1, and the window in which
+// it must be unique, see Configuration.RequireClientNonce. At most
+// CLIENT_NONCE_CACHE_SIZE nonces are remembered, so under heavy load
+// the window is shorter.
+const (
+	MIN_CLIENT_NONCE_SIZE       = 16
+	MAX_CLIENT_NONCE_SIZE       = 64
+	DEFAULT_CLIENT_NONCE_WINDOW = 3600
+	CLIENT_NONCE_CACHE_SIZE     = 1 << 16
+)
+
+// Defaults for Configuration.MaxSessions, and Configuration.Timeout
+// in minutes.
+const (
+	DEFAULT_MAX_SESSIONS = 10000
+	DEFAULT_TIMEOUT      = 10
+)
+
+// Bounds for Configuration.ChallengeLength.
+const (
+	DEFAULT_CHALLENGE_LENGTH = 32
+	MIN_CHALLENGE_LENGTH     = 16
+)
+
+// DefaultConfiguration returns a Configuration with the default
+// values filled in. ReadConfiguration reads the configuration file on
+// top of these values, so fields missing from the file keep their
+// defaults.
+func DefaultConfiguration() *Configuration {
+	return &Configuration{
+		MaxSessions:       DEFAULT_MAX_SESSIONS,
+		Timeout:           DEFAULT_TIMEOUT,
+		ChallengeLength:   DEFAULT_CHALLENGE_LENGTH,
+		MeasurementPolicy: MEASUREMENT_BOTH,
+		LogRedaction:      REDACT_SECRETS,
+		ClientNonceWindow: DEFAULT_CLIENT_NONCE_WINDOW,
+	}
 }
 
 // Internal configuration used to create a session manager.
@@ -85,78 +460,763 @@ type configuration struct {
 	subscription      string
 	mrenclaves        [][MR_SIZE]byte
 	mrsigners         [][MR_SIZE]byte
+	measurementPolicy MeasurementPolicy
+	maxMRAge          int
 	spid              []byte
+	linkable          bool
 	longTermKey       *ecdsa.PrivateKey
+	secondaryKeys     []*ecdsa.PrivateKey
 	allowedAdvisories map[string][]string
 	prodID            uint16
 	prodSVN           uint16
+	prodSVNs          map[uint16]uint16
 	maxSessions       int
+	maxInFlight       int
 	timeout           int
+	maxTimeout        int
+	useSigRL          bool
+	iasClientCert     *tls.Certificate
+	signingRoots      *x509.CertPool
+	maxIASCallsPerDay int
+	iasMaxConcurrent  int
+	iasQueueTimeout   int
+	iasTimeout        int
+	iasUserAgent      string
+	iasEndpoints      []string
+	iasInsecure       bool
+	nonceCacheSize    int
+	nonceCacheTTL     int
+	traceHandshake    bool
+	redaction         RedactionLevel
+	minTCBEvaluation  int
+	allowCachedReport bool
+	maxCachedAge      int
+	sigRLGroups       [][]byte
+	sigRLCacheTime    int
+	flagsMask         uint64
+	flags             uint64
+	xfrmMask          uint64
+	xfrm              uint64
+	miscSelectMask    uint32
+	miscSelect        uint32
+	challengeLength   int
+	maxMessages       int
+	minCPUSVN         []byte
+	minQESVN          uint16
+	minPCESVN         uint16
+	isvFamilyID       []byte
+	configID          []byte
+	minConfigSVN      uint16
+	invalidateOnRaise bool
+	reverifyInterval  int
+	requireNonce      bool
+	nonceWindow       int
+	msg4Payload       []byte
+
+	// logger, rand, and onVerified are not part of the
+	// configuration file, and are set by the session manager. If
+	// rand is nil, keys are generated using crypto/rand.
+	logger     Logger
+	rand       io.Reader
+	onVerified func(sn Session) ([]byte, error)
 }
 
-func readMRs(dir string) [][MR_SIZE]byte {
-	mrFiles, err := ioutil.ReadDir(dir)
+// osFS is the local filesystem as an fs.FS. Unlike os.DirFS, it
+// takes the paths as they are, so both relative and absolute paths
+// work like with os.Open.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// measurementsFS returns the filesystem the MR directories of config
+// are in.
+func measurementsFS(config *Configuration) fs.FS {
+	if config.MeasurementsFS != nil {
+		return config.MeasurementsFS
+	}
+	return osFS{}
+}
+
+// readMR reads a hex encoded measurement from file in fsys.
+// Surrounding whitespace (e.g., a trailing newline) is ignored.
+func readMR(fsys fs.FS, file string) ([MR_SIZE]byte, error) {
+	var mr [MR_SIZE]byte
+	raw, err := fs.ReadFile(fsys, file)
 	if err != nil {
-		log.Fatal("Could not read mr directory:", err)
+		return mr, fmt.Errorf("Could not read the MR file %s: %w", file, err)
 	}
 
-	mrs := make([][MR_SIZE]byte, len(mrFiles))
-	for i, mr := range mrFiles {
+	decoded, err := decodeHexOrBase64("MR file "+file, string(bytes.TrimSpace(raw)), MR_SIZE)
+	if err != nil {
+		return mr, err
+	}
+	copy(mr[:], decoded)
+	return mr, nil
+}
+
+// loadMRs reads every MR file in dir in fsys, except for the
+// .gitignore. The error tells apart a missing path from a file given
+// in place of the directory.
+func loadMRs(fsys fs.FS, dir string) ([][MR_SIZE]byte, error) {
+	if dir == "" {
+		return nil, errors.New("No MR directory is configured.")
+	}
+	info, err := fs.Stat(fsys, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.New(fmt.Sprintf("MR directory %s does not exist.", dir))
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read the MR directory %s: %w", dir, err)
+	} else if !info.IsDir() {
+		return nil, errors.New(fmt.Sprintf("MR path %s is a file, expected a directory of MR files.", dir))
+	}
+
+	mrFiles, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the MR directory %s: %w", dir, err)
+	}
+
+	var mrs [][MR_SIZE]byte
+	for _, mr := range mrFiles {
 		if mr.Name() == ".gitignore" {
 			continue
 		}
 
-		mhex, err := ioutil.ReadFile(path.Join(dir, mr.Name()))
+		parsed, err := readMR(fsys, path.Join(dir, mr.Name()))
 		if err != nil {
-			log.Fatal("Could not read the MR.")
+			return nil, err
+		}
+		mrs = append(mrs, parsed)
+	}
+	return mrs, nil
+}
+
+// checkMeasurementAge returns an error unless one of the MR files in
+// dirs was modified within maxAge of now. Empty dirs are skipped.
+func checkMeasurementAge(fsys fs.FS, maxAge time.Duration, now time.Time, dirs ...string) error {
+	var newest time.Time
+	var checked []string
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
 		}
-		mrenclave := make([]byte, hex.DecodedLen(len(mhex)))
-		l, err := hex.Decode(mrenclave, mhex)
+		checked = append(checked, dir)
+		mrFiles, err := fs.ReadDir(fsys, dir)
 		if err != nil {
-			log.Fatal("Could not parse the hex MR.")
+			return fmt.Errorf("Could not read the MR directory %s: %w", dir, err)
 		}
-		if l != MR_SIZE {
-			log.Fatal("MR file should contain 32 bytes, but instead got", l)
+		for _, mr := range mrFiles {
+			if mr.Name() == ".gitignore" {
+				continue
+			}
+			info, err := mr.Info()
+			if err != nil {
+				return fmt.Errorf("Could not read the MR file %s: %w", path.Join(dir, mr.Name()), err)
+			}
+			if info.ModTime().After(newest) {
+				newest = info.ModTime()
+			}
 		}
+	}
 
-		copy(mrs[i][:], mrenclave[:])
+	if now.Sub(newest) > maxAge {
+		if newest.IsZero() {
+			return errors.New(fmt.Sprintf("The MR files in %s have no modification time, expected one within %v.", strings.Join(checked, " and "), maxAge))
+		}
+		return errors.New(fmt.Sprintf("The newest MR file in %s is from %v, older than MaxMeasurementAge %v.", strings.Join(checked, " and "), newest.Format(time.RFC3339), maxAge))
 	}
-	return mrs
+	return nil
+}
+
+func parseCPUSVN(shex string) ([]byte, error) {
+	return parseHexField("CPUSVN", shex, CPUSVN_SIZE)
 }
 
-func readSPID(shex string) []byte {
-	spid := make([]byte, hex.DecodedLen(len(shex)))
-	l, err := hex.Decode(spid, []byte(shex))
+// parseHexField decodes the hex encoded field name of the quote, which
+// must be size bytes. It returns nil if shex is empty, i.e., the field
+// is not checked.
+func parseHexField(name string, shex string, size int) ([]byte, error) {
+	if shex == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(shex)
 	if err != nil {
-		log.Fatal("Could not parse the hex spid:", err)
-	} else if l != 16 {
-		log.Fatal("SPID files should contain 16 bytes, but instead got", l)
+		return nil, fmt.Errorf("Could not parse the hex %s: %w", name, err)
+	} else if len(b) != size {
+		return nil, errors.New(fmt.Sprintf("%s should contain %d bytes, but instead got %d.", name, size, len(b)))
+	}
+	return b, nil
+}
+
+// parseSPID decodes a hex or base64 encoded 16 byte SPID. Any
+// whitespace (e.g., a trailing newline, or spaces between groups of
+// digits) is ignored, and so is a 0x prefix of a hex SPID, since that
+// is how the SPID often ends up after copying it from the Intel
+// portal.
+func parseSPID(shex string) ([]byte, error) {
+	cleaned := strings.Join(strings.Fields(shex), "")
+	if strings.HasPrefix(cleaned, "0x") || strings.HasPrefix(cleaned, "0X") {
+		cleaned = cleaned[2:]
+		if len(cleaned) != hex.EncodedLen(16) {
+			return nil, errors.New(fmt.Sprintf("SPID should contain %d hex characters, but instead got %d.", hex.EncodedLen(16), len(cleaned)))
+		}
+	}
+	return decodeHexOrBase64("SPID", cleaned, 16)
+}
+
+// decodeHexOrBase64 decodes the size byte value of name, which may be
+// hex or padded base64 encoded, since some of Intel's tools show
+// SPIDs and measurements in base64. The two are told apart by their
+// length, which never matches for the same size.
+func decodeHexOrBase64(name string, value string, size int) ([]byte, error) {
+	if len(value) == hex.EncodedLen(size) {
+		b, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse the hex %s: %w", name, err)
+		}
+		return b, nil
+	} else if len(value) != base64.StdEncoding.EncodedLen(size) {
+		return nil, errors.New(fmt.Sprintf("%s should contain %d hex or %d base64 characters, but instead got %d.", name, hex.EncodedLen(size), base64.StdEncoding.EncodedLen(size), len(value)))
+	}
+
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse the base64 %s: %w", name, err)
+	} else if len(b) != size {
+		return nil, errors.New(fmt.Sprintf("%s is %d bytes once decoded from base64, expected %d.", name, len(b), size))
+	}
+	return b, nil
+}
+
+// decodeGID parses a hex encoded EPID group id in the big-endian order
+// used by IAS, and returns it in the little-endian order used in
+// message 1.
+func decodeGID(ghex string) ([]byte, error) {
+	gid, err := hex.DecodeString(ghex)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse the hex group id: %w", err)
+	} else if len(gid) != EPID_GID_SIZE {
+		return nil, errors.New(fmt.Sprintf("Group ids should contain %d bytes, but instead got %d.", EPID_GID_SIZE, len(gid)))
+	}
+	reverse(gid)
+	return gid, nil
+}
+
+// checkMeasurements refuses empty MREnclave and MRSigner lists (read
+// from enclaveDir and signerDir), which can never be a valid
+// configuration.
+func checkMeasurements(policy MeasurementPolicy, enclaveDir string, mrenclaves [][MR_SIZE]byte, signerDir string, mrsigners [][MR_SIZE]byte) error {
+	switch policy {
+	case MEASUREMENT_BOTH, MEASUREMENT_EITHER:
+		if len(mrenclaves) == 0 && len(mrsigners) == 0 {
+			return errors.New(fmt.Sprintf("No MREnclaves or MRSigners are configured (directories %s and %s are empty), so no enclave could ever be accepted.", enclaveDir, signerDir))
+		}
+	case MEASUREMENT_MRENCLAVE_ONLY:
+		if len(mrenclaves) == 0 {
+			return errors.New(fmt.Sprintf("No MREnclaves are configured (directory %s is empty), so no enclave could ever be accepted.", enclaveDir))
+		}
+	case MEASUREMENT_MRSIGNER_ONLY:
+		if len(mrsigners) == 0 {
+			return errors.New(fmt.Sprintf("No MRSigners are configured (directory %s is empty), so no enclave could ever be accepted.", signerDir))
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unknown measurement policy %s.", policy))
+	}
+	return nil
+}
+
+// checkChallengeLength returns the challenge length to use for the
+// configured length n.
+func checkChallengeLength(n int) (int, error) {
+	if n == 0 {
+		return DEFAULT_CHALLENGE_LENGTH, nil
+	} else if n < MIN_CHALLENGE_LENGTH {
+		return 0, errors.New(fmt.Sprintf("Challenge length %d is shorter than the minimum %d.", n, MIN_CHALLENGE_LENGTH))
+	}
+	return n, nil
+}
+
+// checkEnvironment makes sure release mode matches the declared
+// environment.
+func checkEnvironment(env string, release bool) error {
+	switch env {
+	case "":
+		return nil
+	case ENV_PRODUCTION:
+		if !release {
+			return errors.New("Release must be true in the production environment, refusing to use the development IAS.")
+		}
+	case ENV_DEVELOPMENT:
+		if release {
+			return errors.New("Release must be false in the development environment, refusing to use the production IAS.")
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unknown environment %s.", env))
+	}
+	return nil
+}
+
+// checkMsg4Payload makes sure payload fits in message 4.
+func checkMsg4Payload(payload []byte) error {
+	if len(payload) > MAX_MSG4_PAYLOAD_SIZE {
+		return errors.New(fmt.Sprintf("Message 4 payload of %d bytes is larger than the maximum %d.", len(payload), MAX_MSG4_PAYLOAD_SIZE))
+	}
+	return nil
+}
+
+// longTermKeyPassword returns the password to decrypt the long-term
+// keys with, which is empty if they are not encrypted.
+func longTermKeyPassword(config *Configuration) (string, error) {
+	if !config.LongTermKeyEncrypted {
+		return "", nil
+	} else if config.LongTermKeyPassword != "" {
+		return config.LongTermKeyPassword, nil
+	}
+
+	reader := config.PasswordReader
+	if reader == nil {
+		reader = TerminalPasswordReader()
+	}
+	return reader.ReadPassword(fmt.Sprintf("Password for %s: ", config.LongTermKey))
+}
+
+// checkUint16 makes sure the configured value v of name fits in the
+// 16 bit field of the quote it is compared against, instead of
+// silently truncating it.
+func checkUint16(name string, v int) error {
+	if v < 0 || v > math.MaxUint16 {
+		return errors.New(fmt.Sprintf("%s %d is out of range, expected 0 to %d.", name, v, math.MaxUint16))
+	}
+	return nil
+}
+
+// checkLimit makes sure the configured value v of name is either -1,
+// which means unlimited, or not negative. Other negative values are
+// most likely typos, and would break the eviction and timeout math.
+// Unless zero is true, 0 is refused as well, for the limits where it
+// would leave no room for any session.
+func checkLimit(name string, v int, zero bool) error {
+	if v < -1 {
+		return errors.New(fmt.Sprintf("%s %d is out of range, expected -1 (unlimited) or at least 0.", name, v))
+	} else if v == 0 && !zero {
+		return errors.New(fmt.Sprintf("%s 0 is out of range, expected -1 (unlimited) or at least 1.", name))
 	}
-	return spid
+	return nil
+}
+
+// loadCertPool reads the PEM encoded certificates in file into a
+// pool.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the certificate file %s: %w", file, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(fmt.Sprintf("No certificates found in %s.", file))
+	}
+	return pool, nil
 }
 
 func parseConfiguration(config *Configuration) *configuration {
-	passwd := ""
-	if config.LongTermKeyEncrypted {
-		if config.LongTermKeyPassword != "" {
-			passwd = config.LongTermKeyPassword
-		} else {
-			// TODO: read the password
+	c, err := newConfiguration(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return c
+}
+
+// newConfiguration is like parseConfiguration, but returns an error
+// rather than exit if the configuration is invalid.
+func newConfiguration(config *Configuration) (*configuration, error) {
+	if err := checkEnvironment(config.Environment, config.Release); err != nil {
+		return nil, err
+	}
+
+	passwd, err := longTermKeyPassword(config)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the long-term key password: %w", err)
+	}
+
+	if config.IASInsecureSkipTLSVerify && config.Release {
+		return nil, errors.New("IASInsecureSkipTLSVerify is only allowed in development mode, refusing to skip the TLS verification of the production IAS.")
+	} else if config.IASInsecureSkipTLSVerify && config.IASReportSigningRoot == "" {
+		return nil, errors.New("IASInsecureSkipTLSVerify requires IASReportSigningRoot, refusing to skip the TLS verification of IAS without checking its reports.")
+	}
+
+	var iasClientCert *tls.Certificate
+	if config.IASClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.IASClientCert, config.IASClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load the IAS client certificate: %w", err)
+		}
+		iasClientCert = &cert
+	}
+
+	var signingRoots *x509.CertPool
+	if config.IASReportSigningRoot != "" {
+		roots, err := loadCertPool(config.IASReportSigningRoot)
+		if err != nil {
+			return nil, err
+		}
+		signingRoots = roots
+	}
+
+	longTermKey, err := readPrivateKey(config.LongTermKey, passwd)
+	if err != nil {
+		return nil, err
+	}
+	var secondaryKeys []*ecdsa.PrivateKey
+	for _, keyFile := range config.SecondaryLongTermKeys {
+		key, err := readPrivateKey(keyFile, passwd)
+		if err != nil {
+			return nil, err
+		}
+		secondaryKeys = append(secondaryKeys, key)
+	}
+
+	var sigRLGroups [][]byte
+	for _, ghex := range config.SigRLGroups {
+		gid, err := decodeGID(ghex)
+		if err != nil {
+			return nil, err
+		}
+		sigRLGroups = append(sigRLGroups, gid)
+	}
+
+	spid, err := parseSPID(config.Spid)
+	if err != nil {
+		return nil, err
+	}
+	minCPUSVN, err := parseCPUSVN(config.MinCPUSVN)
+	if err != nil {
+		return nil, err
+	}
+	isvFamilyID, err := parseHexField("ISVFamilyID", config.ISVFamilyID, ISVFAMILYID_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	configID, err := parseHexField("ConfigID", config.ConfigID, CONFIGID_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	challengeLength, err := checkChallengeLength(config.ChallengeLength)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMsg4Payload(config.Msg4Payload); err != nil {
+		return nil, err
+	}
+
+	svns := []struct {
+		name  string
+		value int
+	}{
+		{"ProdID", config.ProdID},
+		{"ProdSVN", config.ProdSVN},
+		{"MinQESVN", config.MinQESVN},
+		{"MinPCESVN", config.MinPCESVN},
+		{"MinConfigSVN", config.MinConfigSVN},
+	}
+	for _, svn := range svns {
+		if err := checkUint16(svn.name, svn.value); err != nil {
+			return nil, err
+		}
+	}
+
+	var prodSVNs map[uint16]uint16
+	if len(config.ProdSVNs) > 0 {
+		prodSVNs = make(map[uint16]uint16, len(config.ProdSVNs))
+	}
+	for prodID, svn := range config.ProdSVNs {
+		if err := checkUint16("ProdSVNs key", prodID); err != nil {
+			return nil, err
+		} else if err := checkUint16(fmt.Sprintf("ProdSVNs[%d]", prodID), svn); err != nil {
+			return nil, err
+		}
+		prodSVNs[uint16(prodID)] = uint16(svn)
+	}
+
+	limits := []struct {
+		name  string
+		value int
+		zero  bool
+	}{
+		{"MaxSessions", config.MaxSessions, false},
+		{"Timeout", config.Timeout, false},
+		{"MaxSessionTimeout", config.MaxSessionTimeout, true},
+	}
+	for _, limit := range limits {
+		if err := checkLimit(limit.name, limit.value, limit.zero); err != nil {
+			return nil, err
+		}
+	}
+	if config.ReverifyInterval < 0 {
+		return nil, errors.New(fmt.Sprintf("ReverifyInterval %d is negative.", config.ReverifyInterval))
+	}
+	nonceWindow := config.ClientNonceWindow
+	if nonceWindow < 0 {
+		return nil, errors.New(fmt.Sprintf("ClientNonceWindow %d is negative.", nonceWindow))
+	} else if nonceWindow == 0 {
+		nonceWindow = DEFAULT_CLIENT_NONCE_WINDOW
+	}
+
+	redaction := config.LogRedaction
+	switch redaction {
+	case "":
+		redaction = REDACT_SECRETS
+	case REDACT_SECRETS, REDACT_IDENTIFIERS:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown log redaction level %s.", redaction))
+	}
+
+	policy := config.MeasurementPolicy
+	if policy == "" {
+		policy = MEASUREMENT_BOTH
+	}
+	var mrenclaves, mrsigners [][MR_SIZE]byte
+	mrFS := measurementsFS(config)
+	if config.Mrenclaves != "" || policy != MEASUREMENT_MRSIGNER_ONLY {
+		if mrenclaves, err = loadMRs(mrFS, config.Mrenclaves); err != nil {
+			return nil, err
+		}
+	}
+	if config.Mrsigners != "" || policy != MEASUREMENT_MRENCLAVE_ONLY {
+		if mrsigners, err = loadMRs(mrFS, config.Mrsigners); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkMeasurements(policy, config.Mrenclaves, mrenclaves, config.Mrsigners, mrsigners); err != nil {
+		return nil, err
+	}
+	if config.MaxMeasurementAge < 0 {
+		return nil, errors.New(fmt.Sprintf("MaxMeasurementAge %d is negative.", config.MaxMeasurementAge))
+	} else if config.MaxMeasurementAge > 0 {
+		maxAge := time.Duration(config.MaxMeasurementAge) * time.Hour
+		if err := checkMeasurementAge(mrFS, maxAge, time.Now(), config.Mrenclaves, config.Mrsigners); err != nil {
+			return nil, err
 		}
 	}
 
 	return &configuration{
 		release:           config.Release,
 		subscription:      config.Subscription,
-		mrenclaves:        readMRs(config.Mrenclaves),
-		mrsigners:         readMRs(config.Mrsigners),
-		spid:              readSPID(config.Spid),
-		longTermKey:       loadPrivateKey(config.LongTermKey, passwd),
+		mrenclaves:        mrenclaves,
+		mrsigners:         mrsigners,
+		measurementPolicy: policy,
+		maxMRAge:          config.MaxMeasurementAge,
+		spid:              spid,
+		linkable:          config.LinkableSignatures,
+		longTermKey:       longTermKey,
+		secondaryKeys:     secondaryKeys,
 		allowedAdvisories: config.AllowedAdvisories,
 		prodID:            uint16(config.ProdID),
 		prodSVN:           uint16(config.ProdSVN),
+		prodSVNs:          prodSVNs,
 		maxSessions:       config.MaxSessions,
+		maxInFlight:       config.MaxInFlightHandshakes,
 		timeout:           config.Timeout,
+		maxTimeout:        config.MaxSessionTimeout,
+		useSigRL:          !config.SkipSigRL,
+		iasClientCert:     iasClientCert,
+		signingRoots:      signingRoots,
+		maxIASCallsPerDay: config.MaxIASCallsPerDay,
+		iasMaxConcurrent:  config.IASMaxConcurrent,
+		iasQueueTimeout:   config.IASQueueTimeout,
+		iasTimeout:        config.IASTimeout,
+		iasUserAgent:      config.IASUserAgent,
+		iasEndpoints:      config.IASEndpoints,
+		iasInsecure:       config.IASInsecureSkipTLSVerify,
+		nonceCacheSize:    config.IASNonceCacheSize,
+		nonceCacheTTL:     config.IASNonceCacheTTL,
+		traceHandshake:    config.TraceHandshake,
+		redaction:         redaction,
+		minTCBEvaluation:  config.MinTCBEvaluationDataNumber,
+		allowCachedReport: config.AllowCachedOnIASOutage,
+		maxCachedAge:      config.MaxCachedReportAge,
+		sigRLGroups:       sigRLGroups,
+		sigRLCacheTime:    config.SigRLCacheTime,
+		flagsMask:         config.AttributesFlagsMask,
+		flags:             config.AttributesFlags,
+		xfrmMask:          config.XFRMMask,
+		xfrm:              config.XFRM,
+		miscSelectMask:    config.MiscSelectMask,
+		miscSelect:        config.MiscSelect,
+		challengeLength:   challengeLength,
+		maxMessages:       config.MaxMessagesPerSession,
+		minCPUSVN:         minCPUSVN,
+		minQESVN:          uint16(config.MinQESVN),
+		minPCESVN:         uint16(config.MinPCESVN),
+		isvFamilyID:       isvFamilyID,
+		configID:          configID,
+		minConfigSVN:      uint16(config.MinConfigSVN),
+		invalidateOnRaise: config.InvalidateOnSVNRaise,
+		reverifyInterval:  config.ReverifyInterval,
+		requireNonce:      config.RequireClientNonce,
+		nonceWindow:       nonceWindow,
+		msg4Payload:       config.Msg4Payload,
+	}, nil
+}
+
+// minProdSVN returns the minimum security version number of the
+// enclaves with prodID, and whether such enclaves are accepted at
+// all.
+func (c *configuration) minProdSVN(prodID uint16) (uint16, bool) {
+	if svn, ok := c.prodSVNs[prodID]; ok {
+		return svn, true
+	} else if prodID == c.prodID {
+		return c.prodSVN, true
+	}
+	return 0, false
+}
+
+// secrets returns the long-lived secrets of c, which the logs must
+// never contain: the IAS subscription key, the message 4 payload,
+// and the long-term private keys in both byte orders.
+func (c *configuration) secrets() [][]byte {
+	secrets := [][]byte{[]byte(c.subscription), c.msg4Payload}
+	for _, key := range append([]*ecdsa.PrivateKey{c.longTermKey}, c.secondaryKeys...) {
+		if key != nil {
+			secrets = append(secrets, key.D.Bytes(), serializeBigInt(key.D))
+		}
+	}
+	return secrets
+}
+
+// fixedSettings returns the settings of c that a session manager is
+// built from, by their name in Configuration. Reconfigure cannot
+// change them, nor the secrets, since they configure the IAS client,
+// the bounds of the session manager, its background work, and its
+// logs.
+func (c *configuration) fixedSettings() map[string]interface{} {
+	var clientCert [][]byte
+	if c.iasClientCert != nil {
+		clientCert = c.iasClientCert.Certificate
+	}
+	var signingRoots [][]byte
+	if c.signingRoots != nil {
+		// Subjects lists every root, since the pool is not
+		// the system pool.
+		signingRoots = c.signingRoots.Subjects()
+	}
+	return map[string]interface{}{
+		"Release":                    c.release,
+		"AllowedAdvisories":          c.allowedAdvisories,
+		"MaxSessions":                c.maxSessions,
+		"MaxInFlightHandshakes":      c.maxInFlight,
+		"IASClientCert":              clientCert,
+		"IASReportSigningRoot":       signingRoots,
+		"MaxIASCallsPerDay":          c.maxIASCallsPerDay,
+		"IASMaxConcurrent":           c.iasMaxConcurrent,
+		"IASQueueTimeout":            c.iasQueueTimeout,
+		"IASTimeout":                 c.iasTimeout,
+		"IASUserAgent":               c.iasUserAgent,
+		"IASEndpoints":               c.iasEndpoints,
+		"IASInsecureSkipTLSVerify":   c.iasInsecure,
+		"IASNonceCacheSize":          c.nonceCacheSize,
+		"IASNonceCacheTTL":           c.nonceCacheTTL,
+		"TraceHandshake":             c.traceHandshake,
+		"LogRedaction":               c.redaction,
+		"MinTCBEvaluationDataNumber": c.minTCBEvaluation,
+		"AllowCachedOnIASOutage":     c.allowCachedReport,
+		"MaxCachedReportAge":         c.maxCachedAge,
+		"SigRLCacheTime":             c.sigRLCacheTime,
+		"ReverifyInterval":           c.reverifyInterval,
+		"RequireClientNonce":         c.requireNonce,
+		"ClientNonceWindow":          c.nonceWindow,
+	}
+}
+
+// iasHosts returns the IAS endpoints to use, in order.
+func (c *configuration) iasHosts() []string {
+	if len(c.iasEndpoints) > 0 {
+		return c.iasEndpoints
+	}
+	return []string{iasHost(c.release)}
+}
+
+// toConfiguration is the reverse of parseConfiguration, and returns
+// the effective values of c as a Configuration. Secrets (the IAS
+// subscription key, the long-term keys, and the message 4 payload,
+// which may carry a token) are never included.
+// Settings that were read from files (the MR directories, and the
+// key and certificate files) cannot be recovered and are left empty;
+// use the parsed values in c for those instead.
+func (c *configuration) toConfiguration() *Configuration {
+	var prodSVNs map[int]int
+	if len(c.prodSVNs) > 0 {
+		prodSVNs = make(map[int]int, len(c.prodSVNs))
+		for prodID, svn := range c.prodSVNs {
+			prodSVNs[int(prodID)] = int(svn)
+		}
+	}
+	var allowedAdvisories map[string][]string
+	if c.allowedAdvisories != nil {
+		allowedAdvisories = make(map[string][]string, len(c.allowedAdvisories))
+		for status, advisories := range c.allowedAdvisories {
+			allowedAdvisories[status] = append([]string(nil), advisories...)
+		}
+	}
+
+	var sigRLGroups []string
+	for _, gid := range c.sigRLGroups {
+		big := append([]byte(nil), gid...)
+		reverse(big)
+		sigRLGroups = append(sigRLGroups, hex.EncodeToString(big))
+	}
+
+	return &Configuration{
+		Release:                    c.release,
+		MeasurementPolicy:          c.measurementPolicy,
+		MaxMeasurementAge:          c.maxMRAge,
+		Spid:                       hex.EncodeToString(c.spid),
+		LinkableSignatures:         c.linkable,
+		AllowedAdvisories:          allowedAdvisories,
+		ProdID:                     int(c.prodID),
+		ProdSVN:                    int(c.prodSVN),
+		ProdSVNs:                   prodSVNs,
+		MaxSessions:                c.maxSessions,
+		MaxInFlightHandshakes:      c.maxInFlight,
+		Timeout:                    c.timeout,
+		MaxSessionTimeout:          c.maxTimeout,
+		SkipSigRL:                  !c.useSigRL,
+		MaxIASCallsPerDay:          c.maxIASCallsPerDay,
+		IASMaxConcurrent:           c.iasMaxConcurrent,
+		IASQueueTimeout:            c.iasQueueTimeout,
+		IASTimeout:                 c.iasTimeout,
+		IASUserAgent:               c.iasUserAgent,
+		IASEndpoints:               append([]string(nil), c.iasEndpoints...),
+		IASInsecureSkipTLSVerify:   c.iasInsecure,
+		IASNonceCacheSize:          c.nonceCacheSize,
+		IASNonceCacheTTL:           c.nonceCacheTTL,
+		TraceHandshake:             c.traceHandshake,
+		LogRedaction:               c.redaction,
+		MinTCBEvaluationDataNumber: c.minTCBEvaluation,
+		AllowCachedOnIASOutage:     c.allowCachedReport,
+		MaxCachedReportAge:         c.maxCachedAge,
+		SigRLGroups:                sigRLGroups,
+		SigRLCacheTime:             c.sigRLCacheTime,
+		AttributesFlagsMask:        c.flagsMask,
+		AttributesFlags:            c.flags,
+		XFRMMask:                   c.xfrmMask,
+		XFRM:                       c.xfrm,
+		MiscSelectMask:             c.miscSelectMask,
+		MiscSelect:                 c.miscSelect,
+		ChallengeLength:            c.challengeLength,
+		MaxMessagesPerSession:      c.maxMessages,
+		MinCPUSVN:                  hex.EncodeToString(c.minCPUSVN),
+		MinQESVN:                   int(c.minQESVN),
+		MinPCESVN:                  int(c.minPCESVN),
+		ISVFamilyID:                hex.EncodeToString(c.isvFamilyID),
+		ConfigID:                   hex.EncodeToString(c.configID),
+		MinConfigSVN:               int(c.minConfigSVN),
+		InvalidateOnSVNRaise:       c.invalidateOnRaise,
+		ReverifyInterval:           c.reverifyInterval,
+		RequireClientNonce:         c.requireNonce,
+		ClientNonceWindow:          c.nonceWindow,
 	}
 }
 
@@ -170,7 +1230,7 @@ func ReadConfiguration(fileName string) *Configuration {
 	}
 	defer file.Close()
 
-	config := &Configuration{}
+	config := DefaultConfiguration()
 	decoder := json.NewDecoder(file)
 	err = decoder.Decode(config)
 	if err != nil {
@@ -179,3 +1239,236 @@ func ReadConfiguration(fileName string) *Configuration {
 
 	return config
 }
+
+// ConfigurationFromEnv builds a Configuration from environment
+// variables instead of a file, starting from DefaultConfiguration.
+// Every field of Configuration is read from SGX_ followed by its name
+// in upper snake case:
+//
+//	SGX_RELEASE                        Release
+//	SGX_ENVIRONMENT                    Environment
+//	SGX_SUBSCRIPTION                   Subscription (required)
+//	SGX_MRENCLAVES                     Mrenclaves (required, unless the policy is mrsigner)
+//	SGX_MRSIGNERS                      Mrsigners (required, unless the policy is mrenclave)
+//	SGX_MEASUREMENT_POLICY             MeasurementPolicy
+//	SGX_MAX_MEASUREMENT_AGE            MaxMeasurementAge
+//	SGX_SPID                           Spid (required)
+//	SGX_LINKABLE_SIGNATURES            LinkableSignatures
+//	SGX_LONG_TERM_KEY                  LongTermKey (required)
+//	SGX_SECONDARY_LONG_TERM_KEYS       SecondaryLongTermKeys
+//	SGX_LONG_TERM_KEY_ENCRYPTED        LongTermKeyEncrypted
+//	SGX_LONG_TERM_KEY_PASSWORD         LongTermKeyPassword
+//	SGX_ALLOWED_ADVISORIES             AllowedAdvisories
+//	SGX_PROD_ID                        ProdID
+//	SGX_PROD_SVN                       ProdSVN
+//	SGX_PROD_SVNS                      ProdSVNs
+//	SGX_MAX_SESSIONS                   MaxSessions
+//	SGX_MAX_IN_FLIGHT_HANDSHAKES       MaxInFlightHandshakes
+//	SGX_TIMEOUT                        Timeout
+//	SGX_MAX_SESSION_TIMEOUT            MaxSessionTimeout
+//	SGX_SKIP_SIGRL                     SkipSigRL
+//	SGX_IAS_CLIENT_CERT                IASClientCert
+//	SGX_IAS_CLIENT_KEY                 IASClientKey
+//	SGX_IAS_REPORT_SIGNING_ROOT        IASReportSigningRoot
+//	SGX_MAX_IAS_CALLS_PER_DAY          MaxIASCallsPerDay
+//	SGX_IAS_MAX_CONCURRENT             IASMaxConcurrent
+//	SGX_IAS_QUEUE_TIMEOUT              IASQueueTimeout
+//	SGX_IAS_TIMEOUT                    IASTimeout
+//	SGX_IAS_ENDPOINTS                  IASEndpoints
+//	SGX_IAS_INSECURE_SKIP_TLS_VERIFY   IASInsecureSkipTLSVerify
+//	SGX_IAS_NONCE_CACHE_SIZE           IASNonceCacheSize
+//	SGX_IAS_NONCE_CACHE_TTL            IASNonceCacheTTL
+//	SGX_IAS_USER_AGENT                 IASUserAgent
+//	SGX_TRACE_HANDSHAKE                TraceHandshake
+//	SGX_LOG_REDACTION                  LogRedaction
+//	SGX_MIN_TCB_EVALUATION_DATA_NUMBER MinTCBEvaluationDataNumber
+//	SGX_ALLOW_CACHED_ON_IAS_OUTAGE     AllowCachedOnIASOutage
+//	SGX_MAX_CACHED_REPORT_AGE          MaxCachedReportAge
+//	SGX_SIGRL_GROUPS                   SigRLGroups
+//	SGX_SIGRL_CACHE_TIME               SigRLCacheTime
+//	SGX_ATTRIBUTES_FLAGS_MASK          AttributesFlagsMask
+//	SGX_ATTRIBUTES_FLAGS               AttributesFlags
+//	SGX_XFRM_MASK                      XFRMMask
+//	SGX_XFRM                           XFRM
+//	SGX_MISC_SELECT_MASK               MiscSelectMask
+//	SGX_MISC_SELECT                    MiscSelect
+//	SGX_CHALLENGE_LENGTH               ChallengeLength
+//	SGX_MAX_MESSAGES_PER_SESSION       MaxMessagesPerSession
+//	SGX_MIN_CPUSVN                     MinCPUSVN
+//	SGX_MIN_QESVN                      MinQESVN
+//	SGX_MIN_PCESVN                     MinPCESVN
+//	SGX_ISV_FAMILY_ID                  ISVFamilyID
+//	SGX_CONFIG_ID                      ConfigID
+//	SGX_MIN_CONFIG_SVN                 MinConfigSVN
+//	SGX_INVALIDATE_ON_SVN_RAISE        InvalidateOnSVNRaise
+//	SGX_REVERIFY_INTERVAL              ReverifyInterval
+//	SGX_REQUIRE_CLIENT_NONCE           RequireClientNonce
+//	SGX_CLIENT_NONCE_WINDOW            ClientNonceWindow
+//	SGX_MSG4_PAYLOAD                   Msg4Payload
+//
+// Booleans are parsed by strconv.ParseBool, and integers may be
+// decimal or 0x prefixed hex. Lists are comma separated,
+// SGX_ALLOWED_ADVISORIES and SGX_PROD_SVNS are the JSON encodings of
+// the maps (e.g., {"GROUP_OUT_OF_DATE": ["INTEL-SA-00161"]} and
+// {"3": 2}), and SGX_MSG4_PAYLOAD is base64 encoded, as in the
+// configuration file. Unset variables keep
+// their defaults. An error is returned if a variable cannot be parsed,
+// or if a required one is missing.
+func ConfigurationFromEnv() (*Configuration, error) {
+	config := DefaultConfiguration()
+	vars := []struct {
+		name  string
+		field interface{}
+	}{
+		{"SGX_RELEASE", &config.Release},
+		{"SGX_ENVIRONMENT", &config.Environment},
+		{"SGX_SUBSCRIPTION", &config.Subscription},
+		{"SGX_MRENCLAVES", &config.Mrenclaves},
+		{"SGX_MRSIGNERS", &config.Mrsigners},
+		{"SGX_MEASUREMENT_POLICY", &config.MeasurementPolicy},
+		{"SGX_MAX_MEASUREMENT_AGE", &config.MaxMeasurementAge},
+		{"SGX_SPID", &config.Spid},
+		{"SGX_LINKABLE_SIGNATURES", &config.LinkableSignatures},
+		{"SGX_LONG_TERM_KEY", &config.LongTermKey},
+		{"SGX_SECONDARY_LONG_TERM_KEYS", &config.SecondaryLongTermKeys},
+		{"SGX_LONG_TERM_KEY_ENCRYPTED", &config.LongTermKeyEncrypted},
+		{"SGX_LONG_TERM_KEY_PASSWORD", &config.LongTermKeyPassword},
+		{"SGX_ALLOWED_ADVISORIES", &config.AllowedAdvisories},
+		{"SGX_PROD_ID", &config.ProdID},
+		{"SGX_PROD_SVN", &config.ProdSVN},
+		{"SGX_PROD_SVNS", &config.ProdSVNs},
+		{"SGX_MAX_SESSIONS", &config.MaxSessions},
+		{"SGX_MAX_IN_FLIGHT_HANDSHAKES", &config.MaxInFlightHandshakes},
+		{"SGX_TIMEOUT", &config.Timeout},
+		{"SGX_MAX_SESSION_TIMEOUT", &config.MaxSessionTimeout},
+		{"SGX_SKIP_SIGRL", &config.SkipSigRL},
+		{"SGX_IAS_CLIENT_CERT", &config.IASClientCert},
+		{"SGX_IAS_CLIENT_KEY", &config.IASClientKey},
+		{"SGX_IAS_REPORT_SIGNING_ROOT", &config.IASReportSigningRoot},
+		{"SGX_MAX_IAS_CALLS_PER_DAY", &config.MaxIASCallsPerDay},
+		{"SGX_IAS_MAX_CONCURRENT", &config.IASMaxConcurrent},
+		{"SGX_IAS_QUEUE_TIMEOUT", &config.IASQueueTimeout},
+		{"SGX_IAS_TIMEOUT", &config.IASTimeout},
+		{"SGX_IAS_ENDPOINTS", &config.IASEndpoints},
+		{"SGX_IAS_INSECURE_SKIP_TLS_VERIFY", &config.IASInsecureSkipTLSVerify},
+		{"SGX_IAS_NONCE_CACHE_SIZE", &config.IASNonceCacheSize},
+		{"SGX_IAS_NONCE_CACHE_TTL", &config.IASNonceCacheTTL},
+		{"SGX_IAS_USER_AGENT", &config.IASUserAgent},
+		{"SGX_TRACE_HANDSHAKE", &config.TraceHandshake},
+		{"SGX_LOG_REDACTION", &config.LogRedaction},
+		{"SGX_MIN_TCB_EVALUATION_DATA_NUMBER", &config.MinTCBEvaluationDataNumber},
+		{"SGX_ALLOW_CACHED_ON_IAS_OUTAGE", &config.AllowCachedOnIASOutage},
+		{"SGX_MAX_CACHED_REPORT_AGE", &config.MaxCachedReportAge},
+		{"SGX_SIGRL_GROUPS", &config.SigRLGroups},
+		{"SGX_SIGRL_CACHE_TIME", &config.SigRLCacheTime},
+		{"SGX_ATTRIBUTES_FLAGS_MASK", &config.AttributesFlagsMask},
+		{"SGX_ATTRIBUTES_FLAGS", &config.AttributesFlags},
+		{"SGX_XFRM_MASK", &config.XFRMMask},
+		{"SGX_XFRM", &config.XFRM},
+		{"SGX_MISC_SELECT_MASK", &config.MiscSelectMask},
+		{"SGX_MISC_SELECT", &config.MiscSelect},
+		{"SGX_CHALLENGE_LENGTH", &config.ChallengeLength},
+		{"SGX_MAX_MESSAGES_PER_SESSION", &config.MaxMessagesPerSession},
+		{"SGX_MIN_CPUSVN", &config.MinCPUSVN},
+		{"SGX_MIN_QESVN", &config.MinQESVN},
+		{"SGX_MIN_PCESVN", &config.MinPCESVN},
+		{"SGX_ISV_FAMILY_ID", &config.ISVFamilyID},
+		{"SGX_CONFIG_ID", &config.ConfigID},
+		{"SGX_MIN_CONFIG_SVN", &config.MinConfigSVN},
+		{"SGX_INVALIDATE_ON_SVN_RAISE", &config.InvalidateOnSVNRaise},
+		{"SGX_REVERIFY_INTERVAL", &config.ReverifyInterval},
+		{"SGX_REQUIRE_CLIENT_NONCE", &config.RequireClientNonce},
+		{"SGX_CLIENT_NONCE_WINDOW", &config.ClientNonceWindow},
+		{"SGX_MSG4_PAYLOAD", &config.Msg4Payload},
+	}
+	for _, v := range vars {
+		value, ok := os.LookupEnv(v.name)
+		if !ok {
+			continue
+		}
+		if err := parseEnv(value, v.field); err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %w", v.name, err)
+		}
+	}
+
+	// Only the measurements the policy checks are required, as in
+	// newConfiguration.
+	type requiredVar struct {
+		name  string
+		value string
+	}
+	required := []requiredVar{
+		{"SGX_SUBSCRIPTION", config.Subscription},
+		{"SGX_SPID", config.Spid},
+		{"SGX_LONG_TERM_KEY", config.LongTermKey},
+	}
+	if config.MeasurementPolicy != MEASUREMENT_MRSIGNER_ONLY {
+		required = append(required, requiredVar{"SGX_MRENCLAVES", config.Mrenclaves})
+	}
+	if config.MeasurementPolicy != MEASUREMENT_MRENCLAVE_ONLY {
+		required = append(required, requiredVar{"SGX_MRSIGNERS", config.Mrsigners})
+	}
+	for _, v := range required {
+		if v.value == "" {
+			return nil, errors.New(fmt.Sprintf("Missing required environment variable %s.", v.name))
+		}
+	}
+	return config, nil
+}
+
+// parseEnv parses the environment variable value into field, which
+// points to a field of Configuration.
+func parseEnv(value string, field interface{}) error {
+	switch f := field.(type) {
+	case *string:
+		*f = value
+	case *MeasurementPolicy:
+		*f = MeasurementPolicy(value)
+	case *RedactionLevel:
+		*f = RedactionLevel(value)
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*f = b
+	case *int:
+		n, err := strconv.ParseInt(value, 0, 0)
+		if err != nil {
+			return err
+		}
+		*f = int(n)
+	case *uint32:
+		n, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return err
+		}
+		*f = uint32(n)
+	case *uint64:
+		n, err := strconv.ParseUint(value, 0, 64)
+		if err != nil {
+			return err
+		}
+		*f = n
+	case *[]string:
+		*f = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*f = append(*f, item)
+			}
+		}
+	case *[]byte:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return err
+		}
+		*f = b
+	case *map[string][]string:
+		return json.Unmarshal([]byte(value), f)
+	case *map[int]int:
+		return json.Unmarshal([]byte(value), f)
+	default:
+		return errors.New(fmt.Sprintf("Unsupported field type %T.", field))
+	}
+	return nil
+}
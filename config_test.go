@@ -0,0 +1,964 @@
+package sgx_server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestReadMR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mr := hex.EncodeToString(testMR[:])
+	write := func(name, content string) string {
+		file := path.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	parsed, err := readMR(osFS{}, write("newline", mr+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	} else if parsed != testMR {
+		t.Fatal("Incorrect MR.")
+	}
+
+	odd := write("odd", mr[:len(mr)-1])
+	if _, err := readMR(osFS{}, odd); err == nil {
+		t.Fatal("Odd length MR should be rejected.")
+	} else if !strings.Contains(err.Error(), odd) || !strings.Contains(err.Error(), "63") {
+		t.Fatal("Error should name the file and the length found:", err)
+	}
+
+	long := write("long", mr+"00")
+	if _, err := readMR(osFS{}, long); err == nil || !strings.Contains(err.Error(), "66") {
+		t.Fatal("Oversized MR should be rejected with its length:", err)
+	}
+
+	if _, err := readMR(osFS{}, write("garbage", strings.Repeat("zz", MR_SIZE))); err == nil {
+		t.Fatal("Non-hex MR should be rejected.")
+	}
+
+	// Measurements may also be base64 encoded.
+	if parsed, err := readMR(osFS{}, write("base64", base64.StdEncoding.EncodeToString(testMR[:])+"\n")); err != nil {
+		t.Fatal(err)
+	} else if parsed != testMR {
+		t.Fatal("Incorrect base64 MR.")
+	}
+	// 44 base64 characters without padding are 33 bytes.
+	if _, err := readMR(osFS{}, write("base64 long", strings.Repeat("A", 44))); err == nil || !strings.Contains(err.Error(), "33 bytes") {
+		t.Fatal("Oversized base64 MR should be rejected with its length:", err)
+	}
+	if _, err := readMR(osFS{}, write("base64 short", base64.StdEncoding.EncodeToString(testMR[1:]))); err == nil {
+		t.Fatal("Short base64 MR should be rejected.")
+	}
+}
+
+func TestChallengeLength(t *testing.T) {
+	if n, err := checkChallengeLength(0); err != nil || n != DEFAULT_CHALLENGE_LENGTH {
+		t.Error("Missing challenge length should use the default.")
+	}
+	if n, err := checkChallengeLength(20); err != nil || n != 20 {
+		t.Error("Custom challenge length should be accepted.")
+	}
+	if _, err := checkChallengeLength(MIN_CHALLENGE_LENGTH - 1); err == nil {
+		t.Error("Short challenge length should be rejected.")
+	}
+	if _, err := checkChallengeLength(-1); err == nil {
+		t.Error("Negative challenge length should be rejected.")
+	}
+}
+
+func TestCheckUint16(t *testing.T) {
+	for _, v := range []int{0, 1, 4464, math.MaxUint16} {
+		if err := checkUint16("ProdID", v); err != nil {
+			t.Errorf("%d should be accepted: %v", v, err)
+		}
+	}
+	for _, v := range []int{-1, math.MaxUint16 + 1, 70000} {
+		if err := checkUint16("ProdID", v); err == nil {
+			t.Errorf("%d should be rejected.", v)
+		} else if !strings.Contains(err.Error(), "ProdID") {
+			t.Error("The error should name the field:", err)
+		}
+	}
+}
+
+func TestCheckLimit(t *testing.T) {
+	for _, v := range []int{-1, 0, 1, 1000} {
+		if err := checkLimit("MaxSessionTimeout", v, true); err != nil {
+			t.Errorf("%d should be accepted: %v", v, err)
+		}
+	}
+	if err := checkLimit("Timeout", 0, false); err == nil || !strings.Contains(err.Error(), "Timeout 0") {
+		t.Error("0 should be rejected where it leaves no room for a session, got:", err)
+	}
+	for _, v := range []int{-2, -5, -100} {
+		if err := checkLimit("Timeout", v, false); err == nil {
+			t.Errorf("%d should be rejected.", v)
+		} else if !strings.Contains(err.Error(), "Timeout") || !strings.Contains(err.Error(), "-1") {
+			t.Error("The error should name the field and the sentinel:", err)
+		}
+	}
+}
+
+func TestCheckEnvironment(t *testing.T) {
+	tests := []struct {
+		env     string
+		release bool
+		ok      bool
+	}{
+		{"", false, true},
+		{"", true, true},
+		{ENV_PRODUCTION, true, true},
+		{ENV_PRODUCTION, false, false},
+		{ENV_DEVELOPMENT, false, true},
+		{ENV_DEVELOPMENT, true, false},
+		{"staging", true, false},
+	}
+	for _, test := range tests {
+		err := checkEnvironment(test.env, test.release)
+		if test.ok && err != nil {
+			t.Errorf("%q with release %t should be accepted: %v", test.env, test.release, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%q with release %t should refuse to start.", test.env, test.release)
+		}
+	}
+}
+
+func TestConfigurationRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der, err := x509.MarshalPKCS8PrivateKey(generateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mrDir := path.Join(dir, "mrs")
+	if err := os.Mkdir(mrDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(mrDir, "enclave"), []byte(hex.EncodeToString(testMR[:])), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfiguration()
+	config.Release = true
+	config.Spid = "00112233445566778899aabbccddeeff"
+	config.AllowedAdvisories = map[string][]string{ISV_GROUP_OUT_OF_DATE: {"INTEL-SA-00161"}}
+	config.ProdID = 3
+	config.ProdSVN = 2
+	config.ProdSVNs = map[int]int{7: 5, 9: 0}
+	config.MaxSessions = 10
+	config.MaxInFlightHandshakes = 8
+	config.Timeout = 5
+	config.MaxSessionTimeout = 60
+	config.MaxIASCallsPerDay = 100
+	config.IASMaxConcurrent = 4
+	config.IASQueueTimeout = 10
+	config.IASTimeout = 5
+	config.IASUserAgent = "proxy-route/1"
+	config.IASNonceCacheSize = 128
+	config.IASNonceCacheTTL = 600
+	config.IASEndpoints = []string{"https://proxy.example", "https://backup.example"}
+	config.SkipSigRL = true
+	config.SigRLGroups = []string{"00000b1e"}
+	config.SigRLCacheTime = 15
+	config.XFRMMask = 0x3
+	config.XFRM = 0x3
+	config.MaxMessagesPerSession = 1000
+	config.MinCPUSVN = "0404020401800000000000000000000f"
+	config.MinPCESVN = 10
+	config.ISVFamilyID = strings.Repeat("f1", ISVFAMILYID_SIZE)
+	config.ConfigID = strings.Repeat("c1", CONFIGID_SIZE)
+	config.MinConfigSVN = 2
+	config.ReverifyInterval = 60
+	config.LinkableSignatures = true
+	config.RequireClientNonce = true
+	config.ClientNonceWindow = 300
+	config.LogRedaction = REDACT_IDENTIFIERS
+	config.MaxMeasurementAge = 24
+
+	// Files and secrets are not part of the round trip.
+	input := *config
+	input.Subscription = "secret"
+	input.Mrenclaves = mrDir
+	input.Mrsigners = mrDir
+	input.LongTermKey = keyFile
+
+	parsed := parseConfiguration(&input)
+	if len(parsed.mrenclaves) != 1 || parsed.longTermKey == nil {
+		t.Fatal("Configuration was not parsed.")
+	}
+	if round := parsed.toConfiguration(); !reflect.DeepEqual(round, config) {
+		t.Fatalf("Configuration did not survive the round trip:\n%+v\n%+v", round, config)
+	}
+}
+
+func TestParseSPID(t *testing.T) {
+	expected := "00112233445566778899aabbccddeeff"
+	for _, input := range []string{
+		expected,
+		"0x" + expected,
+		"0X00112233445566778899AABBCCDDEEFF",
+		"  " + expected + "  ",
+		expected + "\n",
+		"0x" + expected + "\r\n",
+		"00112233 44556677 8899aabb ccddeeff",
+	} {
+		spid, err := parseSPID(input)
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+		} else if hex.EncodeToString(spid) != expected {
+			t.Errorf("%q: incorrect SPID %x.", input, spid)
+		}
+	}
+
+	if _, err := parseSPID("0x" + expected[:30] + "\n"); err == nil {
+		t.Error("Short SPID should be rejected.")
+	} else if !strings.Contains(err.Error(), "30") {
+		t.Error("Error should show the cleaned length:", err)
+	}
+	if _, err := parseSPID(strings.Repeat("zz", 16)); err == nil {
+		t.Error("Non-hex SPID should be rejected.")
+	}
+
+	raw, _ := hex.DecodeString(expected)
+	if spid, err := parseSPID(base64.StdEncoding.EncodeToString(raw) + "\n"); err != nil {
+		t.Error("Base64 SPID:", err)
+	} else if hex.EncodeToString(spid) != expected {
+		t.Errorf("Incorrect base64 SPID %x.", spid)
+	}
+	// 24 base64 characters without padding are 18 bytes.
+	if _, err := parseSPID(strings.Repeat("A", 24)); err == nil || !strings.Contains(err.Error(), "18 bytes") {
+		t.Error("Oversized base64 SPID should be rejected with its length:", err)
+	}
+	if _, err := parseSPID(base64.StdEncoding.EncodeToString(raw[:12])); err == nil {
+		t.Error("Short base64 SPID should be rejected.")
+	}
+}
+
+func TestEmptyMeasurements(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A directory with only the .gitignore is still empty.
+	if err := ioutil.WriteFile(path.Join(dir, ".gitignore"), []byte("*\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	empty, err := loadMRs(osFS{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty) != 0 {
+		t.Fatal("Expected no MRs, got", len(empty))
+	}
+	if err := checkMeasurements(MEASUREMENT_BOTH, dir, empty, dir, empty); err == nil {
+		t.Fatal("Empty MREnclave and MRSigner lists should be refused.")
+	} else if !strings.Contains(err.Error(), dir) {
+		t.Fatal("Error should name the empty directories:", err)
+	}
+	if err := checkMeasurements(MEASUREMENT_BOTH, dir, [][MR_SIZE]byte{testMR}, dir, empty); err != nil {
+		t.Fatal(err)
+	}
+
+	// A policy only needs the list it checks.
+	mrs := [][MR_SIZE]byte{testMR}
+	if err := checkMeasurements(MEASUREMENT_MRSIGNER_ONLY, dir, mrs, dir, empty); err == nil {
+		t.Fatal("MRSigner only needs MRSigners.")
+	} else if err := checkMeasurements(MEASUREMENT_MRSIGNER_ONLY, dir, empty, dir, mrs); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMeasurements(MEASUREMENT_MRENCLAVE_ONLY, dir, empty, dir, mrs); err == nil {
+		t.Fatal("MREnclave only needs MREnclaves.")
+	} else if err := checkMeasurements(MEASUREMENT_MRENCLAVE_ONLY, dir, mrs, dir, empty); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMeasurements(MEASUREMENT_EITHER, dir, empty, dir, mrs); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMeasurements("any", dir, mrs, dir, mrs); err == nil {
+		t.Fatal("Unknown policies should be refused.")
+	}
+}
+
+func TestMeasurementAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	enclaves, signers := path.Join(dir, "mrenclaves"), path.Join(dir, "mrsigners")
+	for _, mrDir := range []string{enclaves, signers} {
+		if err := os.Mkdir(mrDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []struct {
+		name string
+		age  time.Duration
+	}{
+		{path.Join(enclaves, "old"), 90 * 24 * time.Hour},
+		{path.Join(enclaves, ".gitignore"), 0},
+		{path.Join(signers, "older"), 100 * 24 * time.Hour},
+	}
+	for _, file := range files {
+		if err := ioutil.WriteFile(file.name, []byte(hex.EncodeToString(testMR[:])), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file.name, now.Add(-file.age), now.Add(-file.age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The .gitignore does not count as a rotation.
+	if err := checkMeasurementAge(osFS{}, 30*24*time.Hour, now, enclaves, signers); err == nil {
+		t.Fatal("Measurements older than the maximum age should be refused.")
+	} else if !strings.Contains(err.Error(), enclaves) || !strings.Contains(err.Error(), signers) {
+		t.Fatal("The error should name the directories:", err)
+	}
+	if err := checkMeasurementAge(osFS{}, 95*24*time.Hour, now, enclaves, signers); err != nil {
+		t.Fatal(err)
+	}
+
+	// One fresh file is enough.
+	fresh := path.Join(signers, "fresh")
+	if err := ioutil.WriteFile(fresh, []byte(hex.EncodeToString(testMR[:])), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fresh, now.Add(-time.Hour), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMeasurementAge(osFS{}, 30*24*time.Hour, now, enclaves, signers); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMeasurementAge(osFS{}, 30*24*time.Hour, now, enclaves, ""); err == nil {
+		t.Fatal("Only the configured directories should count.")
+	}
+
+	// Files without a modification time are always too old.
+	mapFS := fstest.MapFS{"mrs/enclave": {Data: []byte(hex.EncodeToString(testMR[:]))}}
+	if err := checkMeasurementAge(mapFS, 30*24*time.Hour, now, "mrs"); err == nil {
+		t.Fatal("Files without a modification time should be refused.")
+	}
+
+	// The check is off by default.
+	der, err := x509.MarshalPKCS8PrivateKey(generateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfiguration()
+	config.Spid = "00112233445566778899aabbccddeeff"
+	config.Mrenclaves = enclaves
+	config.Mrsigners = enclaves
+	config.LongTermKey = keyFile
+	if _, err := newConfiguration(config); err != nil {
+		t.Fatal("Old measurements should be accepted without MaxMeasurementAge:", err)
+	}
+	config.MaxMeasurementAge = 30 * 24
+	if _, err := newConfiguration(config); err == nil || !strings.Contains(err.Error(), "MaxMeasurementAge") {
+		t.Fatal("Old measurements should be refused with MaxMeasurementAge, got:", err)
+	}
+}
+
+// setEnv sets the environment variables in vars, and returns a
+// function that restores their previous values.
+func setEnv(vars map[string]string) func() {
+	old := make(map[string]*string)
+	for name, value := range vars {
+		if prev, ok := os.LookupEnv(name); ok {
+			old[name] = &prev
+		} else {
+			old[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, prev := range old {
+			if prev == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *prev)
+			}
+		}
+	}
+}
+
+func TestConfigurationFromEnv(t *testing.T) {
+	defer setEnv(map[string]string{
+		"SGX_RELEASE":                  "true",
+		"SGX_ENVIRONMENT":              ENV_PRODUCTION,
+		"SGX_SUBSCRIPTION":             "secret",
+		"SGX_MRENCLAVES":               "/mrenclaves",
+		"SGX_MRSIGNERS":                "/mrsigners",
+		"SGX_SPID":                     "00112233445566778899aabbccddeeff",
+		"SGX_LONG_TERM_KEY":            "/key.pem",
+		"SGX_SECONDARY_LONG_TERM_KEYS": "/old.pem, /older.pem",
+		"SGX_ALLOWED_ADVISORIES":       `{"GROUP_OUT_OF_DATE": ["INTEL-SA-00161"]}`,
+		"SGX_PROD_SVNS":                `{"7": 5}`,
+		"SGX_PROD_ID":                  "3",
+		"SGX_PROD_SVN":                 "2",
+		"SGX_MAX_SESSIONS":             "-1",
+		"SGX_SKIP_SIGRL":               "true",
+		"SGX_SIGRL_GROUPS":             "00000b1e",
+		"SGX_XFRM_MASK":                "0x3",
+		"SGX_MISC_SELECT":              "1",
+		"SGX_MSG4_PAYLOAD":             "aGVsbG8=",
+		"SGX_MEASUREMENT_POLICY":       "either",
+	})()
+
+	config, err := ConfigurationFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := DefaultConfiguration()
+	expected.Release = true
+	expected.Environment = ENV_PRODUCTION
+	expected.Subscription = "secret"
+	expected.Mrenclaves = "/mrenclaves"
+	expected.Mrsigners = "/mrsigners"
+	expected.Spid = "00112233445566778899aabbccddeeff"
+	expected.LongTermKey = "/key.pem"
+	expected.SecondaryLongTermKeys = []string{"/old.pem", "/older.pem"}
+	expected.AllowedAdvisories = map[string][]string{ISV_GROUP_OUT_OF_DATE: {"INTEL-SA-00161"}}
+	expected.ProdSVNs = map[int]int{7: 5}
+	expected.ProdID = 3
+	expected.ProdSVN = 2
+	expected.MaxSessions = -1
+	expected.SkipSigRL = true
+	expected.SigRLGroups = []string{"00000b1e"}
+	expected.XFRMMask = 0x3
+	expected.MiscSelect = 1
+	expected.Msg4Payload = []byte("hello")
+	expected.MeasurementPolicy = MEASUREMENT_EITHER
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("Incorrect configuration:\n%+v\n%+v", config, expected)
+	}
+}
+
+func TestConfigurationFromEnvErrors(t *testing.T) {
+	required := map[string]string{
+		"SGX_SUBSCRIPTION":  "secret",
+		"SGX_MRENCLAVES":    "/mrenclaves",
+		"SGX_MRSIGNERS":     "/mrsigners",
+		"SGX_SPID":          "00112233445566778899aabbccddeeff",
+		"SGX_LONG_TERM_KEY": "/key.pem",
+	}
+	for name := range required {
+		func() {
+			defer setEnv(required)()
+			os.Unsetenv(name)
+			if _, err := ConfigurationFromEnv(); err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("Missing %s should be reported, got: %v", name, err)
+			}
+		}()
+	}
+
+	for name, value := range map[string]string{
+		"SGX_RELEASE":            "maybe",
+		"SGX_PROD_ID":            "three",
+		"SGX_MISC_SELECT":        "0x100000000",
+		"SGX_ALLOWED_ADVISORIES": "[]",
+		"SGX_MSG4_PAYLOAD":       "not base64",
+	} {
+		func() {
+			defer setEnv(required)()
+			defer setEnv(map[string]string{name: value})()
+			if _, err := ConfigurationFromEnv(); err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("Invalid %s should be reported, got: %v", name, err)
+			}
+		}()
+	}
+}
+
+func TestConfigurationFromEnvMeasurementPolicy(t *testing.T) {
+	required := map[string]string{
+		"SGX_SUBSCRIPTION":  "secret",
+		"SGX_MRENCLAVES":    "/mrenclaves",
+		"SGX_MRSIGNERS":     "/mrsigners",
+		"SGX_SPID":          "00112233445566778899aabbccddeeff",
+		"SGX_LONG_TERM_KEY": "/key.pem",
+	}
+	tests := []struct {
+		policy  MeasurementPolicy
+		missing string
+		ok      bool
+	}{
+		{MEASUREMENT_MRSIGNER_ONLY, "SGX_MRENCLAVES", true},
+		{MEASUREMENT_MRSIGNER_ONLY, "SGX_MRSIGNERS", false},
+		{MEASUREMENT_MRENCLAVE_ONLY, "SGX_MRSIGNERS", true},
+		{MEASUREMENT_MRENCLAVE_ONLY, "SGX_MRENCLAVES", false},
+		{MEASUREMENT_EITHER, "SGX_MRENCLAVES", false},
+	}
+	for _, test := range tests {
+		func() {
+			defer setEnv(required)()
+			defer setEnv(map[string]string{"SGX_MEASUREMENT_POLICY": string(test.policy)})()
+			os.Unsetenv(test.missing)
+			config, err := ConfigurationFromEnv()
+			if test.ok && err != nil {
+				t.Errorf("Policy %s without %s: unexpected error: %v", test.policy, test.missing, err)
+			} else if test.ok && config.MeasurementPolicy != test.policy {
+				t.Errorf("Policy %s without %s: got policy %s.", test.policy, test.missing, config.MeasurementPolicy)
+			} else if !test.ok && (err == nil || !strings.Contains(err.Error(), test.missing)) {
+				t.Errorf("Policy %s without %s: missing variable should be reported, got: %v", test.policy, test.missing, err)
+			}
+		}()
+	}
+}
+
+//go:embed testdata/mrenclaves
+var testMRFS embed.FS
+
+func TestLoadMRsFS(t *testing.T) {
+	mrs, err := loadMRs(testMRFS, "testdata/mrenclaves")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var second [MR_SIZE]byte
+	copy(second[:], bytes.Repeat([]byte{0xe1}, MR_SIZE))
+	if !reflect.DeepEqual(mrs, [][MR_SIZE]byte{testMR, second}) {
+		t.Fatal("Incorrect MRs:", mrs)
+	}
+
+	// Paths are always in the filesystem given, never on disk.
+	if _, err := loadMRs(testMRFS, "testdata/mrsigners"); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatal("Expected a missing directory, got:", err)
+	}
+	if _, err := loadMRs(testMRFS, "testdata/mrenclaves/enclave1"); err == nil || !strings.Contains(err.Error(), "is a file") {
+		t.Fatal("Expected a file in place of the directory, got:", err)
+	}
+
+	config := &Configuration{Mrenclaves: "testdata/mrenclaves"}
+	if measurementsFS(config) != (osFS{}) {
+		t.Fatal("The local filesystem should be the default.")
+	}
+	config.MeasurementsFS = testMRFS
+	if mrs, err := loadMRs(measurementsFS(config), config.Mrenclaves); err != nil || len(mrs) != 2 {
+		t.Fatal("Could not load the MRs of the configuration:", mrs, err)
+	}
+}
+
+func TestLoadMRsPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "enclave")
+	if err := ioutil.WriteFile(file, []byte(hex.EncodeToString(testMR[:])), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		dir  string
+		msg  string
+	}{
+		{"unset", "", "No MR directory"},
+		{"missing", path.Join(dir, "missing"), "does not exist"},
+		{"file", file, "is a file, expected a directory"},
+	}
+	for _, test := range tests {
+		if _, err := loadMRs(osFS{}, test.dir); err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%s: expected %q, got: %v", test.name, test.msg, err)
+		}
+	}
+
+	if mrs, err := loadMRs(osFS{}, dir); err != nil {
+		t.Fatal(err)
+	} else if len(mrs) != 1 || mrs[0] != testMR {
+		t.Fatal("Incorrect MRs:", mrs)
+	}
+}
+
+func TestNewSessionManagerFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der, err := x509.MarshalPKCS8PrivateKey(generateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfiguration()
+	config.Subscription = "secret"
+	config.Mrenclaves = "testdata/mrenclaves"
+	config.Mrsigners = "testdata/mrenclaves"
+	config.Spid = "00112233445566778899aabbccddeeff"
+	config.LongTermKey = keyFile
+	config.AllowedAdvisories = map[string][]string{ISV_GROUP_OUT_OF_DATE: {"INTEL-SA-00161"}}
+	config.ProdID = 3
+	config.ProdSVN = 2
+	config.MaxSessions = 10
+	config.Timeout = 5
+	config.SigRLGroups = []string{"00000b1e"}
+	config.MinCPUSVN = "0404020401800000000000000000000f"
+	config.IASEndpoints = []string{"https://proxy.example"}
+
+	sm, err := NewSessionManagerFromConfig(config, WithLogger(log.New(ioutil.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := sm.Describe()
+	if info.ProdID != 3 || info.ProdSVN != 2 || info.MaxSessions != 10 || info.MREnclaves != 2 || info.MRSigners != 2 {
+		t.Fatalf("Incorrect session manager: %+v", info)
+	} else if info.IASHost != "https://proxy.example" {
+		t.Fatal("Incorrect IAS host:", info.IASHost)
+	}
+	if _, err := sm.NewSession(&Request{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid configurations are reported rather than fatal.
+	tests := []struct {
+		name   string
+		modify func(c *Configuration)
+	}{
+		{"missing key", func(c *Configuration) { c.LongTermKey = path.Join(dir, "missing.pem") }},
+		{"bad SPID", func(c *Configuration) { c.Spid = "0011" }},
+		{"bad group", func(c *Configuration) { c.SigRLGroups = []string{"0b1e"} }},
+		{"bad CPUSVN", func(c *Configuration) { c.MinCPUSVN = "04" }},
+		{"bad ConfigID", func(c *Configuration) { c.ConfigID = strings.Repeat("c1", ISVFAMILYID_SIZE) }},
+		{"large MinConfigSVN", func(c *Configuration) { c.MinConfigSVN = math.MaxUint16 + 1 }},
+		{"missing MRs", func(c *Configuration) { c.Mrenclaves = path.Join(dir, "missing") }},
+		{"large ProdSVN", func(c *Configuration) { c.ProdSVN = math.MaxUint16 + 1 }},
+		{"large ProdSVNs", func(c *Configuration) { c.ProdSVNs = map[int]int{7: math.MaxUint16 + 1} }},
+		{"negative ProdSVNs key", func(c *Configuration) { c.ProdSVNs = map[int]int{-7: 5} }},
+		{"negative MaxSessions", func(c *Configuration) { c.MaxSessions = -100 }},
+		{"negative Timeout", func(c *Configuration) { c.Timeout = -5 }},
+		{"negative ReverifyInterval", func(c *Configuration) { c.ReverifyInterval = -1 }},
+		{"negative ClientNonceWindow", func(c *Configuration) { c.ClientNonceWindow = -1 }},
+		{"negative MaxMeasurementAge", func(c *Configuration) { c.MaxMeasurementAge = -1 }},
+		{"unknown redaction", func(c *Configuration) { c.LogRedaction = "everything" }},
+		{"environment", func(c *Configuration) { c.Environment = ENV_PRODUCTION }},
+		{"insecure IAS in release", func(c *Configuration) {
+			c.Release = true
+			c.IASInsecureSkipTLSVerify = true
+		}},
+		{"insecure IAS without signing root", func(c *Configuration) {
+			c.IASInsecureSkipTLSVerify = true
+			c.IASReportSigningRoot = ""
+		}},
+	}
+	for _, test := range tests {
+		invalid := *config
+		test.modify(&invalid)
+		if sm, err := NewSessionManagerFromConfig(&invalid); err == nil || sm != nil {
+			t.Errorf("%s: expected an error, got: %v", test.name, err)
+		}
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der, err := x509.MarshalPKCS8PrivateKey(generateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfiguration()
+	config.Subscription = "secret"
+	config.Mrenclaves = "testdata/mrenclaves"
+	config.Mrsigners = "testdata/mrenclaves"
+	config.Spid = "00112233445566778899aabbccddeeff"
+	config.LongTermKey = keyFile
+	config.SkipSigRL = true
+
+	// 0 would leave no room for any session.
+	for name, modify := range map[string]func(c *Configuration){
+		"MaxSessions": func(c *Configuration) { c.MaxSessions = 0 },
+		"Timeout":     func(c *Configuration) { c.Timeout = 0 },
+	} {
+		invalid := *config
+		modify(&invalid)
+		if _, err := NewSessionManagerFromConfig(&invalid); err == nil || !strings.Contains(err.Error(), name+" 0") {
+			t.Errorf("%s 0 should be rejected, got: %v", name, err)
+		}
+	}
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	newSessions := func(sm SessionManager, n int) []string {
+		var ids []string
+		for i := 0; i < n; i++ {
+			challenge, err := sm.NewSession(&Request{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, challenge.SessionId)
+		}
+		return ids
+	}
+	msg1Err := func(sm SessionManager, id string) error {
+		_, msg1 := newTestMsg1()
+		_, err := sm.Msg1ToMsg2(id, msg1)
+		return err
+	}
+
+	// One session at a time, which never expires.
+	config.MaxSessions = 1
+	config.Timeout = -1
+	sm, err := NewSessionManagerFromConfig(config, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Stop()
+	ids := newSessions(sm, 2)
+	now = now.Add(365 * 24 * time.Hour)
+	if err := msg1Err(sm, ids[0]); !errors.Is(err, ErrSessionManagerFull) {
+		t.Fatal("The first session should be evicted, got:", err)
+	} else if err := msg1Err(sm, ids[1]); err != nil {
+		t.Fatal("The session should never expire, got:", err)
+	}
+
+	// Any number of sessions, which expire after a minute.
+	config.MaxSessions = -1
+	config.Timeout = 1
+	sm, err = NewSessionManagerFromConfig(config, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Stop()
+	ids = newSessions(sm, 3)
+	if err := msg1Err(sm, ids[0]); err != nil {
+		t.Fatal("No session should be evicted, got:", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := msg1Err(sm, ids[1]); !errors.Is(err, ErrSessionExpired) {
+		t.Fatal("The session should expire, got:", err)
+	}
+}
+
+func TestIASInsecureSkipTLSVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der, err := x509.MarshalPKCS8PrivateKey(generateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfiguration()
+	config.Subscription = "secret"
+	config.Mrenclaves = "testdata/mrenclaves"
+	config.Mrsigners = "testdata/mrenclaves"
+	config.Spid = "00112233445566778899aabbccddeeff"
+	config.LongTermKey = keyFile
+	config.IASInsecureSkipTLSVerify = true
+
+	// The reports of an IAS that is not verified must be checked.
+	if _, err := NewSessionManagerFromConfig(config); err == nil || !strings.Contains(err.Error(), "IASReportSigningRoot") {
+		t.Fatal("Skipping the TLS verification of IAS without a signing root should be refused, got:", err)
+	}
+	_, cert := reportSigner(t)
+	rootFile := path.Join(dir, "root.pem")
+	if err := ioutil.WriteFile(rootFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.IASReportSigningRoot = rootFile
+
+	var logs bytes.Buffer
+	sm, err := NewSessionManagerFromConfig(config, WithLogger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Stop()
+	if !strings.Contains(logs.String(), "WARNING: IASInsecureSkipTLSVerify") {
+		t.Fatal("Skipping the TLS verification of IAS should be warned about:", logs.String())
+	}
+	transport := sm.(*sessionManager).baseIAS.(*ias).client.Transport.(*http.Transport)
+	if !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("The TLS verification of IAS should be skipped in development mode.")
+	}
+
+	config.Release = true
+	if _, err := NewSessionManagerFromConfig(config); err == nil || !strings.Contains(err.Error(), "IASInsecureSkipTLSVerify") {
+		t.Fatal("Skipping the TLS verification of the production IAS should be refused, got:", err)
+	}
+}
+
+func TestConfigurationLiteralUsesSigRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der, err := x509.MarshalPKCS8PrivateKey(generateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A literal that leaves out SkipSigRL still sends the SigRL.
+	config := &Configuration{
+		Subscription: "secret",
+		Mrenclaves:   "testdata/mrenclaves",
+		Mrsigners:    "testdata/mrenclaves",
+		Spid:         "00112233445566778899aabbccddeeff",
+		LongTermKey:  keyFile,
+		MaxSessions:  10,
+		Timeout:      5,
+	}
+	sm, err := NewSessionManagerFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Stop()
+	if sm.Describe().SkipSigRL {
+		t.Fatal("A Configuration literal should use the SigRL.")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der, err := x509.MarshalPKCS8PrivateKey(generateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfiguration()
+	config.Subscription = "secret"
+	config.Mrenclaves = "testdata/mrenclaves"
+	config.Mrsigners = "testdata/mrenclaves"
+	config.Spid = "00112233445566778899aabbccddeeff"
+	config.LongTermKey = keyFile
+	config.ProdID = 3
+	config.ProdSVN = 2
+	config.MaxSessions = 10
+	config.InvalidateOnSVNRaise = true
+	sm, err := NewSessionManagerFromConfig(config, WithLogger(log.New(ioutil.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new enclave build, with a raised SVN.
+	canary := strings.Repeat("ca", MR_SIZE)
+	next := *config
+	next.MeasurementsFS = fstest.MapFS{"mrs/canary": {Data: []byte(canary + "\n")}}
+	next.Mrenclaves = "mrs"
+	next.Mrsigners = "mrs"
+	next.ProdSVN = 4
+	if err := sm.Reconfigure(&next); err != nil {
+		t.Fatal(err)
+	}
+	check := func(stage string) {
+		mrenclaves, mrsigners := sm.TrustedMeasurements()
+		if info := sm.Describe(); info.ProdSVN != 4 {
+			t.Fatalf("%s: incorrect ProdSVN %d.", stage, info.ProdSVN)
+		} else if !reflect.DeepEqual(mrenclaves, []string{canary}) || !reflect.DeepEqual(mrsigners, []string{canary}) {
+			t.Fatalf("%s: incorrect measurements %v and %v.", stage, mrenclaves, mrsigners)
+		}
+	}
+	check("reconfigured")
+	if _, ok := sm.GetSession(pending.SessionId); ok {
+		t.Fatal("The pending session should be closed once ProdSVN is raised.")
+	}
+	if _, err := sm.NewSession(&Request{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changes if the configuration is invalid, or changes
+	// what cannot be reconfigured.
+	tests := []struct {
+		name   string
+		modify func(c *Configuration)
+	}{
+		{"bad SPID", func(c *Configuration) { c.Spid = "0011" }},
+		{"missing MRs", func(c *Configuration) { c.Mrsigners = "missing" }},
+		{"MaxSessions", func(c *Configuration) { c.MaxSessions = 20 }},
+		{"IASEndpoints", func(c *Configuration) { c.IASEndpoints = []string{"https://proxy.example"} }},
+		{"Subscription", func(c *Configuration) { c.Subscription = "other" }},
+	}
+	for _, test := range tests {
+		invalid := next
+		invalid.ProdSVN = 5
+		invalid.Mrenclaves = "testdata/mrenclaves"
+		invalid.Mrsigners = "testdata/mrenclaves"
+		invalid.MeasurementsFS = nil
+		test.modify(&invalid)
+		if err := sm.Reconfigure(&invalid); err == nil {
+			t.Errorf("%s: expected an error.", test.name)
+		} else if test.name != "bad SPID" && test.name != "missing MRs" && !strings.Contains(err.Error(), test.name) {
+			t.Errorf("%s: the error should name the setting: %v", test.name, err)
+		}
+		check(test.name)
+	}
+}
@@ -0,0 +1,110 @@
+package sgx_server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// The largest message ServeConn accepts from a client. Message 3
+// with a signed quote and a PSE manifest is well below this.
+const MAX_CONN_MSG_SIZE = 1 << 16
+
+// ServeConn runs one full attestation handshake with the client on
+// conn, for clients that do not speak gRPC. Every message is a
+// protobuf encoding prefixed by its length as a 4 byte big-endian
+// integer. The client sends a Request, Msg1, and Msg3, and the server
+// replies to each with a Challenge, Msg2, and Msg4 respectively.
+// Since the connection carries the session, the client does not need
+// to send the session id back. Returns the authenticated session, so
+// that the caller can keep using conn as the attested channel. The
+// session is tied to ctx as with NewSessionCtx, so cancel ctx once
+// conn is closed. If the handshake fails, e.g., because the client
+// went away, ServeConn closes conn and removes the session.
+func ServeConn(ctx context.Context, sm SessionManager, conn net.Conn) (sn Session, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+			conn.Close()
+		}
+	}()
+
+	var req Request
+	if err := readConnMsg(conn, &req); err != nil {
+		return nil, err
+	}
+	challenge, err := sm.NewSessionCtx(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeConnMsg(conn, challenge); err != nil {
+		return nil, err
+	}
+	id := challenge.SessionId
+
+	var msg1 Msg1
+	if err := readConnMsg(conn, &msg1); err != nil {
+		return nil, err
+	}
+	msg2, err := sm.Msg1ToMsg2(id, &msg1)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeConnMsg(conn, msg2); err != nil {
+		return nil, err
+	}
+
+	var msg3 Msg3
+	if err := readConnMsg(conn, &msg3); err != nil {
+		return nil, err
+	}
+	msg4, err := sm.Msg3ToMsg4(id, &msg3)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeConnMsg(conn, msg4); err != nil {
+		return nil, err
+	}
+	sn, ok := sm.GetSession(id)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return sn, nil
+}
+
+// readConnMsg reads one length-prefixed message from r into msg.
+func readConnMsg(r io.Reader, msg proto.Message) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > MAX_CONN_MSG_SIZE {
+		return fmt.Errorf("%w Message of %d bytes is too large.", ErrMalformedMessage, n)
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	return proto.Unmarshal(buf, msg)
+}
+
+// writeConnMsg writes msg to w prefixed by its length.
+func writeConnMsg(w io.Writer, msg proto.Message) error {
+	buf, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	out := make([]byte, 4+len(buf))
+	binary.BigEndian.PutUint32(out, uint32(len(buf)))
+	copy(out[4:], buf)
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,147 @@
+package sgx_server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeConn(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	defer sm.Stop()
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		sn  Session
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		sn, err := ServeConn(ctx, sm, server)
+		done <- result{sn, err}
+	}()
+
+	if err := writeConnMsg(client, &Request{}); err != nil {
+		t.Fatal(err)
+	}
+	var challenge Challenge
+	if err := readConnMsg(client, &challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	priv, msg1 := newTestMsg1()
+	if err := writeConnMsg(client, msg1); err != nil {
+		t.Fatal(err)
+	}
+	var msg2 Msg2
+	if err := readConnMsg(client, &msg2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeConnMsg(client, newTestMsg3(priv, msg1, &msg2, newTestQuote())); err != nil {
+		t.Fatal(err)
+	}
+	var msg4 Msg4
+	if err := readConnMsg(client, &msg4); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if sn, ok := sm.GetSession(challenge.SessionId); !ok || sn != res.sn || !sn.Authenticated() {
+		t.Fatal("ServeConn should return the authenticated session.")
+	}
+
+	// The connection stays open for the attested channel, until the
+	// caller is done with it.
+	sealed, err := res.sn.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go writeConnMsg(server, &Msg4{Payload: sealed})
+	var msg Msg4
+	if err := readConnMsg(client, &msg); err != nil {
+		t.Fatal("The connection should stay open after the handshake:", err)
+	}
+	cancel()
+	waitSessionRemoved(t, sm, challenge.SessionId, ErrSessionCanceled)
+}
+
+// waitSessionRemoved waits for the session matching id to be removed
+// by the background goroutine watching its context.
+func waitSessionRemoved(t *testing.T, sm *sessionManager, id string, reason error) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := sm.lookup(id)
+		if errors.Is(err, reason) {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatal("The session should be removed, got:", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServeConnClientGone(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	defer sm.Stop()
+	client, server := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ServeConn(context.Background(), sm, server)
+		done <- err
+	}()
+
+	if err := writeConnMsg(client, &Request{}); err != nil {
+		t.Fatal(err)
+	}
+	var challenge Challenge
+	if err := readConnMsg(client, &challenge); err != nil {
+		t.Fatal(err)
+	}
+	_, msg1 := newTestMsg1()
+	if err := writeConnMsg(client, msg1); err != nil {
+		t.Fatal(err)
+	}
+	var msg2 Msg2
+	if err := readConnMsg(client, &msg2); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client goes away in the middle of the handshake.
+	client.Close()
+	if err := <-done; err == nil {
+		t.Fatal("The handshake should fail without the client.")
+	}
+	waitSessionRemoved(t, sm, challenge.SessionId, ErrSessionCanceled)
+}
+
+func TestServeConnTooLarge(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ServeConn(context.Background(), sm, server)
+		done <- err
+	}()
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], MAX_CONN_MSG_SIZE+1)
+	if _, err := client.Write(size[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Fatal("Oversized message should be rejected.")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build debug
+// +build debug
+
+package sgx_server
+
+// KDK returns a copy of the key derivation key of the session, the
+// CMAC of the shared Diffie-Hellman secret that all the other session
+// keys are derived from, e.g., to compare it with the one computed by
+// a client enclave that fails the handshake. Sessions created by this
+// package have it when built with the debug tag:
+//
+//	kdk, err := sn.(interface{ KDK() ([]byte, error) }).KDK()
+//
+// NEVER build a production server with the debug tag. The KDK is
+// enough to derive SK and MK, so whoever can call KDK can read and
+// forge every message of the session. Returns ErrMsg2NotCreated
+// before message 2, when the KDK is derived.
+func (sn *session) KDK() ([]byte, error) {
+	if sn.kdk == nil {
+		return nil, ErrMsg2NotCreated
+	}
+	return append([]byte(nil), sn.kdk...), nil
+}
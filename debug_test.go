@@ -0,0 +1,57 @@
+//go:build debug
+// +build debug
+
+package sgx_server
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKDK(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	challenge, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn, _ := sm.GetSession(challenge.SessionId)
+	debug, ok := sn.(interface{ KDK() ([]byte, error) })
+	if !ok {
+		t.Fatal("Sessions should have KDK with the debug tag.")
+	}
+	if _, err := debug.KDK(); !errors.Is(err, ErrMsg2NotCreated) {
+		t.Fatal("The KDK should not exist before message 2, got:", err)
+	}
+
+	_, msg1 := newTestMsg1()
+	if _, err := sm.Msg1ToMsg2(challenge.SessionId, msg1); err != nil {
+		t.Fatal(err)
+	}
+	kdk, err := debug.KDK()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(kdk) != 16 {
+		t.Fatal("The KDK should be 16 bytes, got", len(kdk))
+	}
+
+	// The KDK is what SK is derived from.
+	id, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn, _ = sm.GetSession(id)
+	kdk, err = sn.(interface{ KDK() ([]byte, error) }).KDK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, err := deriveLabelKeyFromBase(kdk, SK_LABEL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported, err := sn.ExportKey(SK_LABEL); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(sk, exported) {
+		t.Fatal("SK should be derived from the KDK.")
+	}
+}
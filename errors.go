@@ -0,0 +1,230 @@
+package sgx_server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors returned while processing SGX attestation messages.
+var (
+	// ErrInvalidClientKey is returned when the client's public
+	// key (GA) in message 1 is missing, zero, or not a valid
+	// point on the P-256 curve.
+	ErrInvalidClientKey = errors.New("Invalid client public key.")
+
+	// ErrUnsupportedExtendedGID is returned for message 0 with
+	// an extended EPID group other than 0, which is the only one
+	// IAS supports.
+	ErrUnsupportedExtendedGID = errors.New("Only extended EPID group 0 is supported.")
+
+	// ErrMalformedMessage is returned when a message from the
+	// client is missing fields, or has fields of the wrong size.
+	ErrMalformedMessage = errors.New("Malformed message.")
+
+	// ErrSignTypeMismatch is returned when the quote in message 3
+	// is linkable but the SPID is for unlinkable signatures, or
+	// the other way around. IAS would reject it anyway.
+	ErrSignTypeMismatch = errors.New("Quote signature type does not match the SPID.")
+
+	// ErrUnknownKeyHash is returned when message 1 asks for a
+	// long-term key that is not configured.
+	ErrUnknownKeyHash = errors.New("No long-term key matches the requested key hash.")
+
+	// ErrInvalidPEM is returned when a key file has no PEM block,
+	// e.g., because it is DER encoded or empty.
+	ErrInvalidPEM = errors.New("Not a valid PEM file.")
+
+	// ErrInvalidLabel is returned for key derivation labels that
+	// are too long, too short, or not allowed.
+	ErrInvalidLabel = errors.New("Invalid key label.")
+
+	// ErrInvalidMsg3 is returned when message 3 does not match
+	// the handshake: the GA, the MAC, or the report data hash.
+	ErrInvalidMsg3 = errors.New("Message 3 failed verification.")
+
+	// ErrEnclaveNotAllowed is returned when the attested enclave
+	// does not meet the policy: its MREnclave, MRSigner,
+	// production ID, SVN, or attributes.
+	ErrEnclaveNotAllowed = errors.New("Enclave is not allowed.")
+
+	// ErrQuoteRejected is returned (wrapped in a
+	// QuoteStatusError or a TCBEvaluationError) when IAS did not
+	// accept the quote.
+	ErrQuoteRejected = errors.New("Quote rejected by IAS.")
+
+	// ErrInvalidReport is returned when the report from IAS does
+	// not match the request, or cannot be parsed.
+	ErrInvalidReport = errors.New("Invalid IAS report.")
+
+	// ErrNoSessionID is returned when a gRPC call that needs a
+	// session id does not carry one in its metadata.
+	ErrNoSessionID = errors.New("No session id in the metadata.")
+
+	// ErrNotAuthenticated is returned when an operation requires
+	// the session to have completed attestation.
+	ErrNotAuthenticated = errors.New("Session is not authenticated.")
+
+	// ErrMsg1NotProcessed is returned when reading what the
+	// client sent in message 1 before message 1 was processed.
+	ErrMsg1NotProcessed = errors.New("Message 1 has not been processed.")
+
+	// ErrInvalidTimeout is returned by Session.SetTimeout for a
+	// timeout that is not positive or above MaxSessionTimeout.
+	ErrInvalidTimeout = errors.New("Invalid session timeout.")
+
+	// ErrInvalidToken is returned by VerifyToken for a token that
+	// is malformed or not signed by the expected key.
+	ErrInvalidToken = errors.New("Invalid session token.")
+
+	// ErrTokenExpired is returned by VerifyToken for a token past
+	// its expiry.
+	ErrTokenExpired = errors.New("Session token expired.")
+
+	// ErrMsg2NotCreated is returned when reading what the server
+	// sent in message 2 before message 2 was created.
+	ErrMsg2NotCreated = errors.New("Message 2 has not been created.")
+
+	// ErrMsg1Mismatch is returned when a session receives
+	// another message 1 that is not an exact retransmission of
+	// the one it already processed.
+	ErrMsg1Mismatch = errors.New("Message 1 differs from the one already processed for this session.")
+
+	// ErrMsg3AlreadyProcessed is returned when a session receives
+	// another message 3 after it has already been authenticated.
+	ErrMsg3AlreadyProcessed = errors.New("Message 3 was already processed for this session.")
+
+	// ErrIASQuotaExceeded is returned when the SessionManager has
+	// already verified MaxIASCallsPerDay quotes today.
+	ErrIASQuotaExceeded = errors.New("Daily IAS quota exceeded.")
+
+	// ErrIASBusy is returned when a request to IAS waited for
+	// longer than IASQueueTimeout, since IASMaxConcurrent requests
+	// were already in flight.
+	ErrIASBusy = errors.New("Too many concurrent IAS requests.")
+
+	// ErrIASRedirect is returned when an IAS endpoint answers with
+	// a redirect. Redirects are never followed, since they would
+	// carry the subscription key to wherever they point.
+	ErrIASRedirect = errors.New("IAS redirected the request.")
+
+	// ErrBusy is returned for a message 3 when
+	// MaxInFlightHandshakes messages 3 are already being verified.
+	// The session is kept, so the client can retry the same
+	// message 3 later, or with another server.
+	ErrBusy = errors.New("Too many handshakes in flight, try again later.")
+
+	// ErrTCBTooLow is returned when the security version numbers
+	// of the platform in the quote are below the configured TCB
+	// baseline, regardless of the quote status from IAS.
+	ErrTCBTooLow = errors.New("Platform TCB is below the baseline.")
+
+	// ErrRekeyRequired is returned by Seal and Open once the
+	// session has reached MaxMessagesPerSession. The client must
+	// attest again to get fresh keys.
+	ErrRekeyRequired = errors.New("Session reached its message limit and must re-key.")
+
+	// ErrNonceReused is returned when the nonce for a request to
+	// IAS was already used recently, which means the random
+	// number generator is broken.
+	ErrNonceReused = errors.New("IAS nonce was already used.")
+
+	// ErrReplayedNonce is returned when a message 1 carries a
+	// client nonce already sent recently, if the session manager
+	// requires client nonces.
+	ErrReplayedNonce = errors.New("Client nonce was already used.")
+
+	// ErrInvalidReportSignature is returned when the IAS report
+	// is missing its signature or signing certificate, or the
+	// signature does not verify. The report is never accepted.
+	ErrInvalidReportSignature = errors.New("IAS report signature is missing or invalid.")
+
+	// ErrInvalidSessionID is returned when a message names the
+	// empty session id, which NewSession never generates.
+	ErrInvalidSessionID = errors.New("Invalid session id.")
+
+	// ErrSessionNotFound is returned when no session matches the
+	// id, and the SessionManager has no record of removing it.
+	ErrSessionNotFound = errors.New("Session not found.")
+
+	// ErrSessionExpired is returned when the session was not used
+	// for longer than the configured timeout. The client should
+	// start a new handshake.
+	ErrSessionExpired = errors.New("Session expired.")
+
+	// ErrSessionInvalidated is returned when the session was
+	// closed because ProdSVN was raised above its enclave SVN.
+	ErrSessionInvalidated = errors.New("Session was closed because the minimum enclave SVN was raised.")
+
+	// ErrSessionCanceled is returned when the context the session
+	// was created with by NewSessionCtx is done.
+	ErrSessionCanceled = errors.New("Session context is done.")
+
+	// ErrSessionRevoked is returned when the session was revoked
+	// with SessionManager.Revoke.
+	ErrSessionRevoked = errors.New("Session was revoked.")
+
+	// ErrSessionReplaced is returned when the pending session was
+	// replaced by a newer session of the same client.
+	ErrSessionReplaced = errors.New("Session was replaced by a newer session of the same client.")
+
+	// ErrSessionDegraded is returned when the session was closed
+	// because IAS no longer accepted its quote when it was
+	// verified again. See ReverifyInterval.
+	ErrSessionDegraded = errors.New("Session was closed because its platform is no longer trusted.")
+
+	// ErrSessionManagerFull is returned when the session was
+	// evicted to make room for a new session because MaxSessions
+	// was reached. The client may want to back off before
+	// retrying.
+	ErrSessionManagerFull = errors.New("Session was evicted because the session manager is full.")
+)
+
+// TCBEvaluationError is returned when IAS evaluated the quote using
+// TCB evaluation data older than MinTCBEvaluationDataNumber.
+type TCBEvaluationError struct {
+	// Number is the TCB evaluation data number in the report.
+	Number int
+	// Min is the minimum number that is accepted.
+	Min int
+}
+
+func (e *TCBEvaluationError) Error() string {
+	return fmt.Sprintf("TCB evaluation data number %d is lower than the minimum %d.", e.Number, e.Min)
+}
+
+func (e *TCBEvaluationError) Unwrap() error {
+	return ErrQuoteRejected
+}
+
+// QuoteStatusError is returned when IAS reports a quote status that
+// is not allowed by AllowedAdvisories.
+type QuoteStatusError struct {
+	// Status is the quote status reported by IAS.
+	Status string
+	// Advisories are the advisories that are not allowed, if the
+	// status itself is allowed.
+	Advisories []string
+}
+
+func (e *QuoteStatusError) Error() string {
+	if len(e.Advisories) == 0 {
+		return fmt.Sprintf(quoteErr, e.Status)
+	}
+	return fmt.Sprintf(quoteErrWithAdvisory, e.Status, strings.Join(e.Advisories, ", "))
+}
+
+func (e *QuoteStatusError) Unwrap() error {
+	return ErrQuoteRejected
+}
+
+// IASStatusError is returned when IAS answers a request with an HTTP
+// status other than 200. For example, 401 means the subscription key
+// is wrong, and 429 that the subscription is rate limited.
+type IASStatusError struct {
+	StatusCode int
+}
+
+func (e *IASStatusError) Error() string {
+	return fmt.Sprintf("IAS returned error code [%d].", e.StatusCode)
+}
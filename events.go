@@ -0,0 +1,67 @@
+package sgx_server
+
+import "time"
+
+// EventType is the kind of lifecycle event a SessionManager emits.
+type EventType string
+
+const (
+	// A session was created by NewSession.
+	EVENT_SESSION_CREATED EventType = "session_created"
+	// Message 2 was created for the session.
+	EVENT_MSG2_SENT EventType = "msg2_sent"
+	// Message 3 of the session was processed. Err tells why
+	// the enclave was rejected, and is nil if it was
+	// authenticated.
+	EVENT_ATTESTATION_RESULT EventType = "attestation_result"
+	// The session was removed. Reason tells why.
+	EVENT_SESSION_CLOSED EventType = "session_closed"
+)
+
+// Event is a lifecycle event of a session.
+type Event struct {
+	Type      EventType
+	SessionID string
+	Time      time.Time
+
+	// Err is only set for EVENT_ATTESTATION_RESULT.
+	Err error
+	// Reason is only set for EVENT_SESSION_CLOSED.
+	Reason RemovalReason
+	// Timing is only set for EVENT_ATTESTATION_RESULT, if the
+	// session was authenticated.
+	Timing *HandshakeTiming
+}
+
+// The number of events buffered for SessionManager.Events.
+const EVENT_BUFFER_SIZE = 256
+
+// emit sends the event of type t for the session matching id. If the
+// buffer is full, the oldest event is dropped, so that a slow
+// consumer never blocks the handshake.
+func (sm *sessionManager) emit(t EventType, id string, err error, reason RemovalReason) {
+	sm.send(Event{
+		Type:      t,
+		SessionID: id,
+		Time:      sm.now(),
+		Err:       err,
+		Reason:    reason,
+	})
+}
+
+// send is like emit, for events with more than the common fields.
+func (sm *sessionManager) send(e Event) {
+	sm.eventsMu.Lock()
+	defer sm.eventsMu.Unlock()
+	for {
+		select {
+		case sm.events <- e:
+			return
+		default:
+		}
+		select {
+		case <-sm.events:
+		default:
+		}
+	}
+}
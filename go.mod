@@ -1,6 +1,6 @@
 module github.com/kwonalbert/sgx_server
 
-go 1.13
+go 1.16
 
 require (
 	github.com/aead/cmac v0.0.0-20160719120800-7af84192f0b1
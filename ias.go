@@ -2,19 +2,27 @@ package sgx_server
 
 import (
 	"bytes"
+	"container/list"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	_ "embed"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Intel Attestation Server parameteres.
@@ -45,10 +53,173 @@ type IAS interface {
 
 type ias struct {
 	release           bool
-	host              string
+	hosts             []string // tried in order, see WithEndpoints
 	subscription      string
 	allowedAdvisories map[string][]string
 	client            *http.Client
+	logger            Logger
+	minTCBEvaluation  int
+	// The roots the report signing certificate must chain up to,
+	// for the release and development IAS.
+	signingRoots map[bool]*x509.CertPool
+	userAgent    string
+
+	// The nonces are read from rand, and must never repeat
+	// within the window of nonces.
+	rand   io.Reader
+	nonces *nonceCache
+}
+
+// IASOption changes how the IAS created by NewIAS talks to the Intel
+// Attestation Service.
+type IASOption func(*ias)
+
+// WithClientCertificate makes the IAS present cert during the TLS
+// handshake. This is needed when the traffic to IAS goes through a
+// gateway that requires mutual TLS.
+func WithClientCertificate(cert tls.Certificate) IASOption {
+	return func(ias *ias) {
+		config := ias.tlsConfig()
+		config.Certificates = append(config.Certificates, cert)
+	}
+}
+
+// WithReportLogger makes the IAS log the id and statuses of each
+// verification report it receives to logger.
+func WithReportLogger(logger Logger) IASOption {
+	return func(ias *ias) {
+		ias.logger = logger
+	}
+}
+
+// WithMinTCBEvaluationDataNumber makes the IAS reject reports that
+// were evaluated using TCB evaluation data older than min. Reports
+// from IAS versions before 4 do not have this number, so they are
+// always rejected if min is greater than 0.
+func WithMinTCBEvaluationDataNumber(min int) IASOption {
+	return func(ias *ias) {
+		ias.minTCBEvaluation = min
+	}
+}
+
+// The default time limit for each request to IAS, including reading
+// the response.
+const DEFAULT_IAS_TIMEOUT = 10 * time.Second
+
+// WithTimeout limits each request to IAS to timeout instead of
+// DEFAULT_IAS_TIMEOUT, so that a hung connection to IAS fails the
+// request rather than blocking it forever. A timeout of 0 means no
+// limit, which is not recommended.
+func WithTimeout(timeout time.Duration) IASOption {
+	return func(ias *ias) {
+		ias.client.Timeout = timeout
+	}
+}
+
+// The version of this package, as sent to IAS in the default
+// User-Agent.
+const VERSION = "0.1.0"
+
+// The User-Agent of the requests to IAS, unless changed with
+// WithUserAgent.
+const DEFAULT_IAS_USER_AGENT = "sgx_server/" + VERSION
+
+// WithUserAgent makes the IAS send userAgent as the User-Agent of its
+// requests instead of DEFAULT_IAS_USER_AGENT, e.g., for a proxy that
+// routes by the agent.
+func WithUserAgent(userAgent string) IASOption {
+	return func(ias *ias) {
+		ias.userAgent = userAgent
+	}
+}
+
+// WithEndpoints makes the IAS send its requests to hosts instead of
+// the Intel endpoint for its release mode, e.g., to go through a
+// proxy. The hosts are tried in order: a request only goes to the
+// next host if the previous one could not be reached or answered with
+// a server error (5xx). Any other answer, including a rejection
+// (4xx), is final. Each attempt has its own timeout, so a request can
+// take up to the timeout times the number of hosts.
+func WithEndpoints(hosts ...string) IASOption {
+	return func(ias *ias) {
+		if len(hosts) > 0 {
+			ias.hosts = append([]string(nil), hosts...)
+		}
+	}
+}
+
+// WithInsecureSkipVerify makes the IAS accept any TLS certificate
+// from its endpoints, e.g., the self-signed certificate of a local
+// IAS emulator. It has no effect on an IAS in release mode, so that
+// the production IAS is always verified. The reports are still
+// checked against the report signing roots, see
+// WithReportSigningRoots. NEVER use it outside of development.
+func WithInsecureSkipVerify() IASOption {
+	return func(ias *ias) {
+		if !ias.release {
+			ias.tlsConfig().InsecureSkipVerify = true
+		}
+	}
+}
+
+// WithNonceCache makes the IAS remember the last size nonces it sent,
+// for up to ttl each, instead of DEFAULT_NONCE_CACHE_SIZE nonces for
+// DEFAULT_NONCE_CACHE_TTL. A request that would reuse a remembered
+// nonce, from any session, fails with ErrNonceReused. Random nonces
+// never repeat in practice, so this only guards against a broken
+// random number generator, on top of checking that each report
+// carries the nonce of its request.
+func WithNonceCache(size int, ttl time.Duration) IASOption {
+	return func(ias *ias) {
+		ias.nonces = newNonceCache(size, ttl, time.Now)
+	}
+}
+
+// intelSigningCA is the Intel SGX Attestation Report Signing CA, from
+// https://certificates.trustedservices.intel.com. Intel signs the
+// reports of both the development and the production IAS under it.
+//
+//go:embed intel_report_signing_ca.pem
+var intelSigningCA []byte
+
+// intelSigningRoots returns the roots NewIAS checks the report
+// signing certificate against, unless changed with
+// WithReportSigningRoots.
+func intelSigningRoots() map[bool]*x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(intelSigningCA)
+	return map[bool]*x509.CertPool{false: roots, true: roots}
+}
+
+// WithReportSigningRoots makes the IAS check that the certificate
+// signing the verification reports chains up to one of roots, instead
+// of the Intel report signing CA. The roots are only used against the
+// production IAS if release is true, and only against the development
+// IAS if it is false; NewIAS picks the ones for its own mode. This
+// way, a report signed under the roots of an IAS emulator is never
+// accepted in release mode. Without roots for its mode, the IAS
+// rejects every report.
+func WithReportSigningRoots(release bool, roots *x509.CertPool) IASOption {
+	return func(ias *ias) {
+		if ias.signingRoots == nil {
+			ias.signingRoots = make(map[bool]*x509.CertPool)
+		}
+		ias.signingRoots[release] = roots
+	}
+}
+
+// tlsConfig returns the TLS configuration of the transport used to
+// talk to IAS, creating one if the client is using the defaults.
+func (ias *ias) tlsConfig() *tls.Config {
+	transport, ok := ias.client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		ias.client.Transport = transport
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	return transport.TLSClientConfig
 }
 
 // NewIAS creates a service that talks to the Intel Attestation
@@ -60,44 +231,132 @@ type ias struct {
 // allowedAdvisories paramter specifies which error-advisory
 // combinations are allowed when verifying quotes. This can be
 // useful, for example, when trying to allow hyperthreading in SGX,
-// which automatically yields misconfigured error.
-func NewIAS(release bool, subscription string, allowedAdvisories map[string][]string) IAS {
-	host := DEBUG_IAS_HOST
-	if release {
-		host = IAS_HOST
-	}
-
-	client := &http.Client{}
+// which automatically yields misconfigured error. Any opts are applied
+// after the defaults are set.
+func NewIAS(release bool, subscription string, allowedAdvisories map[string][]string, opts ...IASOption) IAS {
+	client := &http.Client{Timeout: DEFAULT_IAS_TIMEOUT, CheckRedirect: refuseRedirect}
 
 	ias := &ias{
 		release:           release,
-		host:              host,
+		hosts:             []string{iasHost(release)},
 		subscription:      subscription,
 		allowedAdvisories: allowedAdvisories,
 		client:            client,
+		signingRoots:      intelSigningRoots(),
+		userAgent:         DEFAULT_IAS_USER_AGENT,
+		rand:              rand.Reader,
+		nonces:            newNonceCache(DEFAULT_NONCE_CACHE_SIZE, DEFAULT_NONCE_CACHE_TTL, time.Now),
+	}
+	for _, opt := range opts {
+		opt(ias)
 	}
 	return ias
 }
 
+// refuseRedirect stops the client from following redirects. IAS does
+// not redirect, so a redirect comes from something like a
+// misconfigured proxy, and following it would send the subscription
+// key to another host.
+func refuseRedirect(req *http.Request, via []*http.Request) error {
+	return fmt.Errorf("%w %s redirected to %s.", ErrIASRedirect, via[0].URL.Host, req.URL.Host)
+}
+
+// setHeaders sets the headers every request to IAS carries.
+func (ias *ias) setHeaders(req *http.Request) {
+	req.Header.Set(HEADER_SUBSCRIPTION_KEY, ias.subscription)
+	req.Header.Set(HEADER_USER_AGENT, ias.userAgent)
+}
+
+// do sends the request newRequest builds for each host in turn, until
+// a host answers without a server error. The response of the last host
+// is returned if they all fail.
+func (ias *ias) do(newRequest func(host string) (*http.Request, error)) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	for i, host := range ias.hosts {
+		var req *http.Request
+		req, err = newRequest(host)
+		if err != nil {
+			return nil, err
+		}
+		ias.setHeaders(req)
+
+		resp, err = ias.client.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+		if i < len(ias.hosts)-1 {
+			if resp != nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			if ias.logger != nil {
+				ias.logger.Printf("IAS at %s failed, trying %s: %s", host, ias.hosts[i+1], failure(resp, err))
+			}
+		}
+	}
+	return resp, err
+}
+
+// failure describes why a request failed with resp and err.
+func failure(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+// iasHost returns the IAS endpoint for the release mode.
+func iasHost(release bool) string {
+	if release {
+		return IAS_HOST
+	}
+	return DEBUG_IAS_HOST
+}
+
+// iasConnector is implemented by IAS implementations that can set up
+// their connection ahead of the first request.
+type iasConnector interface {
+	connect(ctx context.Context) error
+}
+
+// connect establishes the TLS connection to IAS, so that the next
+// request can reuse it. Any response from IAS means the connection is
+// up, so the status code is ignored.
+func (ias *ias) connect(ctx context.Context) error {
+	resp, err := ias.do(func(host string) (*http.Request, error) {
+		req, err := http.NewRequest("HEAD", host, nil)
+		if err != nil {
+			return nil, err
+		}
+		return req.WithContext(ctx), nil
+	})
+	if err != nil {
+		return err
+	}
+	// The body must be drained for the connection to be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
 func (ias *ias) GetRevocationList(gid []byte) ([]byte, error) {
-	// SGX gives gid in little endian, but we need big endian.
-	reverse(gid)
-	url := ias.host + "/sigrl/" + hex.EncodeToString(gid)
-	reverse(gid) // reverse is an inplace reverse, so reverse it back.
-	req, err := http.NewRequest("GET", url, nil)
+	// SGX gives gid in little endian, but IAS takes the group
+	// as a big endian hex number.
+	group, err := parseGID(gid)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set(HEADER_SUBSCRIPTION_KEY, ias.subscription)
-
-	resp, err := ias.client.Do(req)
+	path := fmt.Sprintf("/sigrl/%08x", group)
+	resp, err := ias.do(func(host string) (*http.Request, error) {
+		return http.NewRequest("GET", host+path, nil)
+	})
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(fmt.Sprintf("Could not fetch revocation list: %d.", resp.StatusCode))
+		return nil, fmt.Errorf("Could not fetch revocation list: %w", &IASStatusError{resp.StatusCode})
 	}
 
 	dec := base64.NewDecoder(base64.StdEncoding, resp.Body)
@@ -113,39 +372,90 @@ func (ias *ias) verifyResponseSignature(resp *http.Response, body []byte) error
 	// Passing in the body separately, since resp.Body is a Reader
 	// which behaves like a stream. if we wanted to pass a Reader type,
 	// we'd have to create a new one.
-	sig, err := base64.StdEncoding.DecodeString(resp.Header.Get("x-iasreport-signature"))
-	if err != nil {
-		return err
+	// A report without a signature is never accepted, no matter
+	// how valid the body looks.
+	sigHeader := resp.Header.Get(HEADER_REPORT_SIGNATURE)
+	certHeader := resp.Header.Get(HEADER_REPORT_SIGNING_CERT)
+	if sigHeader == "" || certHeader == "" {
+		return ErrInvalidReportSignature
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(sigHeader)
+	if err != nil || len(sig) == 0 {
+		return ErrInvalidReportSignature
 	}
 
-	unescaped, err := url.QueryUnescape(resp.Header.Get("x-iasreport-signing-certificate"))
+	unescaped, err := url.QueryUnescape(certHeader)
 	if err != nil {
-		return err
+		return ErrInvalidReportSignature
 	}
 
-	// The first block is the key used to verify the signature.
-	// this currently assumes that Intel always returns the right cert,
-	// and that we verified Intel's identity when we connect to it via TLS.
-	block, _ := pem.Decode([]byte(unescaped))
-	if block == nil {
-		return errors.New("Failed to get the IAS certificate for signature verification.")
+	// The first block is the key used to verify the signature,
+	// and the rest is the chain up to the root.
+	var certs []*x509.Certificate
+	for rest := []byte(unescaped); ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return ErrInvalidReportSignature
+		}
+		certs = append(certs, cert)
 	}
-	certs, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
+	if len(certs) == 0 {
+		return ErrInvalidReportSignature
+	}
+
+	if err := ias.verifySigningChain(certs); err != nil {
 		return err
 	}
+	if err := certs[0].CheckSignature(x509.SHA256WithRSA, body, sig); err != nil {
+		return ErrInvalidReportSignature
+	}
+	return nil
+}
 
-	return certs.CheckSignature(x509.SHA256WithRSA, body, sig)
+// verifySigningChain checks that certs (the signing certificate
+// followed by its chain) lead to the signing roots for the release
+// mode of ias. The TLS connection to IAS is not enough, since it may
+// go through a proxy or an emulator.
+func (ias *ias) verifySigningChain(certs []*x509.Certificate) error {
+	roots := ias.signingRoots[ias.release]
+	if roots == nil {
+		return ErrInvalidReportSignature
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w %v", ErrInvalidReportSignature, err)
+	}
+	return nil
 }
 
-// Check if the advisories we got from Intel are allowed.
+// Check if the advisories we got from Intel are allowed. A quote with
+// a status other than OK is only accepted if the status is in the
+// allow-list, and every one of the advisories is allowed for that
+// status; an advisory allowed only for another status does not count.
+// Otherwise, the QuoteStatusError lists each advisory that was not
+// allowed.
 func (ias *ias) errorAllowed(status string, advisories []string) error {
 	if status == ISV_OK {
 		return nil
 	}
 
 	if _, ok := ias.allowedAdvisories[status]; !ok {
-		return errors.New(fmt.Sprintf(quoteErr, status))
+		return &QuoteStatusError{Status: status}
 	}
 
 	// find the list of advisories that we consider critical
@@ -156,6 +466,7 @@ func (ias *ias) errorAllowed(status string, advisories []string) error {
 		for _, good := range allowed {
 			if adv == good {
 				found = true
+				break
 			}
 		}
 
@@ -168,56 +479,115 @@ func (ias *ias) errorAllowed(status string, advisories []string) error {
 		// No unallowed advisories found.
 		return nil
 	} else {
-		return errors.New(fmt.Sprintf(quoteErrWithAdvisory, status, strings.Join(notAllowed, ", ")))
+		return &QuoteStatusError{Status: status, Advisories: notAllowed}
+	}
+}
+
+// iasReport is the attestation verification report returned by IAS.
+// It covers both version 3 and version 4 of the API.
+type iasReport struct {
+	ID                    string `json:"id"`
+	Timestamp             string `json:"timestamp"`
+	Version               int    `json:"version"`
+	Nonce                 string `json:"nonce"`
+	IsvEnclaveQuoteStatus string `json:"isvEnclaveQuoteStatus"`
+	IsvEnclaveQuoteBody   string `json:"isvEnclaveQuoteBody"`
+	PseManifestStatus     string `json:"pseManifestStatus"`
+	PseManifestHash       string `json:"pseManifestHash"`
+	PlatformInfoBlob      string `json:"platformInfoBlob"`
+
+	// Fields added in version 4. In version 3, the advisories
+	// are sent in the HTTP headers instead.
+	TCBEvaluationDataNumber int      `json:"tcbEvaluationDataNumber"`
+	AdvisoryURL             string   `json:"advisoryURL"`
+	AdvisoryIDs             []string `json:"advisoryIDs"`
+
+	// Whether IAS sent the advisory ids at all, in the body or
+	// the headers, even as an empty list. IAS usually leaves them
+	// out for an OK quote.
+	hasAdvisories bool
+}
+
+// parseReport decodes the report body, and fills in the advisories
+// from the headers if the report is from an older version of IAS.
+func parseReport(body []byte, header http.Header) (*iasReport, error) {
+	report := &iasReport{}
+	if err := json.Unmarshal(body, report); err != nil {
+		return nil, fmt.Errorf("%w Could not decode the report: %v", ErrInvalidReport, err)
+	}
+
+	report.hasAdvisories = report.AdvisoryIDs != nil
+	if report.AdvisoryIDs == nil {
+		if ids, ok := header[http.CanonicalHeaderKey(HEADER_ADVISORY_IDS)]; ok {
+			report.hasAdvisories = true
+			if len(ids) > 0 && ids[0] != "" {
+				report.AdvisoryIDs = strings.Split(ids[0], ",")
+			}
+		}
 	}
+	if report.AdvisoryURL == "" {
+		report.AdvisoryURL = header.Get(HEADER_ADVISORY_URL)
+	}
+	return report, nil
 }
 
 func (ias *ias) processReport(hexNonce string, quote, pse []byte, resp *http.Response) (bool, []byte, []string, error) {
 	if resp.StatusCode != http.StatusOK {
-		return false, nil, nil, errors.New(fmt.Sprintf("Could not fetch the report: Error code [%d].", resp.StatusCode))
+		return false, nil, nil, fmt.Errorf("Could not fetch the report: %w", &IASStatusError{resp.StatusCode})
 	}
 
 	reportBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return false, nil, nil, err
 	}
-	report := make(map[string]interface{})
-	err = json.Unmarshal(reportBytes, &report)
+	report, err := parseReport(reportBytes, resp.Header)
 	if err != nil {
 		return false, nil, nil, err
 	}
 
-	if int(report["version"].(float64)) < MIN_IAS_VERSION_NUMBER {
-		return false, nil, nil, errors.New("IAS version is too old.")
+	if report.Version < MIN_IAS_VERSION_NUMBER {
+		return false, nil, nil, fmt.Errorf("%w IAS version is too old.", ErrInvalidReport)
 	}
 
-	if hexNonce != report[ISV_NONCE].(string) {
-		return false, nil, nil, errors.New("Incorrect nonce from IAS.")
+	if hexNonce != report.Nonce {
+		return false, nil, nil, fmt.Errorf("%w Incorrect nonce from IAS.", ErrInvalidReport)
 	}
 
 	if err := ias.verifyResponseSignature(resp, reportBytes); err != nil {
 		return false, nil, nil, err
 	}
 
-	isvStatus := report[ISV_QUOTE_STATUS].(string)
+	if report.TCBEvaluationDataNumber < ias.minTCBEvaluation {
+		return false, nil, nil, &TCBEvaluationError{
+			Number: report.TCBEvaluationDataNumber,
+			Min:    ias.minTCBEvaluation,
+		}
+	}
+
+	if ias.logger != nil {
+		ias.logger.Printf("IAS report [%s]: quote status %s, PSE status %s, advisories %v.",
+			identifier(report.ID), report.IsvEnclaveQuoteStatus, report.PseManifestStatus, report.AdvisoryIDs)
+	}
+
+	isvStatus := report.IsvEnclaveQuoteStatus
 	pseStatus := ""
 	if len(pse) > 0 {
 		pseHash := sha256.Sum256(pse)
-		if retPSEHash, err := hex.DecodeString(report[PSE_MANIFEST_HASH].(string)); err != nil {
-			return false, nil, nil, err
+		if retPSEHash, err := hex.DecodeString(report.PseManifestHash); err != nil {
+			return false, nil, nil, fmt.Errorf("%w Could not decode the PSE hash: %v", ErrInvalidReport, err)
 		} else if !bytes.Equal(pseHash[:], retPSEHash) {
-			return false, nil, nil, errors.New("PSE hash mismatch.")
+			return false, nil, nil, fmt.Errorf("%w PSE hash mismatch.", ErrInvalidReport)
 		}
-		pseStatus = report[PSE_MANIFEST_STATUS].(string)
+		pseStatus = report.PseManifestStatus
 	}
 
-	retQuote, err := base64.StdEncoding.DecodeString(report[ISV_QUOTE_BODY].(string))
+	retQuote, err := base64.StdEncoding.DecodeString(report.IsvEnclaveQuoteBody)
 	if err != nil {
-		return false, nil, nil, err
+		return false, nil, nil, fmt.Errorf("%w Could not decode the quote: %v", ErrInvalidReport, err)
 	}
 
 	if len(retQuote) != NO_SIG_QUOTE_LEN || !bytes.Equal(retQuote, quote[:NO_SIG_QUOTE_LEN]) {
-		return false, nil, nil, errors.New("Incorrect quote returned from IAS.")
+		return false, nil, nil, fmt.Errorf("%w Incorrect quote returned from IAS.", ErrInvalidReport)
 	}
 
 	// Platform information blob is only set on specific errors.
@@ -229,15 +599,25 @@ func (ias *ias) processReport(hexNonce string, quote, pse []byte, resp *http.Res
 		pseStatus == PSE_RL_VERSION_MISMATCH
 	var pib []byte
 	if isvBad || pseBad {
-		pib, err = hex.DecodeString(report[PLATFORM_INFO_BLOB].(string))
+		pib, err = hex.DecodeString(report.PlatformInfoBlob)
 		if err != nil {
-			return false, nil, nil, err
+			return false, nil, nil, fmt.Errorf("%w Could not decode the platform info blob: %v", ErrInvalidReport, err)
+		} else if len(pib) < 4 {
+			return false, nil, nil, fmt.Errorf("%w Platform info blob is missing.", ErrInvalidReport)
 		}
 		// pib[0] is type, pib[1] is version, pib[2:4] is size
 		pib = pib[4:]
 	}
 
-	advisories := strings.Split(resp.Header.Get("advisory-ids"), ",")
+	// The allow-list can only be checked if IAS told us the
+	// advisories, so they have to be there, even if empty, for
+	// a status that is not OK but may be allowed.
+	_, allowList := ias.allowedAdvisories[isvStatus]
+	if isvStatus != ISV_OK && allowList && !report.hasAdvisories {
+		return false, pib, nil, fmt.Errorf("%w Report with quote status %s is missing the advisory ids.", ErrInvalidReport, isvStatus)
+	}
+
+	advisories := report.AdvisoryIDs
 	err = ias.errorAllowed(isvStatus, advisories)
 	if err != nil {
 		return false, pib, advisories, err
@@ -255,12 +635,15 @@ func (ias *ias) processReport(hexNonce string, quote, pse []byte, resp *http.Res
 }
 
 func (ias *ias) VerifyQuoteAndPSE(quote, pse []byte) (bool, []byte, []string, error) {
-	url := ias.host + "/report"
 
 	var nonce [16]byte
-	if _, err := rand.Read(nonce[:]); err != nil {
+	if _, err := io.ReadFull(ias.rand, nonce[:]); err != nil {
 		return false, nil, nil, err
 	}
+	hexNonce := hex.EncodeToString(nonce[:])
+	if !ias.nonces.use(hexNonce) {
+		return false, nil, nil, ErrNonceReused
+	}
 
 	bodyMap := make(map[string]string)
 	hexQuote := base64.StdEncoding.EncodeToString(quote)
@@ -269,7 +652,6 @@ func (ias *ias) VerifyQuoteAndPSE(quote, pse []byte) (bool, []byte, []string, er
 		bodyMap[PSE_MANIFEST] = base64.StdEncoding.EncodeToString(pse)
 	}
 
-	hexNonce := hex.EncodeToString(nonce[:])
 	bodyMap[ISV_NONCE] = hexNonce
 
 	body := bytes.NewBuffer(nil)
@@ -277,22 +659,292 @@ func (ias *ias) VerifyQuoteAndPSE(quote, pse []byte) (bool, []byte, []string, er
 	encoder.SetEscapeHTML(false)
 	err := encoder.Encode(bodyMap)
 
-	req, err := http.NewRequest("POST", url, body)
+	resp, err := ias.do(func(host string) (*http.Request, error) {
+		req, err := http.NewRequest("POST", host+"/report", bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		// need to manually set it to json content type!
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
 		return false, nil, nil, err
 	}
+	defer resp.Body.Close()
 
-	req.Header.Set(HEADER_SUBSCRIPTION_KEY, ias.subscription)
-	// need to manually set it to json content type!
-	req.Header.Set("Content-Type", "application/json")
+	return ias.processReport(hexNonce, quote, pse, resp)
+}
 
-	resp, err := ias.client.Do(req)
-	if err != nil {
+// quotaIAS limits the number of quote verifications per UTC day, and
+// passes everything else through to the underlying IAS.
+type quotaIAS struct {
+	IAS
+	sync.Mutex
+	max   int
+	now   func() time.Time
+	day   time.Time
+	calls int
+}
+
+func newQuotaIAS(ias IAS, max int, now func() time.Time) IAS {
+	return &quotaIAS{
+		IAS: ias,
+		max: max,
+		now: now,
+	}
+}
+
+func (q *quotaIAS) VerifyQuoteAndPSE(quote, pse []byte) (bool, []byte, []string, error) {
+	q.Lock()
+	// Truncate works on absolute time, so this is always midnight UTC.
+	day := q.now().UTC().Truncate(24 * time.Hour)
+	if !day.Equal(q.day) {
+		q.day = day
+		q.calls = 0
+	}
+	if q.calls >= q.max {
+		q.Unlock()
+		return false, nil, nil, ErrIASQuotaExceeded
+	}
+	q.calls += 1
+	q.Unlock()
+
+	return q.IAS.VerifyQuoteAndPSE(quote, pse)
+}
+
+// limitIAS bounds the number of requests in flight to the underlying
+// IAS. Requests over the bound wait for a slot for up to timeout (or
+// forever if timeout is 0), and fail with ErrIASBusy after that.
+type limitIAS struct {
+	IAS
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newLimitIAS(ias IAS, max int, timeout time.Duration) IAS {
+	return &limitIAS{
+		IAS:     ias,
+		slots:   make(chan struct{}, max),
+		timeout: timeout,
+	}
+}
+
+// acquire waits for a free slot.
+func (l *limitIAS) acquire() error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	var expired <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-expired:
+		return ErrIASBusy
+	}
+}
+
+func (l *limitIAS) release() {
+	<-l.slots
+}
+
+func (l *limitIAS) GetRevocationList(gid []byte) ([]byte, error) {
+	if err := l.acquire(); err != nil {
+		return nil, err
+	}
+	defer l.release()
+	return l.IAS.GetRevocationList(gid)
+}
+
+func (l *limitIAS) VerifyQuoteAndPSE(quote, pse []byte) (bool, []byte, []string, error) {
+	if err := l.acquire(); err != nil {
 		return false, nil, nil, err
 	}
-	defer resp.Body.Close()
+	defer l.release()
+	return l.IAS.VerifyQuoteAndPSE(quote, pse)
+}
 
-	return ias.processReport(hexNonce, quote, pse, resp)
+// sigRLCacheIAS reuses the revocation lists fetched from the
+// underlying IAS for up to maxAge.
+type sigRLCacheIAS struct {
+	IAS
+	sync.Mutex
+	maxAge time.Duration
+	now    func() time.Time
+	lists  map[string]*cachedSigRL
+}
+
+type cachedSigRL struct {
+	sigRl   []byte
+	fetched time.Time
+}
+
+func newSigRLCacheIAS(ias IAS, maxAge time.Duration, now func() time.Time) IAS {
+	return &sigRLCacheIAS{
+		IAS:    ias,
+		maxAge: maxAge,
+		now:    now,
+		lists:  make(map[string]*cachedSigRL),
+	}
+}
+
+func (c *sigRLCacheIAS) GetRevocationList(gid []byte) ([]byte, error) {
+	key := hex.EncodeToString(gid)
+
+	c.Lock()
+	cached, ok := c.lists[key]
+	if ok && c.now().Sub(cached.fetched) <= c.maxAge {
+		c.Unlock()
+		return cached.sigRl, nil
+	}
+	c.Unlock()
+
+	sigRl, err := c.IAS.GetRevocationList(gid)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	c.lists[key] = &cachedSigRL{
+		sigRl:   sigRl,
+		fetched: c.now(),
+	}
+	c.Unlock()
+	return sigRl, nil
+}
+
+// The most verifications an outageIAS remembers. Once it is full,
+// the oldest verification is forgotten first.
+const MAX_CACHED_REPORTS = 4096
+
+// outageIAS remembers successful verifications, and falls back to
+// them when the underlying IAS cannot be reached.
+type outageIAS struct {
+	IAS
+	sync.Mutex
+	maxAge  time.Duration
+	now     func() time.Time
+	queue   *list.List // the oldest result is at the back
+	results map[[sha256.Size]byte]*list.Element
+}
+
+type cachedResult struct {
+	key        [sha256.Size]byte
+	pseTrusted bool
+	pib        []byte
+	advisories []string
+	verified   time.Time
+}
+
+func newOutageIAS(ias IAS, maxAge time.Duration, now func() time.Time) IAS {
+	return &outageIAS{
+		IAS:     ias,
+		maxAge:  maxAge,
+		now:     now,
+		queue:   list.New(),
+		results: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// quoteCacheKey returns the key results for quote and pse are cached
+// under. It is the SHA-256 of
+//
+//	quote[:NO_SIG_QUOTE_LEN] || pse
+//
+// that is, the 48 byte quote header and the 384 byte report body,
+// followed by the whole PSE manifest if there is one. The signature
+// length and the EPID signature after the body are left out, since
+// the quoting enclave randomizes the signature (and its nonce) every
+// time it signs the same report. The nonce sent to IAS is chosen per
+// request and is not part of the quote at all. A quote shorter than
+// NO_SIG_QUOTE_LEN is hashed as a whole.
+func quoteCacheKey(quote, pse []byte) [sha256.Size]byte {
+	if len(quote) > NO_SIG_QUOTE_LEN {
+		quote = quote[:NO_SIG_QUOTE_LEN]
+	}
+	h := sha256.New()
+	h.Write(quote)
+	h.Write(pse)
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+func (o *outageIAS) VerifyQuoteAndPSE(quote, pse []byte) (bool, []byte, []string, error) {
+	key := quoteCacheKey(quote, pse)
+	pseTrusted, pib, advisories, err := o.IAS.VerifyQuoteAndPSE(quote, pse)
+
+	o.Lock()
+	defer o.Unlock()
+	now := o.now()
+	if err == nil {
+		o.remember(&cachedResult{
+			key:        key,
+			pseTrusted: pseTrusted,
+			pib:        pib,
+			advisories: advisories,
+			verified:   now,
+		})
+		return pseTrusted, pib, advisories, nil
+	}
+
+	// Only fall back when IAS could not be reached. If IAS
+	// actually rejected the quote, the rejection stands.
+	if !iasUnreachable(err) {
+		return pseTrusted, pib, advisories, err
+	}
+	if e, ok := o.results[key]; ok {
+		result := e.Value.(*cachedResult)
+		if now.Sub(result.verified) <= o.maxAge {
+			return result.pseTrusted, result.pib, result.advisories, nil
+		}
+		o.forget(e)
+	}
+	return pseTrusted, pib, advisories, err
+}
+
+// remember caches result, and forgets the results that are stale or
+// beyond MAX_CACHED_REPORTS. The results are ordered by the time they
+// were verified, so only the oldest ones are ever looked at.
+func (o *outageIAS) remember(result *cachedResult) {
+	if e, ok := o.results[result.key]; ok {
+		o.forget(e)
+	}
+	o.results[result.key] = o.queue.PushFront(result)
+	for e := o.queue.Back(); e != nil; e = o.queue.Back() {
+		if o.queue.Len() <= MAX_CACHED_REPORTS && result.verified.Sub(e.Value.(*cachedResult).verified) <= o.maxAge {
+			break
+		}
+		o.forget(e)
+	}
+}
+
+func (o *outageIAS) forget(e *list.Element) {
+	delete(o.results, e.Value.(*cachedResult).key)
+	o.queue.Remove(e)
+}
+
+// iasUnreachable reports whether err means that IAS could not answer,
+// either because it could not be reached, or because it (or a proxy in
+// front of it) failed with a server error on every endpoint.
+func iasUnreachable(err error) bool {
+	var netErr net.Error
+	var statusErr *IASStatusError
+	if errors.As(err, &netErr) {
+		return true
+	} else if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError
+	}
+	return false
 }
 
 // URL for the IAS attestation API.
@@ -306,6 +958,18 @@ const (
 // Fields of the header we set for the IAS.
 const (
 	HEADER_SUBSCRIPTION_KEY = "Ocp-Apim-Subscription-Key"
+	HEADER_USER_AGENT       = "User-Agent"
+)
+
+// Fields of the header IAS sets in the version 3 report response.
+const (
+	HEADER_ADVISORY_IDS = "Advisory-IDs"
+	HEADER_ADVISORY_URL = "Advisory-URL"
+
+	// The signature over the report body, and the certificate
+	// chain to verify it with.
+	HEADER_REPORT_SIGNATURE    = "X-IASReport-Signature"
+	HEADER_REPORT_SIGNING_CERT = "X-IASReport-Signing-Certificate"
 )
 
 // Fields of the report body.
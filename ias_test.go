@@ -0,0 +1,981 @@
+package sgx_server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a self-signed certificate usable for
+// both TLS clients and servers.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sgx_server test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}
+}
+
+// newTestIAS creates an IAS that talks to srv instead of Intel,
+// unless opts set other endpoints, and accepts the reports signed by
+// the mock IAS.
+func newTestIAS(t testing.TB, srv *httptest.Server, opts ...IASOption) *ias {
+	_, cert := reportSigner(t)
+	signingRoots := x509.NewCertPool()
+	signingRoots.AppendCertsFromPEM(cert)
+	opts = append([]IASOption{WithEndpoints(srv.URL), WithReportSigningRoots(false, signingRoots)}, opts...)
+	ias := NewIAS(false, "subscription", nil, opts...).(*ias)
+	if srv.TLS != nil {
+		roots := x509.NewCertPool()
+		roots.AddCert(srv.Certificate())
+		ias.tlsConfig().RootCAs = roots
+	}
+	return ias
+}
+
+var (
+	signingOnce sync.Once
+	signingKey  *rsa.PrivateKey
+	signingCert []byte
+)
+
+// reportSigner returns the RSA key and PEM encoded certificate the
+// mock IAS uses to sign its reports.
+func reportSigner(t testing.TB) (*rsa.PrivateKey, []byte) {
+	signingOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "Mock IAS Report Signing"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signingKey = key
+		signingCert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	})
+	return signingKey, signingCert
+}
+
+// mockIASServer imitates the IAS API. It returns a signed report with
+// the configured status for any quote it receives.
+type mockIASServer struct {
+	*httptest.Server
+	sync.Mutex
+
+	version    int
+	status     string
+	advisories []string
+	tcb        int
+	reports    int
+	// The hex encoded platform info blob, if any.
+	pib string
+
+	// Headers to leave out of the report response, and a
+	// signing certificate header to send instead of the real one.
+	omitHeaders []string
+	signingCert string
+
+	// The key reports are signed with, and the PEM encoded chain
+	// sent along with them.
+	key   *rsa.PrivateKey
+	chain []byte
+}
+
+func newMockIASServer(t *testing.T) *mockIASServer {
+	key, cert := reportSigner(t)
+	m := &mockIASServer{
+		version: 4,
+		status:  ISV_OK,
+		key:     key,
+		chain:   cert,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sigrl/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		m.reports++
+
+		req := make(map[string]string)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		quote, err := base64.StdEncoding.DecodeString(req[ISV_QUOTE])
+		if err != nil || len(quote) < NO_SIG_QUOTE_LEN {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		report := map[string]interface{}{
+			"id":                      "1",
+			"version":                 m.version,
+			ISV_NONCE:                 req[ISV_NONCE],
+			ISV_QUOTE_STATUS:          m.status,
+			ISV_QUOTE_BODY:            base64.StdEncoding.EncodeToString(quote[:NO_SIG_QUOTE_LEN]),
+			"tcbEvaluationDataNumber": m.tcb,
+		}
+		if m.advisories != nil {
+			report["advisoryIDs"] = m.advisories
+		}
+		if m.pib != "" {
+			report[PLATFORM_INFO_BLOB] = m.pib
+		}
+		body, _ := json.Marshal(report)
+		hash := sha256.Sum256(body)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, hash[:])
+
+		w.Header().Set(HEADER_REPORT_SIGNATURE, base64.StdEncoding.EncodeToString(sig))
+		w.Header().Set(HEADER_REPORT_SIGNING_CERT, url.QueryEscape(string(m.chain)))
+		if m.signingCert != "" {
+			w.Header().Set(HEADER_REPORT_SIGNING_CERT, m.signingCert)
+		}
+		for _, header := range m.omitHeaders {
+			w.Header().Del(header)
+		}
+		w.Write(body)
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func TestIASClientCertificate(t *testing.T) {
+	sigRl := []byte("revocation list")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString(sigRl)))
+	}))
+	clientCert := newTestCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	withCert := newTestIAS(t, srv, WithClientCertificate(clientCert))
+	rl, err := withCert.GetRevocationList([]byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	} else if string(rl) != string(sigRl) {
+		t.Fatal("Incorrect revocation list.")
+	}
+
+	withoutCert := newTestIAS(t, srv)
+	if _, err := withoutCert.GetRevocationList([]byte{1, 2, 3, 4}); err == nil {
+		t.Fatal("Request without a client certificate should fail.")
+	}
+}
+
+// Report fixtures for each version of the IAS API, trimmed down to
+// the fields relevant to parsing.
+const (
+	reportV3 = `{"id":"1","version":3,"nonce":"abcd","isvEnclaveQuoteStatus":"GROUP_OUT_OF_DATE","platformInfoBlob":"1502"}`
+	reportV4 = `{"id":"1","version":4,"nonce":"abcd","isvEnclaveQuoteStatus":"GROUP_OUT_OF_DATE","platformInfoBlob":"1502","tcbEvaluationDataNumber":5,"advisoryURL":"https://security-center.intel.com","advisoryIDs":["INTEL-SA-00219","INTEL-SA-00220"]}`
+
+	// IAS leaves out the advisories for an OK quote.
+	reportOK             = `{"id":"1","version":4,"nonce":"abcd","isvEnclaveQuoteStatus":"OK","tcbEvaluationDataNumber":5}`
+	reportOutOfDateEmpty = `{"id":"1","version":4,"nonce":"abcd","isvEnclaveQuoteStatus":"GROUP_OUT_OF_DATE","platformInfoBlob":"1502","tcbEvaluationDataNumber":5,"advisoryURL":"https://security-center.intel.com","advisoryIDs":[]}`
+)
+
+func TestParseReportVersions(t *testing.T) {
+	v3Header := http.Header{}
+	v3Header.Set(HEADER_ADVISORY_IDS, "INTEL-SA-00219,INTEL-SA-00220")
+	v3Header.Set(HEADER_ADVISORY_URL, "https://security-center.intel.com")
+
+	tests := []struct {
+		body   string
+		header http.Header
+		tcb    int
+	}{
+		{reportV3, v3Header, 0},
+		{reportV4, http.Header{}, 5},
+	}
+
+	allowed := map[string][]string{
+		ISV_GROUP_OUT_OF_DATE: []string{"INTEL-SA-00219", "INTEL-SA-00220"},
+	}
+	ias := NewIAS(false, "", allowed).(*ias)
+	for _, test := range tests {
+		report, err := parseReport([]byte(test.body), test.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.AdvisoryIDs) != 2 || report.AdvisoryIDs[1] != "INTEL-SA-00220" {
+			t.Errorf("Version %d: incorrect advisories %v.", report.Version, report.AdvisoryIDs)
+		}
+		if report.AdvisoryURL != "https://security-center.intel.com" {
+			t.Errorf("Version %d: incorrect advisory URL.", report.Version)
+		}
+		if report.TCBEvaluationDataNumber != test.tcb {
+			t.Errorf("Version %d: incorrect TCB evaluation data number.", report.Version)
+		}
+		if err := ias.errorAllowed(report.IsvEnclaveQuoteStatus, report.AdvisoryIDs); err != nil {
+			t.Errorf("Version %d: advisories should be allowed: %v", report.Version, err)
+		}
+	}
+}
+
+func TestParseReportOptionalAdvisories(t *testing.T) {
+	emptyHeader := http.Header{}
+	emptyHeader.Set(HEADER_ADVISORY_IDS, "")
+
+	tests := []struct {
+		body          string
+		header        http.Header
+		hasAdvisories bool
+	}{
+		{reportOK, http.Header{}, false},
+		{reportV4, http.Header{}, true},
+		{reportOutOfDateEmpty, http.Header{}, true},
+		{reportV3, emptyHeader, true},
+		{reportV3, http.Header{}, false},
+	}
+	for i, test := range tests {
+		report, err := parseReport([]byte(test.body), test.header)
+		if err != nil {
+			t.Fatalf("Report %d: %v", i, err)
+		}
+		if report.hasAdvisories != test.hasAdvisories {
+			t.Errorf("Report %d: expected advisories present %v.", i, test.hasAdvisories)
+		}
+	}
+
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	ias := newTestIAS(t, srv.Server)
+	ias.allowedAdvisories = map[string][]string{ISV_GROUP_OUT_OF_DATE: {"INTEL-SA-00219"}}
+	quote := newTestQuote()
+
+	// An OK report needs no advisories.
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A status that goes through the allow-list does.
+	srv.status = ISV_GROUP_OUT_OF_DATE
+	srv.pib = "150200650400010000"
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); !errors.Is(err, ErrInvalidReport) {
+		t.Fatal("Expected a report without advisories to be invalid, got:", err)
+	}
+	for _, advisories := range [][]string{{}, {"INTEL-SA-00219"}} {
+		srv.advisories = advisories
+		if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+			t.Fatalf("Advisories %v should be allowed: %v", advisories, err)
+		}
+	}
+}
+
+func TestPartiallyAllowedAdvisories(t *testing.T) {
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	srv.status = ISV_GROUP_OUT_OF_DATE
+	srv.pib = "150200650400010000"
+	srv.advisories = []string{"INTEL-SA-00161", "INTEL-SA-00219"}
+
+	ias := newTestIAS(t, srv.Server)
+	quote := newTestQuote()
+
+	tests := []struct {
+		allowed    map[string][]string
+		notAllowed []string
+	}{
+		{map[string][]string{ISV_GROUP_OUT_OF_DATE: {"INTEL-SA-00161"}}, []string{"INTEL-SA-00219"}},
+		// Advisories allowed for another status do not count.
+		{map[string][]string{
+			ISV_GROUP_OUT_OF_DATE:    {"INTEL-SA-00161"},
+			ISV_CONFIGURATION_NEEDED: {"INTEL-SA-00219"},
+		}, []string{"INTEL-SA-00219"}},
+		{map[string][]string{ISV_GROUP_OUT_OF_DATE: {"INTEL-SA-00334"}}, []string{"INTEL-SA-00161", "INTEL-SA-00219"}},
+		{map[string][]string{ISV_GROUP_OUT_OF_DATE: {"INTEL-SA-00219", "INTEL-SA-00161"}}, nil},
+	}
+	for i, test := range tests {
+		ias.allowedAdvisories = test.allowed
+		_, _, _, err := ias.VerifyQuoteAndPSE(quote, nil)
+		if test.notAllowed == nil {
+			if err != nil {
+				t.Errorf("%d: all the advisories are allowed, got: %v", i, err)
+			}
+			continue
+		}
+
+		var statusErr *QuoteStatusError
+		if !errors.As(err, &statusErr) || !errors.Is(err, ErrQuoteRejected) {
+			t.Errorf("%d: expected the quote to be rejected, got: %v", i, err)
+		} else if !reflect.DeepEqual(statusErr.Advisories, test.notAllowed) {
+			t.Errorf("%d: expected %v not to be allowed, got %v", i, test.notAllowed, statusErr.Advisories)
+		} else if !strings.Contains(err.Error(), test.notAllowed[0]) {
+			t.Errorf("%d: the error does not name the advisory: %v", i, err)
+		}
+	}
+}
+
+func TestMinTCBEvaluationDataNumber(t *testing.T) {
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	srv.tcb = 5
+
+	quote := newTestQuote()
+	below := newTestIAS(t, srv.Server, WithMinTCBEvaluationDataNumber(6))
+	_, _, _, err := below.VerifyQuoteAndPSE(quote, nil)
+	if tcbErr, ok := err.(*TCBEvaluationError); !ok {
+		t.Fatal("Expected a TCB evaluation error, got:", err)
+	} else if tcbErr.Number != 5 || tcbErr.Min != 6 {
+		t.Fatal("Incorrect TCB evaluation error:", tcbErr)
+	}
+
+	at := newTestIAS(t, srv.Server, WithMinTCBEvaluationDataNumber(5))
+	if _, _, _, err := at.VerifyQuoteAndPSE(quote, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachedReportOnIASOutage(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	fake := &fakeIAS{}
+	ias := newOutageIAS(fake, time.Hour, clock)
+
+	quote := newTestQuote()
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	outage := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	fake.verifyErr = outage
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+		t.Fatal("Expected the cached result during the outage, got:", err)
+	}
+
+	other := newTestQuote()
+	other[0] = 1
+	if _, _, _, err := ias.VerifyQuoteAndPSE(other, nil); err != outage {
+		t.Fatal("A quote that was never verified should fail during the outage.")
+	}
+
+	rejection := errors.New("rejected")
+	fake.verifyErr = rejection
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != rejection {
+		t.Fatal("A rejection from IAS should not fall back to the cache.")
+	}
+
+	fake.verifyErr = outage
+	now = now.Add(2 * time.Hour)
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != outage {
+		t.Fatal("A stale result should not be used.")
+	}
+}
+
+func TestCachedReportOnIASServerError(t *testing.T) {
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	var status int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := atomic.LoadInt32(&status); code != 0 {
+			w.WriteHeader(int(code))
+			return
+		}
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	ias := newOutageIAS(newTestIAS(t, proxy), time.Hour, time.Now)
+
+	quote := newTestQuote()
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// IAS, or the proxy in front of it, is down.
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+		t.Fatal("Expected the cached result during the outage, got:", err)
+	}
+
+	// A client error is an answer from IAS, so it stands.
+	atomic.StoreInt32(&status, http.StatusUnauthorized)
+	var statusErr *IASStatusError
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Fatal("A client error should not fall back to the cache, got:", err)
+	}
+}
+
+func TestCachedReportsBound(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	ias := newOutageIAS(&fakeIAS{}, time.Hour, clock).(*outageIAS)
+
+	quote := newTestQuote()
+	for i := 0; i <= MAX_CACHED_REPORTS; i++ {
+		binary.BigEndian.PutUint32(quote, uint32(i))
+		if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	binary.BigEndian.PutUint32(quote, 0)
+	if len(ias.results) != MAX_CACHED_REPORTS || ias.queue.Len() != MAX_CACHED_REPORTS {
+		t.Fatalf("Expected %d cached reports, got %d.", MAX_CACHED_REPORTS, len(ias.results))
+	} else if _, ok := ias.results[quoteCacheKey(quote, nil)]; ok {
+		t.Fatal("The oldest report should be forgotten first.")
+	}
+
+	// Stale reports are forgotten as new ones come in.
+	now = now.Add(2 * time.Hour)
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(ias.results) != 1 || ias.queue.Len() != 1 {
+		t.Fatal("Expected only the fresh report to be cached, got", len(ias.results))
+	}
+}
+
+func TestIASConnect(t *testing.T) {
+	srv := newMockIASServer(t)
+	ias := newTestIAS(t, srv.Server)
+
+	if err := ias.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Close()
+	if err := ias.connect(context.Background()); err == nil {
+		t.Fatal("Connecting to a stopped IAS should fail.")
+	}
+}
+
+func TestUnsignedReport(t *testing.T) {
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	ias := newTestIAS(t, srv.Server)
+	quote := newTestQuote()
+
+	omits := [][]string{
+		{HEADER_REPORT_SIGNATURE, HEADER_REPORT_SIGNING_CERT},
+		{HEADER_REPORT_SIGNATURE},
+		{HEADER_REPORT_SIGNING_CERT},
+	}
+	for _, omit := range omits {
+		srv.omitHeaders = omit
+		if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != ErrInvalidReportSignature {
+			t.Errorf("Report without %v should be rejected, got: %v", omit, err)
+		}
+	}
+
+	srv.omitHeaders = nil
+	srv.signingCert = "not a certificate"
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != ErrInvalidReportSignature {
+		t.Error("Report with an unparseable certificate should be rejected, got:", err)
+	}
+
+	srv.signingCert = ""
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIASErrorsWrapped(t *testing.T) {
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	ias := newTestIAS(t, srv.Server, WithMinTCBEvaluationDataNumber(1))
+	quote := newTestQuote()
+
+	srv.version = MIN_IAS_VERSION_NUMBER - 1
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); !errors.Is(err, ErrInvalidReport) {
+		t.Error("Old IAS version should be an invalid report, got:", err)
+	}
+
+	srv.version = 4
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); !errors.Is(err, ErrQuoteRejected) {
+		t.Error("Low TCB evaluation data number should reject the quote, got:", err)
+	}
+
+	srv.tcb = 1
+	srv.status = ISV_KEY_REVOKED
+	_, _, _, err := ias.VerifyQuoteAndPSE(quote, nil)
+	var statusErr *QuoteStatusError
+	if !errors.Is(err, ErrQuoteRejected) || !errors.As(err, &statusErr) || statusErr.Status != ISV_KEY_REVOKED {
+		t.Error("Revoked key should reject the quote, got:", err)
+	}
+
+	// A revoked group comes with a platform info blob, which the
+	// mock IAS leaves out.
+	srv.status = ISV_GROUP_REVOKED
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); !errors.Is(err, ErrInvalidReport) {
+		t.Error("Report without the platform info blob should be invalid, got:", err)
+	}
+
+	// The mock IAS refuses quotes that are too short.
+	_, _, _, err = ias.VerifyQuoteAndPSE(quote[:10], nil)
+	var iasErr *IASStatusError
+	if !errors.As(err, &iasErr) || iasErr.StatusCode != http.StatusBadRequest {
+		t.Error("Expected the HTTP status from IAS, got:", err)
+	}
+}
+
+func TestQuoteCacheKey(t *testing.T) {
+	quote := newTestQuote()
+	resigned := newTestQuote()
+	// Only the signature differs.
+	resigned[NO_SIG_QUOTE_LEN] = 1
+	resigned[len(resigned)-1] = 0xff
+	if quoteCacheKey(quote, nil) != quoteCacheKey(resigned, nil) {
+		t.Fatal("Quotes that only differ in the signature should share a cache key.")
+	}
+
+	other := newTestQuote()
+	other[REPORT_DATA_IN_QUOTE] = 1
+	if quoteCacheKey(quote, nil) == quoteCacheKey(other, nil) {
+		t.Fatal("Quotes with different report data should not share a cache key.")
+	}
+	if quoteCacheKey(quote, nil) == quoteCacheKey(quote, []byte{1}) {
+		t.Fatal("The PSE manifest should be part of the cache key.")
+	}
+
+	fake := &fakeIAS{}
+	ias := newOutageIAS(fake, time.Hour, time.Now)
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+		t.Fatal(err)
+	}
+	fake.verifyErr = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	if _, _, _, err := ias.VerifyQuoteAndPSE(resigned, nil); err != nil {
+		t.Fatal("Expected the cached result for the re-signed quote, got:", err)
+	}
+}
+
+// newSigningChain returns a root CA, and the PEM encoded chain of a
+// report signing certificate issued by it, both using key.
+func newSigningChain(t *testing.T, key *rsa.PrivateKey, name string) (*x509.CertPool, []byte) {
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + " Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err = x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name + " Report Signing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, root, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER})...)
+	return roots, chain
+}
+
+func TestReportSigningRoots(t *testing.T) {
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	key, _ := reportSigner(t)
+	devRoots, devChain := newSigningChain(t, key, "Development")
+	prodRoots, prodChain := newSigningChain(t, key, "Production")
+	opts := []IASOption{
+		WithReportSigningRoots(false, devRoots),
+		WithReportSigningRoots(true, prodRoots),
+	}
+
+	dev := newTestIAS(t, srv.Server, opts...)
+	prod := newTestIAS(t, srv.Server, opts...)
+	prod.release = true
+	quote := newTestQuote()
+
+	tests := []struct {
+		name  string
+		ias   *ias
+		chain []byte
+		ok    bool
+	}{
+		{"dev report in dev mode", dev, devChain, true},
+		{"dev report in release mode", prod, devChain, false},
+		{"prod report in release mode", prod, prodChain, true},
+		{"prod report in dev mode", dev, prodChain, false},
+	}
+	for _, test := range tests {
+		srv.chain = test.chain
+		_, _, _, err := test.ias.VerifyQuoteAndPSE(quote, nil)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.ok && !errors.Is(err, ErrInvalidReportSignature) {
+			t.Errorf("%s: expected an invalid signature, got: %v", test.name, err)
+		}
+	}
+}
+
+func TestIntelSigningRoots(t *testing.T) {
+	block, _ := pem.Decode(intelSigningCA)
+	if block == nil {
+		t.Fatal("The Intel report signing CA is not PEM encoded.")
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.CheckSignatureFrom(ca); err != nil {
+		t.Fatal("The Intel report signing CA is not self-signed:", err)
+	} else if ca.Subject.CommonName != "Intel SGX Attestation Report Signing CA" {
+		t.Fatal("Unexpected Intel report signing CA:", ca.Subject)
+	}
+
+	// Without other roots, the reports of the mock IAS are not
+	// signed under the Intel CA, in either mode.
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	quote := newTestQuote()
+	for _, release := range []bool{false, true} {
+		ias := NewIAS(release, "subscription", nil, WithEndpoints(srv.URL)).(*ias)
+		if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); !errors.Is(err, ErrInvalidReportSignature) {
+			t.Errorf("Release %t: expected an invalid signature, got: %v", release, err)
+		}
+	}
+
+	// Removing the roots rejects every report.
+	ias := newTestIAS(t, srv.Server, WithReportSigningRoots(false, nil))
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); !errors.Is(err, ErrInvalidReportSignature) {
+		t.Error("Expected an invalid signature without roots, got:", err)
+	}
+}
+
+// blockingIAS counts the verifications in flight, and blocks each
+// of them until release is closed.
+type blockingIAS struct {
+	fakeIAS
+	sync.Mutex
+	inFlight int
+	peak     int
+	started  chan struct{}
+	release  chan struct{}
+}
+
+func (b *blockingIAS) VerifyQuoteAndPSE(quote, pse []byte) (bool, []byte, []string, error) {
+	b.Lock()
+	b.inFlight++
+	if b.inFlight > b.peak {
+		b.peak = b.inFlight
+	}
+	b.Unlock()
+	b.started <- struct{}{}
+
+	<-b.release
+	b.Lock()
+	b.inFlight--
+	b.Unlock()
+	return false, nil, nil, nil
+}
+
+func TestLimitIAS(t *testing.T) {
+	const max, requests = 3, 10
+	base := &blockingIAS{
+		started: make(chan struct{}, requests),
+		release: make(chan struct{}),
+	}
+	ias := newLimitIAS(base, max, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, err := ias.VerifyQuoteAndPSE(newTestQuote(), nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for i := 0; i < max; i++ {
+		<-base.started
+	}
+	select {
+	case <-base.started:
+		t.Fatal("More than", max, "requests reached IAS at once.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(base.release)
+	wg.Wait()
+
+	if base.peak != max {
+		t.Fatalf("Expected at most %d concurrent requests, got %d.", max, base.peak)
+	}
+
+	// A request that cannot get a slot in time fails fast.
+	busy := &blockingIAS{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	defer close(busy.release)
+	ias = newLimitIAS(busy, 1, 10*time.Millisecond)
+	go ias.VerifyQuoteAndPSE(newTestQuote(), nil)
+	<-busy.started
+	if _, _, _, err := ias.VerifyQuoteAndPSE(newTestQuote(), nil); err != ErrIASBusy {
+		t.Fatal("Expected IAS to be busy, got:", err)
+	}
+}
+
+func TestIASTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stall
+	}))
+	defer srv.Close()
+	defer close(stall)
+
+	if NewIAS(false, "", nil).(*ias).client.Timeout != DEFAULT_IAS_TIMEOUT {
+		t.Fatal("IAS requests should time out by default.")
+	}
+
+	ias := newTestIAS(t, srv, WithTimeout(50*time.Millisecond))
+	conf := authConfiguration()
+	conf.useSigRL = false
+	sm := newSessionManager(*conf, ias)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := managerHandshake(t, sm)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatal("Expected a timeout, got:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message 3 hung on a stalled IAS.")
+	}
+}
+
+func TestIASUserAgent(t *testing.T) {
+	agents := make(chan string, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get(HEADER_USER_AGENT)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ias := newTestIAS(t, srv)
+	if err := ias.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ias.GetRevocationList([]byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if agent := <-agents; agent != DEFAULT_IAS_USER_AGENT {
+			t.Fatal("Expected the default User-Agent, got", agent)
+		}
+	}
+
+	ias = newTestIAS(t, srv, WithUserAgent("proxy-route/1"))
+	ias.VerifyQuoteAndPSE(newTestQuote(), nil)
+	if agent := <-agents; agent != "proxy-route/1" {
+		t.Fatal("Expected the configured User-Agent, got", agent)
+	}
+}
+
+func TestIASFailover(t *testing.T) {
+	secondary := newMockIASServer(t)
+	defer secondary.Close()
+
+	status := http.StatusServiceUnavailable
+	primaryCalls := 0
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls++
+		w.WriteHeader(status)
+	}))
+	defer primary.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	ias := newTestIAS(t, secondary.Server, WithEndpoints(down.URL, primary.URL, secondary.URL))
+	quote := newTestQuote()
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err != nil {
+		t.Fatal("Expected the secondary to verify the quote, got:", err)
+	}
+	if _, err := ias.GetRevocationList([]byte{0, 0, 0, 0}); err != nil {
+		t.Fatal("Expected the secondary to return the SigRL, got:", err)
+	}
+	if primaryCalls != 2 || secondary.reports != 1 {
+		t.Fatal("Expected both requests to fail over, got", primaryCalls, secondary.reports)
+	}
+
+	// A rejection from the primary is final.
+	status = http.StatusBadRequest
+	var statusErr *IASStatusError
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected the rejection of the primary, got:", err)
+	} else if secondary.reports != 1 {
+		t.Fatal("A rejection should not fail over.")
+	}
+
+	// If every endpoint fails, so does the request.
+	ias = newTestIAS(t, secondary.Server, WithEndpoints(down.URL, down.URL))
+	if _, _, _, err := ias.VerifyQuoteAndPSE(quote, nil); err == nil {
+		t.Fatal("Expected the request to fail.")
+	}
+}
+
+func TestIASNonceReuse(t *testing.T) {
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	ias := newTestIAS(t, srv.Server)
+	// A broken random number generator that always returns the
+	// same nonce.
+	ias.rand = bytes.NewReader(bytes.Repeat([]byte{7}, 32))
+
+	conf := authConfiguration()
+	conf.useSigRL = false
+	sm := newSessionManager(*conf, ias)
+	if _, _, err := managerHandshake(t, sm); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := managerHandshake(t, sm); !errors.Is(err, ErrNonceReused) {
+		t.Fatal("A reused nonce should be rejected in another session, got:", err)
+	} else if srv.reports != 1 {
+		t.Fatal("A reused nonce should never be sent, got", srv.reports, "reports")
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Now()
+	cache := newNonceCache(2, time.Minute, func() time.Time { return now })
+	if !cache.use("a") || cache.use("a") {
+		t.Fatal("A nonce should only be usable once.")
+	}
+
+	// The cache is bounded in size...
+	cache.use("b")
+	cache.use("c")
+	if !cache.use("a") {
+		t.Fatal("The oldest nonce should have been forgotten.")
+	}
+
+	// ... and in time.
+	now = now.Add(time.Minute)
+	if !cache.use("c") {
+		t.Fatal("An expired nonce should have been forgotten.")
+	}
+}
+
+func TestIASRedirect(t *testing.T) {
+	leaked := make(chan string, 1)
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked <- r.Header.Get(HEADER_SUBSCRIPTION_KEY)
+	}))
+	defer elsewhere.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, elsewhere.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer proxy.Close()
+
+	ias := newTestIAS(t, proxy)
+	if _, err := ias.GetRevocationList([]byte{0, 0, 0, 0}); !errors.Is(err, ErrIASRedirect) {
+		t.Fatal("Expected the redirect to fail the request, got:", err)
+	} else if strings.Contains(err.Error(), "subscription") {
+		t.Fatal("The error should not carry the subscription key:", err)
+	}
+	if _, _, _, err := ias.VerifyQuoteAndPSE(newTestQuote(), nil); !errors.Is(err, ErrIASRedirect) {
+		t.Fatal("Expected the redirect to fail the request, got:", err)
+	}
+	select {
+	case key := <-leaked:
+		t.Fatalf("The redirect was followed with the subscription key [%s].", key)
+	default:
+	}
+}
+
+func TestIASInsecureSkipVerify(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	// The self-signed certificate of the server is rejected by
+	// default.
+	gid := []byte{0, 0, 0, 0}
+	ias := NewIAS(false, "subscription", nil, WithEndpoints(srv.URL))
+	if _, err := ias.GetRevocationList(gid); err == nil {
+		t.Fatal("The self-signed certificate should be rejected.")
+	}
+
+	ias = NewIAS(false, "subscription", nil, WithEndpoints(srv.URL), WithInsecureSkipVerify())
+	if _, err := ias.GetRevocationList(gid); err != nil {
+		t.Fatal("The self-signed certificate should be accepted in development mode, got:", err)
+	}
+
+	ias = NewIAS(true, "subscription", nil, WithEndpoints(srv.URL), WithInsecureSkipVerify())
+	if _, err := ias.GetRevocationList(gid); err == nil {
+		t.Fatal("The certificate should always be verified in release mode.")
+	}
+}
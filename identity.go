@@ -0,0 +1,80 @@
+package sgx_server
+
+import "crypto/subtle"
+
+// EnclaveIdentity identifies a verified enclave, as returned by
+// Session.Peer.
+type EnclaveIdentity struct {
+	MREnclave [MR_SIZE]byte
+	MRSigner  [MR_SIZE]byte
+	ProdID    uint16
+	SVN       uint16
+
+	// The KSS identity of the enclave, all 0 without KSS.
+	FamilyID  [ISVFAMILYID_SIZE]byte
+	ConfigID  [CONFIGID_SIZE]byte
+	ConfigSVN uint16
+}
+
+// identityOf returns the identity of the enclave that produced quote.
+func identityOf(quote *Quote) *EnclaveIdentity {
+	return &EnclaveIdentity{
+		MREnclave: quote.MREnclave,
+		MRSigner:  quote.MRSigner,
+		ProdID:    quote.ISVProdID,
+		SVN:       quote.ISVSVN,
+		FamilyID:  quote.ISVFamilyID,
+		ConfigID:  quote.ConfigID,
+		ConfigSVN: quote.ConfigSVN,
+	}
+}
+
+// Equal reports whether e and other are the exact same enclave,
+// including the security version number and the KSS identity. The
+// measurements are compared in constant time.
+func (e *EnclaveIdentity) Equal(other *EnclaveIdentity) bool {
+	if e == nil || other == nil {
+		return e == other
+	}
+	return e.sameEnclave(other)&
+		e.sameSigner(other)&
+		subtle.ConstantTimeEq(int32(e.ProdID), int32(other.ProdID))&
+		subtle.ConstantTimeEq(int32(e.SVN), int32(other.SVN))&
+		subtle.ConstantTimeCompare(e.FamilyID[:], other.FamilyID[:])&
+		subtle.ConstantTimeCompare(e.ConfigID[:], other.ConfigID[:])&
+		subtle.ConstantTimeEq(int32(e.ConfigSVN), int32(other.ConfigSVN)) == 1
+}
+
+// MatchesPolicy reports whether e is acceptable in place of expected
+// under policy, with the same rules a session manager applies to the
+// quote: the measurements policy names must match, ProdID must be the
+// same, and SVN must be at least expected.SVN. An empty or unknown
+// policy is treated as MEASUREMENT_BOTH.
+func (e *EnclaveIdentity) MatchesPolicy(policy MeasurementPolicy, expected *EnclaveIdentity) bool {
+	if e == nil || expected == nil {
+		return false
+	}
+
+	var measured int
+	switch policy {
+	case MEASUREMENT_MRENCLAVE_ONLY:
+		measured = e.sameEnclave(expected)
+	case MEASUREMENT_MRSIGNER_ONLY:
+		measured = e.sameSigner(expected)
+	case MEASUREMENT_EITHER:
+		measured = e.sameEnclave(expected) | e.sameSigner(expected)
+	default:
+		measured = e.sameEnclave(expected) & e.sameSigner(expected)
+	}
+	return measured == 1 && e.ProdID == expected.ProdID && e.SVN >= expected.SVN
+}
+
+// sameEnclave and sameSigner return 1 if the measurements match, and
+// 0 otherwise, so that they can be combined without branching.
+func (e *EnclaveIdentity) sameEnclave(other *EnclaveIdentity) int {
+	return subtle.ConstantTimeCompare(e.MREnclave[:], other.MREnclave[:])
+}
+
+func (e *EnclaveIdentity) sameSigner(other *EnclaveIdentity) int {
+	return subtle.ConstantTimeCompare(e.MRSigner[:], other.MRSigner[:])
+}
@@ -0,0 +1,102 @@
+package sgx_server
+
+import (
+	"errors"
+	"testing"
+)
+
+func testIdentity() *EnclaveIdentity {
+	return &EnclaveIdentity{
+		MREnclave: [MR_SIZE]byte{1},
+		MRSigner:  [MR_SIZE]byte{2},
+		ProdID:    3,
+		SVN:       4,
+	}
+}
+
+func TestEnclaveIdentityEqual(t *testing.T) {
+	expected := testIdentity()
+	if !testIdentity().Equal(expected) {
+		t.Error("Identical enclaves should be equal.")
+	}
+
+	newer := testIdentity()
+	newer.SVN++
+	if newer.Equal(expected) {
+		t.Error("Enclaves with different SVNs should not be equal.")
+	}
+
+	signer := testIdentity()
+	signer.MRSigner[MR_SIZE-1] ^= 1
+	if signer.Equal(expected) {
+		t.Error("Enclaves with different signers should not be equal.")
+	}
+
+	prod := testIdentity()
+	prod.ProdID++
+	if prod.Equal(expected) {
+		t.Error("Enclaves with different production IDs should not be equal.")
+	}
+
+	if expected.Equal(nil) {
+		t.Error("No enclave is equal to nil.")
+	}
+}
+
+func TestEnclaveIdentityMatchesPolicy(t *testing.T) {
+	expected := testIdentity()
+	newer := testIdentity()
+	newer.SVN++
+	older := testIdentity()
+	older.SVN--
+	signer := testIdentity()
+	signer.MRSigner[0] ^= 1
+	enclave := testIdentity()
+	enclave.MREnclave[0] ^= 1
+	prod := testIdentity()
+	prod.ProdID++
+
+	tests := []struct {
+		name     string
+		identity *EnclaveIdentity
+		policy   MeasurementPolicy
+		ok       bool
+	}{
+		{"same", testIdentity(), MEASUREMENT_BOTH, true},
+		{"newer SVN", newer, MEASUREMENT_BOTH, true},
+		{"older SVN", older, MEASUREMENT_EITHER, false},
+		{"other production ID", prod, MEASUREMENT_EITHER, false},
+		{"signer differs", signer, MEASUREMENT_BOTH, false},
+		{"signer differs", signer, MEASUREMENT_MRSIGNER_ONLY, false},
+		{"signer differs", signer, MEASUREMENT_MRENCLAVE_ONLY, true},
+		{"signer differs", signer, MEASUREMENT_EITHER, true},
+		{"enclave differs", enclave, "", false},
+		{"enclave differs", enclave, MEASUREMENT_MRENCLAVE_ONLY, false},
+		{"enclave differs", enclave, MEASUREMENT_MRSIGNER_ONLY, true},
+		{"enclave differs", enclave, MEASUREMENT_EITHER, true},
+	}
+	for _, test := range tests {
+		if ok := test.identity.MatchesPolicy(test.policy, expected); ok != test.ok {
+			t.Errorf("%s under %q: expected %t, got %t", test.name, test.policy, test.ok, ok)
+		}
+	}
+}
+
+func TestSessionPeer(t *testing.T) {
+	sn := newSession("0", authConfiguration(), &fakeIAS{})
+	if _, err := sn.Peer(); !errors.Is(err, ErrNotAuthenticated) {
+		t.Fatal("Expected an unauthenticated session, got:", err)
+	}
+
+	quote := newTestQuote()
+	quote[ISVSVN_IN_QUOTE] = 7
+	handshakeWithQuote(t, sn, quote)
+	peer, err := sn.Peer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &EnclaveIdentity{MREnclave: testMR, MRSigner: testMR, SVN: 7}
+	if !peer.Equal(expected) {
+		t.Fatalf("Incorrect peer:\n%+v\n%+v", peer, expected)
+	}
+}
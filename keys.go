@@ -5,8 +5,12 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
@@ -22,36 +26,87 @@ func exchange(mine *ecdsa.PrivateKey, peer *ecdsa.PublicKey) []byte {
 	return serializeBigInt(x)
 }
 
-// TODO: implement password
 func loadPrivateKey(fileName string, password string) *ecdsa.PrivateKey {
+	key, err := readPrivateKey(fileName, password)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// readPrivateKey is like loadPrivateKey, but returns an error rather
+// than exit if the key cannot be read.
+func readPrivateKey(fileName string, password string) (*ecdsa.PrivateKey, error) {
 	pem_encoded, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		log.Fatal("Could not open the private key file:", err)
+		return nil, fmt.Errorf("Could not open the private key file: %w", err)
 	}
 
+	key, err := parsePrivateKey(pem_encoded, password)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse the private key %s: %w", fileName, err)
+	}
+	return key, nil
+}
+
+// parsePrivateKey parses a PEM encoded PKCS #8 ECDSA key. If the PEM
+// block is encrypted (RFC 1423), it is decrypted with password first.
+func parsePrivateKey(pem_encoded []byte, password string) (*ecdsa.PrivateKey, error) {
 	block, _ := pem.Decode(pem_encoded)
+	if block == nil {
+		return nil, ErrInvalidPEM
+	}
 
-	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		log.Fatal("Could not parse the private key:", err)
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		var err error
+		der, err = x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return key.(*ecdsa.PrivateKey)
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("The private key is not an ECDSA key.")
+	}
+	return priv, nil
 }
 
 func loadPublicKey(fileName string) *ecdsa.PublicKey {
+	pub, err := readPublicKey(fileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pub
+}
+
+// readPublicKey is like loadPublicKey, but returns an error rather
+// than exit if the key cannot be read.
+func readPublicKey(fileName string) (*ecdsa.PublicKey, error) {
 	pem_encoded, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		log.Fatal("Could not open the public key file:", err)
+		return nil, fmt.Errorf("Could not open the public key file: %w", err)
 	}
 
 	block, _ := pem.Decode(pem_encoded)
+	if block == nil {
+		return nil, fmt.Errorf("Could not parse the public key %s: %w", fileName, ErrInvalidPEM)
+	}
 
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		log.Fatal("Could not parse the public key:", err)
+		return nil, fmt.Errorf("Could not parse the public key %s: %w", fileName, err)
 	}
-	return pub.(*ecdsa.PublicKey)
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("The public key %s is not an ECDSA key.", fileName))
+	}
+	return pub, nil
 }
 
 func loadKeyPair(privFile string, pubFile string, password string) (*ecdsa.PrivateKey, *ecdsa.PublicKey) {
@@ -68,6 +123,14 @@ func marshalPublicKey(pub *ecdsa.PublicKey) ([]byte, []byte, error) {
 	return serializeBigInt(pub.X), serializeBigInt(pub.Y), nil
 }
 
+// publicKeyHash identifies a long-term key by the SHA-256 hash of its
+// public key, in the same little endian format as the keys in the SGX
+// messages.
+func publicKeyHash(pub *ecdsa.PublicKey) [sha256.Size]byte {
+	x, y, _ := marshalPublicKey(pub)
+	return sha256.Sum256(append(x, y...))
+}
+
 func unmarshalPublicKey(xb, yb []byte) (*ecdsa.PublicKey, error) {
 	// to big endian
 	reverse(xb)
@@ -86,6 +149,57 @@ func unmarshalPublicKey(xb, yb []byte) (*ecdsa.PublicKey, error) {
 	return pub, nil
 }
 
+// validateClientKey makes sure the client's public key can be used for
+// the key exchange. A missing or all zero key (which is how the point
+// at infinity is encoded), or a point not on the curve would result in
+// a degenerate shared secret.
+func validateClientKey(ga *PublicKey) error {
+	if ga == nil || isZero(ga.X) && isZero(ga.Y) {
+		return ErrInvalidClientKey
+	}
+
+	pub, err := unmarshalPublicKey(ga.X, ga.Y)
+	if err != nil {
+		return err
+	}
+	if (pub.X.Sign() == 0 && pub.Y.Sign() == 0) || !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return ErrInvalidClientKey
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// generateKeyFrom derives a key from the bytes read from r. Unlike
+// ecdsa.GenerateKey, which may mix in randomness of its own, the key
+// only depends on r, so a fixed r always yields the same key. The
+// extra 64 bits make the bias of the reduction negligible, as in FIPS
+// 186-4 B.4.1.
+func generateKeyFrom(r io.Reader) *ecdsa.PrivateKey {
+	params := elliptic.P256().Params()
+	b := make([]byte, params.BitSize/8+8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		log.Fatal("Couldn't generate an elliptic curve key.")
+	}
+
+	one := big.NewInt(1)
+	d := new(big.Int).SetBytes(b)
+	d.Mod(d, new(big.Int).Sub(params.N, one))
+	d.Add(d, one)
+
+	priv := &ecdsa.PrivateKey{D: d}
+	priv.PublicKey.Curve = elliptic.P256()
+	priv.PublicKey.X, priv.PublicKey.Y = priv.PublicKey.Curve.ScalarBaseMult(d.Bytes())
+	return priv
+}
+
 func generateKey() *ecdsa.PrivateKey {
 	curve := elliptic.P256() // this should be SECP256R1
 	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
@@ -96,57 +210,71 @@ func generateKey() *ecdsa.PrivateKey {
 }
 
 // key deriviation key
-func kdk(mine *ecdsa.PrivateKey, peer *ecdsa.PublicKey) []byte {
+func kdk(mine *ecdsa.PrivateKey, peer *ecdsa.PublicKey) ([]byte, error) {
 	var cmac_key [16]byte // this always initializes to 0s in go
 	shared := exchange(mine, peer)
 	block, err := aes.NewCipher(cmac_key[:])
 	if err != nil {
-		log.Fatal("Could not create AES for CMAC: ", err)
+		return nil, fmt.Errorf("Could not create AES for CMAC: %w", err)
 	}
 
 	key, err := cmac.Sum(shared, block, aes.BlockSize)
 	if err != nil {
-		log.Fatal("Could not derive the KDK: ", err)
+		return nil, fmt.Errorf("Could not derive the KDK: %w", err)
 	}
 
-	return key
+	return key, nil
 }
 
-func keyDerivationString(label []byte) []byte {
-	out := make([]byte, 4+len(label))
-	copy(out[1:], label)
-	// These are magic onstants from the remote attestation key derivation.
-	out[0] = 1
-	out[len(out)-2] = 128
-	return out
-}
+// Key derivation labels must be between 1 and MAX_LABEL_SIZE bytes.
+const MAX_LABEL_SIZE = 32
+
+// keyDerivationString builds the input to the CMAC based key
+// derivation for label. The format is
+//
+//	counter (0x01) || label || 0x00 || L (0x0080, little endian)
+//
+// where L is the size of the derived key in bits. The counter is
+// always 1 since all the derived keys are 128 bits, a single CMAC
+// block.
+func keyDerivationString(label []byte) ([]byte, error) {
+	if len(label) == 0 || len(label) > MAX_LABEL_SIZE {
+		return nil, fmt.Errorf("%w Invalid key derivation label length: %d.", ErrInvalidLabel, len(label))
+	}
 
-func deriveLabelKey(mine *ecdsa.PrivateKey, peer *ecdsa.PublicKey, label []byte) ([]byte, []byte) {
-	base := kdk(mine, peer)
+	out := make([]byte, 0, 4+len(label))
+	out = append(out, 1)
+	out = append(out, label...)
+	out = append(out, 0)
+	out = append(out, 128, 0)
+	return out, nil
+}
 
-	block, err := aes.NewCipher(base[:])
+func deriveLabelKey(mine *ecdsa.PrivateKey, peer *ecdsa.PublicKey, label []byte) ([]byte, []byte, error) {
+	base, err := kdk(mine, peer)
 	if err != nil {
-		log.Fatal("Could not create AES for CMAC: ", err)
+		return nil, nil, err
 	}
+	key, err := deriveLabelKeyFromBase(base, label)
+	return base, key, err
+}
 
-	key, err := cmac.Sum(keyDerivationString(label), block, aes.BlockSize)
+func deriveLabelKeyFromBase(base []byte, label []byte) ([]byte, error) {
+	kds, err := keyDerivationString(label)
 	if err != nil {
-		log.Fatal("Could not derive the KDK: ", err)
+		return nil, err
 	}
-	return base, key
-}
 
-func deriveLabelKeyFromBase(base []byte, label []byte) []byte {
 	block, err := aes.NewCipher(base[:])
 	if err != nil {
-		log.Fatal("Could not create AES for CMAC: ", err)
+		return nil, fmt.Errorf("Could not create AES for CMAC: %w", err)
 	}
 
-	key, err := cmac.Sum(keyDerivationString(label), block, aes.BlockSize)
+	key, err := cmac.Sum(kds, block, aes.BlockSize)
 	if err != nil {
-		log.Fatal("Could not derive the KDK: ", err)
+		return nil, fmt.Errorf("Could not derive the key for label [%s]: %w", label, err)
 	}
-	return key
+	return key, nil
 }
 
 // serialize a big int to always 32 byte, little endian
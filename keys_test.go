@@ -4,9 +4,17 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/big"
+	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -76,7 +84,10 @@ func TestECDHAndKeyDerivation(t *testing.T) {
 		D:         D,
 	}
 
-	baseKey, labelKey := deriveLabelKey(mine, pub2, []byte("helloworld"))
+	baseKey, labelKey, err := deriveLabelKey(mine, pub2, []byte("helloworld"))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !bytes.Equal(baseKey, kb) {
 		fmt.Println(kb)
 		fmt.Println(baseKey)
@@ -89,3 +100,252 @@ func TestECDHAndKeyDerivation(t *testing.T) {
 		t.Error("Label key derivation failed.")
 	}
 }
+
+func TestKeyDerivationString(t *testing.T) {
+	expected := map[string]string{
+		"SMK": "01534d4b008000",
+		"VK":  "01564b008000",
+		"SK":  "01534b008000",
+		"MK":  "014d4b008000",
+	}
+	for _, label := range [][]byte{SMK_LABEL, VK_LABEL, SK_LABEL, MK_LABEL} {
+		kds, err := keyDerivationString(label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(kds) != expected[string(label)] {
+			t.Errorf("Incorrect derivation string for %s: %x.", label, kds)
+		}
+	}
+
+	if _, err := keyDerivationString(nil); err == nil {
+		t.Error("Empty label should be rejected.")
+	}
+	if _, err := keyDerivationString(make([]byte, MAX_LABEL_SIZE+1)); err == nil {
+		t.Error("Long label should be rejected.")
+	}
+}
+
+// A missing key is an error rather than a reason to exit, e.g., for
+// a session that is asked for a MAC before it has keys.
+func TestKeyDerivationWithoutKey(t *testing.T) {
+	for _, key := range [][]byte{nil, make([]byte, 5)} {
+		if _, err := deriveLabelKeyFromBase(key, SK_LABEL); err == nil {
+			t.Errorf("Deriving from a %d byte key should fail.", len(key))
+		}
+		if _, err := cmacWithKey([]byte("message"), key); err == nil {
+			t.Errorf("A CMAC with a %d byte key should fail.", len(key))
+		}
+	}
+
+	sn := newSession("0", authConfiguration(), &fakeIAS{})
+	if mac := sn.MAC([]byte("message")); mac != nil {
+		t.Fatal("A session without keys should not MAC, got", mac)
+	}
+}
+
+func TestMarshalShortCoordinate(t *testing.T) {
+	// About 1 in 128 keys has a coordinate with a leading zero
+	// byte, so this finds one quickly.
+	for i := 0; i < 100000; i++ {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := &priv.PublicKey
+		if len(pub.X.Bytes()) == EC_COORD_SIZE && len(pub.Y.Bytes()) == EC_COORD_SIZE {
+			continue
+		}
+
+		x, y, err := marshalPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(x) != EC_COORD_SIZE || len(y) != EC_COORD_SIZE {
+			t.Fatalf("Coordinates should be %d bytes, got %d and %d.", EC_COORD_SIZE, len(x), len(y))
+		}
+		// Little endian, so the leading zero is the last byte.
+		if (len(pub.X.Bytes()) < EC_COORD_SIZE && x[EC_COORD_SIZE-1] != 0) ||
+			(len(pub.Y.Bytes()) < EC_COORD_SIZE && y[EC_COORD_SIZE-1] != 0) {
+			t.Fatal("Short coordinate was not padded with a trailing zero.")
+		}
+
+		round, err := unmarshalPublicKey(x, y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if round.X.Cmp(pub.X) != 0 || round.Y.Cmp(pub.Y) != 0 {
+			t.Fatal("Public key did not survive the round trip.")
+		}
+		return
+	}
+	t.Fatal("Could not generate a key with a short coordinate.")
+}
+
+// stubPasswordReader always returns the same password.
+type stubPasswordReader struct {
+	password string
+	prompts  []string
+}
+
+func (r *stubPasswordReader) ReadPassword(prompt string) (string, error) {
+	r.prompts = append(r.prompts, prompt)
+	return r.password, nil
+}
+
+func TestEncryptedLongTermKey(t *testing.T) {
+	priv := generateKey()
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "PRIVATE KEY", der, []byte("hunter2"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := &stubPasswordReader{password: "hunter2"}
+	config := &Configuration{
+		LongTermKey:          keyFile,
+		LongTermKeyEncrypted: true,
+		PasswordReader:       reader,
+	}
+	passwd, err := longTermKeyPassword(config)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(reader.prompts) != 1 {
+		t.Fatal("The password should have been read once, got", reader.prompts)
+	}
+	if key := loadPrivateKey(keyFile, passwd); key.D.Cmp(priv.D) != 0 {
+		t.Fatal("Decrypted the wrong key.")
+	}
+
+	// A configured password takes precedence over the reader.
+	config.LongTermKeyPassword = "wrong"
+	if passwd, err := longTermKeyPassword(config); err != nil || passwd != "wrong" {
+		t.Fatal("Expected the configured password, got:", passwd, err)
+	} else if len(reader.prompts) != 1 {
+		t.Fatal("The reader should not have been used.")
+	}
+	// The legacy PEM encryption cannot always tell a wrong
+	// password, but then the key fails to parse.
+	if _, err := parsePrivateKey(pem.EncodeToMemory(block), "wrong"); err == nil {
+		t.Fatal("A wrong password should not decrypt the key.")
+	}
+
+	// Unencrypted keys never read a password.
+	config.LongTermKeyEncrypted = false
+	if passwd, err := longTermKeyPassword(config); err != nil || passwd != "" {
+		t.Fatal("Expected no password, got:", passwd, err)
+	}
+}
+
+func TestPasswordReaders(t *testing.T) {
+	defer setEnv(map[string]string{"SGX_TEST_PASSWORD": "from env"})()
+	if passwd, err := EnvPasswordReader("SGX_TEST_PASSWORD").ReadPassword(""); err != nil || passwd != "from env" {
+		t.Error("Incorrect password from the environment:", passwd, err)
+	}
+	if _, err := EnvPasswordReader("SGX_TEST_NO_PASSWORD").ReadPassword(""); err == nil {
+		t.Error("A missing variable should be an error.")
+	}
+
+	f, err := ioutil.TempFile("", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from file\n")
+	f.Close()
+	if passwd, err := FilePasswordReader(f.Name()).ReadPassword(""); err != nil || passwd != "from file" {
+		t.Error("Incorrect password from the file:", passwd, err)
+	}
+}
+
+// benchmarkKeys returns the key pairs of both ends of a key exchange.
+func benchmarkKeys() (*ecdsa.PrivateKey, *ecdsa.PrivateKey) {
+	return generateKey(), generateKey()
+}
+
+func BenchmarkExchange(b *testing.B) {
+	mine, peer := benchmarkKeys()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		exchange(mine, &peer.PublicKey)
+	}
+}
+
+func BenchmarkKDK(b *testing.B) {
+	mine, peer := benchmarkKeys()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := kdk(mine, &peer.PublicKey); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDeriveLabelKey(b *testing.B) {
+	mine, peer := benchmarkKeys()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := deriveLabelKey(mine, &peer.PublicKey, SMK_LABEL); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDeriveLabelKeyFromBase derives a session key from an
+// existing KDK, as is done for every key after SMK.
+func BenchmarkDeriveLabelKeyFromBase(b *testing.B) {
+	mine, peer := benchmarkKeys()
+	base, err := kdk(mine, &peer.PublicKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := deriveLabelKeyFromBase(base, SK_LABEL); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestKeyFilesNotPEM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A DER encoded key is a common mistake.
+	der, err := x509.MarshalPKCS8PrivateKey(generateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{"key.der": der, "empty.pem": nil} {
+		file := path.Join(dir, name)
+		if err := ioutil.WriteFile(file, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPrivateKey(file, ""); !errors.Is(err, ErrInvalidPEM) || !strings.Contains(err.Error(), file) {
+			t.Errorf("%s: expected an invalid PEM private key error naming the file, got: %v", name, err)
+		}
+		if _, err := readPublicKey(file); !errors.Is(err, ErrInvalidPEM) || !strings.Contains(err.Error(), file) {
+			t.Errorf("%s: expected an invalid PEM public key error naming the file, got: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package sgx_server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Logger is where the SessionManager writes its logs. The standard
+// library's *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// defaultLogger writes to stderr like the standard log package.
+func defaultLogger() Logger {
+	return log.New(os.Stderr, "", log.LstdFlags)
+}
+
+// RedactionLevel is how much the logs of a SessionManager leave out.
+// Secrets (the session keys, the long-term private keys, the IAS
+// subscription key, and the message 4 payload) are redacted at every
+// level, including with TraceHandshake.
+type RedactionLevel string
+
+// Values for Configuration.LogRedaction.
+const (
+	// Only secrets are redacted. This is the default.
+	REDACT_SECRETS RedactionLevel = "secrets"
+	// The identifiers in the logs (session ids, EPID group ids,
+	// and IAS report ids) are also replaced by a short hash of
+	// them, so that the lines of one session can still be told
+	// apart, but a session id cannot be lifted from the logs and
+	// used to talk to the server.
+	REDACT_IDENTIFIERS RedactionLevel = "identifiers"
+)
+
+// REDACTED replaces the secrets found in a log line.
+const REDACTED = "[REDACTED]"
+
+// Secrets shorter than this are not looked for in the logs, since
+// they would match by chance.
+const minRedactedSecret = 8
+
+// identifier marks a logged value that is hashed at
+// REDACT_IDENTIFIERS.
+type identifier string
+
+// redactArgs replaces the identifiers in the logging arguments v
+// according to level.
+func redactArgs(level RedactionLevel, v []interface{}) []interface{} {
+	args := make([]interface{}, len(v))
+	for i, arg := range v {
+		if id, ok := arg.(identifier); ok && level == REDACT_IDENTIFIERS {
+			sum := sha256.Sum256([]byte(id))
+			arg = fmt.Sprintf("redacted-%x", sum[:4])
+		} else if ok {
+			arg = string(id)
+		}
+		args[i] = arg
+	}
+	return args
+}
+
+// redactSecrets replaces every occurrence of secrets in line with
+// REDACTED, whether they appear as raw bytes, hex, or base64.
+func redactSecrets(line string, secrets [][]byte) string {
+	for _, secret := range secrets {
+		if len(secret) < minRedactedSecret {
+			continue
+		}
+		for _, encoded := range []string{
+			string(secret),
+			hex.EncodeToString(secret),
+			strings.ToUpper(hex.EncodeToString(secret)),
+			base64.StdEncoding.EncodeToString(secret),
+			base64.RawStdEncoding.EncodeToString(secret),
+		} {
+			line = strings.Replace(line, encoded, REDACTED, -1)
+		}
+	}
+	return line
+}
+
+// redactingLogger is the Logger that the SessionManager, its sessions,
+// and its IAS write to. It redacts the identifiers according to
+// level, and the long-lived secrets of the session manager, in case
+// they ever end up in a log line by mistake.
+type redactingLogger struct {
+	Logger
+	level   RedactionLevel
+	secrets [][]byte
+}
+
+func newRedactingLogger(logger Logger, level RedactionLevel, secrets ...[]byte) *redactingLogger {
+	return &redactingLogger{
+		Logger:  logger,
+		level:   level,
+		secrets: secrets,
+	}
+}
+
+func (l *redactingLogger) Printf(format string, v ...interface{}) {
+	line := fmt.Sprintf(format, redactArgs(l.level, v)...)
+	l.Logger.Printf("%s", redactSecrets(line, l.secrets))
+}
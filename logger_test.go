@@ -0,0 +1,99 @@
+package sgx_server
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLogsNeverContainSecrets(t *testing.T) {
+	srv := newMockIASServer(t)
+	defer srv.Close()
+
+	conf := authConfiguration()
+	conf.traceHandshake = true
+	conf.subscription = "9f86d081884c7d659a2feaa0c55ad015"
+	conf.msg4Payload = []byte("capability token for the enclave")
+	conf.secondaryKeys = []*ecdsa.PrivateKey{generateKey()}
+	logs := &bufferLogger{}
+	ias := newTestIAS(t, srv.Server)
+	sm := newSessionManager(*conf, ias, WithLogger(logs))
+	ias.subscription = conf.subscription
+	ias.logger = sm.logger
+
+	id, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn, _ := sm.GetSession(id)
+	s := sn.(*session)
+
+	// Secrets that end up in a log line by mistake are redacted
+	// too.
+	s.trace("leak %x %s", s.sk, base64.StdEncoding.EncodeToString(s.mk))
+	sm.logger.Printf("leak %s %x %X", conf.subscription, conf.msg4Payload, conf.longTermKey.D.Bytes())
+
+	secrets := map[string][]byte{
+		"KDK":          s.kdk,
+		"SMK":          s.smk,
+		"VK":           s.vk,
+		"SK":           s.sk,
+		"MK":           s.mk,
+		"subscription": []byte(conf.subscription),
+		"payload":      conf.msg4Payload,
+	}
+	for i, key := range append([]*ecdsa.PrivateKey{conf.longTermKey}, conf.secondaryKeys...) {
+		secrets[fmt.Sprintf("long-term key %d", i)] = key.D.Bytes()
+		secrets[fmt.Sprintf("little endian long-term key %d", i)] = serializeBigInt(key.D)
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, "msg3:") || !strings.Contains(out, "IAS report") {
+		t.Fatal("The handshake was not traced:", out)
+	} else if !strings.Contains(out, REDACTED) {
+		t.Fatal("The leaked secrets were not redacted:", out)
+	}
+	for name, secret := range secrets {
+		for _, encoded := range []string{
+			string(secret),
+			hex.EncodeToString(secret),
+			strings.ToUpper(hex.EncodeToString(secret)),
+			base64.StdEncoding.EncodeToString(secret),
+		} {
+			if strings.Contains(out, encoded) {
+				t.Errorf("The %s was logged: %s", name, out)
+			}
+		}
+	}
+}
+
+func TestRedactIdentifiers(t *testing.T) {
+	conf := authConfiguration()
+	conf.traceHandshake = true
+	conf.redaction = REDACT_IDENTIFIERS
+	logs := &bufferLogger{}
+	sm := newSessionManager(*conf, &fakeIAS{}, WithLogger(logs))
+
+	id, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := logs.String(); strings.Contains(out, id) {
+		t.Fatal("The session id was logged:", out)
+	} else if !strings.Contains(out, "Session [redacted-") {
+		t.Fatal("The session id was not replaced by its hash:", out)
+	}
+
+	// By default, the identifiers are logged as they are.
+	conf.redaction = REDACT_SECRETS
+	logs.Reset()
+	sm = newSessionManager(*conf, &fakeIAS{}, WithLogger(logs))
+	if id, _, err = managerHandshake(t, sm); err != nil {
+		t.Fatal(err)
+	} else if out := logs.String(); !strings.Contains(out, "Session ["+id+"]") {
+		t.Fatal("The session id should be logged:", out)
+	}
+}
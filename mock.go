@@ -0,0 +1,153 @@
+package sgx_server
+
+import "context"
+
+// MockSessionManager is a SessionManager that does not need any keys
+// or access to IAS, meant for testing code that depends on a
+// SessionManager. Each method calls the corresponding function field
+// if it is set. Otherwise, it does nothing and returns an empty
+// message (or no session) with no error.
+type MockSessionManager struct {
+	GetSessionFunc          func(id string) (Session, bool)
+	NewSessionFunc          func(in *Request) (*Challenge, error)
+	NewSessionCtxFunc       func(ctx context.Context, in *Request) (*Challenge, error)
+	ProcessMsg0Func         func(id string, msg0 *Msg0) (*Msg0Response, error)
+	Msg1ToMsg2Func          func(id string, msg1 *Msg1) (*Msg2, error)
+	Msg3ToMsg4Func          func(id string, msg3 *Msg3) (*Msg4, error)
+	DescribeFunc            func() ManagerInfo
+	StatsFunc               func() Stats
+	LongTermPublicBytesFunc func() (x, y []byte)
+	WarmFunc                func(ctx context.Context) error
+	ReloadProdSVNFunc       func(svn uint16) int
+	ReconfigureFunc         func(config *Configuration) error
+	TrustMREnclaveFunc      func(mr [MR_SIZE]byte)
+	UntrustMREnclaveFunc    func(mr [MR_SIZE]byte) bool
+	TrustedMeasurementsFunc func() (mrenclaves, mrsigners []string)
+	RevokeFunc              func(id string) error
+	EventsFunc              func() <-chan Event
+	StopFunc                func()
+}
+
+func (m *MockSessionManager) GetSession(id string) (Session, bool) {
+	if m.GetSessionFunc != nil {
+		return m.GetSessionFunc(id)
+	}
+	return nil, false
+}
+
+func (m *MockSessionManager) NewSession(in *Request) (*Challenge, error) {
+	if m.NewSessionFunc != nil {
+		return m.NewSessionFunc(in)
+	}
+	return &Challenge{}, nil
+}
+
+func (m *MockSessionManager) NewSessionCtx(ctx context.Context, in *Request) (*Challenge, error) {
+	if m.NewSessionCtxFunc != nil {
+		return m.NewSessionCtxFunc(ctx, in)
+	}
+	return &Challenge{}, nil
+}
+
+func (m *MockSessionManager) ProcessMsg0(id string, msg0 *Msg0) (*Msg0Response, error) {
+	if m.ProcessMsg0Func != nil {
+		return m.ProcessMsg0Func(id, msg0)
+	}
+	return &Msg0Response{}, nil
+}
+
+func (m *MockSessionManager) Msg1ToMsg2(id string, msg1 *Msg1) (*Msg2, error) {
+	if m.Msg1ToMsg2Func != nil {
+		return m.Msg1ToMsg2Func(id, msg1)
+	}
+	return &Msg2{}, nil
+}
+
+func (m *MockSessionManager) Msg3ToMsg4(id string, msg3 *Msg3) (*Msg4, error) {
+	if m.Msg3ToMsg4Func != nil {
+		return m.Msg3ToMsg4Func(id, msg3)
+	}
+	return &Msg4{}, nil
+}
+
+func (m *MockSessionManager) Describe() ManagerInfo {
+	if m.DescribeFunc != nil {
+		return m.DescribeFunc()
+	}
+	return ManagerInfo{}
+}
+
+func (m *MockSessionManager) Stats() Stats {
+	if m.StatsFunc != nil {
+		return m.StatsFunc()
+	}
+	return Stats{}
+}
+
+func (m *MockSessionManager) LongTermPublicBytes() ([]byte, []byte) {
+	if m.LongTermPublicBytesFunc != nil {
+		return m.LongTermPublicBytesFunc()
+	}
+	return nil, nil
+}
+
+func (m *MockSessionManager) Warm(ctx context.Context) error {
+	if m.WarmFunc != nil {
+		return m.WarmFunc(ctx)
+	}
+	return nil
+}
+
+func (m *MockSessionManager) ReloadProdSVN(svn uint16) int {
+	if m.ReloadProdSVNFunc != nil {
+		return m.ReloadProdSVNFunc(svn)
+	}
+	return 0
+}
+
+func (m *MockSessionManager) Reconfigure(config *Configuration) error {
+	if m.ReconfigureFunc != nil {
+		return m.ReconfigureFunc(config)
+	}
+	return nil
+}
+
+func (m *MockSessionManager) TrustMREnclave(mr [MR_SIZE]byte) {
+	if m.TrustMREnclaveFunc != nil {
+		m.TrustMREnclaveFunc(mr)
+	}
+}
+
+func (m *MockSessionManager) UntrustMREnclave(mr [MR_SIZE]byte) bool {
+	if m.UntrustMREnclaveFunc != nil {
+		return m.UntrustMREnclaveFunc(mr)
+	}
+	return false
+}
+
+func (m *MockSessionManager) TrustedMeasurements() ([]string, []string) {
+	if m.TrustedMeasurementsFunc != nil {
+		return m.TrustedMeasurementsFunc()
+	}
+	return nil, nil
+}
+
+func (m *MockSessionManager) Revoke(id string) error {
+	if m.RevokeFunc != nil {
+		return m.RevokeFunc(id)
+	}
+	return nil
+}
+
+func (m *MockSessionManager) Events() <-chan Event {
+	if m.EventsFunc != nil {
+		return m.EventsFunc()
+	}
+	return nil
+}
+
+func (m *MockSessionManager) Stop() {
+	if m.StopFunc != nil {
+		m.StopFunc()
+	}
+}
@@ -0,0 +1,64 @@
+package sgx_server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Defaults for the nonces an IAS remembers, see WithNonceCache.
+const (
+	DEFAULT_NONCE_CACHE_SIZE = 4096
+	DEFAULT_NONCE_CACHE_TTL  = time.Hour
+)
+
+// nonceCache remembers the nonces recently sent to IAS (or received
+// from the clients in message 1), up to size nonces for at most ttl
+// each, so that no nonce is ever used twice within that window,
+// whichever session it was sent for.
+type nonceCache struct {
+	sync.Mutex
+	size  int
+	ttl   time.Duration
+	now   func() time.Time
+	queue *list.List // the oldest nonce is at the back
+	seen  map[string]*list.Element
+}
+
+type nonceEntry struct {
+	nonce string
+	used  time.Time
+}
+
+func newNonceCache(size int, ttl time.Duration, now func() time.Time) *nonceCache {
+	return &nonceCache{
+		size:  size,
+		ttl:   ttl,
+		now:   now,
+		queue: list.New(),
+		seen:  make(map[string]*list.Element),
+	}
+}
+
+// use records nonce, and reports whether it was not used before
+// within the window.
+func (c *nonceCache) use(nonce string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.now()
+	for e := c.queue.Back(); e != nil; e = c.queue.Back() {
+		entry := e.Value.(*nonceEntry)
+		if c.queue.Len() < c.size && now.Sub(entry.used) < c.ttl {
+			break
+		}
+		delete(c.seen, entry.nonce)
+		c.queue.Remove(e)
+	}
+
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = c.queue.PushFront(&nonceEntry{nonce, now})
+	return true
+}
@@ -0,0 +1,88 @@
+package sgx_server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// PasswordReader reads the password of the encrypted long-term key,
+// e.g., from a terminal, a file, or a secrets manager.
+type PasswordReader interface {
+	// ReadPassword returns the password. prompt describes the
+	// password, and is only meant for interactive readers.
+	ReadPassword(prompt string) (string, error)
+}
+
+type terminalPasswordReader struct{}
+
+// TerminalPasswordReader reads the password from the terminal
+// attached to stdin, without echoing it. It is used when the long-term
+// key is encrypted and neither LongTermKeyPassword nor PasswordReader
+// is set.
+func TerminalPasswordReader() PasswordReader {
+	return terminalPasswordReader{}
+}
+
+func (terminalPasswordReader) ReadPassword(prompt string) (string, error) {
+	// Refuse to read the password if it would be echoed.
+	if err := stty("-echo"); err != nil {
+		return "", fmt.Errorf("Could not turn off the terminal echo: %w", err)
+	}
+	defer stty("echo")
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+type envPasswordReader struct {
+	name string
+}
+
+// EnvPasswordReader reads the password from the environment variable
+// name.
+func EnvPasswordReader(name string) PasswordReader {
+	return envPasswordReader{name}
+}
+
+func (r envPasswordReader) ReadPassword(prompt string) (string, error) {
+	passwd, ok := os.LookupEnv(r.name)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("%s is not set.", r.name))
+	}
+	return passwd, nil
+}
+
+type filePasswordReader struct {
+	file string
+}
+
+// FilePasswordReader reads the password from file, e.g., a secret
+// mounted into a container. A trailing newline is not part of the
+// password.
+func FilePasswordReader(file string) PasswordReader {
+	return filePasswordReader{file}
+}
+
+func (r filePasswordReader) ReadPassword(prompt string) (string, error) {
+	b, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return "", fmt.Errorf("Could not read the password file: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,103 @@
+package sgx_server
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Offsets of the quote fields that are not part of the enclave
+// report body. The rest are next to the session constants.
+const (
+	VERSION_IN_QUOTE   = 0
+	SIGN_TYPE_IN_QUOTE = 2
+	GID_IN_QUOTE       = 4
+	XEID_IN_QUOTE      = 12
+	BASENAME_IN_QUOTE  = 16
+	BASENAME_SIZE      = 32
+
+	// The signature length follows the report body, and the
+	// signature follows its length.
+	SIGNATURE_LEN_IN_QUOTE = NO_SIG_QUOTE_LEN
+	SIGNATURE_IN_QUOTE     = SIGNATURE_LEN_IN_QUOTE + 4
+)
+
+// Quote is an EPID quote (sgx_quote_t) of an enclave, as sent in
+// message 3. All the integers are little endian in the raw quote.
+type Quote struct {
+	Version  uint16
+	SignType uint16 // UNLINKABLE_QUOTE_INT or LINKABLE_QUOTE_INT
+	GID      uint32 // EPID group id
+	QESVN    uint16
+	PCESVN   uint16
+	XEID     uint32 // extended EPID group id
+	Basename [BASENAME_SIZE]byte
+
+	// The report body of the enclave. ISVExtProdID, ConfigID,
+	// ConfigSVN, and ISVFamilyID are only set by KSS enclaves.
+	CPUSVN       [CPUSVN_SIZE]byte
+	MiscSelect   uint32
+	ISVExtProdID [ISVEXTPRODID_SIZE]byte
+	Flags        uint64 // the first half of the attributes
+	XFRM         uint64 // the second half of the attributes
+	MREnclave    [MR_SIZE]byte
+	MRSigner     [MR_SIZE]byte
+	ConfigID     [CONFIGID_SIZE]byte
+	ISVProdID    uint16
+	ISVSVN       uint16
+	ConfigSVN    uint16
+	ISVFamilyID  [ISVFAMILYID_SIZE]byte
+	ReportData   [REPORT_DATA_SIZE]byte
+
+	// The EPID signature over the quote. It is empty if the quote
+	// was parsed without one, e.g., the quote body returned by
+	// IAS.
+	Signature []byte
+}
+
+// ParseQuote parses the raw quote b. b must either be exactly the
+// NO_SIG_QUOTE_LEN bytes of the header and the report body, or also
+// carry the signature length and the signature, and nothing after
+// them.
+func ParseQuote(b []byte) (*Quote, error) {
+	if len(b) < NO_SIG_QUOTE_LEN {
+		return nil, fmt.Errorf("%w Quote is %d bytes, shorter than the minimum %d.", ErrMalformedMessage, len(b), NO_SIG_QUOTE_LEN)
+	}
+
+	q := &Quote{
+		Version:    binary.LittleEndian.Uint16(b[VERSION_IN_QUOTE:]),
+		SignType:   binary.LittleEndian.Uint16(b[SIGN_TYPE_IN_QUOTE:]),
+		GID:        binary.LittleEndian.Uint32(b[GID_IN_QUOTE:]),
+		QESVN:      binary.LittleEndian.Uint16(b[QESVN_IN_QUOTE:]),
+		PCESVN:     binary.LittleEndian.Uint16(b[PCESVN_IN_QUOTE:]),
+		XEID:       binary.LittleEndian.Uint32(b[XEID_IN_QUOTE:]),
+		MiscSelect: binary.LittleEndian.Uint32(b[MISCSELECT_IN_QUOTE:]),
+		Flags:      binary.LittleEndian.Uint64(b[ATTRIBUTES_IN_QUOTE:]),
+		XFRM:       binary.LittleEndian.Uint64(b[ATTRIBUTES_IN_QUOTE+8:]),
+		ISVProdID:  binary.LittleEndian.Uint16(b[ISVPRODID_IN_QUOTE:]),
+		ISVSVN:     binary.LittleEndian.Uint16(b[ISVSVN_IN_QUOTE:]),
+		ConfigSVN:  binary.LittleEndian.Uint16(b[CONFIGSVN_IN_QUOTE:]),
+	}
+	if q.SignType != UNLINKABLE_QUOTE_INT && q.SignType != LINKABLE_QUOTE_INT {
+		return nil, fmt.Errorf("%w Unknown quote sign type %d.", ErrMalformedMessage, q.SignType)
+	}
+	copy(q.Basename[:], b[BASENAME_IN_QUOTE:])
+	copy(q.CPUSVN[:], b[CPUSVN_IN_QUOTE:])
+	copy(q.ISVExtProdID[:], b[ISVEXTPRODID_IN_QUOTE:])
+	copy(q.MREnclave[:], b[MRENCLAVE_IN_QUOTE:])
+	copy(q.MRSigner[:], b[MRSIGNER_IN_QUOTE:])
+	copy(q.ConfigID[:], b[CONFIGID_IN_QUOTE:])
+	copy(q.ISVFamilyID[:], b[ISVFAMILYID_IN_QUOTE:])
+	copy(q.ReportData[:], b[REPORT_DATA_IN_QUOTE:])
+
+	if len(b) == NO_SIG_QUOTE_LEN {
+		return q, nil
+	} else if len(b) < SIGNATURE_IN_QUOTE {
+		return nil, fmt.Errorf("%w Quote is missing the signature length.", ErrMalformedMessage)
+	}
+	sigLen := binary.LittleEndian.Uint32(b[SIGNATURE_LEN_IN_QUOTE:])
+	if uint64(len(b)-SIGNATURE_IN_QUOTE) != uint64(sigLen) {
+		return nil, fmt.Errorf("%w Quote signature is %d bytes, but the quote has %d bytes after its length.", ErrMalformedMessage, sigLen, len(b)-SIGNATURE_IN_QUOTE)
+	}
+	q.Signature = append([]byte(nil), b[SIGNATURE_IN_QUOTE:]...)
+	return q, nil
+}
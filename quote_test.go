@@ -0,0 +1,107 @@
+package sgx_server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// rawQuote lays out a quote with a distinct value in every field, at
+// the offsets of sgx_quote_t.
+func rawQuote(signature []byte) []byte {
+	b := make([]byte, SIGNATURE_IN_QUOTE+len(signature))
+	binary.LittleEndian.PutUint16(b[VERSION_IN_QUOTE:], 2)
+	binary.LittleEndian.PutUint16(b[SIGN_TYPE_IN_QUOTE:], LINKABLE_QUOTE_INT)
+	copy(b[GID_IN_QUOTE:], []byte{0x1e, 0x0b, 0x00, 0x00})
+	binary.LittleEndian.PutUint16(b[QESVN_IN_QUOTE:], 11)
+	binary.LittleEndian.PutUint16(b[PCESVN_IN_QUOTE:], 10)
+	binary.LittleEndian.PutUint32(b[XEID_IN_QUOTE:], 0)
+	copy(b[BASENAME_IN_QUOTE:], bytes.Repeat([]byte{0xba}, BASENAME_SIZE))
+	copy(b[CPUSVN_IN_QUOTE:], []byte{4, 4, 2, 4, 1, 0x80})
+	binary.LittleEndian.PutUint32(b[MISCSELECT_IN_QUOTE:], 0x1)
+	copy(b[ISVEXTPRODID_IN_QUOTE:], bytes.Repeat([]byte{0xe9}, ISVEXTPRODID_SIZE))
+	binary.LittleEndian.PutUint64(b[ATTRIBUTES_IN_QUOTE:], SGX_FLAGS_INITTED|SGX_FLAGS_MODE64BIT)
+	binary.LittleEndian.PutUint64(b[ATTRIBUTES_IN_QUOTE+8:], 0x7)
+	copy(b[MRENCLAVE_IN_QUOTE:], bytes.Repeat([]byte{0xe1}, MR_SIZE))
+	copy(b[MRSIGNER_IN_QUOTE:], bytes.Repeat([]byte{0x51}, MR_SIZE))
+	copy(b[CONFIGID_IN_QUOTE:], bytes.Repeat([]byte{0xc1}, CONFIGID_SIZE))
+	binary.LittleEndian.PutUint16(b[ISVPRODID_IN_QUOTE:], 3)
+	binary.LittleEndian.PutUint16(b[ISVSVN_IN_QUOTE:], 5)
+	binary.LittleEndian.PutUint16(b[CONFIGSVN_IN_QUOTE:], 6)
+	copy(b[ISVFAMILYID_IN_QUOTE:], bytes.Repeat([]byte{0xf1}, ISVFAMILYID_SIZE))
+	copy(b[REPORT_DATA_IN_QUOTE:], bytes.Repeat([]byte{0xda}, REPORT_DATA_SIZE))
+	binary.LittleEndian.PutUint32(b[SIGNATURE_LEN_IN_QUOTE:], uint32(len(signature)))
+	copy(b[SIGNATURE_IN_QUOTE:], signature)
+	return b
+}
+
+func TestParseQuote(t *testing.T) {
+	signature := bytes.Repeat([]byte{0x5e}, 680)
+	q, err := ParseQuote(rawQuote(signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected Quote
+	expected.Version = 2
+	expected.SignType = LINKABLE_QUOTE_INT
+	expected.GID = 0xb1e
+	expected.QESVN = 11
+	expected.PCESVN = 10
+	copy(expected.Basename[:], bytes.Repeat([]byte{0xba}, BASENAME_SIZE))
+	copy(expected.CPUSVN[:], []byte{4, 4, 2, 4, 1, 0x80})
+	expected.MiscSelect = 0x1
+	copy(expected.ISVExtProdID[:], bytes.Repeat([]byte{0xe9}, ISVEXTPRODID_SIZE))
+	expected.Flags = SGX_FLAGS_INITTED | SGX_FLAGS_MODE64BIT
+	expected.XFRM = 0x7
+	copy(expected.MREnclave[:], bytes.Repeat([]byte{0xe1}, MR_SIZE))
+	copy(expected.MRSigner[:], bytes.Repeat([]byte{0x51}, MR_SIZE))
+	copy(expected.ConfigID[:], bytes.Repeat([]byte{0xc1}, CONFIGID_SIZE))
+	expected.ISVProdID = 3
+	expected.ISVSVN = 5
+	expected.ConfigSVN = 6
+	copy(expected.ISVFamilyID[:], bytes.Repeat([]byte{0xf1}, ISVFAMILYID_SIZE))
+	copy(expected.ReportData[:], bytes.Repeat([]byte{0xda}, REPORT_DATA_SIZE))
+	expected.Signature = signature
+
+	if !reflect.DeepEqual(*q, expected) {
+		t.Fatalf("Incorrect quote:\n%+v\n%+v", *q, expected)
+	}
+
+	// The body alone, as returned by IAS, parses without a
+	// signature.
+	if q, err := ParseQuote(rawQuote(nil)[:NO_SIG_QUOTE_LEN]); err != nil {
+		t.Fatal(err)
+	} else if q.Signature != nil || q.ISVSVN != 5 {
+		t.Fatal("Incorrect quote body:", q)
+	}
+}
+
+func TestParseQuoteMalformed(t *testing.T) {
+	full := rawQuote(make([]byte, 8))
+	badSignType := rawQuote(nil)
+	binary.LittleEndian.PutUint16(badSignType[SIGN_TYPE_IN_QUOTE:], 2)
+	longSig := rawQuote(nil)
+	binary.LittleEndian.PutUint32(longSig[SIGNATURE_LEN_IN_QUOTE:], 8)
+
+	tests := []struct {
+		name  string
+		quote []byte
+	}{
+		{"empty", nil},
+		{"header only", full[:BASENAME_IN_QUOTE+BASENAME_SIZE]},
+		{"truncated body", full[:NO_SIG_QUOTE_LEN-1]},
+		{"truncated signature length", full[:NO_SIG_QUOTE_LEN+2]},
+		{"truncated signature", full[:len(full)-1]},
+		{"trailing bytes", append(full, 0)},
+		{"signature length past the end", longSig},
+		{"unknown sign type", badSignType},
+	}
+	for _, test := range tests {
+		if _, err := ParseQuote(test.quote); !errors.Is(err, ErrMalformedMessage) {
+			t.Errorf("%s: expected a malformed quote, got: %v", test.name, err)
+		}
+	}
+}
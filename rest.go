@@ -0,0 +1,197 @@
+package sgx_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/protobuf/jsonpb"
+	proto "github.com/golang/protobuf/proto"
+)
+
+// The paths of the REST API served by NewRESTHandler, relative to
+// where the handler is mounted, and the header clients use to send
+// their session id.
+const (
+	REST_PATH_START = "/start"
+	REST_PATH_MSG0  = "/msg0"
+	REST_PATH_MSG1  = "/msg1"
+	REST_PATH_MSG3  = "/msg3"
+
+	REST_SESSION_ID_HEADER = "Sgx-Session-Id"
+)
+
+// The largest request body NewRESTHandler accepts. It leaves room for
+// the base64 encoding of a message of MAX_CONN_MSG_SIZE bytes.
+const MAX_REST_BODY_SIZE = 2 * MAX_CONN_MSG_SIZE
+
+// MarshalMessageJSON encodes msg (e.g., a Challenge, Msg2, or Msg4)
+// for clients that speak JSON rather than protobuf, such as browsers.
+// It follows the proto3 JSON mapping: the fields are named in
+// lowerCamelCase (sessionId, cmacA, sigRlSize), bytes fields are
+// base64 encoded with padding, and fields with their zero value are
+// left out. For example, a Challenge is encoded as
+//
+//	{"sessionId": "4f1c...", "challenge": "q83v..."}
+//
+// and a Msg2 as
+//
+//	{"a": {"gb": {"x": "...", "y": "..."}, "spid": "...",
+//	       "quoteType": "AAA=", "kdfId": "AQA=",
+//	       "signature": {"r": "...", "s": "..."}},
+//	 "cmacA": "...", "sigRlSize": 0}
+func MarshalMessageJSON(msg proto.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalMessageJSON decodes the JSON encoding of msg (e.g., a Msg1
+// or Msg3) described in MarshalMessageJSON. The fields may also be
+// named as in sgx.proto (cmac_m, ps_security_prop). Unknown fields are
+// rejected. A message 3 is encoded as
+//
+//	{"cmacM": "...", "m": {"ga": {"x": "...", "y": "..."},
+//	                       "psSecurityProp": "...", "quote": "..."}}
+func UnmarshalMessageJSON(b []byte, msg proto.Message) error {
+	if err := jsonpb.Unmarshal(bytes.NewReader(b), msg); err != nil {
+		return fmt.Errorf("%w Could not parse the JSON message: %v", ErrMalformedMessage, err)
+	}
+	return nil
+}
+
+// NewRESTHandler serves the attestation handshake of sm over HTTP, for
+// clients that speak neither gRPC nor the length-prefixed protocol of
+// ServeConn. Every call is a POST whose body and response are the
+// JSON encodings of the messages, as described in MarshalMessageJSON:
+//
+//	REST_PATH_START  Request  -> Challenge
+//	REST_PATH_MSG0   Msg0     -> Msg0Response
+//	REST_PATH_MSG1   Msg1     -> Msg2
+//	REST_PATH_MSG3   Msg3     -> Msg4
+//
+// Except for REST_PATH_START, the client sends the session id of the
+// Challenge in the REST_SESSION_ID_HEADER header. Errors are returned
+// as {"error": "..."} with a 4xx or 5xx status, see restStatus. To
+// mount the handler under a prefix, use http.StripPrefix.
+func NewRESTHandler(sm SessionManager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(REST_PATH_START, func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		serveREST(w, r, &req, false, func(id string) (proto.Message, error) {
+			return sm.NewSession(&req)
+		})
+	})
+	mux.HandleFunc(REST_PATH_MSG0, func(w http.ResponseWriter, r *http.Request) {
+		var msg0 Msg0
+		serveREST(w, r, &msg0, true, func(id string) (proto.Message, error) {
+			return sm.ProcessMsg0(id, &msg0)
+		})
+	})
+	mux.HandleFunc(REST_PATH_MSG1, func(w http.ResponseWriter, r *http.Request) {
+		var msg1 Msg1
+		serveREST(w, r, &msg1, true, func(id string) (proto.Message, error) {
+			return sm.Msg1ToMsg2(id, &msg1)
+		})
+	})
+	mux.HandleFunc(REST_PATH_MSG3, func(w http.ResponseWriter, r *http.Request) {
+		var msg3 Msg3
+		serveREST(w, r, &msg3, true, func(id string) (proto.Message, error) {
+			return sm.Msg3ToMsg4(id, &msg3)
+		})
+	})
+	return mux
+}
+
+// serveREST parses the body of r into in, and calls handle with the
+// session id of the request, if needID is set. The result of handle
+// is written to w.
+func serveREST(w http.ResponseWriter, r *http.Request, in proto.Message, needID bool, handle func(id string) (proto.Message, error)) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeRESTError(w, http.StatusMethodNotAllowed, errors.New("Only POST is allowed."))
+		return
+	}
+
+	id := r.Header.Get(REST_SESSION_ID_HEADER)
+	if needID && id == "" {
+		writeRESTError(w, http.StatusBadRequest, ErrNoSessionID)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_REST_BODY_SIZE))
+	if err != nil {
+		writeRESTError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	// An empty body is the empty message, e.g., a Request without
+	// a client id.
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := UnmarshalMessageJSON(body, in); err != nil {
+			writeRESTError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	out, err := handle(id)
+	if err != nil {
+		writeRESTError(w, restStatus(err), err)
+		return
+	}
+	b, err := MarshalMessageJSON(out)
+	if err != nil {
+		writeRESTError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// restStatus picks the HTTP status for an error of the session
+// manager: 400 for malformed or unexpected messages, 403 if the
+// enclave or its platform is not trusted, 404 if the session is gone
+// (the client has to start over), 503 if the server is overloaded
+// (the client may retry later), and 500 otherwise.
+func restStatus(err error) int {
+	for _, status := range []struct {
+		code int
+		errs []error
+	}{
+		{http.StatusBadRequest, []error{
+			ErrNoSessionID, ErrInvalidSessionID, ErrMalformedMessage,
+			ErrInvalidClientKey, ErrUnsupportedExtendedGID,
+			ErrUnknownKeyHash, ErrInvalidMsg3, ErrMsg1Mismatch,
+			ErrMsg3AlreadyProcessed, ErrReplayedNonce, ErrSignTypeMismatch,
+			ErrMsg2NotCreated,
+		}},
+		{http.StatusForbidden, []error{
+			ErrEnclaveNotAllowed, ErrQuoteRejected, ErrTCBTooLow,
+		}},
+		{http.StatusNotFound, []error{
+			ErrSessionNotFound, ErrSessionExpired, ErrSessionInvalidated,
+			ErrSessionCanceled, ErrSessionRevoked, ErrSessionReplaced,
+			ErrSessionDegraded, ErrSessionManagerFull,
+		}},
+		{http.StatusServiceUnavailable, []error{
+			ErrBusy, ErrIASBusy, ErrIASQuotaExceeded,
+		}},
+	} {
+		for _, e := range status.errs {
+			if errors.Is(err, e) {
+				return status.code
+			}
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+func writeRESTError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,176 @@
+package sgx_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+func TestMessageJSONRoundTrip(t *testing.T) {
+	key := &PublicKey{X: bytes.Repeat([]byte{1}, EC_COORD_SIZE), Y: bytes.Repeat([]byte{2}, EC_COORD_SIZE)}
+	messages := []proto.Message{
+		&Challenge{SessionId: "1234", Challenge: []byte{0xab, 0xcd, 0xef}},
+		&Msg1{Msg0: &Msg0{Exgid: 0}, Ga: key, Gid: []byte{0x1e, 0x0b, 0, 0}},
+		&Msg2{
+			A: &A{
+				Gb:        key,
+				Spid:      make([]byte, 16),
+				QuoteType: UNLINKABLE_QUOTE,
+				KdfId:     KDF_ID,
+				Signature: &Signature{R: []byte{3}, S: []byte{4}},
+			},
+			CmacA:     bytes.Repeat([]byte{5}, 16),
+			SigRlSize: 2,
+			SigRl:     []byte{6, 7},
+		},
+		&Msg3{CmacM: bytes.Repeat([]byte{8}, 16), M: &M{Ga: key, PsSecurityProp: []byte{9}, Quote: newTestQuote()}},
+		&Msg4{
+			Result:  &AttestationResult{EnclaveTrusted: true, Advisories: []string{"INTEL-SA-00161"}},
+			Secret:  []byte{10},
+			Cmac:    []byte{11},
+			Payload: []byte{12},
+		},
+	}
+	for _, msg := range messages {
+		b, err := MarshalMessageJSON(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed := proto.Clone(msg)
+		parsed.Reset()
+		if err := UnmarshalMessageJSON(b, parsed); err != nil {
+			t.Fatal(err)
+		} else if !proto.Equal(parsed, msg) {
+			t.Fatalf("Message did not survive the round trip through %s:\n%v\n%v", b, parsed, msg)
+		}
+	}
+
+	// Bytes fields are base64 encoded.
+	b, _ := MarshalMessageJSON(messages[0])
+	var challenge map[string]string
+	if err := json.Unmarshal(b, &challenge); err != nil {
+		t.Fatal(err)
+	} else if challenge["sessionId"] != "1234" || challenge["challenge"] != "q83v" {
+		t.Fatal("Incorrect JSON encoding of the challenge:", string(b))
+	}
+
+	// The names in sgx.proto are accepted, unknown fields are not.
+	var msg3 Msg3
+	if err := UnmarshalMessageJSON([]byte(`{"cmac_m": "CAg=", "m": {"ps_security_prop": "CQ=="}}`), &msg3); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(msg3.CmacM, []byte{8, 8}) || !bytes.Equal(msg3.M.PsSecurityProp, []byte{9}) {
+		t.Fatal("Incorrect message 3:", msg3)
+	}
+	if err := UnmarshalMessageJSON([]byte(`{"cmacM": "CAg=", "mac": "CAg="}`), &msg3); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatal("Unknown fields should be rejected, got:", err)
+	}
+}
+
+// postJSON posts msg to path of srv as JSON with the session id, and
+// parses the response into out. Returns the HTTP status.
+func postJSON(t *testing.T, srv *httptest.Server, path, id string, msg, out proto.Message) int {
+	b, err := MarshalMessageJSON(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "" {
+		req.Header.Set(REST_SESSION_ID_HEADER, id)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		if err := UnmarshalMessageJSON(body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+	} else if !strings.Contains(body.String(), `"error"`) {
+		t.Fatal("Error response without an error:", body.String())
+	}
+	return resp.StatusCode
+}
+
+func TestRESTHandler(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	srv := httptest.NewServer(NewRESTHandler(sm))
+	defer srv.Close()
+
+	var challenge Challenge
+	if status := postJSON(t, srv, REST_PATH_START, "", &Request{}, &challenge); status != http.StatusOK {
+		t.Fatal("Could not start a session:", status)
+	}
+	id := challenge.SessionId
+
+	priv, msg1 := newTestMsg1()
+	var msg2 Msg2
+	if status := postJSON(t, srv, REST_PATH_MSG1, "", msg1, &msg2); status != http.StatusBadRequest {
+		t.Fatal("Message 1 without a session id should be rejected, got", status)
+	}
+	if status := postJSON(t, srv, REST_PATH_MSG1, id, msg1, &msg2); status != http.StatusOK {
+		t.Fatal("Message 1 failed:", status)
+	}
+
+	var msg4 Msg4
+	if status := postJSON(t, srv, REST_PATH_MSG3, id, newTestMsg3(priv, msg1, &msg2, newTestQuote()), &msg4); status != http.StatusOK {
+		t.Fatal("Message 3 failed:", status)
+	} else if !msg4.Result.EnclaveTrusted {
+		t.Fatal("Enclave should be trusted.")
+	}
+	if sn, ok := sm.GetSession(id); !ok || !sn.Authenticated() {
+		t.Fatal("Session should be authenticated after the handshake.")
+	}
+
+	if status := postJSON(t, srv, REST_PATH_MSG1, "missing", msg1, &msg2); status != http.StatusNotFound {
+		t.Fatal("Unknown sessions should not be found, got", status)
+	}
+	resp, err := srv.Client().Get(srv.URL + REST_PATH_START)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("Only POST should be allowed, got", resp.StatusCode)
+	}
+}
+
+func TestRESTMsg3BeforeMsg2(t *testing.T) {
+	ias := &fakeIAS{}
+	sm := newSessionManager(*authConfiguration(), ias)
+	srv := httptest.NewServer(NewRESTHandler(sm))
+	defer srv.Close()
+
+	var challenge Challenge
+	if status := postJSON(t, srv, REST_PATH_START, "", &Request{}, &challenge); status != http.StatusOK {
+		t.Fatal("Could not start a session:", status)
+	}
+
+	// A message 3 straight after the start is refused, rather than
+	// checked against keys that do not exist yet.
+	priv, msg1 := newTestMsg1()
+	msg3 := newTestMsg3(priv, msg1, &Msg2{A: &A{Gb: msg1.Ga}}, newTestQuote())
+	var msg4 Msg4
+	if status := postJSON(t, srv, REST_PATH_MSG3, challenge.SessionId, msg3, &msg4); status != http.StatusBadRequest {
+		t.Fatal("Message 3 before message 2 should be a bad request, got", status)
+	} else if ias.verifyCalls != 0 {
+		t.Fatal("Message 3 before message 2 should not reach IAS.")
+	}
+
+	// The server is still up.
+	if status := postJSON(t, srv, REST_PATH_START, "", &Request{}, &challenge); status != http.StatusOK {
+		t.Fatal("Could not start a session:", status)
+	}
+}
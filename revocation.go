@@ -0,0 +1,47 @@
+package sgx_server
+
+import "sync"
+
+// RevocationStore is a set of revoked session ids shared by the
+// SessionManagers of several replicas, so that a session revoked on
+// one replica is dropped by all of them. A SessionManager consults it
+// every time one of its sessions is used, so a Redis (or similar)
+// backend can either query a shared set directly, or keep a local set
+// up to date from a pub/sub channel. Session ids are random and never
+// reused, so an implementation may forget a revocation once the
+// session would have expired anyway.
+type RevocationStore interface {
+	// Revoke adds id to the revoked sessions. It returns once the
+	// revocation is visible to Revoked on every replica.
+	Revoke(id string) error
+
+	// Revoked reports whether id was revoked.
+	Revoked(id string) (bool, error)
+}
+
+type memoryRevocationStore struct {
+	mu      sync.Mutex
+	revoked map[string]bool
+}
+
+// NewMemoryRevocationStore creates a RevocationStore that keeps the
+// revoked ids in memory. It can only be shared by SessionManagers in
+// the same process, and is mostly useful in tests.
+func NewMemoryRevocationStore() RevocationStore {
+	return &memoryRevocationStore{
+		revoked: make(map[string]bool),
+	}
+}
+
+func (s *memoryRevocationStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[id] = true
+	return nil
+}
+
+func (s *memoryRevocationStore) Revoked(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revoked[id], nil
+}
@@ -0,0 +1,118 @@
+package sgx_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// The gRPC metadata key clients use to send their session id.
+const SESSION_ID_KEY = "id"
+
+type attestationServer struct {
+	sm SessionManager
+}
+
+// NewAttestationServer wraps sm so that it can be registered with a
+// gRPC server using RegisterAttestationServer. The returned server
+// reads the session id from the SESSION_ID_KEY metadata of the calls
+// that need one. Since it only depends on the SessionManager
+// interface, a MockSessionManager can be used in its place in tests.
+func NewAttestationServer(sm SessionManager) AttestationServer {
+	return &attestationServer{sm: sm}
+}
+
+// sessionID extracts the session id from the metadata of ctx.
+func sessionID(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", ErrNoSessionID
+	}
+
+	ids, ok := md[SESSION_ID_KEY]
+	if !ok || len(ids) == 0 {
+		return "", ErrNoSessionID
+	}
+	return ids[0], nil
+}
+
+func (s *attestationServer) StartAttestation(ctx context.Context, in *Request) (*Challenge, error) {
+	return s.sm.NewSession(in)
+}
+
+func (s *attestationServer) SendMsg0(ctx context.Context, in *Msg0) (*Msg0Response, error) {
+	id, err := sessionID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.sm.ProcessMsg0(id, in)
+}
+
+func (s *attestationServer) SendMsg1(ctx context.Context, in *Msg1) (*Msg2, error) {
+	id, err := sessionID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.sm.Msg1ToMsg2(id, in)
+}
+
+func (s *attestationServer) SendMsg3(ctx context.Context, in *Msg3) (*Msg4, error) {
+	id, err := sessionID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.sm.Msg3ToMsg4(id, in)
+}
+
+// CallerAddress returns the normalized IP address of the client that
+// made the gRPC call in ctx. IPv4-mapped IPv6 addresses are returned
+// in IPv4 form, and IPv6 addresses in their canonical form, so the
+// same client always maps to the same string.
+//
+// If trustedHeader is not empty (e.g., "x-forwarded-for") and the
+// call carries that metadata, the address is taken from the last
+// entry of the header, which is the one added by the proxy in front
+// of this server. Only set trustedHeader if there is such a proxy,
+// since clients can send the header themselves. Otherwise, the
+// address of the peer connection is used.
+func CallerAddress(ctx context.Context, trustedHeader string) (string, error) {
+	if trustedHeader != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(trustedHeader); len(values) > 0 {
+			entries := strings.Split(values[len(values)-1], ",")
+			return normalizeAddress(entries[len(entries)-1])
+		}
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "", errors.New("No peer information for the call.")
+	}
+	if tcp, ok := p.Addr.(*net.TCPAddr); ok {
+		return normalizeAddress(tcp.IP.String())
+	}
+	return normalizeAddress(p.Addr.String())
+}
+
+// normalizeAddress parses an IP address which may come with a port
+// or an IPv6 zone, and returns it in canonical form.
+func normalizeAddress(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", errors.New("Invalid caller address [" + addr + "].")
+	}
+	return ip.String(), nil
+}
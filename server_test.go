@@ -0,0 +1,78 @@
+package sgx_server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+var _ SessionManager = &MockSessionManager{}
+
+func TestAttestationServerSessionID(t *testing.T) {
+	var got string
+	sm := &MockSessionManager{
+		Msg1ToMsg2Func: func(id string, msg1 *Msg1) (*Msg2, error) {
+			got = id
+			return &Msg2{}, nil
+		},
+	}
+	srv := NewAttestationServer(sm)
+
+	if _, err := srv.SendMsg1(context.Background(), &Msg1{}); err == nil {
+		t.Fatal("Message 1 without a session id should fail.")
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(SESSION_ID_KEY, "1234"))
+	if _, err := srv.SendMsg1(ctx, &Msg1{}); err != nil {
+		t.Fatal(err)
+	} else if got != "1234" {
+		t.Fatal("Incorrect session id passed to the session manager:", got)
+	}
+
+	if _, err := srv.SendMsg3(ctx, &Msg3{}); err != nil {
+		t.Fatal("The mock should accept message 3 by default:", err)
+	}
+}
+
+func TestCallerAddress(t *testing.T) {
+	withPeer := func(ip string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{
+			Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234},
+		})
+	}
+	forwarded := func(ctx context.Context, value string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs("x-forwarded-for", value))
+	}
+
+	tests := []struct {
+		ctx      context.Context
+		header   string
+		expected string
+	}{
+		{withPeer("10.0.0.1"), "", "10.0.0.1"},
+		{withPeer("::ffff:10.0.0.1"), "", "10.0.0.1"},
+		{withPeer("2001:0db8:0000:0000:0000:0000:0000:0001"), "", "2001:db8::1"},
+		{forwarded(withPeer("10.0.0.1"), "1.1.1.1"), "", "10.0.0.1"},
+		{forwarded(withPeer("10.0.0.1"), "1.1.1.1, 192.168.1.1"), "x-forwarded-for", "192.168.1.1"},
+		{forwarded(withPeer("10.0.0.1"), "[2001:db8:0::1]:443"), "x-forwarded-for", "2001:db8::1"},
+		{withPeer("10.0.0.1"), "x-forwarded-for", "10.0.0.1"},
+	}
+	for i, test := range tests {
+		addr, err := CallerAddress(test.ctx, test.header)
+		if err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		} else if addr != test.expected {
+			t.Errorf("Test %d: expected %s, got %s.", i, test.expected, addr)
+		}
+	}
+
+	if _, err := CallerAddress(context.Background(), ""); err == nil {
+		t.Error("A call without peer information should fail.")
+	}
+	if _, err := CallerAddress(forwarded(context.Background(), "garbage"), "x-forwarded-for"); err == nil {
+		t.Error("An invalid forwarded address should fail.")
+	}
+}
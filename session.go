@@ -2,15 +2,19 @@ package sgx_server
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aead/cmac"
@@ -39,6 +43,17 @@ const (
 	KDF_ID_INT           = 1
 	EC_COORD_SIZE        = 32
 	EPID_GID_SIZE        = 4
+	MAC_SIZE             = 16
+
+	// The PSE security property descriptor in message 3, if the
+	// enclave uses the platform services.
+	PS_SECURITY_PROP_SIZE = 256
+
+	// Security version numbers of the quoting and provisioning
+	// certification enclaves.
+	QESVN_IN_QUOTE  = 8
+	PCESVN_IN_QUOTE = 10
+	SVN_SIZE        = 2
 
 	// CPU security version number.
 	CPUSVN_IN_QUOTE = 48
@@ -64,12 +79,38 @@ const (
 	ISVSVN_IN_QUOTE = 306
 	ISVSVN_SIZE     = 2
 
+	// Key Separation and Sharing (KSS) identity of the enclave.
+	// These are all 0 if the enclave does not use KSS.
+	ISVEXTPRODID_IN_QUOTE = 80
+	ISVEXTPRODID_SIZE     = 16
+	CONFIGID_IN_QUOTE     = 240
+	CONFIGID_SIZE         = 64
+	CONFIGSVN_IN_QUOTE    = 308
+	ISVFAMILYID_IN_QUOTE  = 352
+	ISVFAMILYID_SIZE      = 16
+
 	// Enclave attributes start at 96, and is 16 bytes.
 	ATTRIBUTES_IN_QUOTE = 96
 	ATTRIBUTES_SIZE     = 16
 
 	// Hash report starts at byte 368 in the quote
 	HASH_REPORT_IN_QUOTE = 368
+
+	// Report data also starts at byte 368, and is 64 bytes. The
+	// first 32 bytes hold the hash report.
+	REPORT_DATA_IN_QUOTE = 368
+	REPORT_DATA_SIZE     = 64
+)
+
+// Measurements are SHA-256 hashes, so this does not compile unless
+// MR_SIZE is sha256.Size.
+var _ = [1]struct{}{}[MR_SIZE-sha256.Size]
+
+// Directions appended to the session id to form the additional
+// authenticated data used by Seal and Open.
+const (
+	AAD_SERVER_TO_CLIENT = 0x01
+	AAD_CLIENT_TO_SERVER = 0x02
 )
 
 // Magic constants for deriving cryptographic keys for SGX sessions.
@@ -93,7 +134,7 @@ const (
 	// If set, then the enclave has access to EINITTOKEN key
 	SGX_FLAGS_EINITTOKEN_KEY = 0x0000000000000020
 	// If set enclave uses KSS
-	SGX_FLAGS_KSS = 0x000000000000008
+	SGX_FLAGS_KSS = 0x0000000000000080
 )
 
 // Session represents a logical connection between an SGX client and
@@ -104,21 +145,59 @@ type Session interface {
 	// the default SessionManager provided in this module.
 	Id() string
 
+	// Challenge returns a copy of the random challenge sent to the
+	// client with the id, e.g., to correlate the logs of a client
+	// that answers with a stale or wrong challenge.
+	Challenge() []byte
+
+	// ProcessMsg0 processes the SGX message 0 for clients that
+	// send it on its own, as the Intel SDK sample does. It must
+	// come before message 1, which may then leave message 0 out.
+	ProcessMsg0(msg0 *Msg0) error
+
 	// ProcessMsg1 processes the SGX message 1 (which actually
 	// contains SGX message 0 as well), and updates the internal
-	// states of the session.
+	// states of the session. An exact retransmission of the
+	// message 1 already processed leaves the session unchanged,
+	// and any other message 1 fails with ErrMsg1Mismatch. If the
+	// session manager requires client nonces, a message 1 whose
+	// nonce was seen recently fails with ErrReplayedNonce.
 	ProcessMsg1(msg1 *Msg1) error
 
 	// CreateMsg2 returns the message 2 after processing
-	// message 1.
+	// message 1. Once created, the same message 2 is returned
+	// again, e.g., for a retransmitted message 1. Returns
+	// ErrMsg1NotProcessed before message 1.
 	CreateMsg2() (*Msg2, error)
 
 	// ProcessMsg3 receives the SGX message 3 (which contains
 	// things like the enclave quote), and verifies the validity
-	// of the message with the Intel Attestation Service.
+	// of the message with the Intel Attestation Service. Once
+	// the session is authenticated, an exact retransmission of
+	// the same message 3 is accepted without contacting IAS
+	// again, and any other message 3 fails with
+	// ErrMsg3AlreadyProcessed. Returns ErrMsg2NotCreated before
+	// message 2.
 	ProcessMsg3(msg3 *Msg3) error
 
+	// ProbeMsg3 runs the checks of ProcessMsg3 on msg3, including
+	// the verification of the quote by IAS, without changing the
+	// session, e.g., to replay a captured handshake for
+	// diagnostics. The session keeps its state, whether or not
+	// the probe succeeds, and msg3 may be the message 3 that
+	// authenticated it. The result is what message 4 would carry;
+	// it is also returned with the error if IAS answered but a
+	// later check failed. A probe is not free: like a message 3,
+	// its IAS call counts against MaxIASCallsPerDay, and a quote
+	// IAS accepts is cached for AllowCachedOnIASOutage. Returns
+	// ErrMsg2NotCreated before message 2, and the error of Expired
+	// once the session expired, without calling IAS.
+	ProbeMsg3(msg3 *Msg3) (*AttestationResult, error)
+
 	// CreateMsg4 returns the last message in SGX attestation.
+	// Once created for an authenticated session, the same
+	// message 4 is returned again, e.g., for a retransmitted
+	// message 3.
 	CreateMsg4() (*Msg4, error)
 
 	// Authenticated returns if the session has been
@@ -129,42 +208,130 @@ type Session interface {
 	// SGX client. It uses AES GCM to encrypt the message with
 	// a random nonce, and it prepends the nonce the resulting
 	// ciphertext. The key used is SK derived during the
-	// attestation process. This function MUST be called AFTER
-	// ProcessMsg3 returns no error.
+	// attestation process. The additional authenticated data is
+	// the session id (as sent in the Challenge) followed by the
+	// byte AAD_SERVER_TO_CLIENT, so a ciphertext cannot be
+	// opened in any other session or replayed back to the
+	// server. This function MUST be called AFTER ProcessMsg3
+	// returns no error.
 	Seal(msg []byte) ([]byte, error)
 
 	// Open decrypts and verifies the integrity of a ciphertext
 	// generated using Seal. In practice, the ciphertext will
 	// be generated by the client which implements the same
-	// Seal and Open protocol.
+	// Seal and Open protocol, using the session id followed by
+	// the byte AAD_CLIENT_TO_SERVER as the additional
+	// authenticated data.
 	Open(ciphertext []byte) ([]byte, error)
 
 	// MAC generates a message authentication code using MK
 	// derived during the attestation process. It uses CMAC
 	// based on AES to genearate the MAC, which is the standard
-	// for SGX.
+	// for SGX. Returns nil if the session is not authenticated.
 	MAC(msg []byte) []byte
 
+	// ExportKey returns a copy of the session key derived using
+	// label, which must be one of SK_LABEL, MK_LABEL, or
+	// VK_LABEL. The keys are only available after the session
+	// has been authenticated. VK is the key the enclave uses to
+	// bind its report data to the handshake (the report data is
+	// SHA-256(GA || GB || VK)), so it is mostly useful for
+	// custom verification flows.
+	ExportKey(label []byte) ([]byte, error)
+
+	// RemoteReportData returns the 64 byte report data from the
+	// verified enclave quote. The first 32 bytes are always
+	// SHA-256(GA || GB || VK), which binds the quote to this
+	// session. The last 32 bytes are chosen by the enclave, and
+	// typically carry something like a hash of an application
+	// level public key the enclave wants the server to trust.
+	// Returns an error if the session is not authenticated.
+	RemoteReportData() ([REPORT_DATA_SIZE]byte, error)
+
+	// EphemeralPublicBytes returns the coordinates of the
+	// ephemeral public key of the server (GB), exactly as they
+	// are sent in message 2: 32 bytes each, little endian. This
+	// is meant for debugging interoperability with a client.
+	// Returns ErrMsg2NotCreated before message 2.
+	EphemeralPublicBytes() (gx, gy []byte, err error)
+
+	// Peer returns the identity of the verified enclave, e.g., to
+	// pin specific enclaves per client with
+	// EnclaveIdentity.Equal or MatchesPolicy. Returns
+	// ErrNotAuthenticated if the session is not authenticated.
+	Peer() (*EnclaveIdentity, error)
+
+	// PeerGID returns the EPID group id the client sent in
+	// message 1, e.g., for per-group policies. Returns
+	// ErrMsg1NotProcessed before message 1.
+	PeerGID() (uint32, error)
+
+	// Usage returns how many messages and bytes of plaintext
+	// went through Seal and Open in this session.
+	Usage() Usage
+
 	// Expires returns an error if the sesion is expired already.
 	Expired() error
+
+	// SetTimeout makes the session expire after it is not used
+	// for d, instead of the Timeout of the session manager, e.g.,
+	// to give a high-value client a shorter timeout, or a batch
+	// client a longer one. d must be positive and at most
+	// MaxSessionTimeout (or Timeout, if MaxSessionTimeout is 0),
+	// or ErrInvalidTimeout is returned.
+	SetTimeout(d time.Duration) error
+
+	// IssueToken returns a compact JWS (a JWT) signed by signer,
+	// which says that this session is with Peer, and when IAS
+	// last verified it. Other services can check it with
+	// VerifyToken and the public key of signer, without attesting
+	// the client themselves. The token expires after ttl, however
+	// long the session lasts. Returns ErrNotAuthenticated if the
+	// session is not authenticated.
+	IssueToken(signer crypto.Signer, ttl time.Duration) (string, error)
+}
+
+// Usage counts the traffic of a session. Sent messages are the ones
+// sealed for the client, and received messages are the ones from the
+// client that opened successfully.
+type Usage struct {
+	MessagesSent     uint64
+	MessagesReceived uint64
+	BytesSent        uint64
+	BytesReceived    uint64
 }
 
 type session struct {
-	id      string
-	timeout int
-
-	release     bool
-	ias         IAS
-	mrenclaves  [][MR_SIZE]byte
-	mrsigners   [][MR_SIZE]byte
-	prodID      uint16
-	prodSVN     uint16
-	spid        []byte
-	longTermKey *ecdsa.PrivateKey
-	exgid       uint32
-	gid         []byte
-	ga          *PublicKey
-	gb          *PublicKey
+	*configuration
+	id string
+	// The random challenge sent to the client with the id.
+	challenge []byte
+	// The client nonces recently seen by the session manager, if
+	// it requires them.
+	clientNonces *nonceCache
+
+	ias   IAS
+	exgid uint32
+	gid   []byte
+	ga    *PublicKey
+	gb    *PublicKey
+	// Whether message 0 was sent on its own.
+	msg0Done bool
+
+	// The message 1 the session processed, and the message 2 it
+	// created, so that a retransmitted message 1 gets the same
+	// message 2 instead of changing the session.
+	msg1 *Msg1
+	msg2 *Msg2
+
+	// Likewise, the message 3 that authenticated the session,
+	// and the message 4 sent for it.
+	msg3 *Msg3
+	msg4 *Msg4
+
+	// The long-term key the client expects message 2 to be
+	// signed with.
+	signingKey *ecdsa.PrivateKey
 
 	// Various session keys.
 	ephKey *ecdsa.PrivateKey
@@ -174,9 +341,17 @@ type session struct {
 	sk     []byte
 	mk     []byte
 
+	// Whether IAS was asked to verify the quote, and how long it
+	// took.
+	iasCalled  bool
+	iasLatency time.Duration
+
 	pseTrusted    bool
 	pib           []byte
 	advisories    []string
+	reportData    [REPORT_DATA_SIZE]byte
+	peer          *EnclaveIdentity
+	isvSVN        uint16
 	authenticated bool
 
 	aes cipher.AEAD
@@ -186,7 +361,38 @@ type session struct {
 	// an error.
 	sealCount int
 
+	// usage is updated atomically, so it is allocated separately
+	// to keep its counters 64-bit aligned.
+	usage *Usage
+
+	// now returns the current time, and is replaced by the
+	// session manager's clock.
+	now      func() time.Time
+	created  time.Time
 	lastUsed time.Time
+
+	// When the messages of the handshake were received or sent,
+	// see HandshakeTiming.
+	msg1At, msg2At, msg3At, msg4At time.Time
+
+	// If timeoutOverride is not 0, it replaces the timeout of
+	// the configuration. See SetTimeout.
+	timeoutOverride time.Duration
+
+	// When IAS last accepted the quote of the authenticated
+	// session. See ReverifyInterval.
+	verifiedAt time.Time
+
+	// verifyMu guards what the session manager reads from other
+	// goroutines, e.g., to verify the session again: authenticated,
+	// msg3, peer, and verifiedAt. The session only sets them with
+	// verifyMu held, so the goroutine handling the handshake may
+	// read them without it.
+	verifyMu sync.Mutex
+
+	// The context the session was created with. The session
+	// expires once it is done.
+	ctx context.Context
 }
 
 // NewSession creates a new session with id. If a session is not used
@@ -195,28 +401,42 @@ type session struct {
 // MREnclaves, the SPID for this server, and the private key whose
 // public key is baked into the enclave.
 func NewSession(id string, release bool, timeout int, ias IAS, mrenclaves, mrsigners [][MR_SIZE]byte, spid []byte, longTermKey *ecdsa.PrivateKey, prodID, prodSVN uint16) Session {
-	s := &session{
-		id:      id,
-		timeout: timeout,
-
-		ias:         ias,
+	conf := &configuration{
+		release:     release,
 		mrenclaves:  mrenclaves,
 		mrsigners:   mrsigners,
-		prodID:      prodID,
-		prodSVN:     prodSVN,
-		release:     release,
 		spid:        spid,
 		longTermKey: longTermKey,
+		prodID:      prodID,
+		prodSVN:     prodSVN,
+		timeout:     timeout,
+		useSigRL:    true,
+	}
+	return newSession(id, conf, ias)
+}
+
+func newSession(id string, conf *configuration, ias IAS) *session {
+	s := &session{
+		configuration: conf,
+		id:            id,
+
+		ias: ias,
 
 		pseTrusted:    false,
 		authenticated: false,
 
-		ephKey: generateKey(),
-
 		sealCount: 0,
+		usage:     &Usage{},
 
+		now:      time.Now,
+		created:  time.Now(),
 		lastUsed: time.Now(),
 	}
+	if conf.rand != nil {
+		s.ephKey = generateKeyFrom(conf.rand)
+	} else {
+		s.ephKey = generateKey()
+	}
 	return s
 }
 
@@ -224,24 +444,83 @@ func (sn *session) Id() string {
 	return sn.id
 }
 
+func (sn *session) Challenge() []byte {
+	return append([]byte(nil), sn.challenge...)
+}
+
+func (sn *session) ProcessMsg0(msg0 *Msg0) error {
+	if err := sn.Expired(); err != nil {
+		return err
+	} else if sn.ga != nil {
+		return errors.New("Message 0 must come before message 1.")
+	} else if msg0 == nil {
+		return fmt.Errorf("%w Message 0 is missing.", ErrMalformedMessage)
+	} else if msg0.Exgid != 0 {
+		return ErrUnsupportedExtendedGID
+	}
+
+	sn.exgid = msg0.Exgid
+	sn.msg0Done = true
+	sn.trace("msg0: exgid %d.", sn.exgid)
+
+	sn.lastUsed = sn.now()
+	return nil
+}
+
 func (sn *session) ProcessMsg1(msg1 *Msg1) error {
+	received := sn.now()
 	if err := sn.Expired(); err != nil {
 		return err
-	} else if !checkMsg1Format(msg1) {
-		return errors.New("Malformed message 1")
+	} else if sn.msg1 != nil {
+		if !proto.Equal(msg1, sn.msg1) {
+			return ErrMsg1Mismatch
+		}
+		sn.trace("msg1: retransmission.")
+		sn.lastUsed = sn.now()
+		return nil
+	} else if err := validateClientKey(msg1.Ga); err != nil {
+		return err
+	} else if !checkMsg1Format(msg1) || (msg1.Msg0 == nil && !sn.msg0Done) {
+		return fmt.Errorf("%w Message 1 has missing or incorrectly sized fields.", ErrMalformedMessage)
+	} else if sn.msg0Done && msg1.Msg0 != nil && msg1.Msg0.Exgid != sn.exgid {
+		return fmt.Errorf("%w Message 1 has a different extended GID than message 0.", ErrMalformedMessage)
+	}
+
+	signingKey, err := sn.selectLongTermKey(msg1.SpKeyHash)
+	if err != nil {
+		return err
+	}
+	if err := sn.useClientNonce(msg1.ClientNonce); err != nil {
+		return err
 	}
+	sn.signingKey = signingKey
 
-	sn.exgid = msg1.Msg0.Exgid
+	if msg1.Msg0 != nil {
+		sn.exgid = msg1.Msg0.Exgid
+	}
 	sn.ga = msg1.Ga
-	sn.gid = msg1.Gid
+	// Copied, since msg1 belongs to the caller.
+	sn.gid = append([]byte(nil), msg1.Gid...)
+	sn.msg1 = proto.Clone(msg1).(*Msg1)
+	sn.trace("msg1: exgid %d, gid %s.", sn.exgid, identifier(hex.EncodeToString(sn.gid)))
 
-	sn.lastUsed = time.Now()
+	sn.msg1At = received
+	sn.lastUsed = sn.now()
 	return nil
 }
 
 func (sn *session) CreateMsg2() (*Msg2, error) {
 	if err := sn.Expired(); err != nil {
 		return nil, err
+	} else if sn.msg2 != nil {
+		// Message 1 was retransmitted, so send the same message
+		// 2 again rather than a new key.
+		sn.lastUsed = sn.now()
+		return sn.msg2, nil
+	} else if sn.ga == nil || sn.signingKey == nil {
+		// Without the key of the client, there is nothing to
+		// exchange keys with.
+		return nil, ErrMsg1NotProcessed
 	}
 
 	gbx, gby, err := marshalPublicKey(&sn.ephKey.PublicKey)
@@ -258,7 +537,7 @@ func (sn *session) CreateMsg2() (*Msg2, error) {
 	keyMsg = append(keyMsg, sn.ga.Y...)
 
 	sum := sha256.Sum256(keyMsg)
-	r, s, err := ecdsa.Sign(rand.Reader, sn.longTermKey, sum[:])
+	r, s, err := ecdsa.Sign(rand.Reader, sn.signingKey, sum[:])
 	if err != nil {
 		return nil, err
 	}
@@ -273,29 +552,46 @@ func (sn *session) CreateMsg2() (*Msg2, error) {
 		return nil, err
 	}
 
-	sn.kdk, sn.smk = deriveLabelKey(sn.ephKey, enclavePub, SMK_LABEL)
+	sn.kdk, sn.smk, err = deriveLabelKey(sn.ephKey, enclavePub, SMK_LABEL)
+	if err != nil {
+		return nil, err
+	}
 
+	quoteType := UNLINKABLE_QUOTE
+	if sn.linkable {
+		quoteType = LINKABLE_QUOTE
+	}
 	a := &A{
 		Gb:        sn.gb,
 		Spid:      sn.spid,
-		QuoteType: UNLINKABLE_QUOTE,
+		QuoteType: quoteType,
 		KdfId:     KDF_ID,
 		Signature: sig,
 	}
 
-	sigRl, err := sn.ias.GetRevocationList(sn.gid)
+	var sigRl []byte
+	if sn.useSigRL {
+		sigRl, err = sn.ias.GetRevocationList(sn.gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cmacA, err := sn.cmacA(a)
 	if err != nil {
 		return nil, err
 	}
-
 	msg2 := &Msg2{
 		A:         a,
-		CmacA:     sn.cmacA(a),
+		CmacA:     cmacA,
 		SigRlSize: uint32(len(sigRl)),
 		SigRl:     sigRl,
 	}
+	sn.trace("msg2: quote type %x, kdf id %x, sigrl length %d.", a.QuoteType, a.KdfId, msg2.SigRlSize)
 
-	sn.lastUsed = time.Now()
+	sn.msg2 = msg2
+	sn.lastUsed = sn.now()
+	sn.msg2At = sn.lastUsed
 	return msg2, nil
 }
 
@@ -309,100 +605,337 @@ func checkMR(mr [MR_SIZE]byte, mrs [][MR_SIZE]byte) error {
 		}
 	}
 	if !found {
-		return errors.New("Invalid MR.")
+		return ErrEnclaveNotAllowed
+	}
+	return nil
+}
+
+// checkMeasurements checks the MREnclave and the MRSigner of quote
+// according to the measurement policy.
+func (sn *session) checkMeasurements(quote *Quote) error {
+	enclaveErr := checkMR(quote.MREnclave, sn.mrenclaves)
+	signerErr := checkMR(quote.MRSigner, sn.mrsigners)
+	switch sn.measurementPolicy {
+	case MEASUREMENT_MRENCLAVE_ONLY:
+		signerErr = nil
+	case MEASUREMENT_MRSIGNER_ONLY:
+		enclaveErr = nil
+	case MEASUREMENT_EITHER:
+		if enclaveErr != nil && signerErr != nil {
+			return fmt.Errorf("%w Neither the MREnclave nor the MRSigner is allowed.", ErrEnclaveNotAllowed)
+		}
+		return nil
+	}
+
+	if enclaveErr != nil {
+		return fmt.Errorf("%w Invalid MREnclave.", ErrEnclaveNotAllowed)
+	} else if signerErr != nil {
+		return fmt.Errorf("%w Invalid MRSigner.", ErrEnclaveNotAllowed)
 	}
 	return nil
 }
 
 func (sn *session) ProcessMsg3(msg3 *Msg3) error {
+	received := sn.now()
 	if err := sn.Expired(); err != nil {
 		return err
+	} else if sn.retransmittedMsg3(msg3) {
+		sn.trace("msg3: retransmission.")
+		sn.lastUsed = sn.now()
+		return nil
+	} else if sn.authenticated {
+		// Only one valid message 3 is accepted per session, so
+		// a replayed message never reaches the IAS.
+		return ErrMsg3AlreadyProcessed
 	}
 
-	// Used in hash report so derived ahead of all the other keys.
-	sn.vk = deriveLabelKeyFromBase(sn.kdk, VK_LABEL)
-
-	if !bytes.Equal(msg3.M.Ga.X, sn.ga.X) {
-		return errors.New("Msg3 GA mismatch.")
-	} else if !bytes.Equal(msg3.M.Ga.Y, sn.ga.Y) {
-		return errors.New("Msg3 GA mismatch.")
-	} else if !bytes.Equal(sn.cmacM(msg3.M), msg3.CmacM) {
-		return errors.New("Msg3 MAC on M mismatch.")
-	} else if !bytes.Equal(sn.hashReport(), msg3.M.Quote[HASH_REPORT_IN_QUOTE:HASH_REPORT_IN_QUOTE+sha256.Size]) {
-		return errors.New("Hash mismatch on report.")
+	v, err := sn.verifyMsg3(msg3)
+	if v != nil {
+		sn.vk = v.vk
+	}
+	if v != nil && v.iasCalled {
+		sn.iasCalled = true
+		sn.iasLatency = v.iasLatency
+		sn.pseTrusted = v.pseTrusted
+		sn.pib = v.pib
+		sn.advisories = v.advisories
 	}
+	if err != nil {
+		return err
+	}
+	quote := v.quote
+	sn.isvSVN = quote.ISVSVN
+	sn.reportData = quote.ReportData
 
-	pseTrusted, pib, advisories, err := sn.ias.VerifyQuoteAndPSE(msg3.M.Quote, msg3.M.PsSecurityProp)
-	sn.pseTrusted = pseTrusted
-	sn.pib = pib
-	sn.advisories = advisories
+	sn.sk, err = deriveLabelKeyFromBase(sn.kdk, SK_LABEL)
+	if err != nil {
+		return err
+	}
+	sn.mk, err = deriveLabelKeyFromBase(sn.kdk, MK_LABEL)
 	if err != nil {
 		return err
 	}
 
-	// Check for valid MREnclave and MRSigner
-	var mr [MR_SIZE]byte
-	copy(mr[:], msg3.M.Quote[MRENCLAVE_IN_QUOTE:MRENCLAVE_IN_QUOTE+MR_SIZE])
-	if err := checkMR(mr, sn.mrenclaves); err != nil {
-		return errors.New("Invalid MREnclave.")
+	block, err := aes.NewCipher(sn.sk)
+	if err != nil {
+		return err
 	}
-	copy(mr[:], msg3.M.Quote[MRSIGNER_IN_QUOTE:MRSIGNER_IN_QUOTE+MR_SIZE])
-	if err := checkMR(mr, sn.mrsigners); err != nil {
-		return errors.New("Invalid MRSigner.")
+	sn.aes, err = cipher.NewGCM(block)
+	if err != nil {
+		return err
 	}
 
-	// TODO: Check for CPU security version.
-	prodID := binary.LittleEndian.Uint16(msg3.M.Quote[ISVPRODID_IN_QUOTE : ISVPRODID_IN_QUOTE+ISVPRODID_SIZE])
-	if sn.prodID != prodID {
-		return errors.New("Enclave production ID mismatch.")
+	sn.msg3At = received
+	sn.lastUsed = sn.now()
+
+	sn.verifyMu.Lock()
+	sn.authenticated = true
+	sn.peer = identityOf(quote)
+	sn.msg3 = proto.Clone(msg3).(*Msg3)
+	sn.verifiedAt = sn.lastUsed
+	sn.verifyMu.Unlock()
+	return nil
+}
+
+// verifiedIdentity returns the identity of the enclave and when IAS
+// last accepted its quote, if the session is authenticated. It is safe
+// to call from any goroutine.
+func (sn *session) verifiedIdentity() (*EnclaveIdentity, time.Time, bool) {
+	sn.verifyMu.Lock()
+	defer sn.verifyMu.Unlock()
+	if !sn.authenticated {
+		return nil, time.Time{}, false
 	}
+	return sn.peer, sn.verifiedAt, true
+}
 
-	prodSVN := binary.LittleEndian.Uint16(msg3.M.Quote[ISVSVN_IN_QUOTE : ISVSVN_IN_QUOTE+ISVSVN_SIZE])
-	if sn.prodSVN > prodSVN {
-		return errors.New("Enclave security version number is too low.")
+// dueForReverify returns the message 3 that authenticated the
+// session, if IAS last accepted it at least interval before now.
+func (sn *session) dueForReverify(now time.Time, interval time.Duration) *Msg3 {
+	sn.verifyMu.Lock()
+	defer sn.verifyMu.Unlock()
+	if !sn.authenticated || sn.msg3 == nil || now.Sub(sn.verifiedAt) < interval {
+		return nil
 	}
+	return sn.msg3
+}
 
-	// Check for enclave attributes
-	if sn.release {
-		attr := msg3.M.Quote[ATTRIBUTES_IN_QUOTE : ATTRIBUTES_IN_QUOTE+ATTRIBUTES_SIZE]
-		if (attr[0] & SGX_FLAGS_DEBUG) != 0 {
-			// debug flag is set
-			return errors.New("Debug flag set in release mode.")
-		}
-		// TODO: What should we do about the other flags?
+// reverified records that IAS accepted the quote again at t.
+func (sn *session) reverified(t time.Time) {
+	sn.verifyMu.Lock()
+	sn.verifiedAt = t
+	sn.verifyMu.Unlock()
+}
+
+func (sn *session) ProbeMsg3(msg3 *Msg3) (*AttestationResult, error) {
+	if err := sn.Expired(); err != nil {
+		return nil, err
+	}
+	v, err := sn.verifyMsg3(msg3)
+	if v == nil || !v.iasCalled {
+		return nil, err
 	}
+	return &AttestationResult{
+		EnclaveTrusted: err == nil,
+		PseTrusted:     v.pseTrusted,
+		Pib:            v.pib,
+		Advisories:     v.advisories,
+	}, err
+}
 
-	sn.authenticated = true
+// msg3Verification is what verifyMsg3 found out about a message 3.
+type msg3Verification struct {
+	quote *Quote
+	vk    []byte
+
+	// Whether IAS was asked to verify the quote, how long it
+	// took, and what it said.
+	iasCalled  bool
+	iasLatency time.Duration
+	pseTrusted bool
+	pib        []byte
+	advisories []string
+}
 
-	sn.sk = deriveLabelKeyFromBase(sn.kdk, SK_LABEL)
-	sn.mk = deriveLabelKeyFromBase(sn.kdk, MK_LABEL)
+// verifyMsg3 runs every check of message 3 against the handshake of
+// the session and the policy of the session manager, including the
+// verification of the quote by IAS, without changing the session.
+// The result is returned, as far as it got, even with an error.
+func (sn *session) verifyMsg3(msg3 *Msg3) (*msg3Verification, error) {
+	// Without message 2, there are no keys to check message 3
+	// against.
+	if sn.kdk == nil || sn.ga == nil || sn.gb == nil {
+		return nil, ErrMsg2NotCreated
+	}
+	if err := ValidateMsg3Format(msg3); err != nil {
+		return nil, err
+	}
+	quote, err := ParseQuote(msg3.M.Quote)
+	if err != nil {
+		return nil, err
+	}
+	if err := sn.checkSignType(quote); err != nil {
+		return nil, err
+	}
 
-	block, err := aes.NewCipher(sn.sk)
+	// Used in hash report so derived ahead of all the other keys.
+	v := &msg3Verification{quote: quote}
+	v.vk, err = deriveLabelKeyFromBase(sn.kdk, VK_LABEL)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	sn.aes, err = cipher.NewGCM(block)
+
+	gaMatch := bytes.Equal(msg3.M.Ga.X, sn.ga.X) && bytes.Equal(msg3.M.Ga.Y, sn.ga.Y)
+	cmacM, err := sn.cmacM(msg3.M)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	macMatch := bytes.Equal(cmacM, msg3.CmacM)
+	hashMatch := bytes.Equal(sn.hashReport(v.vk), quote.ReportData[:sha256.Size])
+	sn.trace("msg3: ga match %t, mac valid %t, report hash match %t, quote %d bytes.", gaMatch, macMatch, hashMatch, len(msg3.M.Quote))
+	if !gaMatch {
+		return v, fmt.Errorf("%w GA mismatch.", ErrInvalidMsg3)
+	} else if !macMatch {
+		return v, fmt.Errorf("%w MAC on M mismatch.", ErrInvalidMsg3)
+	} else if !hashMatch {
+		return v, fmt.Errorf("%w Hash mismatch on report.", ErrInvalidMsg3)
+	}
+
+	start := sn.now()
+	pseTrusted, pib, advisories, err := sn.ias.VerifyQuoteAndPSE(msg3.M.Quote, msg3.M.PsSecurityProp)
+	v.iasCalled = true
+	v.iasLatency = sn.now().Sub(start)
+	v.pseTrusted = pseTrusted
+	v.pib = pib
+	v.advisories = advisories
+	sn.trace("msg3: IAS pse trusted %t, advisories %v, error %v.", pseTrusted, advisories, err)
+	if err != nil {
+		return v, err
+	}
+
+	if err := sn.checkMeasurements(quote); err != nil {
+		return v, err
+	}
+
+	if err := sn.checkTCB(quote); err != nil {
+		return v, err
+	}
+
+	minSVN, ok := sn.minProdSVN(quote.ISVProdID)
+	if !ok {
+		return v, fmt.Errorf("%w Enclave production ID mismatch.", ErrEnclaveNotAllowed)
+	}
+
+	if minSVN > quote.ISVSVN {
+		return v, fmt.Errorf("%w Enclave security version number is too low.", ErrEnclaveNotAllowed)
+	}
+
+	if err := sn.checkAttributes(quote); err != nil {
+		return v, err
+	}
+
+	if err := sn.checkKSS(quote); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+// retransmittedMsg3 reports whether msg3 is the message 3 that
+// already authenticated the session.
+func (sn *session) retransmittedMsg3(msg3 *Msg3) bool {
+	return sn.msg3 != nil && proto.Equal(msg3, sn.msg3)
+}
+
+// checkTCB checks the security version numbers of the platform in
+// the quote against the configured baseline. Each component of CPUSVN
+// must be at least the corresponding component of the baseline.
+func (sn *session) checkTCB(quote *Quote) error {
+	if sn.minCPUSVN != nil {
+		for i := range quote.CPUSVN {
+			if quote.CPUSVN[i] < sn.minCPUSVN[i] {
+				return ErrTCBTooLow
+			}
+		}
+	}
+	if quote.QESVN < sn.minQESVN {
+		return ErrTCBTooLow
+	}
+	if quote.PCESVN < sn.minPCESVN {
+		return ErrTCBTooLow
+	}
+	return nil
+}
+
+// checkSignType checks that quote is signed with the EPID signature
+// type (linkable or unlinkable) the SPID is provisioned for.
+func (sn *session) checkSignType(quote *Quote) error {
+	expected := uint16(UNLINKABLE_QUOTE_INT)
+	if sn.linkable {
+		expected = LINKABLE_QUOTE_INT
+	}
+	if quote.SignType != expected {
+		return fmt.Errorf("%w Quote sign type is %d, expected %d.", ErrSignTypeMismatch, quote.SignType, expected)
 	}
+	return nil
+}
+
+// checkKSS checks the KSS identity of the enclave in quote against
+// the configured family ID, config ID, and minimum config SVN.
+func (sn *session) checkKSS(quote *Quote) error {
+	if sn.isvFamilyID != nil && !bytes.Equal(quote.ISVFamilyID[:], sn.isvFamilyID) {
+		return fmt.Errorf("%w Enclave ISV family ID %x does not match %x.", ErrEnclaveNotAllowed, quote.ISVFamilyID, sn.isvFamilyID)
+	}
+	if sn.configID != nil && !bytes.Equal(quote.ConfigID[:], sn.configID) {
+		return fmt.Errorf("%w Enclave config ID %x does not match %x.", ErrEnclaveNotAllowed, quote.ConfigID, sn.configID)
+	}
+	if quote.ConfigSVN < sn.minConfigSVN {
+		return fmt.Errorf("%w Enclave config SVN %d is below %d.", ErrEnclaveNotAllowed, quote.ConfigSVN, sn.minConfigSVN)
+	}
+	return nil
+}
 
-	sn.lastUsed = time.Now()
+// checkAttributes checks the enclave attributes and misc select of
+// the quote against the configured masks and expected values.
+func (sn *session) checkAttributes(quote *Quote) error {
+	flags, xfrm, misc := quote.Flags, quote.XFRM, quote.MiscSelect
+
+	if sn.release && (flags&SGX_FLAGS_DEBUG) != 0 {
+		return fmt.Errorf("%w Debug flag set in release mode.", ErrEnclaveNotAllowed)
+	}
+	if flags&sn.flagsMask != sn.flags&sn.flagsMask {
+		return fmt.Errorf("%w Enclave flags %#x do not match %#x under mask %#x.", ErrEnclaveNotAllowed, flags, sn.flags, sn.flagsMask)
+	}
+	if xfrm&sn.xfrmMask != sn.xfrm&sn.xfrmMask {
+		return fmt.Errorf("%w Enclave XFRM %#x does not match %#x under mask %#x.", ErrEnclaveNotAllowed, xfrm, sn.xfrm, sn.xfrmMask)
+	}
+	if misc&sn.miscSelectMask != sn.miscSelect&sn.miscSelectMask {
+		return fmt.Errorf("%w Enclave misc select %#x does not match %#x under mask %#x.", ErrEnclaveNotAllowed, misc, sn.miscSelect, sn.miscSelectMask)
+	}
 	return nil
 }
 
 func (sn *session) CreateMsg4() (*Msg4, error) {
 	if err := sn.Expired(); err != nil {
 		return nil, err
+	} else if sn.msg4 != nil {
+		// Message 3 was retransmitted, so send the same message
+		// 4 again rather than sealing a new secret.
+		sn.lastUsed = sn.now()
+		return sn.msg4, nil
 	}
 
 	var err error
-	var ciphertext []byte
+	var ciphertext, payload []byte
 	if sn.authenticated {
 		secret := []byte(MSG4_SECRET)
 		ciphertext, err = sn.Seal(secret)
 		if err != nil {
 			return nil, err
 		}
+		payload, err = sn.sealPayload()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	ar := &AttestationResult{
@@ -414,22 +947,58 @@ func (sn *session) CreateMsg4() (*Msg4, error) {
 
 	// authenticated, pseTrusted, pib are all set in ProcessMsg3.
 	msg4 := &Msg4{
-		Result: ar,
-		Secret: ciphertext,
+		Result:  ar,
+		Secret:  ciphertext,
+		Payload: payload,
 	}
 	msg4.Cmac, err = sn.cmacMsg4(msg4)
+	if err == nil && sn.authenticated {
+		sn.msg4 = msg4
+		sn.msg4At = sn.now()
+	}
 	return msg4, err
 }
 
+// sealPayload returns the application payload for message 4 sealed
+// with SK, or nil if there is none. The payload from the OnVerified
+// callback replaces the one in the configuration.
+func (sn *session) sealPayload() ([]byte, error) {
+	payload := sn.msg4Payload
+	if sn.onVerified != nil {
+		var err error
+		payload, err = sn.onVerified(sn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	} else if err := checkMsg4Payload(payload); err != nil {
+		return nil, err
+	}
+	return sn.Seal(payload)
+}
+
 func (sn *session) Authenticated() bool {
-	return sn.authenticated
+	_, _, ok := sn.verifiedIdentity()
+	return ok
+}
+
+// aad returns the additional authenticated data for messages going
+// in direction.
+func (sn *session) aad(direction byte) []byte {
+	return append([]byte(sn.id), direction)
 }
 
 func (sn *session) Seal(msg []byte) ([]byte, error) {
 	if err := sn.Expired(); err != nil {
 		return nil, err
+	} else if sn.aes == nil {
+		return nil, ErrNotAuthenticated
 	} else if sn.sealCount > (1 << 32) {
-		return nil, errors.New("Sealed too many messages.")
+		return nil, ErrRekeyRequired
+	} else if err := sn.checkMessageLimit(); err != nil {
+		return nil, err
 	}
 
 	nonce := make([]byte, sn.aes.NonceSize())
@@ -438,9 +1007,11 @@ func (sn *session) Seal(msg []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	ciphertext := sn.aes.Seal(nil, nonce, msg, nil)
+	ciphertext := sn.aes.Seal(nil, nonce, msg, sn.aad(AAD_SERVER_TO_CLIENT))
 	sn.sealCount += 1
-	sn.lastUsed = time.Now()
+	atomic.AddUint64(&sn.usage.MessagesSent, 1)
+	atomic.AddUint64(&sn.usage.BytesSent, uint64(len(msg)))
+	sn.lastUsed = sn.now()
 	return append(nonce, ciphertext...), nil
 }
 
@@ -449,23 +1020,190 @@ func (sn *session) Open(ciphertext []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	sn.lastUsed = time.Now()
+	if sn.aes == nil {
+		return nil, ErrNotAuthenticated
+	} else if err := sn.checkMessageLimit(); err != nil {
+		return nil, err
+	}
+
 	nonce := sn.aes.NonceSize()
-	return sn.aes.Open(nil, ciphertext[:nonce], ciphertext[nonce:], nil)
+	if len(ciphertext) < nonce {
+		return nil, fmt.Errorf("%w Ciphertext is too short.", ErrMalformedMessage)
+	}
+	sn.lastUsed = sn.now()
+	plaintext, err := sn.aes.Open(nil, ciphertext[:nonce], ciphertext[nonce:], sn.aad(AAD_CLIENT_TO_SERVER))
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&sn.usage.MessagesReceived, 1)
+	atomic.AddUint64(&sn.usage.BytesReceived, uint64(len(plaintext)))
+	return plaintext, nil
+}
+
+// checkMessageLimit returns ErrRekeyRequired once the session has
+// sealed and opened maxMessages messages in total.
+func (sn *session) checkMessageLimit() error {
+	if sn.maxMessages <= 0 {
+		return nil
+	}
+	sent := atomic.LoadUint64(&sn.usage.MessagesSent)
+	received := atomic.LoadUint64(&sn.usage.MessagesReceived)
+	if sent+received >= uint64(sn.maxMessages) {
+		return ErrRekeyRequired
+	}
+	return nil
+}
+
+func (sn *session) Usage() Usage {
+	return Usage{
+		MessagesSent:     atomic.LoadUint64(&sn.usage.MessagesSent),
+		MessagesReceived: atomic.LoadUint64(&sn.usage.MessagesReceived),
+		BytesSent:        atomic.LoadUint64(&sn.usage.BytesSent),
+		BytesReceived:    atomic.LoadUint64(&sn.usage.BytesReceived),
+	}
 }
 
 func (sn *session) MAC(msg []byte) []byte {
-	return cmacWithKey(msg, sn.mk)
+	mac, err := cmacWithKey(msg, sn.mk)
+	if err != nil {
+		return nil
+	}
+	return mac
+}
+
+func (sn *session) ExportKey(label []byte) ([]byte, error) {
+	if !sn.authenticated {
+		return nil, ErrNotAuthenticated
+	}
+
+	var key []byte
+	switch {
+	case bytes.Equal(label, SK_LABEL):
+		key = sn.sk
+	case bytes.Equal(label, MK_LABEL):
+		key = sn.mk
+	case bytes.Equal(label, VK_LABEL):
+		key = sn.vk
+	default:
+		return nil, fmt.Errorf("%w Unknown key label [%s].", ErrInvalidLabel, label)
+	}
+	return append([]byte(nil), key...), nil
+}
+
+func (sn *session) RemoteReportData() ([REPORT_DATA_SIZE]byte, error) {
+	if !sn.authenticated {
+		return [REPORT_DATA_SIZE]byte{}, ErrNotAuthenticated
+	}
+	return sn.reportData, nil
+}
+
+func (sn *session) EphemeralPublicBytes() ([]byte, []byte, error) {
+	if sn.msg2 == nil {
+		return nil, nil, ErrMsg2NotCreated
+	}
+	return append([]byte(nil), sn.gb.X...), append([]byte(nil), sn.gb.Y...), nil
+}
+
+func (sn *session) Peer() (*EnclaveIdentity, error) {
+	identity, _, ok := sn.verifiedIdentity()
+	if !ok {
+		return nil, ErrNotAuthenticated
+	}
+	peer := *identity
+	return &peer, nil
+}
+
+func (sn *session) PeerGID() (uint32, error) {
+	if sn.gid == nil {
+		return 0, ErrMsg1NotProcessed
+	}
+	return parseGID(sn.gid)
+}
+
+// parseGID decodes the EPID group id sent in message 1. Like the rest
+// of the SGX messages (sgx_epid_group_id_t in the SDK), it is little
+// endian, so the group 0x00000b1e is sent as 1e 0b 00 00. Everything
+// that needs the group id, e.g., the SigRL request to IAS, must go
+// through parseGID rather than read the bytes in order.
+func parseGID(gid []byte) (uint32, error) {
+	if len(gid) != EPID_GID_SIZE {
+		return 0, fmt.Errorf("%w Group id is %d bytes instead of %d.", ErrMalformedMessage, len(gid), EPID_GID_SIZE)
+	}
+	return binary.LittleEndian.Uint32(gid), nil
 }
 
 func (sn *session) Expired() error {
-	if sn.timeout == -1 { // timeout == -1 means it never expires
+	if sn.ctx != nil && sn.ctx.Err() != nil {
+		return ErrSessionCanceled
+	}
+	timeout := time.Duration(sn.timeout) * time.Minute
+	if sn.timeoutOverride != 0 {
+		timeout = sn.timeoutOverride
+	} else if sn.timeout == -1 { // timeout == -1 means it never expires
 		return nil
 	}
 
-	now := time.Now()
-	if now.After(sn.lastUsed.Add(time.Duration(sn.timeout) * time.Minute)) {
-		return errors.New(fmt.Sprintf("Session [%s] timed out.", sn.id))
+	now := sn.now()
+	if now.After(sn.lastUsed.Add(timeout)) {
+		return ErrSessionExpired
+	}
+	return nil
+}
+
+func (sn *session) SetTimeout(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("%w Timeout %v is not positive.", ErrInvalidTimeout, d)
+	}
+
+	max := sn.maxTimeout
+	if max == 0 {
+		max = sn.timeout
+	}
+	if max != -1 && d > time.Duration(max)*time.Minute {
+		return fmt.Errorf("%w Timeout %v is above the maximum of %d minutes.", ErrInvalidTimeout, d, max)
+	}
+	sn.timeoutOverride = d
+	return nil
+}
+
+// trace logs a step of the handshake if TraceHandshake is enabled.
+// Never pass key material to trace. In case it happens by mistake,
+// the keys of the session are redacted from the line, and the
+// long-lived secrets by the logger of the session manager.
+func (sn *session) trace(format string, v ...interface{}) {
+	if sn.traceHandshake && sn.logger != nil {
+		line := fmt.Sprintf(format, redactArgs(sn.redaction, v)...)
+		line = redactSecrets(line, [][]byte{sn.kdk, sn.smk, sn.vk, sn.sk, sn.mk})
+		sn.logger.Printf("Session [%s] %s", identifier(sn.id), line)
+	}
+}
+
+// selectLongTermKey finds the long-term key whose public key hashes
+// to hash, or returns the primary key if hash is empty.
+func (sn *session) selectLongTermKey(hash []byte) (*ecdsa.PrivateKey, error) {
+	if len(hash) == 0 {
+		return sn.longTermKey, nil
+	}
+
+	for _, key := range append([]*ecdsa.PrivateKey{sn.longTermKey}, sn.secondaryKeys...) {
+		keyHash := publicKeyHash(&key.PublicKey)
+		if bytes.Equal(hash, keyHash[:]) {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKeyHash
+}
+
+// useClientNonce checks the client nonce of message 1, if the session
+// manager requires one, and remembers it so that it cannot be sent
+// again within the window.
+func (sn *session) useClientNonce(nonce []byte) error {
+	if !sn.requireNonce {
+		return nil
+	} else if len(nonce) < MIN_CLIENT_NONCE_SIZE || len(nonce) > MAX_CLIENT_NONCE_SIZE {
+		return fmt.Errorf("%w Message 1 has a client nonce of %d bytes, expected %d to %d.", ErrMalformedMessage, len(nonce), MIN_CLIENT_NONCE_SIZE, MAX_CLIENT_NONCE_SIZE)
+	} else if sn.clientNonces == nil || !sn.clientNonces.use(string(nonce)) {
+		return ErrReplayedNonce
 	}
 	return nil
 }
@@ -476,20 +1214,41 @@ func checkMsg1Format(msg1 *Msg1) bool {
 		len(msg1.Gid) == EPID_GID_SIZE
 }
 
-func cmacWithKey(msg, key []byte) []byte {
+// ValidateMsg3Format checks that msg3 is well formed, without any
+// cryptography or session state: all the fields are present and of
+// the right size, and the quote parses (see ParseQuote). It is cheap
+// enough for a load balancer or an interceptor to shed garbage before
+// it reaches a session or IAS, but a message 3 that passes can still
+// fail verification. ProcessMsg3 runs the same checks. Returns an
+// error wrapping ErrMalformedMessage otherwise.
+func ValidateMsg3Format(msg3 *Msg3) error {
+	if msg3 == nil || msg3.M == nil || msg3.M.Ga == nil {
+		return fmt.Errorf("%w Message 3 is missing fields.", ErrMalformedMessage)
+	} else if len(msg3.CmacM) != MAC_SIZE {
+		return fmt.Errorf("%w Message 3 MAC is %d bytes, expected %d.", ErrMalformedMessage, len(msg3.CmacM), MAC_SIZE)
+	} else if len(msg3.M.Ga.X) != EC_COORD_SIZE || len(msg3.M.Ga.Y) != EC_COORD_SIZE {
+		return fmt.Errorf("%w Message 3 GA is not %d bytes per coordinate.", ErrMalformedMessage, EC_COORD_SIZE)
+	} else if n := len(msg3.M.PsSecurityProp); n != 0 && n != PS_SECURITY_PROP_SIZE {
+		return fmt.Errorf("%w Message 3 PSE security property is %d bytes, expected %d.", ErrMalformedMessage, n, PS_SECURITY_PROP_SIZE)
+	}
+	_, err := ParseQuote(msg3.M.Quote)
+	return err
+}
+
+func cmacWithKey(msg, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
-		log.Fatal("Could not create AES for CMAC: ", err)
+		return nil, fmt.Errorf("Could not create AES for CMAC: %w", err)
 	}
 
 	result, err := cmac.Sum(msg, block, aes.BlockSize)
 	if err != nil {
-		log.Fatal("Could not CMAC the message.")
+		return nil, fmt.Errorf("Could not CMAC the message: %w", err)
 	}
-	return result
+	return result, nil
 }
 
-func (sn *session) cmacA(a *A) []byte {
+func (sn *session) cmacA(a *A) ([]byte, error) {
 	concat := append(a.Gb.X, a.Gb.Y...)
 	concat = append(concat, a.Spid...)
 	concat = append(concat, a.QuoteType...)
@@ -499,7 +1258,7 @@ func (sn *session) cmacA(a *A) []byte {
 	return cmacWithKey(concat, sn.smk)
 }
 
-func (sn *session) cmacM(m *M) []byte {
+func (sn *session) cmacM(m *M) ([]byte, error) {
 	concat := append(m.Ga.X, m.Ga.Y...)
 	concat = append(concat, m.PsSecurityProp...)
 	concat = append(concat, m.Quote...)
@@ -512,14 +1271,15 @@ func (sn *session) cmacMsg4(msg4 *Msg4) ([]byte, error) {
 		return nil, err
 	}
 	concat := append(ar, msg4.Secret...)
-	return cmacWithKey(concat, sn.smk), nil
+	concat = append(concat, msg4.Payload...)
+	return cmacWithKey(concat, sn.smk)
 }
 
-func (sn *session) hashReport() []byte {
+func (sn *session) hashReport(vk []byte) []byte {
 	concat := append(sn.ga.X, sn.ga.Y...)
 	concat = append(concat, sn.gb.X...)
 	concat = append(concat, sn.gb.Y...)
-	concat = append(concat, sn.vk...)
+	concat = append(concat, vk...)
 	hash := sha256.Sum256(concat)
 	return hash[:]
 }
@@ -1,9 +1,19 @@
 package sgx_server
 
 import (
+	"container/list"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // SessionManager keeps records of different SGX sessions with
@@ -12,8 +22,10 @@ import (
 // the client's subsequent messages to the server. This is because the
 // clients are expected to include the ID in the metadata of the gRPC
 // call. The AttestationServer interface, which this interface almost
-// implements, is reponsible for parsing the metadata. See the server
-// in cmd/example_server on how to do this.
+// implements, is reponsible for parsing the metadata.
+// NewAttestationServer turns a SessionManager into an
+// AttestationServer that does this. See the server in
+// cmd/example_server on how to use it.
 type SessionManager interface {
 	// GetSession returns (Session, true) if there exists a
 	// session that matches id. Otherwise, it returns
@@ -25,6 +37,22 @@ type SessionManager interface {
 	// and a random challenge.
 	NewSession(in *Request) (*Challenge, error)
 
+	// NewSessionCtx is NewSession, but ties the session to ctx:
+	// once ctx is done, the session is removed, even in the
+	// middle of the handshake or after it. The idle timeout
+	// still applies, so the session ends at whichever of the two
+	// comes first. The context of a unary gRPC call ends with the
+	// call, so pass a longer lived context such as a deadline for
+	// the whole handshake. ctx should eventually be done, since
+	// the session manager watches it until then.
+	NewSessionCtx(ctx context.Context, in *Request) (*Challenge, error)
+
+	// ProcessMsg0 processes a separate SGX message 0 for the
+	// session matching id, for clients that follow the message
+	// order of the Intel SDK. Other clients can send message 0
+	// inside message 1 instead.
+	ProcessMsg0(id string, msg0 *Msg0) (*Msg0Response, error)
+
 	// Msg1ToMsg3 processes SGX message 1 and generates SGX
 	// message 2 for the session matching id.
 	Msg1ToMsg2(id string, msg1 *Msg1) (*Msg2, error)
@@ -32,86 +60,1219 @@ type SessionManager interface {
 	// Msg3ToMsg4 processes SGX message 3 and generates SGX
 	// message 4 for the session matching id.
 	Msg3ToMsg4(id string, msg3 *Msg3) (*Msg4, error)
+
+	// Describe returns a snapshot of the effective configuration
+	// of the session manager, without any secrets.
+	Describe() ManagerInfo
+
+	// Stats returns the number of live sessions, and how many
+	// sessions were removed for each reason. It does not visit
+	// the sessions, so it is cheap to call however many there are,
+	// and it does not block handshakes in progress.
+	Stats() Stats
+
+	// LongTermPublicBytes returns the coordinates of the public
+	// long-term key that signs message 2, 32 bytes each in little
+	// endian, the byte order of sgx_ec256_public_t in the SGX SDK.
+	// They must match the service provider key built into the
+	// client enclave, or the enclave fails to verify message 2.
+	LongTermPublicBytes() (x, y []byte)
+
+	// ReloadProdSVN changes the minimum enclave security version
+	// number for new sessions to svn. If svn is higher than
+	// before and InvalidateOnSVNRaise is set, the sessions that
+	// no longer meet the minimum are closed. Returns the number of
+	// sessions closed. The enclaves whose ProdID has its own
+	// minimum in ProdSVNs are not affected.
+	ReloadProdSVN(svn uint16) int
+
+	// Reconfigure replaces the configuration of new sessions with
+	// config, including the changes made with ReloadProdSVN and
+	// TrustMREnclave, e.g., to change the measurements, the
+	// enclave and TCB policies, or the SPID. config is validated
+	// and loaded in full first, so that nothing changes if there
+	// is an error. The settings the session manager is built from
+	// (the IAS client, MaxSessions, MaxInFlightHandshakes,
+	// ReverifyInterval, RequireClientNonce, LogRedaction, and the
+	// secrets) cannot be changed, and Reconfigure fails if config
+	// changes them. Sessions that were already started keep the
+	// configuration they were started with, except that, as with
+	// ReloadProdSVN, raising ProdSVN with InvalidateOnSVNRaise set
+	// closes the sessions below the new minimum.
+	Reconfigure(config *Configuration) error
+
+	// TrustMREnclave adds mr to the MREnclaves accepted by new
+	// sessions, e.g., for a canary build of the enclave.
+	// UntrustMREnclave removes it again, and reports whether it
+	// was accepted before. Sessions that were already started
+	// keep the MREnclaves they were started with.
+	TrustMREnclave(mr [MR_SIZE]byte)
+	UntrustMREnclave(mr [MR_SIZE]byte) bool
+
+	// TrustedMeasurements returns the hex encoded MREnclaves and
+	// MRSigners accepted by new sessions, including the changes
+	// made with TrustMREnclave and UntrustMREnclave, e.g., for an
+	// admin endpoint. Which of them are checked depends on
+	// MeasurementPolicy.
+	TrustedMeasurements() (mrenclaves, mrsigners []string)
+
+	// Revoke removes the session matching id, e.g., because it
+	// was compromised. If the session manager has a
+	// RevocationStore, the revocation is also published to it,
+	// and every session manager sharing the store drops the
+	// session the next time it is used.
+	Revoke(id string) error
+
+	// Events returns the lifecycle events of the sessions, in the
+	// order they happened. The channel buffers up to
+	// EVENT_BUFFER_SIZE events. A slow consumer does not block the
+	// handshakes; the oldest events are dropped instead. Every
+	// call returns the same channel, so each event is only
+	// received by one of the consumers.
+	Events() <-chan Event
+
+	// Warm establishes the connection to IAS and pre-fetches the
+	// SigRLs of the configured SigRLGroups, so that the first
+	// client does not pay for it. Call it once before serving
+	// clients.
+	Warm(ctx context.Context) error
+
+	// Stop stops the background work of the session manager,
+	// such as re-verifying the sessions every ReverifyInterval
+	// and watching the contexts of NewSessionCtx, and waits for
+	// it to finish, so that no goroutine of the session manager
+	// is left running once Stop returns. The sessions keep
+	// working, but are no longer re-verified, and the sessions of
+	// a done context are only removed when they are next used.
+	// Call it once the session manager is no longer used, e.g.,
+	// at the end of a test. Stop can be called more than once.
+	Stop()
+}
+
+// RemovalReason is the reason a session was removed from a
+// SessionManager.
+type RemovalReason string
+
+const (
+	// The session was evicted to make room for a new session.
+	REMOVAL_EVICTED RemovalReason = "evicted"
+	// The session was not used within the timeout.
+	REMOVAL_EXPIRED RemovalReason = "expired"
+	// The session failed to process a handshake message.
+	REMOVAL_FAILED RemovalReason = "failed"
+	// The session was closed by ReloadProdSVN.
+	REMOVAL_INVALIDATED RemovalReason = "invalidated"
+	// The context passed to NewSessionCtx was done.
+	REMOVAL_CANCELED RemovalReason = "canceled"
+	// The session was revoked, possibly by another session
+	// manager sharing the RevocationStore.
+	REMOVAL_REVOKED RemovalReason = "revoked"
+	// The session was still waiting for message 1 when the same
+	// client created a new one. See WithRetryCoalescing.
+	REMOVAL_REPLACED RemovalReason = "replaced"
+	// IAS no longer accepted the quote of the session when it
+	// was verified again. See ReverifyInterval.
+	REMOVAL_DEGRADED RemovalReason = "degraded"
+)
+
+// Stats is a snapshot of the sessions held by a SessionManager.
+type Stats struct {
+	// Sessions is the number of sessions currently held.
+	Sessions int
+	// Removals counts the sessions removed since the
+	// SessionManager was created, by reason.
+	Removals map[RemovalReason]int
+	// InFlightHandshakes is the number of messages 3 being
+	// verified right now, at most MaxInFlightHandshakes.
+	InFlightHandshakes int
+	// EnclaveSVNs counts the sessions authenticated since the
+	// SessionManager was created, by the security version number
+	// of the client enclave. This shows when the clients are done
+	// upgrading, and ProdSVN can be raised.
+	EnclaveSVNs map[uint16]int
+	// Advisories counts the verification reports since the
+	// SessionManager was created that carried each advisory id,
+	// whether the advisory was allowed or not. This shows which
+	// advisories are most common in the fleet before deciding
+	// which ones to stop allowing.
+	Advisories map[string]int
+	// HandshakeTimes, Msg1ToMsg2Times, and Msg3ToMsg4Times are
+	// the distributions of the HandshakeTiming of the sessions
+	// authenticated since the SessionManager was created, e.g.,
+	// to pick the timeouts of the clients.
+	HandshakeTimes  Histogram
+	Msg1ToMsg2Times Histogram
+	Msg3ToMsg4Times Histogram
+}
+
+// The number of removed session ids the session manager remembers,
+// so that it can tell clients why their session is gone.
+const maxRemovedSessions = 4096
+
+type removedSession struct {
+	id     string
+	reason RemovalReason
+}
+
+// SessionInfo describes a session held by a SessionManager. It never
+// contains the keys of the session.
+type SessionInfo struct {
+	ID string
+	// Identity is the identity of the client enclave, or nil if
+	// the session is not authenticated.
+	Identity *EnclaveIdentity
+	// Created is when the session was created, and Age how long
+	// ago that was. Both are zero for sessions not created by
+	// the SessionManager.
+	Created time.Time
+	Age     time.Duration
+}
+
+// sessionInfo describes sn.
+func (sm *sessionManager) sessionInfo(sn Session) SessionInfo {
+	info := SessionInfo{ID: sn.Id()}
+	if peer, err := sn.Peer(); err == nil {
+		info.Identity = peer
+	}
+	if s, ok := sn.(*session); ok {
+		info.Created = s.created
+		info.Age = sm.now().Sub(s.created)
+	}
+	return info
+}
+
+// ManagerInfo describes the effective configuration of a
+// SessionManager. It never contains secrets, such as the IAS
+// subscription key or the long-term private keys, so it is safe to
+// log or expose on an admin endpoint.
+type ManagerInfo struct {
+	Release                    bool
+	IASHost                    string
+	ProdID                     uint16
+	ProdSVN                    uint16
+	MaxSessions                int
+	MaxInFlightHandshakes      int
+	Timeout                    int
+	MREnclaves                 int
+	MRSigners                  int
+	MeasurementPolicy          MeasurementPolicy
+	LongTermKeys               int
+	SkipSigRL                  bool
+	MaxIASCallsPerDay          int
+	MinTCBEvaluationDataNumber int
+	AllowCachedOnIASOutage     bool
+	TraceHandshake             bool
+	ChallengeLength            int
 }
 
 type sessionManager struct {
 	configuration
 	sessions Cache
 	ias      IAS
+
+	// The IAS before it is wrapped with caches and quotas, which
+	// Warm uses to establish the connection.
+	baseIAS IAS
+
+	// The IAS the sessions are verified again with, which is ias
+	// without the fallback to cached reports: a session whose
+	// quote cannot be checked is kept, but not as verified.
+	reverifyIAS IAS
+
+	// The configuration given to new sessions, which changes on
+	// reloads. Sessions keep the configuration they were created
+	// with, so it is copied rather than modified in place.
+	sessionConf *configuration
+
+	// Recently removed sessions, most recent at the front, and
+	// the number of removals by reason. Methods that only read
+	// them, like Stats, take the read lock so that they do not
+	// hold up each other or the handshakes.
+	mu         sync.RWMutex
+	removed    *list.List
+	removedM   map[string]*list.Element
+	removals   map[RemovalReason]int
+	svns       map[uint16]int
+	advisories map[string]int
+
+	// The histograms of the handshake timings, guarded by mu.
+	handshakeTimes  Histogram
+	msg1ToMsg2Times Histogram
+	msg3ToMsg4Times Histogram
+
+	// now returns the current time. It can be replaced using
+	// WithClock.
+	now func() time.Time
+
+	// tracer, if not nil, traces each message 3.
+	tracer Tracer
+
+	// revocations, if not nil, is shared with the session
+	// managers of other replicas.
+	revocations RevocationStore
+
+	// Lifecycle events, see emit. eventsMu serializes the
+	// senders, so that dropping the oldest event and sending the
+	// new one happen together.
+	eventsMu sync.Mutex
+	events   chan Event
+
+	// If coalesce is set, the sessions waiting for message 1 by
+	// client id, and the reverse. Both are guarded by mu.
+	coalesce        bool
+	pendingByClient map[string]string
+	pendingClients  map[string]string
+
+	// A slot for each message 3 being verified, if
+	// MaxInFlightHandshakes is set.
+	inFlight chan struct{}
+
+	// The client nonces of the recent messages 1, shared by all
+	// the sessions, if client nonces are required.
+	clientNonces *nonceCache
+
+	// onEvict, if not nil, is told about every evicted session.
+	onEvict func(SessionInfo, string)
+
+	// The background goroutines, such as the one re-verifying
+	// the sessions, run until stop is closed by Stop. bgMu
+	// guards stopped, so that no goroutine is added to wg once
+	// Stop is waiting for it.
+	stop    chan struct{}
+	bgMu    sync.Mutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// Option customizes the SessionManager created by NewSessionManager.
+type Option func(*sessionManager)
+
+// WithClock makes the SessionManager use now instead of time.Now to
+// tell the time. This is mostly useful in tests.
+func WithClock(now func() time.Time) Option {
+	return func(sm *sessionManager) {
+		sm.now = now
+	}
+}
+
+// WithLogger makes the SessionManager write its logs to logger
+// instead of stderr.
+func WithLogger(logger Logger) Option {
+	return func(sm *sessionManager) {
+		sm.logger = logger
+	}
+}
+
+// WithRand makes the SessionManager generate the ephemeral keys of
+// its sessions using the bytes read from r instead of crypto/rand.
+// This is only meant for tests that need reproducible handshakes,
+// and must never be used in production.
+func WithRand(r io.Reader) Option {
+	return func(sm *sessionManager) {
+		sm.rand = r
+	}
+}
+
+// WithTracer makes the SessionManager start a span using tracer for
+// each message 3, and end it once the session is either authenticated
+// or rejected.
+func WithTracer(tracer Tracer) Option {
+	return func(sm *sessionManager) {
+		sm.tracer = tracer
+	}
+}
+
+// WithOnVerified makes the SessionManager call f once a session is
+// authenticated, right before creating message 4. The bytes f returns
+// are sealed with the session key and sent in the payload of message
+// 4, in place of Configuration.Msg4Payload; they can be at most
+// MAX_MSG4_PAYLOAD_SIZE bytes. If f returns an error, the session is
+// removed and message 3 fails with that error.
+func WithOnVerified(f func(sn Session) ([]byte, error)) Option {
+	return func(sm *sessionManager) {
+		sm.onVerified = f
+	}
+}
+
+// WithRevocationStore makes the SessionManager publish the sessions
+// revoked with Revoke to store, and drop its sessions that were
+// revoked in store by others.
+func WithRevocationStore(store RevocationStore) Option {
+	return func(sm *sessionManager) {
+		sm.revocations = store
+	}
+}
+
+// WithRetryCoalescing makes the SessionManager keep at most one
+// session waiting for message 1 per client id (Request.ClientId).
+// When a client that lost its challenge calls NewSession again, its
+// previous session is removed if it has not received message 1 yet,
+// instead of holding a slot until it expires. Requests without a
+// client id are not coalesced. The client id is not authenticated,
+// so it should be hard to guess; otherwise, anyone can replace the
+// pending sessions of a client.
+func WithRetryCoalescing() Option {
+	return func(sm *sessionManager) {
+		sm.coalesce = true
+		sm.pendingByClient = make(map[string]string)
+		sm.pendingClients = make(map[string]string)
+	}
+}
+
+// WithOnEvict makes the SessionManager call onEvict for every session
+// evicted to make room for a new one because of MaxSessions, e.g., to
+// keep an audit log of the clients that were pushed out. reason is
+// always REMOVAL_EVICTED for now. onEvict is called synchronously by
+// the NewSession that caused the eviction, before the removal is
+// recorded (so before the EVENT_SESSION_CLOSED event), and without
+// any of the locks of the SessionManager held, so it may call back
+// into it. It slows down NewSession for as long as it runs. Sessions
+// removed for any other reason are not reported to onEvict.
+func WithOnEvict(onEvict func(info SessionInfo, reason string)) Option {
+	return func(sm *sessionManager) {
+		sm.onEvict = onEvict
+	}
 }
 
 // NewSessionManager creates a simple SessionManager with LRU cache
-// policy using the configuration.
-func NewSessionManager(config *Configuration) SessionManager {
-	configInternal := *parseConfiguration(config)
+// policy using the configuration. It fails with log.Fatal if the
+// configuration is invalid, or its files cannot be read.
+func NewSessionManager(config *Configuration, opts ...Option) SessionManager {
+	sm, err := NewSessionManagerFromConfig(config, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return sm
+}
+
+// NewSessionManagerFromConfig is like NewSessionManager, but returns
+// an error rather than exit if the configuration is invalid, for
+// programs that embed the session manager and handle errors
+// themselves.
+func NewSessionManagerFromConfig(config *Configuration, opts ...Option) (SessionManager, error) {
+	parsed, err := newConfiguration(config)
+	if err != nil {
+		return nil, err
+	}
+	sm := newSessionManager(*parsed, nil, opts...)
+	sm.logger.Printf("Using the %s IAS at %s (Release is %t).",
+		releaseMode(sm.release), strings.Join(sm.iasHosts(), ", "), sm.release)
+	return sm, nil
+}
+
+// releaseMode names the IAS environment for release.
+func releaseMode(release bool) string {
+	if release {
+		return ENV_PRODUCTION
+	}
+	return ENV_DEVELOPMENT
+}
+
+// newSessionManager creates the session manager. If ias is nil, it
+// creates one that talks to the real IAS.
+func newSessionManager(config configuration, ias IAS, opts ...Option) *sessionManager {
 	sm := &sessionManager{
-		configuration: configInternal,
-		sessions:      NewSimpleLRUCache(configInternal.maxSessions),
-		ias:           NewIAS(configInternal.release, configInternal.subscription, configInternal.allowedAdvisories),
+		configuration:   config,
+		removed:         list.New(),
+		removedM:        make(map[string]*list.Element),
+		removals:        make(map[RemovalReason]int),
+		svns:            make(map[uint16]int),
+		advisories:      make(map[string]int),
+		handshakeTimes:  newHistogram(),
+		msg1ToMsg2Times: newHistogram(),
+		msg3ToMsg4Times: newHistogram(),
+		now:             time.Now,
+		events:          make(chan Event, EVENT_BUFFER_SIZE),
+		stop:            make(chan struct{}),
+	}
+	if config.maxInFlight > 0 {
+		sm.inFlight = make(chan struct{}, config.maxInFlight)
+	}
+	sm.sessions = newLRUCache(config.maxSessions, func(id string, sn Session) {
+		if sm.onEvict != nil {
+			sm.onEvict(sm.sessionInfo(sn), string(REMOVAL_EVICTED))
+		}
+		sm.recordRemoval(id, REMOVAL_EVICTED)
+	})
+	for _, opt := range opts {
+		opt(sm)
+	}
+	if sm.logger == nil {
+		sm.logger = defaultLogger()
+	}
+	if config.requireNonce {
+		sm.clientNonces = newNonceCache(CLIENT_NONCE_CACHE_SIZE, time.Duration(config.nonceWindow)*time.Second, sm.now)
 	}
+	sm.logger = newRedactingLogger(sm.logger, sm.redaction, sm.secrets()...)
+	sessionConf := sm.configuration
+	sm.sessionConf = &sessionConf
 
+	if ias == nil {
+		if sm.iasInsecure && !sm.release {
+			sm.logger.Printf("WARNING: IASInsecureSkipTLSVerify is set, the TLS certificate of IAS is NOT verified. Never use this outside of development.")
+		}
+		ias = NewIAS(sm.release, sm.subscription, sm.allowedAdvisories, iasOptions(&sm.configuration)...)
+	}
+
+	sm.baseIAS = ias
+
+	if config.iasMaxConcurrent > 0 {
+		ias = newLimitIAS(ias, config.iasMaxConcurrent, time.Duration(config.iasQueueTimeout)*time.Second)
+	}
+	if config.sigRLCacheTime > 0 {
+		ias = newSigRLCacheIAS(ias, time.Duration(config.sigRLCacheTime)*time.Minute, sm.now)
+	}
+	if config.maxIASCallsPerDay > 0 {
+		ias = newQuotaIAS(ias, config.maxIASCallsPerDay, sm.now)
+	}
+	sm.reverifyIAS = ias
+	if config.allowCachedReport {
+		ias = newOutageIAS(ias, time.Duration(config.maxCachedAge)*time.Minute, sm.now)
+	}
+	sm.ias = ias
+
+	if config.reverifyInterval > 0 {
+		sm.goBackground(sm.reverifyLoop)
+	}
 	return sm
 }
 
+// iasOptions translates the IAS related parts of the configuration
+// into options for NewIAS.
+func iasOptions(config *configuration) []IASOption {
+	var opts []IASOption
+	if config.iasClientCert != nil {
+		opts = append(opts, WithClientCertificate(*config.iasClientCert))
+	}
+	if len(config.iasEndpoints) > 0 {
+		opts = append(opts, WithEndpoints(config.iasEndpoints...))
+	}
+	if config.nonceCacheSize > 0 || config.nonceCacheTTL > 0 {
+		size, ttl := DEFAULT_NONCE_CACHE_SIZE, DEFAULT_NONCE_CACHE_TTL
+		if config.nonceCacheSize > 0 {
+			size = config.nonceCacheSize
+		}
+		if config.nonceCacheTTL > 0 {
+			ttl = time.Duration(config.nonceCacheTTL) * time.Second
+		}
+		opts = append(opts, WithNonceCache(size, ttl))
+	}
+	if config.iasUserAgent != "" {
+		opts = append(opts, WithUserAgent(config.iasUserAgent))
+	}
+	if config.iasTimeout > 0 {
+		opts = append(opts, WithTimeout(time.Duration(config.iasTimeout)*time.Second))
+	}
+	if config.iasInsecure {
+		opts = append(opts, WithInsecureSkipVerify())
+	}
+	if config.signingRoots != nil {
+		opts = append(opts, WithReportSigningRoots(config.release, config.signingRoots))
+	}
+	if config.minTCBEvaluation > 0 {
+		opts = append(opts, WithMinTCBEvaluationDataNumber(config.minTCBEvaluation))
+	}
+	if config.traceHandshake {
+		opts = append(opts, WithReportLogger(config.logger))
+	}
+	return opts
+}
+
 func (sm *sessionManager) GetSession(id string) (Session, bool) {
 	return sm.sessions.Get(id)
 }
 
+// The number of fresh ids NewSession tries before giving up.
+const maxSessionIDAttempts = 8
+
 func (sm *sessionManager) NewSession(in *Request) (*Challenge, error) {
-	// With 16 byte random ids, we should never run into collisions in IDs.
-	var bytes [16]byte
-	_, err := rand.Read(bytes[:])
+	return sm.NewSessionCtx(context.Background(), in)
+}
+
+func (sm *sessionManager) NewSessionCtx(ctx context.Context, in *Request) (*Challenge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%w %v", ErrSessionCanceled, err)
+	}
+
+	conf := sm.currentConfiguration()
+	challenge := make([]byte, conf.challengeLength)
+	_, err := rand.Read(challenge)
 	if err != nil {
 		return nil, err
 	}
-	id := hex.EncodeToString(bytes[:])
 
-	sm.sessions.Set(id, NewSession(id, sm.release, sm.timeout, sm.ias, sm.mrenclaves, sm.mrsigners, sm.spid, sm.longTermKey, sm.prodID, sm.prodSVN))
+	// With 16 byte random ids, we should never run into collisions
+	// in IDs. If we ever do, the id is only taken by storing the
+	// session atomically, so two sessions can never share one.
+	for i := 0; i < maxSessionIDAttempts; i++ {
+		var bytes [16]byte
+		_, err := rand.Read(bytes[:])
+		if err != nil {
+			return nil, err
+		}
+		id := hex.EncodeToString(bytes[:])
 
-	return &Challenge{
-		SessionId: id,
-	}, nil
+		sn := newSession(id, conf, sm.ias)
+		sn.challenge = challenge
+		sn.clientNonces = sm.clientNonces
+		sn.now = sm.now
+		sn.created = sm.now()
+		sn.lastUsed = sn.created
+		sn.ctx = ctx
+		if sm.sessions.SetIfAbsent(id, sn) {
+			sm.emit(EVENT_SESSION_CREATED, id, nil, "")
+			if sm.coalesce && in.GetClientId() != "" {
+				sm.replacePending(in.GetClientId(), id)
+			}
+			if ctx.Done() != nil {
+				sm.goBackground(func() { sm.removeWhenDone(ctx, id, sn) })
+			}
+			return &Challenge{
+				SessionId: id,
+				Challenge: challenge,
+			}, nil
+		}
+	}
+	return nil, errors.New("Could not generate a unique session id.")
 }
 
-func (sm *sessionManager) Msg1ToMsg2(id string, msg1 *Msg1) (*Msg2, error) {
+// replacePending makes id the pending session of client, and removes
+// the previous pending session of client if it still has not
+// processed message 1.
+func (sm *sessionManager) replacePending(client string, id string) {
+	sm.mu.Lock()
+	prev, ok := sm.pendingByClient[client]
+	sm.pendingByClient[client] = id
+	sm.pendingClients[id] = client
+	sm.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if sn, found := sm.sessions.Get(prev); found && awaitingMsg1(sn) {
+		sm.sessions.Delete(prev)
+		sm.recordRemoval(prev, REMOVAL_REPLACED)
+	}
+}
+
+// clearPending forgets the client of the session matching id, once
+// the session is no longer pending.
+func (sm *sessionManager) clearPending(id string) {
+	if !sm.coalesce {
+		return
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.forgetPending(id)
+}
+
+// forgetPending is clearPending with mu held.
+func (sm *sessionManager) forgetPending(id string) {
+	if client, ok := sm.pendingClients[id]; ok {
+		delete(sm.pendingClients, id)
+		if sm.pendingByClient[client] == id {
+			delete(sm.pendingByClient, client)
+		}
+	}
+}
+
+// awaitingMsg1 reports whether sn has not processed message 1 yet.
+func awaitingMsg1(sn Session) bool {
+	s, ok := sn.(*session)
+	return ok && s.ga == nil
+}
+
+// removeWhenDone waits for ctx to be done, and then removes sn if it
+// is still the session matching id. It gives up once the session
+// manager is stopped; Expired still fails once ctx is done.
+func (sm *sessionManager) removeWhenDone(ctx context.Context, id string, sn Session) {
+	select {
+	case <-ctx.Done():
+	case <-sm.stop:
+		return
+	}
+	if current, ok := sm.sessions.Get(id); ok && current == sn {
+		sm.sessions.Delete(id)
+		sm.recordRemoval(id, REMOVAL_CANCELED)
+	}
+}
+
+// lookup returns the session matching id. If there is no such
+// session, the error tells whether it was evicted, expired, or never
+// existed.
+func (sm *sessionManager) lookup(id string) (Session, error) {
+	if id == "" {
+		return nil, ErrInvalidSessionID
+	}
 	session, ok := sm.GetSession(id)
 	if !ok {
-		return nil, errors.New("Session not found")
+		sm.mu.RLock()
+		defer sm.mu.RUnlock()
+		if e, ok := sm.removedM[id]; ok {
+			switch e.Value.(*removedSession).reason {
+			case REMOVAL_EVICTED:
+				return nil, ErrSessionManagerFull
+			case REMOVAL_EXPIRED:
+				return nil, ErrSessionExpired
+			case REMOVAL_INVALIDATED:
+				return nil, ErrSessionInvalidated
+			case REMOVAL_CANCELED:
+				return nil, ErrSessionCanceled
+			case REMOVAL_REVOKED:
+				return nil, ErrSessionRevoked
+			case REMOVAL_REPLACED:
+				return nil, ErrSessionReplaced
+			case REMOVAL_DEGRADED:
+				return nil, ErrSessionDegraded
+			}
+		}
+		return nil, ErrSessionNotFound
+	}
+	if err := session.Expired(); err != nil {
+		sm.remove(id, err)
+		return nil, err
+	}
+	if sm.revocations != nil {
+		// Fail closed, since the session may have been revoked.
+		revoked, err := sm.revocations.Revoked(id)
+		if err != nil {
+			return nil, fmt.Errorf("Could not check whether the session was revoked: %w", err)
+		} else if revoked {
+			sm.sessions.Delete(id)
+			sm.recordRemoval(id, REMOVAL_REVOKED)
+			return nil, ErrSessionRevoked
+		}
+	}
+	return session, nil
+}
+
+// remove deletes the session matching id after it failed with err.
+func (sm *sessionManager) remove(id string, err error) {
+	sm.sessions.Delete(id)
+	if errors.Is(err, ErrSessionExpired) {
+		sm.recordRemoval(id, REMOVAL_EXPIRED)
+	} else if errors.Is(err, ErrSessionCanceled) {
+		sm.recordRemoval(id, REMOVAL_CANCELED)
+	} else {
+		sm.recordRemoval(id, REMOVAL_FAILED)
+	}
+}
+
+// recordRemoval remembers that the session matching id was removed
+// for reason.
+func (sm *sessionManager) recordRemoval(id string, reason RemovalReason) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.removals[reason]++
+	if e, ok := sm.removedM[id]; ok {
+		sm.removed.Remove(e)
+	}
+	sm.removedM[id] = sm.removed.PushFront(&removedSession{id, reason})
+	if sm.removed.Len() > maxRemovedSessions {
+		oldest := sm.removed.Back()
+		delete(sm.removedM, oldest.Value.(*removedSession).id)
+		sm.removed.Remove(oldest)
+	}
+	sm.forgetPending(id)
+	sm.emit(EVENT_SESSION_CLOSED, id, nil, reason)
+}
+
+// recordSVN counts the enclave security version number of the
+// authenticated session sn.
+func (sm *sessionManager) recordSVN(sn Session) {
+	s, ok := sn.(*session)
+	if !ok {
+		return
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.svns[s.isvSVN]++
+}
+
+func (sm *sessionManager) ProcessMsg0(id string, msg0 *Msg0) (*Msg0Response, error) {
+	session, err := sm.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := session.ProcessMsg0(msg0); err != nil {
+		sm.remove(id, err)
+		return nil, err
+	}
+	return &Msg0Response{Exgid: msg0.Exgid}, nil
+}
+
+func (sm *sessionManager) Msg1ToMsg2(id string, msg1 *Msg1) (*Msg2, error) {
+	session, err := sm.lookup(id)
+	if err != nil {
+		return nil, err
 	}
 
 	// If msgs are invalid, or if we fail to create the message
 	// (e.g., due to timeout), then the session is removed from
 	// the list.
-	err := session.ProcessMsg1(msg1)
-	if err != nil {
-		sm.sessions.Delete(id)
+	err = session.ProcessMsg1(msg1)
+	if errors.Is(err, ErrMsg1Mismatch) {
+		// A forged retransmission must not tear down the
+		// handshake of the real client.
+		return nil, err
+	} else if err != nil {
+		sm.remove(id, err)
 		return nil, err
 	}
+	sm.clearPending(id)
 
 	msg2, err := session.CreateMsg2()
 	if err != nil {
-		sm.sessions.Delete(id)
+		sm.remove(id, err)
+		return nil, err
 	}
 
-	return msg2, err
+	sm.emit(EVENT_MSG2_SENT, id, nil, "")
+	return msg2, nil
 }
 
-func (sm *sessionManager) Msg3ToMsg4(id string, msg3 *Msg3) (*Msg4, error) {
-	session, ok := sm.GetSession(id)
-	if !ok {
-		return nil, errors.New("Session not found")
+func (sm *sessionManager) Msg3ToMsg4(id string, msg3 *Msg3) (msg4 *Msg4, err error) {
+	span := sm.startSpan(SPAN_MSG3)
+	span.SetAttribute(SPAN_SESSION_ID, id)
+
+	session, err := sm.lookup(id)
+	defer func() { endMsg3Span(span, session, err) }()
+	if err != nil {
+		return nil, err
+	}
+
+	if retransmittedMsg3(session, msg3) {
+		// The handshake already succeeded, so send the same
+		// message 4 without counting it again, or taking a slot
+		// since IAS is not contacted.
+		if err = session.ProcessMsg3(msg3); err != nil {
+			return nil, err
+		}
+		return session.CreateMsg4()
+	}
+
+	if !sm.acquireInFlight() {
+		return nil, ErrBusy
 	}
+	defer sm.releaseInFlight()
 
 	// TODO: generate a proper Msg4 if an error happens during msg3.
-	err := session.ProcessMsg3(msg3)
+	err = session.ProcessMsg3(msg3)
+	if errors.Is(err, ErrMsg3AlreadyProcessed) {
+		// Don't let a replayed message 3 tear down a session
+		// that has already been authenticated.
+		return nil, err
+	}
+	sm.recordAdvisories(session)
 	if err != nil {
-		sm.sessions.Delete(id)
+		sm.emit(EVENT_ATTESTATION_RESULT, id, err, "")
+		sm.remove(id, err)
 		return nil, err
 	}
 
-	msg4, err := session.CreateMsg4()
+	msg4, err = session.CreateMsg4()
+	timing := handshakeTiming(session)
+	sm.send(Event{
+		Type:      EVENT_ATTESTATION_RESULT,
+		SessionID: id,
+		Time:      sm.now(),
+		Err:       err,
+		Timing:    timing,
+	})
 	if err != nil || !session.Authenticated() {
-		sm.sessions.Delete(id)
+		sm.remove(id, err)
+	} else {
+		sm.recordSVN(session)
+		sm.recordTiming(timing)
 	}
 	return msg4, err
 }
+
+// retransmittedMsg3 reports whether msg3 is the message 3 that
+// already authenticated sn.
+func retransmittedMsg3(sn Session, msg3 *Msg3) bool {
+	s, ok := sn.(*session)
+	return ok && s.retransmittedMsg3(msg3)
+}
+
+// acquireInFlight takes a slot for verifying a message 3, without
+// waiting for one. It always succeeds if there is no limit.
+func (sm *sessionManager) acquireInFlight() bool {
+	if sm.inFlight == nil {
+		return true
+	}
+	select {
+	case sm.inFlight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sm *sessionManager) releaseInFlight() {
+	if sm.inFlight != nil {
+		<-sm.inFlight
+	}
+}
+
+func (sm *sessionManager) Events() <-chan Event {
+	return sm.events
+}
+
+// currentConfiguration returns the configuration for new sessions.
+func (sm *sessionManager) currentConfiguration() *configuration {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.sessionConf
+}
+
+func (sm *sessionManager) ReloadProdSVN(svn uint16) int {
+	sm.mu.Lock()
+	conf := *sm.sessionConf
+	raised := svn > conf.prodSVN
+	conf.prodSVN = svn
+	sm.sessionConf = &conf
+	sm.mu.Unlock()
+
+	if !raised || !conf.invalidateOnRaise {
+		return 0
+	}
+	return sm.closeBelowProdSVN(&conf)
+}
+
+func (sm *sessionManager) Reconfigure(config *Configuration) error {
+	conf, err := newConfiguration(config)
+	if err != nil {
+		return err
+	}
+
+	sm.mu.Lock()
+	current := sm.sessionConf
+	if err := checkFixedSettings(current, conf); err != nil {
+		sm.mu.Unlock()
+		return err
+	}
+	// These are set by the session manager rather than read from
+	// the Configuration.
+	conf.logger = current.logger
+	conf.rand = current.rand
+	conf.onVerified = current.onVerified
+	raised := conf.prodSVN > current.prodSVN
+	sm.sessionConf = conf
+	sm.mu.Unlock()
+
+	if raised && conf.invalidateOnRaise {
+		sm.closeBelowProdSVN(conf)
+	}
+	return nil
+}
+
+// checkFixedSettings returns an error if next changes a setting of
+// current that Reconfigure cannot change.
+func checkFixedSettings(current, next *configuration) error {
+	if !reflect.DeepEqual(current.secrets(), next.secrets()) {
+		return errors.New("Subscription, the long-term keys, and Msg4Payload cannot be reconfigured.")
+	}
+	fixed, nextFixed := current.fixedSettings(), next.fixedSettings()
+	var names []string
+	for name := range fixed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !reflect.DeepEqual(fixed[name], nextFixed[name]) {
+			return errors.New(fmt.Sprintf("%s cannot be reconfigured.", name))
+		}
+	}
+	return nil
+}
+
+// closeBelowProdSVN closes the sessions that do not meet the minimum
+// ProdSVN of conf, which was just raised: the authenticated sessions
+// of a lower SVN, and the ones still in the middle of the handshake.
+// Returns the number of sessions closed.
+func (sm *sessionManager) closeBelowProdSVN(conf *configuration) int {
+	svn := conf.prodSVN
+	var closed []string
+	sm.sessions.Range(func(id string, sn Session) {
+		s, ok := sn.(*session)
+		if !ok {
+			return
+		}
+		if peer, _, authenticated := s.verifiedIdentity(); authenticated {
+			if peer.SVN >= svn {
+				return
+			} else if _, own := conf.prodSVNs[peer.ProdID]; own {
+				return
+			}
+		}
+		closed = append(closed, id)
+	})
+	for _, id := range closed {
+		sm.sessions.Delete(id)
+		sm.recordRemoval(id, REMOVAL_INVALIDATED)
+	}
+	return len(closed)
+}
+
+// How often the sessions are checked for whether they are due to be
+// re-verified, if ReverifyInterval is set.
+const REVERIFY_CHECK_PERIOD = time.Minute
+
+// reverifyLoop re-verifies the sessions that are due until the
+// session manager is stopped.
+func (sm *sessionManager) reverifyLoop() {
+	ticker := time.NewTicker(REVERIFY_CHECK_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sm.stop:
+			return
+		case <-ticker.C:
+			sm.reverifySessions()
+		}
+	}
+}
+
+// reverifySessions sends the quotes of the authenticated sessions that
+// were last verified at least ReverifyInterval ago to IAS again, and
+// closes the sessions whose quotes IAS now rejects. If IAS could not
+// be asked, the session is kept and tried again on the next check.
+// Returns the number of sessions closed.
+func (sm *sessionManager) reverifySessions() int {
+	interval := time.Duration(sm.reverifyInterval) * time.Minute
+	now := sm.now()
+	type dueSession struct {
+		s    *session
+		msg3 *Msg3
+	}
+	var due []dueSession
+	sm.sessions.Range(func(id string, sn Session) {
+		if s, ok := sn.(*session); ok {
+			if msg3 := s.dueForReverify(now, interval); msg3 != nil {
+				due = append(due, dueSession{s, msg3})
+			}
+		}
+	})
+
+	closed := 0
+	for _, d := range due {
+		s := d.s
+		_, _, _, err := sm.reverifyIAS.VerifyQuoteAndPSE(d.msg3.M.Quote, d.msg3.M.PsSecurityProp)
+		if err == nil {
+			s.reverified(now)
+			continue
+		} else if !errors.Is(err, ErrQuoteRejected) {
+			sm.logger.Printf("Could not verify session %s again: %v", identifier(s.id), err)
+			continue
+		}
+		sm.logger.Printf("Closing session %s, its quote is no longer accepted: %v", identifier(s.id), err)
+		if current, ok := sm.sessions.Get(s.id); ok && current == Session(s) {
+			sm.sessions.Delete(s.id)
+			sm.recordRemoval(s.id, REMOVAL_DEGRADED)
+			closed++
+		}
+	}
+	return closed
+}
+
+// goBackground runs f in a goroutine that Stop waits for, unless the
+// session manager is already stopped. f must return once sm.stop is
+// closed. Returns whether f was started.
+func (sm *sessionManager) goBackground(f func()) bool {
+	sm.bgMu.Lock()
+	defer sm.bgMu.Unlock()
+	if sm.stopped {
+		return false
+	}
+	sm.wg.Add(1)
+	go func() {
+		defer sm.wg.Done()
+		f()
+	}()
+	return true
+}
+
+func (sm *sessionManager) Stop() {
+	sm.bgMu.Lock()
+	if !sm.stopped {
+		sm.stopped = true
+		close(sm.stop)
+	}
+	sm.bgMu.Unlock()
+	sm.wg.Wait()
+}
+
+func (sm *sessionManager) Revoke(id string) error {
+	if id == "" {
+		return ErrInvalidSessionID
+	}
+	_, local := sm.sessions.Get(id)
+	if local {
+		sm.sessions.Delete(id)
+		sm.recordRemoval(id, REMOVAL_REVOKED)
+	}
+	if sm.revocations != nil {
+		return sm.revocations.Revoke(id)
+	} else if !local {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (sm *sessionManager) TrustMREnclave(mr [MR_SIZE]byte) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, trusted := range sm.sessionConf.mrenclaves {
+		if trusted == mr {
+			return
+		}
+	}
+
+	// Sessions share the old list, so it is copied rather than
+	// appended to in place.
+	conf := *sm.sessionConf
+	conf.mrenclaves = append(append([][MR_SIZE]byte(nil), conf.mrenclaves...), mr)
+	sm.sessionConf = &conf
+}
+
+func (sm *sessionManager) UntrustMREnclave(mr [MR_SIZE]byte) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	var mrenclaves [][MR_SIZE]byte
+	for _, trusted := range sm.sessionConf.mrenclaves {
+		if trusted != mr {
+			mrenclaves = append(mrenclaves, trusted)
+		}
+	}
+	if len(mrenclaves) == len(sm.sessionConf.mrenclaves) {
+		return false
+	}
+
+	conf := *sm.sessionConf
+	conf.mrenclaves = mrenclaves
+	sm.sessionConf = &conf
+	return true
+}
+
+func (sm *sessionManager) TrustedMeasurements() ([]string, []string) {
+	conf := sm.currentConfiguration()
+	return hexMRs(conf.mrenclaves), hexMRs(conf.mrsigners)
+}
+
+func hexMRs(mrs [][MR_SIZE]byte) []string {
+	encoded := make([]string, len(mrs))
+	for i, mr := range mrs {
+		encoded[i] = hex.EncodeToString(mr[:])
+	}
+	return encoded
+}
+
+func (sm *sessionManager) LongTermPublicBytes() ([]byte, []byte) {
+	x, y, _ := marshalPublicKey(&sm.longTermKey.PublicKey)
+	return x, y
+}
+
+func (sm *sessionManager) Describe() ManagerInfo {
+	current := sm.currentConfiguration()
+	config := current.toConfiguration()
+	return ManagerInfo{
+		Release:                    config.Release,
+		IASHost:                    current.iasHosts()[0],
+		ProdID:                     uint16(config.ProdID),
+		ProdSVN:                    uint16(config.ProdSVN),
+		MaxSessions:                config.MaxSessions,
+		MaxInFlightHandshakes:      config.MaxInFlightHandshakes,
+		Timeout:                    config.Timeout,
+		MREnclaves:                 len(current.mrenclaves),
+		MRSigners:                  len(current.mrsigners),
+		MeasurementPolicy:          config.MeasurementPolicy,
+		LongTermKeys:               1 + len(sm.secondaryKeys),
+		SkipSigRL:                  config.SkipSigRL,
+		MaxIASCallsPerDay:          config.MaxIASCallsPerDay,
+		MinTCBEvaluationDataNumber: config.MinTCBEvaluationDataNumber,
+		AllowCachedOnIASOutage:     config.AllowCachedOnIASOutage,
+		TraceHandshake:             config.TraceHandshake,
+		ChallengeLength:            config.ChallengeLength,
+	}
+}
+
+// recordAdvisories counts the advisories IAS returned for the quote of
+// sn, if IAS was asked to verify it.
+func (sm *sessionManager) recordAdvisories(sn Session) {
+	s, ok := sn.(*session)
+	if !ok || !s.iasCalled || len(s.advisories) == 0 {
+		return
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	seen := make(map[string]bool, len(s.advisories))
+	for _, advisory := range s.advisories {
+		if !seen[advisory] {
+			seen[advisory] = true
+			sm.advisories[advisory]++
+		}
+	}
+}
+
+func (sm *sessionManager) Stats() Stats {
+	// The cache calls recordRemoval when it evicts a session,
+	// so it must not be called while holding sm.mu. Len does not
+	// visit the sessions, so this does not get slower as there
+	// are more of them.
+	sessions := sm.sessions.Len()
+
+	// Only the counters are copied with the lock held. There are
+	// a few of them for each reason, SVN, and advisory, however
+	// many sessions there are.
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	removals := make(map[RemovalReason]int, len(sm.removals))
+	for reason, n := range sm.removals {
+		removals[reason] = n
+	}
+	svns := make(map[uint16]int, len(sm.svns))
+	for svn, n := range sm.svns {
+		svns[svn] = n
+	}
+	advisories := make(map[string]int, len(sm.advisories))
+	for advisory, n := range sm.advisories {
+		advisories[advisory] = n
+	}
+	return Stats{
+		Sessions:           sessions,
+		Removals:           removals,
+		InFlightHandshakes: len(sm.inFlight),
+		EnclaveSVNs:        svns,
+		Advisories:         advisories,
+		HandshakeTimes:     sm.handshakeTimes.copy(),
+		Msg1ToMsg2Times:    sm.msg1ToMsg2Times.copy(),
+		Msg3ToMsg4Times:    sm.msg3ToMsg4Times.copy(),
+	}
+}
+
+func (sm *sessionManager) Warm(ctx context.Context) error {
+	if c, ok := sm.baseIAS.(iasConnector); ok {
+		if err := c.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	conf := sm.currentConfiguration()
+	if !conf.useSigRL {
+		return nil
+	}
+	for _, gid := range conf.sigRLGroups {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := sm.ias.GetRevocationList(gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1557 @@
+package sgx_server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// bufferLogger collects the logs in memory.
+type bufferLogger struct {
+	bytes.Buffer
+}
+
+func (l *bufferLogger) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(l, format+"\n", v...)
+}
+
+// managerHandshake runs a full attestation against sm, and returns
+// the session id along with the result of sending message 3.
+func managerHandshake(t testing.TB, sm SessionManager) (string, *Msg4, error) {
+	return managerHandshakeWithQuote(t, sm, newTestQuote())
+}
+
+// managerHandshakeWithQuote is like managerHandshake, but sends quote
+// in message 3.
+func managerHandshakeWithQuote(t testing.TB, sm SessionManager, quote []byte) (string, *Msg4, error) {
+	challenge, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := challenge.SessionId
+
+	priv, msg1 := newTestMsg1()
+	msg2, err := sm.Msg1ToMsg2(id, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg4, err := sm.Msg3ToMsg4(id, newTestMsg3(priv, msg1, msg2, quote))
+	return id, msg4, err
+}
+
+func TestIASQuota(t *testing.T) {
+	now := time.Date(2019, 10, 1, 23, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	conf := authConfiguration()
+	conf.maxIASCallsPerDay = 2
+	ias := &fakeIAS{}
+	sm := newSessionManager(*conf, ias, WithClock(clock))
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := managerHandshake(t, sm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := managerHandshake(t, sm); err != ErrIASQuotaExceeded {
+		t.Fatal("Expected the IAS quota to be exceeded, got:", err)
+	} else if ias.verifyCalls != 2 {
+		t.Fatal("IAS should not be called after the quota is exceeded.")
+	}
+
+	// The quota resets at midnight UTC.
+	now = now.Add(2 * time.Hour)
+	if _, _, err := managerHandshake(t, sm); err != nil {
+		t.Fatal("Quota should have been reset:", err)
+	}
+}
+
+func TestTraceHandshake(t *testing.T) {
+	conf := authConfiguration()
+	conf.traceHandshake = true
+	logger := &bufferLogger{}
+	sm := newSessionManager(*conf, &fakeIAS{}, WithLogger(logger))
+
+	id, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := logger.String()
+	for _, field := range []string{"gid 01020304", "kdf id 0100", "sigrl length 0", "mac valid true"} {
+		if !strings.Contains(logs, field) {
+			t.Errorf("Trace is missing [%s]:\n%s", field, logs)
+		}
+	}
+
+	session, _ := sm.GetSession(id)
+	for _, label := range [][]byte{SK_LABEL, MK_LABEL, VK_LABEL} {
+		key, err := session.ExportKey(label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(logs, hex.EncodeToString(key)) {
+			t.Errorf("Trace contains the %s.", label)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	conf := authConfiguration()
+	conf.release = true
+	conf.subscription = "secret-subscription-key"
+	conf.prodID = 7
+	conf.maxSessions = 100
+	sm := newSessionManager(*conf, &fakeIAS{})
+
+	info := sm.Describe()
+	if !info.Release || info.IASHost != IAS_HOST || info.ProdID != 7 ||
+		info.MaxSessions != 100 || info.MREnclaves != 1 || info.LongTermKeys != 1 {
+		t.Fatalf("Incorrect description: %+v", info)
+	}
+
+	dump := fmt.Sprintf("%+v", info)
+	if strings.Contains(dump, conf.subscription) {
+		t.Fatal("Description contains the subscription key.")
+	}
+	if strings.Contains(dump, conf.longTermKey.D.String()) || strings.Contains(dump, conf.longTermKey.D.Text(16)) {
+		t.Fatal("Description contains the long-term key.")
+	}
+}
+
+func TestSessionEvicted(t *testing.T) {
+	conf := authConfiguration()
+	conf.maxSessions = 1
+	sm := newSessionManager(*conf, &fakeIAS{})
+
+	first, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.NewSession(&Request{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, msg1 := newTestMsg1()
+	if _, err := sm.Msg1ToMsg2(first.SessionId, msg1); err != ErrSessionManagerFull {
+		t.Fatal("Expected the session to be evicted, got:", err)
+	}
+	stats := sm.Stats()
+	if stats.Sessions != 1 || stats.Removals[REMOVAL_EVICTED] != 1 {
+		t.Fatalf("Incorrect stats: %+v", stats)
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	conf := authConfiguration()
+	conf.timeout = 1
+	sm := newSessionManager(*conf, &fakeIAS{}, WithClock(clock))
+
+	challenge, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := challenge.SessionId
+
+	now = now.Add(2 * time.Minute)
+	_, msg1 := newTestMsg1()
+	if _, err := sm.Msg1ToMsg2(id, msg1); err != ErrSessionExpired {
+		t.Fatal("Expected the session to be expired, got:", err)
+	}
+	// The session is gone, but the manager still knows why.
+	if _, err := sm.Msg1ToMsg2(id, msg1); err != ErrSessionExpired {
+		t.Fatal("Expected the session to be expired, got:", err)
+	}
+	stats := sm.Stats()
+	if stats.Sessions != 0 || stats.Removals[REMOVAL_EXPIRED] != 1 {
+		t.Fatalf("Incorrect stats: %+v", stats)
+	}
+}
+
+func TestSessionFailed(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+
+	challenge, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := challenge.SessionId
+
+	_, msg1 := newTestMsg1()
+	msg1.Ga = &PublicKey{}
+	if _, err := sm.Msg1ToMsg2(id, msg1); err != ErrInvalidClientKey {
+		t.Fatal("Expected an invalid client key, got:", err)
+	}
+	if _, err := sm.Msg1ToMsg2(id, msg1); err != ErrSessionNotFound {
+		t.Fatal("Expected the session to be gone, got:", err)
+	}
+	if _, err := sm.Msg1ToMsg2("unknown", msg1); err != ErrSessionNotFound {
+		t.Fatal("Expected no session, got:", err)
+	}
+	stats := sm.Stats()
+	if stats.Sessions != 0 || stats.Removals[REMOVAL_FAILED] != 1 {
+		t.Fatalf("Incorrect stats: %+v", stats)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	conf := authConfiguration()
+	conf.sigRLCacheTime = 10
+	// The group of newTestMsg1, in the big-endian order of IAS.
+	gid, err := decodeGID("04030201")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.sigRLGroups = [][]byte{gid}
+	ias := &fakeIAS{sigRl: []byte("revocation list")}
+	sm := newSessionManager(*conf, ias)
+
+	if err := sm.Warm(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cache := sm.ias.(*sigRLCacheIAS)
+	if _, ok := cache.lists[hex.EncodeToString([]byte{1, 2, 3, 4})]; !ok || ias.rlCalls != 1 {
+		t.Fatal("Warm should have cached the SigRL.")
+	}
+
+	// The first client should get the SigRL from the cache.
+	challenge, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msg1 := newTestMsg1()
+	msg2, err := sm.Msg1ToMsg2(challenge.SessionId, msg1)
+	if err != nil {
+		t.Fatal(err)
+	} else if ias.rlCalls != 1 || string(msg2.SigRl) != "revocation list" {
+		t.Fatal("Message 2 should use the cached SigRL.")
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	conf := authConfiguration()
+	conf.challengeLength = 20
+	sm := newSessionManager(*conf, &fakeIAS{})
+
+	first, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Challenge) != 20 || len(second.Challenge) != 20 {
+		t.Fatal("Challenge should have the configured length.")
+	} else if bytes.Equal(first.Challenge, second.Challenge) {
+		t.Fatal("Challenges should be random.")
+	}
+
+	// The session remembers its challenge, and hands out copies.
+	sn, ok := sm.GetSession(first.SessionId)
+	if !ok {
+		t.Fatal("Session not found.")
+	}
+	challenge := sn.Challenge()
+	if !bytes.Equal(challenge, first.Challenge) {
+		t.Fatalf("Incorrect challenge %x, expected %x.", challenge, first.Challenge)
+	}
+	challenge[0] ^= 0xff
+	if !bytes.Equal(sn.Challenge(), first.Challenge) {
+		t.Fatal("Challenge should return a copy.")
+	}
+}
+
+// recordingSpan remembers everything recorded on it.
+type recordingSpan struct {
+	name       string
+	attributes map[string]interface{}
+	errors     []error
+	ended      bool
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) { s.attributes[key] = value }
+func (s *recordingSpan) RecordError(err error)                      { s.errors = append(s.errors, err) }
+func (s *recordingSpan) End()                                       { s.ended = true }
+
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+func (t *recordingTracer) StartSpan(name string) Span {
+	span := &recordingSpan{name: name, attributes: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	ias := &fakeIAS{}
+	sm := newSessionManager(*authConfiguration(), ias, WithTracer(tracer))
+
+	id, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ias.verifyErr = &QuoteStatusError{Status: ISV_GROUP_REVOKED}
+	rejected, _, err := managerHandshake(t, sm)
+	if err == nil {
+		t.Fatal("Revoked quote should be rejected.")
+	}
+
+	if len(tracer.spans) != 2 {
+		t.Fatal("Expected a span per message 3, got", len(tracer.spans))
+	}
+	span := tracer.spans[0]
+	if span.name != SPAN_MSG3 || !span.ended || span.attributes[SPAN_SESSION_ID] != id ||
+		span.attributes[SPAN_OUTCOME] != SPAN_AUTHENTICATED || len(span.errors) != 0 {
+		t.Fatalf("Incorrect span for the authenticated session: %+v", span)
+	}
+	if _, ok := span.attributes[SPAN_IAS_LATENCY].(time.Duration); !ok {
+		t.Fatal("Span should record the IAS latency.")
+	}
+
+	span = tracer.spans[1]
+	if !span.ended || span.attributes[SPAN_SESSION_ID] != rejected ||
+		span.attributes[SPAN_OUTCOME] != SPAN_REJECTED ||
+		span.attributes[SPAN_QUOTE_STATUS] != ISV_GROUP_REVOKED || len(span.errors) != 1 {
+		t.Fatalf("Incorrect span for the rejected session: %+v", span)
+	}
+}
+
+func TestGoldenMsg2(t *testing.T) {
+	conf := authConfiguration()
+	conf.longTermKey = generateKeyFrom(mrand.New(mrand.NewSource(1)))
+	sm := newSessionManager(*conf, &fakeIAS{}, WithRand(mrand.New(mrand.NewSource(2))))
+
+	challenge, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := generateKeyFrom(mrand.New(mrand.NewSource(3)))
+	x, y, _ := marshalPublicKey(&client.PublicKey)
+	msg1 := &Msg1{
+		Msg0: &Msg0{},
+		Ga:   &PublicKey{X: x, Y: y},
+		Gid:  []byte{1, 2, 3, 4},
+	}
+	msg2, err := sm.Msg1ToMsg2(challenge.SessionId, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ECDSA signatures (and so the CMAC over A) are randomized, so
+	// only the rest of message 2 is pinned.
+	if !verifyMsg2Signature(&conf.longTermKey.PublicKey, msg1, msg2) {
+		t.Fatal("Invalid message 2 signature.")
+	}
+	msg2.A.Signature = nil
+	msg2.CmacA = nil
+	golden := "0a600a440a20d050424ff5c143bb6edc74117f0358becb9a391b85a3855182f23df2c1d476ca12205bcd450636d4ef977f6848f6b97327d22d06909fce268f571094ec0abd06c7551210000000000000000000000000000000001a02000022020100"
+	if got := hex.EncodeToString(mustMarshal(t, msg2)); got != golden {
+		t.Fatalf("Message 2 does not match the golden bytes:\n%s", got)
+	}
+}
+
+func mustMarshal(t *testing.T, msg proto.Message) []byte {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEnclaveSVNs(t *testing.T) {
+	tracer := &recordingTracer{}
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{}, WithTracer(tracer))
+
+	for _, svn := range []uint16{3, 3, 4} {
+		challenge, err := sm.NewSession(&Request{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, msg1 := newTestMsg1()
+		msg2, err := sm.Msg1ToMsg2(challenge.SessionId, msg1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		quote := newTestQuote()
+		binary.LittleEndian.PutUint16(quote[ISVSVN_IN_QUOTE:], svn)
+		if _, err := sm.Msg3ToMsg4(challenge.SessionId, newTestMsg3(priv, msg1, msg2, quote)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if svns := sm.Stats().EnclaveSVNs; len(svns) != 2 || svns[3] != 2 || svns[4] != 1 {
+		t.Fatalf("Incorrect SVN histogram: %v", svns)
+	}
+	if svn := tracer.spans[2].attributes[SPAN_ISV_SVN]; svn != uint16(4) {
+		t.Fatal("Span should record the enclave SVN, got:", svn)
+	}
+}
+
+func TestReloadProdSVN(t *testing.T) {
+	svnQuote := func(svn uint16) []byte {
+		quote := newTestQuote()
+		binary.LittleEndian.PutUint16(quote[ISVSVN_IN_QUOTE:], svn)
+		return quote
+	}
+
+	for _, invalidate := range []bool{false, true} {
+		conf := authConfiguration()
+		conf.prodSVN = 1
+		conf.invalidateOnRaise = invalidate
+		sm := newSessionManager(*conf, &fakeIAS{})
+
+		old, _, err := managerHandshakeWithQuote(t, sm, svnQuote(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		current, _, err := managerHandshakeWithQuote(t, sm, svnQuote(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending, err := sm.NewSession(&Request{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		closed := sm.ReloadProdSVN(2)
+		_, oldOK := sm.GetSession(old)
+		_, currentOK := sm.GetSession(current)
+		_, msg1 := newTestMsg1()
+		_, pendingErr := sm.Msg1ToMsg2(pending.SessionId, msg1)
+		if invalidate {
+			if closed != 2 || oldOK || !currentOK || pendingErr != ErrSessionInvalidated {
+				t.Fatal("Sessions below the new SVN should be closed.")
+			} else if sm.Stats().Removals[REMOVAL_INVALIDATED] != 2 {
+				t.Fatal("Closed sessions should be counted.")
+			}
+		} else if closed != 0 || !oldOK || !currentOK || pendingErr != nil {
+			t.Fatal("Existing sessions should keep running.")
+		}
+
+		if _, _, err := managerHandshakeWithQuote(t, sm, svnQuote(1)); err == nil {
+			t.Fatal("New sessions should use the new SVN.")
+		}
+		if info := sm.Describe(); info.ProdSVN != 2 {
+			t.Fatal("Describe should show the new SVN, got:", info.ProdSVN)
+		}
+	}
+}
+
+// TestSDKMessageOrder runs the handshake in the order of the Intel
+// SDK sample, with message 0 sent on its own before message 1.
+func TestSDKMessageOrder(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+
+	challenge, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := challenge.SessionId
+
+	resp, err := sm.ProcessMsg0(id, &Msg0{Exgid: 0})
+	if err != nil {
+		t.Fatal(err)
+	} else if resp.Exgid != 0 {
+		t.Fatal("Incorrect extended GID in the response:", resp.Exgid)
+	}
+
+	priv, msg1 := newTestMsg1()
+	msg1.Msg0 = nil
+	msg2, err := sm.Msg1ToMsg2(id, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Msg3ToMsg4(id, newTestMsg3(priv, msg1, msg2, newTestQuote())); err != nil {
+		t.Fatal(err)
+	}
+	if sn, ok := sm.GetSession(id); !ok || !sn.Authenticated() {
+		t.Fatal("Session should be authenticated.")
+	}
+
+	other, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.ProcessMsg0(other.SessionId, &Msg0{Exgid: 1}); err != ErrUnsupportedExtendedGID {
+		t.Fatal("Only extended GID 0 should be accepted, got:", err)
+	}
+}
+
+func TestOnVerified(t *testing.T) {
+	refused := errors.New("no capacity")
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{}, WithOnVerified(func(sn Session) ([]byte, error) {
+		return nil, refused
+	}))
+	id, _, err := managerHandshake(t, sm)
+	if err != refused {
+		t.Fatal("Expected the error from the callback, got:", err)
+	}
+	if _, ok := sm.GetSession(id); ok {
+		t.Fatal("The session should be removed when the callback fails.")
+	}
+}
+
+// TestConcurrentNewSession is meant to be run with -race.
+func TestConcurrentNewSession(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+
+	const workers, perWorker = 16, 20
+	ids := make(chan string, workers*perWorker)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				challenge, err := sm.NewSession(&Request{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- challenge.SessionId
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatal("Session id reused:", id)
+		}
+		seen[id] = true
+	}
+	if stats := sm.Stats(); len(seen) != workers*perWorker || stats.Sessions != len(seen) {
+		t.Fatalf("Expected %d sessions, got %d ids and %d sessions.", workers*perWorker, len(seen), stats.Sessions)
+	}
+}
+
+func TestTrustMREnclave(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	canary := [MR_SIZE]byte{4, 5, 6}
+	quote := newTestQuote()
+	copy(quote[MRENCLAVE_IN_QUOTE:], canary[:])
+
+	if _, _, err := managerHandshakeWithQuote(t, sm, quote); !errors.Is(err, ErrEnclaveNotAllowed) {
+		t.Fatal("The canary should not be trusted yet, got:", err)
+	}
+
+	sm.TrustMREnclave(canary)
+	sm.TrustMREnclave(canary)
+	if info := sm.Describe(); info.MREnclaves != 2 {
+		t.Fatal("Expected 2 MREnclaves, got", info.MREnclaves)
+	}
+	pending, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := managerHandshakeWithQuote(t, sm, quote); err != nil {
+		t.Fatal("The canary should be trusted:", err)
+	}
+
+	if !sm.UntrustMREnclave(canary) {
+		t.Fatal("The canary should have been trusted.")
+	} else if sm.UntrustMREnclave(canary) {
+		t.Fatal("The canary should not be trusted anymore.")
+	}
+	if _, _, err := managerHandshakeWithQuote(t, sm, quote); !errors.Is(err, ErrEnclaveNotAllowed) {
+		t.Fatal("The canary should not be trusted anymore, got:", err)
+	}
+	if _, _, err := managerHandshake(t, sm); err != nil {
+		t.Fatal("The original enclave should still be trusted:", err)
+	}
+
+	// A session started while the canary was trusted keeps
+	// trusting it.
+	priv, msg1 := newTestMsg1()
+	msg2, err := sm.Msg1ToMsg2(pending.SessionId, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Msg3ToMsg4(pending.SessionId, newTestMsg3(priv, msg1, msg2, quote)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrustedMeasurements(t *testing.T) {
+	conf := authConfiguration()
+	var signer [MR_SIZE]byte
+	copy(signer[:], bytes.Repeat([]byte{0x51}, MR_SIZE))
+	conf.mrsigners = append(conf.mrsigners, signer)
+	sm := newSessionManager(*conf, &fakeIAS{})
+
+	mrenclaves, mrsigners := sm.TrustedMeasurements()
+	expected := []string{hex.EncodeToString(testMR[:])}
+	if !reflect.DeepEqual(mrenclaves, expected) {
+		t.Fatal("Incorrect MREnclaves:", mrenclaves)
+	} else if !reflect.DeepEqual(mrsigners, append(expected, hex.EncodeToString(signer[:]))) {
+		t.Fatal("Incorrect MRSigners:", mrsigners)
+	}
+
+	var canary [MR_SIZE]byte
+	copy(canary[:], bytes.Repeat([]byte{0xca}, MR_SIZE))
+	sm.TrustMREnclave(canary)
+	mrenclaves, _ = sm.TrustedMeasurements()
+	if !reflect.DeepEqual(mrenclaves, append(expected, hex.EncodeToString(canary[:]))) {
+		t.Fatal("The canary should be listed:", mrenclaves)
+	}
+
+	// The result is a copy.
+	mrenclaves[0] = "modified"
+	sm.UntrustMREnclave(canary)
+	if mrenclaves, _ = sm.TrustedMeasurements(); !reflect.DeepEqual(mrenclaves, expected) {
+		t.Fatal("The canary should not be listed anymore:", mrenclaves)
+	}
+}
+
+func TestNewSessionCtx(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	ctx, cancel := context.WithCancel(context.Background())
+	challenge, err := sm.NewSessionCtx(ctx, &Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := challenge.SessionId
+
+	priv, msg1 := newTestMsg1()
+	msg2, err := sm.Msg1ToMsg2(id, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancel in the middle of the handshake.
+	cancel()
+	for i := 0; ; i++ {
+		if _, ok := sm.GetSession(id); !ok {
+			break
+		} else if i == 100 {
+			t.Fatal("The session should have been removed.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := sm.Msg3ToMsg4(id, newTestMsg3(priv, msg1, msg2, newTestQuote())); !errors.Is(err, ErrSessionCanceled) {
+		t.Fatal("Expected a canceled session, got:", err)
+	}
+	if removals := sm.Stats().Removals[REMOVAL_CANCELED]; removals != 1 {
+		t.Fatal("Expected 1 canceled session, got", removals)
+	}
+
+	if _, err := sm.NewSessionCtx(ctx, &Request{}); !errors.Is(err, ErrSessionCanceled) {
+		t.Fatal("A done context should not start a session, got:", err)
+	}
+	if _, _, err := managerHandshake(t, sm); err != nil {
+		t.Fatal("NewSession should not be tied to a context:", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	conf := authConfiguration()
+	conf.reverifyInterval = 1
+	var ids []string
+	var managers []*sessionManager
+	for i := 0; i < 10; i++ {
+		sm := newSessionManager(*conf, &fakeIAS{})
+		// A context that is never done keeps its watcher alive
+		// until Stop.
+		challenge, err := sm.NewSessionCtx(context.Background(), &Request{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if _, err := sm.NewSessionCtx(ctx, &Request{}); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, challenge.SessionId)
+		managers = append(managers, sm)
+	}
+	for _, sm := range managers {
+		sm.Stop()
+		// Stopping twice is fine.
+		sm.Stop()
+	}
+
+	// Stop waits for the goroutines, but they may take a moment to
+	// exit after that.
+	for i := 0; ; i++ {
+		if n := runtime.NumGoroutine(); n <= before {
+			break
+		} else if i == 100 {
+			t.Fatalf("%d goroutines were left running after Stop.", n-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The sessions keep working, and new ones do not start any
+	// goroutine.
+	sm := managers[0]
+	if _, ok := sm.GetSession(ids[0]); !ok {
+		t.Fatal("Stop should keep the sessions.")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	challenge, err := sm.NewSessionCtx(ctx, &Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := sm.Msg1ToMsg2(challenge.SessionId, &Msg1{}); !errors.Is(err, ErrSessionCanceled) {
+		t.Fatal("Sessions of a done context should still be canceled, got:", err)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%d goroutines were started after Stop.", n-before)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	store := NewMemoryRevocationStore()
+	a := newSessionManager(*authConfiguration(), &fakeIAS{}, WithRevocationStore(store))
+	b := newSessionManager(*authConfiguration(), &fakeIAS{}, WithRevocationStore(store))
+
+	// A session revoked on its own replica is gone immediately.
+	local, err := a.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Revoke(local.SessionId); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.GetSession(local.SessionId); ok {
+		t.Fatal("The revoked session should have been removed.")
+	}
+
+	// A session on b revoked through a is dropped by b on its
+	// next use, even after the handshake.
+	id, _, err := managerHandshake(t, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Revoke(id); err != nil {
+		t.Fatal(err)
+	}
+	_, msg1 := newTestMsg1()
+	if _, err := b.Msg1ToMsg2(id, msg1); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatal("Expected a revoked session, got:", err)
+	}
+	if _, ok := b.GetSession(id); ok {
+		t.Fatal("b should have dropped the revoked session.")
+	}
+	if _, err := b.Msg1ToMsg2(id, msg1); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatal("The session should stay revoked, got:", err)
+	}
+	for _, sm := range []*sessionManager{a, b} {
+		if removals := sm.Stats().Removals[REMOVAL_REVOKED]; removals != 1 {
+			t.Fatal("Expected 1 revoked session, got", removals)
+		}
+	}
+
+	// Other sessions are not affected.
+	if _, _, err := managerHandshake(t, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a store, only local sessions can be revoked.
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	if err := sm.Revoke(id); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatal("Expected an unknown session, got:", err)
+	}
+}
+
+// drainEvents returns the events buffered in events.
+func drainEvents(events <-chan Event) []Event {
+	var out []Event
+	for {
+		select {
+		case e := <-events:
+			out = append(out, e)
+		default:
+			return out
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	id, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quote := newTestQuote()
+	quote[MRENCLAVE_IN_QUOTE] ^= 1
+	failed, _, err := managerHandshakeWithQuote(t, sm, quote)
+	if !errors.Is(err, ErrEnclaveNotAllowed) {
+		t.Fatal("Expected the enclave to be rejected, got:", err)
+	}
+
+	expected := []Event{
+		{Type: EVENT_SESSION_CREATED, SessionID: id},
+		{Type: EVENT_MSG2_SENT, SessionID: id},
+		{Type: EVENT_ATTESTATION_RESULT, SessionID: id},
+		{Type: EVENT_SESSION_CREATED, SessionID: failed},
+		{Type: EVENT_MSG2_SENT, SessionID: failed},
+		{Type: EVENT_ATTESTATION_RESULT, SessionID: failed, Err: err},
+		{Type: EVENT_SESSION_CLOSED, SessionID: failed, Reason: REMOVAL_FAILED},
+	}
+	events := drainEvents(sm.Events())
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d: %+v", len(expected), len(events), events)
+	}
+	for i, e := range events {
+		if e.Time.IsZero() {
+			t.Error("Event is missing its time:", e)
+		}
+		e.Time = time.Time{}
+		// Only the successful handshake is timed.
+		if (e.Timing != nil) != (i == 2) {
+			t.Errorf("Event %d has timing %v.", i, e.Timing)
+		}
+		e.Timing = nil
+		if e != expected[i] {
+			t.Errorf("Event %d:\n%+v\n%+v", i, e, expected[i])
+		}
+	}
+
+	// Nobody reads the events here, so the oldest are dropped
+	// rather than blocking new sessions.
+	var ids []string
+	for i := 0; i < EVENT_BUFFER_SIZE+1; i++ {
+		challenge, err := sm.NewSession(&Request{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, challenge.SessionId)
+	}
+	events = drainEvents(sm.Events())
+	if len(events) != EVENT_BUFFER_SIZE {
+		t.Fatal("Expected a full buffer, got", len(events))
+	} else if events[0].SessionID != ids[1] || events[len(events)-1].SessionID != ids[len(ids)-1] {
+		t.Fatal("Expected the oldest event to be dropped.")
+	}
+}
+
+func TestRetryCoalescing(t *testing.T) {
+	conf := authConfiguration()
+	conf.maxSessions = 4
+	sm := newSessionManager(*conf, &fakeIAS{}, WithRetryCoalescing())
+
+	// A flaky client retrying many times only holds one slot.
+	var ids []string
+	for i := 0; i < 10; i++ {
+		challenge, err := sm.NewSession(&Request{ClientId: "flaky"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, challenge.SessionId)
+	}
+	if n := sm.Stats().Sessions; n != 1 {
+		t.Fatal("Expected 1 pending session, got", n)
+	}
+	if removals := sm.Stats().Removals[REMOVAL_REPLACED]; removals != 9 {
+		t.Fatal("Expected 9 replaced sessions, got", removals)
+	}
+	_, msg1 := newTestMsg1()
+	if _, err := sm.Msg1ToMsg2(ids[0], msg1); !errors.Is(err, ErrSessionReplaced) {
+		t.Fatal("Expected a replaced session, got:", err)
+	}
+
+	// The latest session still works, and is not replaced once it
+	// is past message 1.
+	latest := ids[len(ids)-1]
+	priv, msg1 := newTestMsg1()
+	msg2, err := sm.Msg1ToMsg2(latest, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.NewSession(&Request{ClientId: "flaky"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Msg3ToMsg4(latest, newTestMsg3(priv, msg1, msg2, newTestQuote())); err != nil {
+		t.Fatal("A session past message 1 should not be replaced:", err)
+	}
+
+	// Clients without an id are never coalesced.
+	before := sm.Stats().Sessions
+	for i := 0; i < 2; i++ {
+		if _, err := sm.NewSession(&Request{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := sm.Stats().Sessions; n != before+2 {
+		t.Fatalf("Expected %d sessions, got %d", before+2, n)
+	}
+
+	// Without the option, retries accumulate.
+	sm = newSessionManager(*conf, &fakeIAS{})
+	for i := 0; i < 3; i++ {
+		if _, err := sm.NewSession(&Request{ClientId: "flaky"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := sm.Stats().Sessions; n != 3 {
+		t.Fatal("Expected 3 sessions, got", n)
+	}
+}
+
+func TestEmptySessionID(t *testing.T) {
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	_, msg1 := newTestMsg1()
+	if _, err := sm.Msg1ToMsg2("", msg1); !errors.Is(err, ErrInvalidSessionID) {
+		t.Error("Message 1 without a session id should be rejected, got:", err)
+	}
+	if _, err := sm.Msg3ToMsg4("", &Msg3{}); !errors.Is(err, ErrInvalidSessionID) {
+		t.Error("Message 3 without a session id should be rejected, got:", err)
+	}
+	if _, err := sm.ProcessMsg0("", &Msg0{}); !errors.Is(err, ErrInvalidSessionID) {
+		t.Error("Message 0 without a session id should be rejected, got:", err)
+	}
+	if err := sm.Revoke(""); !errors.Is(err, ErrInvalidSessionID) {
+		t.Error("The empty session id should not be revoked, got:", err)
+	}
+}
+
+func TestAdvisoryStats(t *testing.T) {
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	ias := newTestIAS(t, srv.Server)
+	ias.allowedAdvisories = map[string][]string{ISV_GROUP_OUT_OF_DATE: {"INTEL-SA-00161", "INTEL-SA-00219"}}
+	conf := authConfiguration()
+	conf.useSigRL = false
+	sm := newSessionManager(*conf, ias)
+
+	reports := []struct {
+		advisories []string
+		ok         bool
+	}{
+		{[]string{"INTEL-SA-00161"}, true},
+		{[]string{"INTEL-SA-00161", "INTEL-SA-00219"}, true},
+		// Advisories are counted even if they are not allowed.
+		{[]string{"INTEL-SA-00161", "INTEL-SA-00334"}, false},
+	}
+	srv.status = ISV_GROUP_OUT_OF_DATE
+	srv.pib = "150200650400010000"
+	for i, report := range reports {
+		srv.advisories = report.advisories
+		id, _, err := managerHandshake(t, sm)
+		if report.ok && err != nil {
+			t.Fatalf("Report %d should be accepted: %v", i, err)
+		} else if !report.ok && !errors.Is(err, ErrQuoteRejected) {
+			t.Fatalf("Report %d should be rejected, got: %v", i, err)
+		}
+		if report.ok {
+			// A replayed message 3 does not count again.
+			sm.Msg3ToMsg4(id, &Msg3{})
+		}
+	}
+
+	// Reports without advisories are not counted.
+	srv.status = ISV_OK
+	srv.advisories = nil
+	if _, _, err := managerHandshake(t, sm); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"INTEL-SA-00161": 3,
+		"INTEL-SA-00219": 1,
+		"INTEL-SA-00334": 1,
+	}
+	if advisories := sm.Stats().Advisories; !reflect.DeepEqual(advisories, expected) {
+		t.Fatalf("Incorrect advisory counts:\n%v\n%v", advisories, expected)
+	}
+}
+
+func TestReverifySessions(t *testing.T) {
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	conf := authConfiguration()
+	conf.useSigRL = false
+	conf.reverifyInterval = 60
+	sm := newSessionManager(*conf, newTestIAS(t, srv.Server), WithClock(clock))
+	defer sm.Stop()
+
+	first, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Minute)
+	second, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first session is due, and IAS still accepts it.
+	now = now.Add(31 * time.Minute)
+	reports := srv.reports
+	if closed := sm.reverifySessions(); closed != 0 {
+		t.Fatal("No session should be closed, closed", closed)
+	} else if srv.reports != reports+1 {
+		t.Fatalf("Expected 1 quote to be verified again, got %d.", srv.reports-reports)
+	}
+
+	// The group of the platform went out of date. Only the
+	// second session is due, since the first was just verified.
+	srv.status = ISV_GROUP_OUT_OF_DATE
+	srv.pib = "150200650400010000"
+	now = now.Add(30 * time.Minute)
+	if closed := sm.reverifySessions(); closed != 1 {
+		t.Fatal("Expected 1 session to be closed, closed", closed)
+	}
+	if _, err := sm.Msg3ToMsg4(second, &Msg3{}); !errors.Is(err, ErrSessionDegraded) {
+		t.Fatal("Expected the session to be degraded, got:", err)
+	} else if _, ok := sm.GetSession(first); !ok {
+		t.Fatal("The session that was not due should be kept.")
+	}
+	if n := sm.Stats().Removals[REMOVAL_DEGRADED]; n != 1 {
+		t.Fatal("Expected 1 degraded session, got", n)
+	}
+
+	// Sessions are kept if IAS cannot be reached.
+	srv.Close()
+	now = now.Add(time.Hour)
+	if closed := sm.reverifySessions(); closed != 0 {
+		t.Fatal("No session should be closed without IAS, closed", closed)
+	} else if _, ok := sm.GetSession(first); !ok {
+		t.Fatal("The session should be kept without IAS.")
+	}
+}
+
+func TestReverifySessionsConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+
+	srv := newMockIASServer(t)
+	defer srv.Close()
+	conf := authConfiguration()
+	conf.useSigRL = false
+	conf.reverifyInterval = 60
+	sm := newSessionManager(*conf, newTestIAS(t, srv.Server), WithClock(clock))
+	defer sm.Stop()
+
+	id, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn, _ := sm.GetSession(id)
+
+	// Verify the sessions again while one is being used, and another
+	// completes its handshake.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			advance(time.Hour)
+			sm.reverifySessions()
+		}
+	}()
+	if _, _, err := managerHandshake(t, sm); err != nil {
+		t.Fatal(err)
+	}
+	key := generateKey()
+	for i := 0; i < 20; i++ {
+		if !sn.Authenticated() {
+			t.Fatal("The session should stay authenticated.")
+		} else if _, err := sn.Peer(); err != nil {
+			t.Fatal(err)
+		} else if _, err := sn.IssueToken(key, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestReverifySessionsWithoutCache(t *testing.T) {
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	conf := authConfiguration()
+	conf.reverifyInterval = 60
+	conf.allowCachedReport = true
+	conf.maxCachedAge = 24 * 60
+	ias := &fakeIAS{}
+	sm := newSessionManager(*conf, ias, WithClock(clock))
+	defer sm.Stop()
+
+	id, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn, _ := sm.GetSession(id)
+
+	// The quote is in the outage cache, but a session is not
+	// verified again from it.
+	ias.verifyErr = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	now = now.Add(2 * time.Hour)
+	if closed := sm.reverifySessions(); closed != 0 {
+		t.Fatal("No session should be closed without IAS, closed", closed)
+	}
+	if _, verifiedAt, _ := sn.(*session).verifiedIdentity(); !verifiedAt.Equal(now.Add(-2 * time.Hour)) {
+		t.Fatal("The session should not be verified again from the cache, verified at", verifiedAt)
+	}
+}
+
+func TestMaxInFlightHandshakes(t *testing.T) {
+	const max = 2
+	ias := &blockingIAS{
+		started: make(chan struct{}, max+1),
+		release: make(chan struct{}),
+	}
+	conf := authConfiguration()
+	conf.maxInFlight = max
+	sm := newSessionManager(*conf, ias)
+
+	ids := make([]string, max+1)
+	msg3s := make([]*Msg3, max+1)
+	for i := range ids {
+		challenge, err := sm.NewSession(&Request{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = challenge.SessionId
+		priv, msg1 := newTestMsg1()
+		msg2, err := sm.Msg1ToMsg2(ids[i], msg1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg3s[i] = newTestMsg3(priv, msg1, msg2, newTestQuote())
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, max)
+	for i := 0; i < max; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = sm.Msg3ToMsg4(ids[i], msg3s[i])
+		}(i)
+	}
+	for i := 0; i < max; i++ {
+		<-ias.started
+	}
+
+	if n := sm.Stats().InFlightHandshakes; n != max {
+		t.Fatalf("Expected %d handshakes in flight, got %d.", max, n)
+	}
+	if _, err := sm.Msg3ToMsg4(ids[max], msg3s[max]); err != ErrBusy {
+		t.Fatal("Expected the manager to be busy, got:", err)
+	}
+
+	close(ias.release)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Handshake %d failed: %v", i, err)
+		}
+	}
+	if n := sm.Stats().InFlightHandshakes; n != 0 {
+		t.Fatal("Expected no handshakes in flight, got", n)
+	}
+
+	// The busy session was kept, so the client can retry.
+	if _, err := sm.Msg3ToMsg4(ids[max], msg3s[max]); err != nil {
+		t.Fatal("Retrying after the manager was busy failed:", err)
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	type eviction struct {
+		info    SessionInfo
+		reason  string
+		removed int
+	}
+	var evictions []eviction
+	var sm *sessionManager
+	onEvict := func(info SessionInfo, reason string) {
+		// The hook runs before the removal is recorded, and
+		// may call back into the session manager.
+		removed := sm.Stats().Removals[REMOVAL_EVICTED]
+		evictions = append(evictions, eviction{info, reason, removed})
+	}
+
+	conf := authConfiguration()
+	conf.maxSessions = 1
+	sm = newSessionManager(*conf, &fakeIAS{}, WithClock(clock), WithOnEvict(onEvict))
+
+	authenticated, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	pending, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	last, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(evictions) != 2 {
+		t.Fatal("Expected 2 evictions, got", len(evictions))
+	}
+	quote, err := ParseQuote(newTestQuote())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := evictions[0], evictions[1]
+	if first.info.ID != authenticated || first.reason != string(REMOVAL_EVICTED) {
+		t.Fatal("Incorrect first eviction:", first.info.ID, first.reason)
+	} else if first.info.Identity == nil || !first.info.Identity.Equal(identityOf(quote)) {
+		t.Fatal("Incorrect identity of the evicted session:", first.info.Identity)
+	} else if first.info.Age != time.Minute || first.removed != 0 {
+		t.Fatal("Incorrect first eviction:", first.info.Age, first.removed)
+	}
+	if second.info.ID != pending.SessionId || second.reason != string(REMOVAL_EVICTED) {
+		t.Fatal("Incorrect second eviction:", second.info.ID, second.reason)
+	} else if second.info.Identity != nil {
+		t.Fatal("A pending session should have no identity.")
+	} else if second.info.Age != time.Minute || second.removed != 1 {
+		t.Fatal("Incorrect second eviction:", second.info.Age, second.removed)
+	}
+
+	// Other removals do not call the hook.
+	if err := sm.Revoke(last.SessionId); err != nil {
+		t.Fatal(err)
+	}
+	if len(evictions) != 2 {
+		t.Fatal("Only evictions should call the hook.")
+	}
+}
+
+func TestLongTermPublicBytes(t *testing.T) {
+	// With the private key 1, the public key is the generator of
+	// P-256, whose coordinates are well known (in big endian).
+	key := &ecdsa.PrivateKey{D: big.NewInt(1)}
+	key.PublicKey.Curve = elliptic.P256()
+	key.PublicKey.X, key.PublicKey.Y = key.PublicKey.Curve.ScalarBaseMult(key.D.Bytes())
+	gx, _ := hex.DecodeString("6b17d1f2e12c4247f8bce6e563a440f277037d812deb33a0f4a13945d898c296")
+	gy, _ := hex.DecodeString("4fe342e2fe1a7f9b8ee7eb4a7c0f9e162bce33576b315ececbb6406837bf51f5")
+	reverse(gx)
+	reverse(gy)
+
+	conf := testConfiguration()
+	conf.longTermKey = key
+	sm := newSessionManager(*conf, &fakeIAS{})
+	x, y := sm.LongTermPublicBytes()
+	if !bytes.Equal(x, gx) || !bytes.Equal(y, gy) {
+		t.Fatalf("Incorrect long-term public key:\n%x %x\n%x %x", x, y, gx, gy)
+	}
+
+	// Changing the returned bytes does not change the key.
+	x[0] ^= 1
+	if again, _ := sm.LongTermPublicBytes(); !bytes.Equal(again, gx) {
+		t.Fatal("The session manager should not share its key bytes.")
+	}
+}
+
+// BenchmarkStats measures Stats with more and more sessions, while
+// other goroutines keep creating sessions. The time per Stats should
+// stay flat, and the rate of new sessions should not drop.
+func BenchmarkStats(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			conf := testConfiguration()
+			conf.maxSessions = n
+			sm := newSessionManager(*conf, &fakeIAS{})
+			for i := 0; i < n; i++ {
+				if _, err := sm.NewSession(&Request{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			done := make(chan struct{})
+			created := make(chan int)
+			go func() {
+				count := 0
+				defer func() { created <- count }()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if _, err := sm.NewSession(&Request{}); err != nil {
+						return
+					}
+					count++
+				}
+			}()
+
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if stats := sm.Stats(); stats.Sessions != n {
+					b.Fatal("Incorrect number of sessions:", stats.Sessions)
+				}
+			}
+			b.StopTimer()
+			close(done)
+			b.ReportMetric(float64(<-created)/time.Since(start).Seconds(), "sessions/s")
+		})
+	}
+}
+
+func TestSessionTimeoutOverride(t *testing.T) {
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	conf := testConfiguration()
+	conf.timeout = 10
+	conf.maxTimeout = 30
+	sm := newSessionManager(*conf, &fakeIAS{}, WithClock(clock))
+
+	newWithTimeout := func(d time.Duration) string {
+		challenge, err := sm.NewSession(&Request{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sn, _ := sm.GetSession(challenge.SessionId)
+		if err := sn.SetTimeout(d); err != nil {
+			t.Fatal(err)
+		}
+		return challenge.SessionId
+	}
+	short := newWithTimeout(2 * time.Minute)
+	long := newWithTimeout(20 * time.Minute)
+
+	now = now.Add(5 * time.Minute)
+	if _, err := sm.lookup(short); err != ErrSessionExpired {
+		t.Fatal("The short session should have expired, got:", err)
+	}
+	// The long session outlives the default timeout.
+	now = now.Add(10 * time.Minute)
+	if _, err := sm.lookup(long); err != nil {
+		t.Fatal("The long session should not have expired:", err)
+	}
+	now = now.Add(10 * time.Minute)
+	if _, err := sm.lookup(long); err != ErrSessionExpired {
+		t.Fatal("The long session should have expired, got:", err)
+	}
+	if removals := sm.Stats().Removals[REMOVAL_EXPIRED]; removals != 2 {
+		t.Fatal("Expected 2 expired sessions, got", removals)
+	}
+
+	sn := newSession("0", conf, &fakeIAS{})
+	for _, d := range []time.Duration{0, -time.Minute, 31 * time.Minute} {
+		if err := sn.SetTimeout(d); !errors.Is(err, ErrInvalidTimeout) {
+			t.Errorf("Timeout %v should be invalid, got: %v", d, err)
+		}
+	}
+	// Without a maximum, a session can only be shortened.
+	conf.maxTimeout = 0
+	if err := sn.SetTimeout(11 * time.Minute); !errors.Is(err, ErrInvalidTimeout) {
+		t.Error("Timeout above Timeout should be invalid, got:", err)
+	} else if err := sn.SetTimeout(10 * time.Minute); err != nil {
+		t.Error(err)
+	}
+	conf.maxTimeout = -1
+	if err := sn.SetTimeout(24 * time.Hour); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMsg3Retransmission(t *testing.T) {
+	ias := &fakeIAS{}
+	sm := newSessionManager(*authConfiguration(), ias)
+
+	challenge, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := challenge.SessionId
+	priv, msg1 := newTestMsg1()
+	msg2, err := sm.Msg1ToMsg2(id, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3 := newTestMsg3(priv, msg1, msg2, newTestQuote())
+	msg4, err := sm.Msg3ToMsg4(id, msg3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := sm.Msg3ToMsg4(id, proto.Clone(msg3).(*Msg3))
+	if err != nil {
+		t.Fatal("Expected the retransmitted message 3 to be accepted, got:", err)
+	} else if !proto.Equal(again, msg4) {
+		t.Fatal("The retransmitted message 3 should get the same message 4.")
+	}
+	if ias.verifyCalls != 1 {
+		t.Fatal("IAS should only be called once, got", ias.verifyCalls)
+	}
+	authenticated := 0
+	for _, n := range sm.Stats().EnclaveSVNs {
+		authenticated += n
+	}
+	if authenticated != 1 {
+		t.Fatal("The retransmission should not be counted again, got", authenticated)
+	}
+
+	// A different message 3 is still rejected, and does not tear
+	// down the session.
+	forged := proto.Clone(msg3).(*Msg3)
+	forged.M.Quote[len(forged.M.Quote)-1] ^= 1
+	if _, err := sm.Msg3ToMsg4(id, forged); err != ErrMsg3AlreadyProcessed {
+		t.Fatal("Expected the forged message 3 to be rejected, got:", err)
+	} else if _, ok := sm.GetSession(id); !ok {
+		t.Fatal("The session should not be removed.")
+	}
+}
+
+func TestClientNonce(t *testing.T) {
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	conf := authConfiguration()
+	conf.requireNonce = true
+	conf.nonceWindow = 60
+	sm := newSessionManager(*conf, &fakeIAS{}, WithClock(clock))
+
+	// msg1To sends msg1 in a new session.
+	msg1To := func(msg1 *Msg1) (string, error) {
+		challenge, err := sm.NewSession(&Request{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = sm.Msg1ToMsg2(challenge.SessionId, msg1)
+		return challenge.SessionId, err
+	}
+
+	_, msg1 := newTestMsg1()
+	if _, err := msg1To(msg1); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatal("Message 1 without a client nonce should be rejected, got:", err)
+	}
+
+	nonce := bytes.Repeat([]byte{0x4e}, MIN_CLIENT_NONCE_SIZE)
+	_, msg1 = newTestMsg1()
+	msg1.ClientNonce = nonce
+	id, err := msg1To(msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A retransmission in the same session is not a replay.
+	if _, err := sm.Msg1ToMsg2(id, msg1); err != nil {
+		t.Fatal("Retransmitted message 1 should be accepted:", err)
+	}
+
+	_, replayed := newTestMsg1()
+	replayed.ClientNonce = nonce
+	if _, err := msg1To(replayed); !errors.Is(err, ErrReplayedNonce) {
+		t.Fatal("Reused client nonce should be rejected, got:", err)
+	}
+
+	// Once the window has passed, the nonce is forgotten.
+	now = now.Add(61 * time.Second)
+	if _, err := msg1To(replayed); err != nil {
+		t.Fatal("Client nonce should be accepted after the window:", err)
+	}
+
+	// Without the option, the nonce is not checked.
+	sm = newSessionManager(*authConfiguration(), &fakeIAS{})
+	for i := 0; i < 2; i++ {
+		_, msg1 := newTestMsg1()
+		msg1.ClientNonce = nonce
+		if _, err := msg1To(msg1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandshakeTiming(t *testing.T) {
+	// Every reading of the clock is a second after the last.
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{}, WithClock(clock))
+
+	id, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var timing *HandshakeTiming
+	for _, e := range drainEvents(sm.Events()) {
+		if e.Type == EVENT_ATTESTATION_RESULT && e.SessionID == id {
+			timing = e.Timing
+		}
+	}
+	if timing == nil {
+		t.Fatal("The attestation result should carry the timing.")
+	} else if timing.Msg1ToMsg2 <= 0 || timing.Msg3ToMsg4 <= 0 {
+		t.Fatal("The phases should take some time:", timing)
+	} else if timing.Total < timing.Msg1ToMsg2+timing.Msg3ToMsg4 {
+		t.Fatal("The phases should fit in the whole handshake:", timing)
+	}
+
+	stats := sm.Stats()
+	for _, h := range []struct {
+		name      string
+		histogram Histogram
+		sum       time.Duration
+	}{
+		{"handshake", stats.HandshakeTimes, timing.Total},
+		{"msg1 to msg2", stats.Msg1ToMsg2Times, timing.Msg1ToMsg2},
+		{"msg3 to msg4", stats.Msg3ToMsg4Times, timing.Msg3ToMsg4},
+	} {
+		if h.histogram.Count != 1 || h.histogram.Sum != h.sum {
+			t.Errorf("%s: incorrect histogram %+v, expected a single %v.", h.name, h.histogram, h.sum)
+		}
+		// Every phase takes a few seconds of this clock.
+		i := sort.Search(len(HANDSHAKE_BUCKETS), func(i int) bool { return h.sum <= HANDSHAKE_BUCKETS[i] })
+		if h.histogram.Counts[i] != 1 {
+			t.Errorf("%s: %v should be in bucket %d: %v", h.name, h.sum, i, h.histogram.Counts)
+		}
+	}
+
+	// Failed handshakes are not timed.
+	quote := newTestQuote()
+	quote[MRENCLAVE_IN_QUOTE] ^= 1
+	managerHandshakeWithQuote(t, sm, quote)
+	if stats := sm.Stats(); stats.HandshakeTimes.Count != 1 {
+		t.Fatal("Only the successful handshake should be counted, got", stats.HandshakeTimes.Count)
+	}
+}
@@ -0,0 +1,1232 @@
+package sgx_server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// fakeIAS is an IAS that never talks to Intel, and counts how many
+// times it has been called.
+type fakeIAS struct {
+	sigRl       []byte
+	rlCalls     int
+	verifyCalls int
+	verifyErr   error
+}
+
+func (ias *fakeIAS) GetRevocationList(gid []byte) ([]byte, error) {
+	ias.rlCalls++
+	return ias.sigRl, nil
+}
+
+func (ias *fakeIAS) VerifyQuoteAndPSE(quote, pse []byte) (bool, []byte, []string, error) {
+	ias.verifyCalls++
+	return false, nil, nil, ias.verifyErr
+}
+
+// testConfiguration returns an internal configuration that does not
+// depend on any files.
+func testConfiguration() *configuration {
+	return &configuration{
+		longTermKey: generateKey(),
+		spid:        make([]byte, 16),
+		maxSessions: -1,
+		timeout:     -1,
+		useSigRL:    true,
+
+		challengeLength: DEFAULT_CHALLENGE_LENGTH,
+	}
+}
+
+// testMR is the measurement used for both MREnclave and MRSigner of
+// the test enclave.
+var testMR = [MR_SIZE]byte{1, 2, 3}
+
+// authConfiguration returns a test configuration that accepts the
+// quotes generated by newTestQuote.
+func authConfiguration() *configuration {
+	conf := testConfiguration()
+	conf.mrenclaves = [][MR_SIZE]byte{testMR}
+	conf.mrsigners = [][MR_SIZE]byte{testMR}
+	return conf
+}
+
+// newTestQuote returns a quote of the test enclave without the
+// report data filled in.
+func newTestQuote() []byte {
+	quote := make([]byte, NO_SIG_QUOTE_LEN+4)
+	copy(quote[MRENCLAVE_IN_QUOTE:], testMR[:])
+	copy(quote[MRSIGNER_IN_QUOTE:], testMR[:])
+	return quote
+}
+
+// newTestMsg3 plays the part of the client enclave: it derives the
+// session keys from message 2, binds them into the report data of
+// quote, and returns the resulting message 3.
+func newTestMsg3(priv *ecdsa.PrivateKey, msg1 *Msg1, msg2 *Msg2, quote []byte) *Msg3 {
+	gb, _ := unmarshalPublicKey(msg2.A.Gb.X, msg2.A.Gb.Y)
+	kdk, smk, _ := deriveLabelKey(priv, gb, SMK_LABEL)
+	vk, _ := deriveLabelKeyFromBase(kdk, VK_LABEL)
+
+	var report []byte
+	report = append(report, msg1.Ga.X...)
+	report = append(report, msg1.Ga.Y...)
+	report = append(report, msg2.A.Gb.X...)
+	report = append(report, msg2.A.Gb.Y...)
+	report = append(report, vk...)
+	hash := sha256.Sum256(report)
+	copy(quote[HASH_REPORT_IN_QUOTE:], hash[:])
+
+	var concat []byte
+	concat = append(concat, msg1.Ga.X...)
+	concat = append(concat, msg1.Ga.Y...)
+	concat = append(concat, quote...)
+	cmacM, _ := cmacWithKey(concat, smk)
+	return &Msg3{
+		CmacM: cmacM,
+		M: &M{
+			Ga:    msg1.Ga,
+			Quote: quote,
+		},
+	}
+}
+
+// handshake runs the session through messages 1 to 3, and returns
+// the message 3 that was accepted.
+func handshake(t testing.TB, sn Session) *Msg3 {
+	return handshakeWithQuote(t, sn, newTestQuote())
+}
+
+// handshakeWithQuote is like handshake, but sends quote in message 3.
+func handshakeWithQuote(t testing.TB, sn Session, quote []byte) *Msg3 {
+	msg3, err := sendQuote(t, sn, quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg3
+}
+
+// sendQuote runs messages 1 and 2 with sn, and returns message 3
+// carrying quote along with the error from processing it.
+func sendQuote(t testing.TB, sn Session, quote []byte) (*Msg3, error) {
+	priv, msg1 := newTestMsg1()
+	if err := sn.ProcessMsg1(msg1); err != nil {
+		t.Fatal(err)
+	}
+	msg2, err := sn.CreateMsg2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3 := newTestMsg3(priv, msg1, msg2, quote)
+	return msg3, sn.ProcessMsg3(msg3)
+}
+
+// newTestMsg1 generates a fresh client key, and returns the key
+// along with message 1 containing it.
+func newTestMsg1() (*ecdsa.PrivateKey, *Msg1) {
+	priv := generateKey()
+	x, y, _ := marshalPublicKey(&priv.PublicKey)
+	return priv, &Msg1{
+		Msg0: &Msg0{},
+		Ga:   &PublicKey{X: x, Y: y},
+		Gid:  []byte{1, 2, 3, 4},
+	}
+}
+
+func TestProcessMsg1RejectsZeroGA(t *testing.T) {
+	sn := nilSession("0").(*session)
+	msg1 := &Msg1{
+		Msg0: &Msg0{},
+		Ga: &PublicKey{
+			X: make([]byte, EC_COORD_SIZE),
+			Y: make([]byte, EC_COORD_SIZE),
+		},
+		Gid: make([]byte, EPID_GID_SIZE),
+	}
+
+	if err := sn.ProcessMsg1(msg1); err != ErrInvalidClientKey {
+		t.Fatal("Expected invalid client key error, got:", err)
+	}
+	if sn.ga != nil || sn.kdk != nil {
+		t.Fatal("Session state changed after rejecting message 1.")
+	}
+
+	msg1.Ga = nil
+	if err := sn.ProcessMsg1(msg1); err != ErrInvalidClientKey {
+		t.Fatal("Expected invalid client key error, got:", err)
+	}
+}
+
+func TestExportKey(t *testing.T) {
+	// The KDK is the one derived in TestECDHAndKeyDerivation, and
+	// the expected keys were computed from it using OpenSSL's
+	// AES-CMAC with the SGX key derivation strings.
+	kdk, _ := hex.DecodeString("7082b5102f5080aba92afb1e3f6c9991")
+	expected := map[string]string{
+		"VK": "1007dd6dc1870538b189ad8b59b396d2",
+		"SK": "a8aa499426af3277e978d29485bc6c69",
+		"MK": "fe96cecbcea93110612681c07fdeb38d",
+	}
+
+	sn := nilSession("0").(*session)
+	sn.kdk = kdk
+	sn.vk, _ = deriveLabelKeyFromBase(kdk, VK_LABEL)
+	sn.sk, _ = deriveLabelKeyFromBase(kdk, SK_LABEL)
+	sn.mk, _ = deriveLabelKeyFromBase(kdk, MK_LABEL)
+
+	if _, err := sn.ExportKey(VK_LABEL); err != ErrNotAuthenticated {
+		t.Fatal("Exported a key before authentication.")
+	}
+
+	sn.authenticated = true
+	for label, keyHex := range expected {
+		key, err := sn.ExportKey([]byte(label))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key) != keyHex {
+			t.Errorf("%s mismatch: expected %s, got %x.", label, keyHex, key)
+		}
+	}
+
+	if _, err := sn.ExportKey(SMK_LABEL); err == nil {
+		t.Error("SMK should not be exportable.")
+	}
+
+	key, _ := sn.ExportKey(VK_LABEL)
+	key[0] ^= 0xff
+	if bytes.Equal(key, sn.vk) {
+		t.Error("ExportKey should return a copy of the key.")
+	}
+}
+
+func TestCreateMsg2SigRL(t *testing.T) {
+	sigRl := []byte("revocation list")
+	for _, useSigRL := range []bool{true, false} {
+		ias := &fakeIAS{sigRl: sigRl}
+		conf := testConfiguration()
+		conf.useSigRL = useSigRL
+		sn := newSession("0", conf, ias)
+
+		_, msg1 := newTestMsg1()
+		if err := sn.ProcessMsg1(msg1); err != nil {
+			t.Fatal(err)
+		}
+		msg2, err := sn.CreateMsg2()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if useSigRL {
+			if ias.rlCalls != 1 || !bytes.Equal(msg2.SigRl, sigRl) || msg2.SigRlSize != uint32(len(sigRl)) {
+				t.Error("Message 2 should contain the SigRL from IAS.")
+			}
+		} else {
+			if ias.rlCalls != 0 || len(msg2.SigRl) != 0 || msg2.SigRlSize != 0 {
+				t.Error("Message 2 should contain an empty SigRL.")
+			}
+		}
+	}
+}
+
+func TestValidateMsg3Format(t *testing.T) {
+	valid := func() *Msg3 {
+		return &Msg3{
+			CmacM: make([]byte, MAC_SIZE),
+			M: &M{
+				Ga:    &PublicKey{X: make([]byte, EC_COORD_SIZE), Y: make([]byte, EC_COORD_SIZE)},
+				Quote: rawQuote(bytes.Repeat([]byte{0x5e}, 680)),
+			},
+		}
+	}
+	if err := ValidateMsg3Format(valid()); err != nil {
+		t.Fatal(err)
+	}
+	withPSE := valid()
+	withPSE.M.PsSecurityProp = make([]byte, PS_SECURITY_PROP_SIZE)
+	if err := ValidateMsg3Format(withPSE); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(msg3 *Msg3)
+	}{
+		{"missing M", func(msg3 *Msg3) { msg3.M = nil }},
+		{"missing GA", func(msg3 *Msg3) { msg3.M.Ga = nil }},
+		{"missing MAC", func(msg3 *Msg3) { msg3.CmacM = nil }},
+		{"long MAC", func(msg3 *Msg3) { msg3.CmacM = make([]byte, MAC_SIZE+1) }},
+		{"short GA", func(msg3 *Msg3) { msg3.M.Ga.Y = msg3.M.Ga.Y[1:] }},
+		{"short PSE", func(msg3 *Msg3) { msg3.M.PsSecurityProp = make([]byte, 100) }},
+		{"missing quote", func(msg3 *Msg3) { msg3.M.Quote = nil }},
+		{"short quote", func(msg3 *Msg3) { msg3.M.Quote = msg3.M.Quote[:NO_SIG_QUOTE_LEN-1] }},
+		{"truncated signature", func(msg3 *Msg3) { msg3.M.Quote = msg3.M.Quote[:len(msg3.M.Quote)-1] }},
+		{"unknown sign type", func(msg3 *Msg3) { msg3.M.Quote[SIGN_TYPE_IN_QUOTE] = 7 }},
+	}
+	for _, test := range tests {
+		msg3 := valid()
+		test.modify(msg3)
+		if err := ValidateMsg3Format(msg3); !errors.Is(err, ErrMalformedMessage) {
+			t.Errorf("%s: expected a malformed message 3, got: %v", test.name, err)
+		}
+	}
+	if err := ValidateMsg3Format(nil); !errors.Is(err, ErrMalformedMessage) {
+		t.Error("Expected a missing message 3 to be malformed, got:", err)
+	}
+}
+
+func TestProcessMsg3Replay(t *testing.T) {
+	ias := &fakeIAS{}
+	sn := newSession("0", authConfiguration(), ias)
+	msg3 := handshake(t, sn)
+	if !sn.Authenticated() {
+		t.Fatal("Session should be authenticated.")
+	}
+
+	msg4, err := sn.CreateMsg4()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any message 3 other than the one that authenticated the
+	// session is rejected.
+	forged := proto.Clone(msg3).(*Msg3)
+	forged.M.Quote[len(forged.M.Quote)-1] ^= 1
+	if err := sn.ProcessMsg3(forged); err != ErrMsg3AlreadyProcessed {
+		t.Fatal("Expected the replayed message 3 to be rejected, got:", err)
+	}
+
+	// An exact retransmission gets the same message 4.
+	if err := sn.ProcessMsg3(msg3); err != nil {
+		t.Fatal("Expected the retransmitted message 3 to be accepted, got:", err)
+	}
+	again, err := sn.CreateMsg4()
+	if err != nil {
+		t.Fatal(err)
+	} else if !proto.Equal(again, msg4) {
+		t.Fatal("The retransmitted message 3 should get the same message 4.")
+	}
+	if ias.verifyCalls != 1 {
+		t.Fatal("The replayed message 3 should not be sent to IAS.")
+	}
+	if !sn.Authenticated() {
+		t.Fatal("Session should still be authenticated.")
+	}
+}
+
+func TestRemoteReportData(t *testing.T) {
+	sn := newSession("0", authConfiguration(), &fakeIAS{})
+	if _, err := sn.RemoteReportData(); err != ErrNotAuthenticated {
+		t.Fatal("Report data should not be available before verification.")
+	}
+
+	quote := newTestQuote()
+	appData := sha256.Sum256([]byte("application public key"))
+	copy(quote[REPORT_DATA_IN_QUOTE+sha256.Size:], appData[:])
+	handshakeWithQuote(t, sn, quote)
+
+	reportData, err := sn.RemoteReportData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reportData[:], quote[REPORT_DATA_IN_QUOTE:REPORT_DATA_IN_QUOTE+REPORT_DATA_SIZE]) {
+		t.Fatal("Report data does not match the quote.")
+	}
+	if !bytes.Equal(reportData[sha256.Size:], appData[:]) {
+		t.Fatal("Application data did not round trip.")
+	}
+}
+
+// verifyMsg2Signature checks the signature in message 2 the same way
+// the client enclave would.
+func verifyMsg2Signature(pub *ecdsa.PublicKey, msg1 *Msg1, msg2 *Msg2) bool {
+	var signed []byte
+	signed = append(signed, msg2.A.Gb.X...)
+	signed = append(signed, msg2.A.Gb.Y...)
+	signed = append(signed, msg1.Ga.X...)
+	signed = append(signed, msg1.Ga.Y...)
+	sum := sha256.Sum256(signed)
+
+	toInt := func(le []byte) *big.Int {
+		be := append([]byte(nil), le...)
+		reverse(be)
+		return new(big.Int).SetBytes(be)
+	}
+	return ecdsa.Verify(pub, sum[:], toInt(msg2.A.Signature.R), toInt(msg2.A.Signature.S))
+}
+
+func TestSecondaryLongTermKeys(t *testing.T) {
+	conf := testConfiguration()
+	primary := conf.longTermKey
+	secondary := generateKey()
+	conf.secondaryKeys = []*ecdsa.PrivateKey{secondary}
+
+	primaryHash := publicKeyHash(&primary.PublicKey)
+	secondaryHash := publicKeyHash(&secondary.PublicKey)
+	tests := []struct {
+		hash     []byte
+		expected *ecdsa.PrivateKey
+	}{
+		{nil, primary},
+		{primaryHash[:], primary},
+		{secondaryHash[:], secondary},
+	}
+	for i, test := range tests {
+		sn := newSession("0", conf, &fakeIAS{})
+		_, msg1 := newTestMsg1()
+		msg1.SpKeyHash = test.hash
+		if err := sn.ProcessMsg1(msg1); err != nil {
+			t.Fatal(err)
+		}
+		msg2, err := sn.CreateMsg2()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !verifyMsg2Signature(&test.expected.PublicKey, msg1, msg2) {
+			t.Errorf("Test %d: message 2 is not signed with the expected key.", i)
+		}
+	}
+
+	sn := newSession("0", conf, &fakeIAS{})
+	_, msg1 := newTestMsg1()
+	msg1.SpKeyHash = make([]byte, sha256.Size)
+	if err := sn.ProcessMsg1(msg1); err == nil {
+		t.Error("Unknown key hash should be rejected.")
+	}
+}
+
+// clientSeal encrypts msg the way the client enclave would for the
+// session with id, using the session key sk.
+func clientSeal(t testing.TB, id string, sk, msg []byte) []byte {
+	block, err := aes.NewCipher(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	aad := append([]byte(id), AAD_CLIENT_TO_SERVER)
+	return append(nonce, gcm.Seal(nil, nonce, msg, aad)...)
+}
+
+// clientOpen plays the part of the client enclave, and opens a
+// message the server sealed in session id using sk.
+func clientOpen(id string, sk, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(sk)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("Ciphertext is too short.")
+	}
+	aad := append([]byte(id), AAD_SERVER_TO_CLIENT)
+	nonce := ciphertext[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], aad)
+}
+
+func TestSealBoundToSession(t *testing.T) {
+	a := newSession("a", authConfiguration(), &fakeIAS{})
+	handshake(t, a)
+	// Pretend the keys got confused, and b ended up with a's keys.
+	b := newSession("b", authConfiguration(), &fakeIAS{})
+	handshake(t, b)
+	b.aes = a.aes
+
+	msg := []byte("hello enclave")
+	ciphertext := clientSeal(t, "a", a.sk, msg)
+	if plaintext, err := a.Open(ciphertext); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(plaintext, msg) {
+		t.Fatal("Incorrect plaintext.")
+	}
+	if _, err := b.Open(ciphertext); err == nil {
+		t.Fatal("Ciphertext from session a should not open in session b.")
+	}
+
+	sealed, err := a.Seal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Open(sealed); err == nil {
+		t.Fatal("A message sealed for the client should not open on the server.")
+	}
+
+	fresh := newSession("c", authConfiguration(), &fakeIAS{})
+	if _, err := fresh.Seal(msg); err != ErrNotAuthenticated {
+		t.Fatal("Seal should fail before authentication.")
+	}
+}
+
+func TestEnclaveAttributes(t *testing.T) {
+	conf := authConfiguration()
+	conf.release = true
+	conf.flagsMask = SGX_FLAGS_INITTED | SGX_FLAGS_MODE64BIT | SGX_FLAGS_KSS
+	conf.flags = SGX_FLAGS_INITTED | SGX_FLAGS_MODE64BIT
+	conf.xfrmMask = 0x7
+	conf.xfrm = 0x7
+	conf.miscSelectMask = 0x1
+	conf.miscSelect = 0x0
+
+	newQuote := func(flags, xfrm uint64, misc uint32) []byte {
+		quote := newTestQuote()
+		binary.LittleEndian.PutUint64(quote[ATTRIBUTES_IN_QUOTE:], flags)
+		binary.LittleEndian.PutUint64(quote[ATTRIBUTES_IN_QUOTE+8:], xfrm)
+		binary.LittleEndian.PutUint32(quote[MISCSELECT_IN_QUOTE:], misc)
+		return quote
+	}
+
+	tests := []struct {
+		name  string
+		quote []byte
+		ok    bool
+	}{
+		{"match", newQuote(SGX_FLAGS_INITTED|SGX_FLAGS_MODE64BIT, 0x7, 0x0), true},
+		// Bits outside of the masks are ignored.
+		{"unmasked bits", newQuote(SGX_FLAGS_INITTED|SGX_FLAGS_MODE64BIT|SGX_FLAGS_PROVISION_KEY, 0x1f, 0x2), true},
+		{"forbidden flag", newQuote(SGX_FLAGS_INITTED|SGX_FLAGS_MODE64BIT|SGX_FLAGS_KSS, 0x7, 0x0), false},
+		{"missing flag", newQuote(SGX_FLAGS_INITTED, 0x7, 0x0), false},
+		{"debug", newQuote(SGX_FLAGS_INITTED|SGX_FLAGS_MODE64BIT|SGX_FLAGS_DEBUG, 0x7, 0x0), false},
+		{"missing xfrm", newQuote(SGX_FLAGS_INITTED|SGX_FLAGS_MODE64BIT, 0x3, 0x0), false},
+		{"misc select", newQuote(SGX_FLAGS_INITTED|SGX_FLAGS_MODE64BIT, 0x7, 0x1), false},
+	}
+	for _, test := range tests {
+		sn := newSession("attributes", conf, &fakeIAS{})
+		_, err := sendQuote(t, sn, test.quote)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.ok && !errors.Is(err, ErrEnclaveNotAllowed) {
+			t.Errorf("%s: quote should have been rejected, got: %v", test.name, err)
+		}
+	}
+}
+
+func TestQuoteSignType(t *testing.T) {
+	newQuote := func(signType uint16) []byte {
+		quote := newTestQuote()
+		binary.LittleEndian.PutUint16(quote[SIGN_TYPE_IN_QUOTE:], signType)
+		return quote
+	}
+
+	for _, linkable := range []bool{false, true} {
+		conf := authConfiguration()
+		conf.linkable = linkable
+		expected := UNLINKABLE_QUOTE
+		if linkable {
+			expected = LINKABLE_QUOTE
+		}
+
+		for _, signType := range []uint16{UNLINKABLE_QUOTE_INT, LINKABLE_QUOTE_INT} {
+			sn := newSession("sign type", conf, &fakeIAS{})
+			_, err := sendQuote(t, sn, newQuote(signType))
+			if msg2, _ := sn.CreateMsg2(); !bytes.Equal(msg2.A.QuoteType, expected) {
+				t.Errorf("linkable %t: message 2 asks for quote type %x.", linkable, msg2.A.QuoteType)
+			}
+			if (signType == LINKABLE_QUOTE_INT) == linkable {
+				if err != nil {
+					t.Errorf("linkable %t: quote of sign type %d should be accepted: %v", linkable, signType, err)
+				}
+			} else if !errors.Is(err, ErrSignTypeMismatch) {
+				t.Errorf("linkable %t: quote of sign type %d should be rejected, got: %v", linkable, signType, err)
+			}
+		}
+	}
+}
+
+func TestEnclaveKSS(t *testing.T) {
+	conf := authConfiguration()
+	conf.isvFamilyID = bytes.Repeat([]byte{0xf1}, ISVFAMILYID_SIZE)
+	conf.configID = bytes.Repeat([]byte{0xc1}, CONFIGID_SIZE)
+	conf.minConfigSVN = 2
+
+	newQuote := func(family, configID byte, configSVN uint16) []byte {
+		quote := newTestQuote()
+		copy(quote[ISVFAMILYID_IN_QUOTE:], bytes.Repeat([]byte{family}, ISVFAMILYID_SIZE))
+		copy(quote[CONFIGID_IN_QUOTE:], bytes.Repeat([]byte{configID}, CONFIGID_SIZE))
+		binary.LittleEndian.PutUint16(quote[CONFIGSVN_IN_QUOTE:], configSVN)
+		return quote
+	}
+
+	tests := []struct {
+		name  string
+		conf  *configuration
+		quote []byte
+		ok    bool
+	}{
+		{"match", conf, newQuote(0xf1, 0xc1, 2), true},
+		{"newer config", conf, newQuote(0xf1, 0xc1, 3), true},
+		{"config ID mismatch", conf, newQuote(0xf1, 0xc2, 2), false},
+		{"family ID mismatch", conf, newQuote(0xf2, 0xc1, 2), false},
+		{"old config", conf, newQuote(0xf1, 0xc1, 1), false},
+		{"without KSS", conf, newTestQuote(), false},
+		// Nothing is enforced by default.
+		{"not enforced", authConfiguration(), newQuote(0xf2, 0xc2, 0), true},
+	}
+	for _, test := range tests {
+		sn := newSession("kss", test.conf, &fakeIAS{})
+		_, err := sendQuote(t, sn, test.quote)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.ok && !errors.Is(err, ErrEnclaveNotAllowed) {
+			t.Errorf("%s: quote should have been rejected, got: %v", test.name, err)
+		}
+	}
+
+	sn := newSession("kss", conf, &fakeIAS{})
+	if _, err := sendQuote(t, sn, newQuote(0xf1, 0xc1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if peer, err := sn.Peer(); err != nil {
+		t.Fatal(err)
+	} else if peer.ConfigSVN != 3 || peer.ConfigID[0] != 0xc1 || peer.FamilyID[0] != 0xf1 {
+		t.Fatal("Incorrect KSS identity:", peer)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	conf := authConfiguration()
+	conf.maxMessages = 4
+	sn := newSession("usage", conf, &fakeIAS{})
+	handshake(t, sn)
+
+	for _, msg := range []string{"hello", "enclave"} {
+		if _, err := sn.Seal([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sn.Open(clientSeal(t, "usage", sn.sk, []byte("hi"))); err != nil {
+		t.Fatal(err)
+	}
+	// Messages that fail to open are not counted.
+	if _, err := sn.Open(clientSeal(t, "other", sn.sk, []byte("bad"))); err == nil {
+		t.Fatal("Message for another session should not open.")
+	}
+
+	expected := Usage{
+		MessagesSent:     2,
+		MessagesReceived: 1,
+		BytesSent:        uint64(len("hello") + len("enclave")),
+		BytesReceived:    uint64(len("hi")),
+	}
+	if usage := sn.Usage(); usage != expected {
+		t.Fatalf("Incorrect usage: %+v", usage)
+	}
+
+	if _, err := sn.Seal([]byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sn.Seal([]byte("one more")); err != ErrRekeyRequired {
+		t.Fatal("Expected the session to need a re-key, got:", err)
+	}
+	if _, err := sn.Open(clientSeal(t, "usage", sn.sk, []byte("hi"))); err != ErrRekeyRequired {
+		t.Fatal("Expected the session to need a re-key, got:", err)
+	}
+}
+
+func TestTCBBaseline(t *testing.T) {
+	conf := authConfiguration()
+	conf.minCPUSVN = []byte{4, 4, 2, 4, 1, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	conf.minQESVN = 11
+	conf.minPCESVN = 10
+
+	newQuote := func(cpuSVN []byte, qeSVN, pceSVN uint16) []byte {
+		quote := newTestQuote()
+		copy(quote[CPUSVN_IN_QUOTE:], cpuSVN)
+		binary.LittleEndian.PutUint16(quote[QESVN_IN_QUOTE:], qeSVN)
+		binary.LittleEndian.PutUint16(quote[PCESVN_IN_QUOTE:], pceSVN)
+		return quote
+	}
+
+	tests := []struct {
+		name  string
+		quote []byte
+		ok    bool
+	}{
+		{"at baseline", newQuote(conf.minCPUSVN, 11, 10), true},
+		{"above baseline", newQuote([]byte{5, 4, 2, 4, 1, 0x80, 1}, 12, 10), true},
+		// Every component must meet the baseline, even if the
+		// CPUSVN is larger as a number.
+		{"cpusvn component", newQuote([]byte{9, 4, 1, 4, 1, 0x80}, 11, 10), false},
+		{"qe svn", newQuote(conf.minCPUSVN, 10, 10), false},
+		{"pce svn", newQuote(conf.minCPUSVN, 11, 9), false},
+	}
+	for _, test := range tests {
+		sn := newSession("tcb", conf, &fakeIAS{})
+		_, err := sendQuote(t, sn, test.quote)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.ok && err != ErrTCBTooLow {
+			t.Errorf("%s: expected the TCB to be too low, got: %v", test.name, err)
+		}
+	}
+}
+
+func TestErrorsIs(t *testing.T) {
+	sn := newSession("errors", authConfiguration(), &fakeIAS{})
+	_, msg1 := newTestMsg1()
+	msg1.Gid = nil
+	if err := sn.ProcessMsg1(msg1); !errors.Is(err, ErrMalformedMessage) {
+		t.Error("Empty message 1 should be malformed, got:", err)
+	}
+
+	sn = newSession("errors", authConfiguration(), &fakeIAS{})
+	priv, msg1 := newTestMsg1()
+	if err := sn.ProcessMsg1(msg1); err != nil {
+		t.Fatal(err)
+	}
+	msg2, err := sn.CreateMsg2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3 := newTestMsg3(priv, msg1, msg2, newTestQuote())
+	msg3.CmacM[0] ^= 1
+	if err := sn.ProcessMsg3(msg3); !errors.Is(err, ErrInvalidMsg3) {
+		t.Error("Message 3 with a bad MAC should fail verification, got:", err)
+	}
+
+	quote := newTestQuote()
+	quote[MRENCLAVE_IN_QUOTE] ^= 1
+	sn = newSession("errors", authConfiguration(), &fakeIAS{})
+	if _, err := sendQuote(t, sn, quote); !errors.Is(err, ErrEnclaveNotAllowed) {
+		t.Error("Unknown MREnclave should not be allowed, got:", err)
+	}
+
+	sn = newSession("errors", authConfiguration(), &fakeIAS{verifyErr: &QuoteStatusError{Status: ISV_GROUP_REVOKED}})
+	if _, err := sendQuote(t, sn, newTestQuote()); !errors.Is(err, ErrQuoteRejected) {
+		t.Error("Quote rejected by IAS should be reported, got:", err)
+	}
+
+	sn = newSession("errors", authConfiguration(), &fakeIAS{})
+	handshake(t, sn)
+	if _, err := sn.Open([]byte{1, 2, 3}); !errors.Is(err, ErrMalformedMessage) {
+		t.Error("Short ciphertext should be malformed, got:", err)
+	}
+	if _, err := sn.ExportKey([]byte("unknown")); !errors.Is(err, ErrInvalidLabel) {
+		t.Error("Unknown label should be invalid, got:", err)
+	}
+}
+
+func TestProcessMsg0(t *testing.T) {
+	sn := newSession("msg0", authConfiguration(), &fakeIAS{})
+	_, msg1 := newTestMsg1()
+	msg1.Msg0 = nil
+	if err := sn.ProcessMsg1(msg1); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatal("Message 1 without message 0 should be malformed, got:", err)
+	}
+
+	sn = newSession("msg0", authConfiguration(), &fakeIAS{})
+	if err := sn.ProcessMsg0(&Msg0{}); err != nil {
+		t.Fatal(err)
+	}
+	_, msg1 = newTestMsg1()
+	msg1.Msg0 = &Msg0{Exgid: 1}
+	if err := sn.ProcessMsg1(msg1); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatal("Message 1 should not change the extended GID, got:", err)
+	}
+	msg1.Msg0 = &Msg0{}
+	if err := sn.ProcessMsg1(msg1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.ProcessMsg0(&Msg0{}); err == nil {
+		t.Fatal("Message 0 after message 1 should be rejected.")
+	}
+}
+
+func TestMsg4Payload(t *testing.T) {
+	conf := authConfiguration()
+	conf.msg4Payload = []byte("endpoint=10.0.0.1:443")
+	sn := newSession("payload", conf, &fakeIAS{})
+	handshake(t, sn)
+
+	msg4, err := sn.CreateMsg4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := clientOpen("payload", sn.sk, msg4.Payload); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(payload, conf.msg4Payload) {
+		t.Fatalf("Incorrect payload %q.", payload)
+	}
+	other := newSession("payload", conf, &fakeIAS{})
+	handshake(t, other)
+	if _, err := clientOpen("payload", other.sk, msg4.Payload); err == nil {
+		t.Fatal("The payload should only open with the key of its session.")
+	}
+	if mac, _ := sn.cmacMsg4(&Msg4{Result: msg4.Result, Secret: msg4.Secret}); bytes.Equal(mac, msg4.Cmac) {
+		t.Fatal("The MAC of message 4 should cover the payload.")
+	}
+
+	conf.onVerified = func(sn Session) ([]byte, error) {
+		return []byte(sn.Id()), nil
+	}
+	sn = newSession("dynamic", conf, &fakeIAS{})
+	handshake(t, sn)
+	msg4, err = sn.CreateMsg4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := clientOpen("dynamic", sn.sk, msg4.Payload); err != nil || string(payload) != "dynamic" {
+		t.Fatal("The callback payload should replace the static one:", string(payload), err)
+	}
+
+	conf.onVerified = func(sn Session) ([]byte, error) {
+		return make([]byte, MAX_MSG4_PAYLOAD_SIZE+1), nil
+	}
+	sn = newSession("large", conf, &fakeIAS{})
+	handshake(t, sn)
+	if _, err := sn.CreateMsg4(); err == nil {
+		t.Fatal("Oversized payload should be rejected.")
+	}
+
+	sn = newSession("rejected", conf, &fakeIAS{})
+	quote := newTestQuote()
+	quote[MRENCLAVE_IN_QUOTE] ^= 1
+	sendQuote(t, sn, quote)
+	if msg4, err := sn.CreateMsg4(); err != nil || msg4.Payload != nil {
+		t.Fatal("Rejected enclaves should not get a payload.")
+	}
+}
+
+func TestCreateMsg2BeforeMsg1(t *testing.T) {
+	sn := newSession("fresh", authConfiguration(), &fakeIAS{})
+	if _, err := sn.CreateMsg2(); err != ErrMsg1NotProcessed {
+		t.Fatal("Expected message 2 to fail before message 1, got:", err)
+	}
+
+	// A message 1 that is rejected does not count either.
+	_, msg1 := newTestMsg1()
+	msg1.SpKeyHash = make([]byte, 32)
+	if err := sn.ProcessMsg1(msg1); err == nil {
+		t.Fatal("Message 1 with an unknown key hash should be rejected.")
+	} else if _, err := sn.CreateMsg2(); err != ErrMsg1NotProcessed {
+		t.Fatal("Expected message 2 to fail after a rejected message 1, got:", err)
+	}
+
+	msg1.SpKeyHash = nil
+	if err := sn.ProcessMsg1(msg1); err != nil {
+		t.Fatal(err)
+	} else if _, err := sn.CreateMsg2(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProdSVNs(t *testing.T) {
+	conf := authConfiguration()
+	conf.prodID = 3
+	conf.prodSVN = 2
+	conf.prodSVNs = map[uint16]uint16{7: 5, 9: 1}
+
+	tests := []struct {
+		prodID, svn uint16
+		ok          bool
+	}{
+		{3, 2, true},
+		{3, 1, false},
+		// Product 7 needs SVN 5, even though it is above ProdSVN.
+		{7, 5, true},
+		{7, 4, false},
+		// Product 9 only needs SVN 1, below ProdSVN.
+		{9, 1, true},
+		{9, 0, false},
+		{8, 9, false},
+	}
+	for _, test := range tests {
+		quote := newTestQuote()
+		binary.LittleEndian.PutUint16(quote[ISVPRODID_IN_QUOTE:], test.prodID)
+		binary.LittleEndian.PutUint16(quote[ISVSVN_IN_QUOTE:], test.svn)
+		sn := newSession("prod", conf, &fakeIAS{})
+		_, err := sendQuote(t, sn, quote)
+		if test.ok && err != nil {
+			t.Errorf("ProdID %d with SVN %d should be accepted: %v", test.prodID, test.svn, err)
+		} else if !test.ok && !errors.Is(err, ErrEnclaveNotAllowed) {
+			t.Errorf("ProdID %d with SVN %d should be rejected, got: %v", test.prodID, test.svn, err)
+		}
+	}
+}
+
+func TestPeerGID(t *testing.T) {
+	sn := newSession("gid", authConfiguration(), &fakeIAS{})
+	if _, err := sn.PeerGID(); err != ErrMsg1NotProcessed {
+		t.Fatal("Expected no GID before message 1, got:", err)
+	}
+
+	_, msg1 := newTestMsg1()
+	msg1.Gid = []byte{0x1e, 0x0b, 0x00, 0x00}
+	if err := sn.ProcessMsg1(msg1); err != nil {
+		t.Fatal(err)
+	}
+	// The session keeps its own copy of the group id.
+	msg1.Gid[0] = 0
+	if gid, err := sn.PeerGID(); err != nil {
+		t.Fatal(err)
+	} else if gid != 0xb1e {
+		t.Fatalf("Incorrect GID %#x.", gid)
+	}
+
+	if _, err := parseGID([]byte{0x1e, 0x0b, 0x00}); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatal("Expected a short group id to be malformed, got:", err)
+	}
+}
+
+func TestSigRLGroupByteOrder(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	conf := authConfiguration()
+	conf.useSigRL = true
+	sn := newSession("gid", conf, newTestIAS(t, srv))
+	_, msg1 := newTestMsg1()
+	msg1.Gid = []byte{0x1e, 0x0b, 0x00, 0x00}
+	if err := sn.ProcessMsg1(msg1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sn.CreateMsg2(); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "/sigrl/00000b1e" {
+		t.Fatal("Incorrect SigRL request:", paths)
+	}
+}
+
+func TestCheckMR(t *testing.T) {
+	mrs := [][MR_SIZE]byte{testMR}
+	if err := checkMR(testMR, mrs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every byte of the measurement counts, up to the last one.
+	for _, i := range []int{0, MR_SIZE / 2, MR_SIZE - 1} {
+		mr := testMR
+		mr[i] ^= 1
+		if err := checkMR(mr, mrs); !errors.Is(err, ErrEnclaveNotAllowed) {
+			t.Errorf("A measurement that differs in byte %d should not be allowed, got: %v", i, err)
+		}
+	}
+	if err := checkMR(testMR, nil); !errors.Is(err, ErrEnclaveNotAllowed) {
+		t.Fatal("No measurement should be allowed by an empty list, got:", err)
+	}
+}
+
+func TestMeasurementPolicy(t *testing.T) {
+	// One quote of a trusted build signed by an unknown key, and
+	// one of an unknown build signed by the trusted key.
+	unknownSigner := newTestQuote()
+	unknownSigner[MRSIGNER_IN_QUOTE] ^= 1
+	unknownEnclave := newTestQuote()
+	unknownEnclave[MRENCLAVE_IN_QUOTE] ^= 1
+
+	tests := []struct {
+		policy                      MeasurementPolicy
+		signerOK, enclaveOK, bothOK bool
+	}{
+		{"", false, false, true},
+		{MEASUREMENT_BOTH, false, false, true},
+		{MEASUREMENT_MRENCLAVE_ONLY, true, false, true},
+		{MEASUREMENT_MRSIGNER_ONLY, false, true, true},
+		{MEASUREMENT_EITHER, true, true, true},
+	}
+	for _, test := range tests {
+		for _, q := range []struct {
+			name  string
+			quote []byte
+			ok    bool
+		}{
+			{"unknown MRSigner", unknownSigner, test.signerOK},
+			{"unknown MREnclave", unknownEnclave, test.enclaveOK},
+			{"trusted", newTestQuote(), test.bothOK},
+		} {
+			conf := authConfiguration()
+			conf.measurementPolicy = test.policy
+			sn := newSession("0", conf, &fakeIAS{})
+			_, err := sendQuote(t, sn, q.quote)
+			if q.ok && err != nil {
+				t.Errorf("%q: %s quote should be accepted: %v", test.policy, q.name, err)
+			} else if !q.ok && !errors.Is(err, ErrEnclaveNotAllowed) {
+				t.Errorf("%q: %s quote should not be allowed, got: %v", test.policy, q.name, err)
+			}
+		}
+	}
+}
+
+// BenchmarkMsg1ToMsg2 measures the server side of message 1 and 2 for
+// a new session: the key exchange, the key derivation, and signing
+// message 2.
+func BenchmarkMsg1ToMsg2(b *testing.B) {
+	conf := authConfiguration()
+	_, msg1 := newTestMsg1()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sn := newSession("0", conf, &fakeIAS{})
+		if err := sn.ProcessMsg1(msg1); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := sn.CreateMsg2(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkHandshake measures full attestations through a session
+// manager, with the fake IAS standing in for the network. This
+// includes the client side of the handshake.
+func BenchmarkHandshake(b *testing.B) {
+	conf := authConfiguration()
+	conf.maxSessions = -1
+	sm := newSessionManager(*conf, &fakeIAS{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := managerHandshake(b, sm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkSeal(b *testing.B, size int) {
+	sn := newSession("0", authConfiguration(), &fakeIAS{})
+	handshake(b, sn)
+	msg := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sn.Seal(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkOpen(b *testing.B, size int) {
+	sn := newSession("0", authConfiguration(), &fakeIAS{})
+	handshake(b, sn)
+	ciphertext := clientSeal(b, "0", sn.sk, make([]byte, size))
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sn.Open(ciphertext); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSeal64(b *testing.B) { benchmarkSeal(b, 64) }
+func BenchmarkSeal4K(b *testing.B) { benchmarkSeal(b, 4096) }
+func BenchmarkOpen64(b *testing.B) { benchmarkOpen(b, 64) }
+func BenchmarkOpen4K(b *testing.B) { benchmarkOpen(b, 4096) }
+
+func TestMsg1Retransmission(t *testing.T) {
+	sn := newSession("0", authConfiguration(), &fakeIAS{})
+	priv, msg1 := newTestMsg1()
+	if err := sn.ProcessMsg1(msg1); err != nil {
+		t.Fatal(err)
+	}
+	msg2, err := sn.CreateMsg2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smk := append([]byte(nil), sn.smk...)
+
+	// The transport delivers message 1 again after message 2.
+	retransmit := proto.Clone(msg1).(*Msg1)
+	if err := sn.ProcessMsg1(retransmit); err != nil {
+		t.Fatal("An exact retransmission should be accepted:", err)
+	}
+	again, err := sn.CreateMsg2()
+	if err != nil {
+		t.Fatal(err)
+	} else if !proto.Equal(again, msg2) {
+		t.Fatal("A retransmission should get the same message 2.")
+	} else if !bytes.Equal(sn.smk, smk) {
+		t.Fatal("A retransmission should not change the session keys.")
+	}
+
+	// Any other message 1 is rejected, and changes nothing.
+	_, other := newTestMsg1()
+	if err := sn.ProcessMsg1(other); !errors.Is(err, ErrMsg1Mismatch) {
+		t.Fatal("A divergent message 1 should be rejected, got:", err)
+	}
+	if !bytes.Equal(sn.ga.X, msg1.Ga.X) || !bytes.Equal(sn.smk, smk) {
+		t.Fatal("A divergent message 1 should not change the session.")
+	}
+
+	// The handshake completes with the original message 2.
+	if err := sn.ProcessMsg3(newTestMsg3(priv, msg1, msg2, newTestQuote())); err != nil {
+		t.Fatal(err)
+	}
+
+	// Through the session manager, a divergent message 1 does not
+	// tear down the session.
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{})
+	challenge, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := challenge.SessionId
+	priv, msg1 = newTestMsg1()
+	msg2, err = sm.Msg1ToMsg2(id, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := sm.Msg1ToMsg2(id, msg1); err != nil || !proto.Equal(again, msg2) {
+		t.Fatal("Expected the same message 2, got:", err)
+	}
+	if _, err := sm.Msg1ToMsg2(id, other); !errors.Is(err, ErrMsg1Mismatch) {
+		t.Fatal("A divergent message 1 should be rejected, got:", err)
+	}
+	if _, err := sm.Msg3ToMsg4(id, newTestMsg3(priv, msg1, msg2, newTestQuote())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEphemeralPublicBytes(t *testing.T) {
+	sn := newSession("0", authConfiguration(), &fakeIAS{})
+	if _, _, err := sn.EphemeralPublicBytes(); !errors.Is(err, ErrMsg2NotCreated) {
+		t.Fatal("Expected no message 2 yet, got:", err)
+	}
+
+	_, msg1 := newTestMsg1()
+	if err := sn.ProcessMsg1(msg1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sn.EphemeralPublicBytes(); !errors.Is(err, ErrMsg2NotCreated) {
+		t.Fatal("Expected no message 2 yet, got:", err)
+	}
+	msg2, err := sn.CreateMsg2()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gx, gy, err := sn.EphemeralPublicBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gx, msg2.A.Gb.X) || !bytes.Equal(gy, msg2.A.Gb.Y) {
+		t.Fatal("The ephemeral key does not match GB in message 2.")
+	}
+	if len(gx) != EC_COORD_SIZE || len(gy) != EC_COORD_SIZE {
+		t.Fatal("Expected 32 byte coordinates, got", len(gx), len(gy))
+	}
+
+	// The bytes are little endian, like marshalPublicKey.
+	x := append([]byte(nil), gx...)
+	reverse(x)
+	if new(big.Int).SetBytes(x).Cmp(sn.ephKey.PublicKey.X) != 0 {
+		t.Fatal("GB is not the little endian encoding of the ephemeral key.")
+	}
+
+	// Changing the returned bytes does not change the session.
+	gx[0] ^= 1
+	if again, _, _ := sn.EphemeralPublicBytes(); !bytes.Equal(again, msg2.A.Gb.X) {
+		t.Fatal("The session should not share its key bytes.")
+	}
+}
+
+func TestProbeMsg3(t *testing.T) {
+	ias := &fakeIAS{}
+	sn := newSession("0", authConfiguration(), ias)
+	priv, msg1 := newTestMsg1()
+	if _, err := sn.ProbeMsg3(&Msg3{}); !errors.Is(err, ErrMsg2NotCreated) {
+		t.Fatal("Expected no message 2 yet, got:", err)
+	}
+	if err := sn.ProcessMsg3(&Msg3{}); !errors.Is(err, ErrMsg2NotCreated) {
+		t.Fatal("Expected no message 2 yet, got:", err)
+	}
+	if err := sn.ProcessMsg1(msg1); err != nil {
+		t.Fatal(err)
+	}
+	msg2, err := sn.CreateMsg2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg3 := newTestMsg3(priv, msg1, msg2, newTestQuote())
+
+	// state is what a probe must leave alone.
+	state := func() []interface{} {
+		return []interface{}{sn.authenticated, sn.vk, sn.sk, sn.mk, sn.msg3, sn.msg4,
+			sn.iasCalled, sn.pseTrusted, sn.advisories, sn.peer, sn.lastUsed, sn.verifiedAt}
+	}
+	probe := func(stage string, msg3 *Msg3) (*AttestationResult, error) {
+		before := state()
+		result, err := sn.ProbeMsg3(msg3)
+		if after := state(); !reflect.DeepEqual(before, after) {
+			t.Fatalf("%s: the probe changed the session:\n%v\n%v", stage, before, after)
+		}
+		return result, err
+	}
+
+	if result, err := probe("valid", msg3); err != nil {
+		t.Fatal(err)
+	} else if !result.EnclaveTrusted {
+		t.Fatal("The enclave should be trusted.")
+	} else if ias.verifyCalls != 1 {
+		t.Fatal("The probe should verify the quote with IAS.")
+	}
+
+	forged := proto.Clone(msg3).(*Msg3)
+	forged.CmacM[0] ^= 1
+	if result, err := probe("forged", forged); !errors.Is(err, ErrInvalidMsg3) || result != nil {
+		t.Fatal("Expected the forged message 3 to fail before IAS, got:", result, err)
+	} else if ias.verifyCalls != 1 {
+		t.Fatal("The forged message 3 should not be sent to IAS.")
+	}
+
+	ias.verifyErr = &QuoteStatusError{Status: ISV_GROUP_OUT_OF_DATE}
+	if result, err := probe("rejected", msg3); !errors.Is(err, ErrQuoteRejected) {
+		t.Fatal("Expected the quote to be rejected, got:", err)
+	} else if result == nil || result.EnclaveTrusted {
+		t.Fatal("The rejection by IAS should come with an untrusted result, got:", result)
+	}
+
+	// The session still goes through the handshake, and the
+	// message 3 that authenticated it can be probed again.
+	ias.verifyErr = nil
+	if err := sn.ProcessMsg3(msg3); err != nil {
+		t.Fatal(err)
+	}
+	msg4, err := sn.CreateMsg4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := probe("authenticated", msg3); err != nil || !result.EnclaveTrusted {
+		t.Fatal("Expected the authenticating message 3 to verify again, got:", err)
+	}
+	if again, err := sn.CreateMsg4(); err != nil || !proto.Equal(again, msg4) {
+		t.Fatal("The probe should not change message 4.")
+	}
+
+	// An expired session is not probed, so IAS is not called.
+	sn.timeout = 5
+	sn.lastUsed = sn.now().Add(-time.Hour)
+	calls := ias.verifyCalls
+	if result, err := probe("expired", msg3); !errors.Is(err, ErrSessionExpired) || result != nil {
+		t.Fatal("Expected the expired session not to be probed, got:", result, err)
+	} else if ias.verifyCalls != calls {
+		t.Fatal("The probe of an expired session should not call IAS.")
+	}
+}
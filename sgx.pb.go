@@ -24,8 +24,10 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
-// TODO: actually put in some relevant values into request
 type Request struct {
+	// optional stable identity of the client, used to replace its
+	// pending session when the session manager coalesces retries
+	ClientId             string   `protobuf:"bytes,1,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -56,8 +58,16 @@ func (m *Request) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_Request proto.InternalMessageInfo
 
+func (m *Request) GetClientId() string {
+	if m != nil {
+		return m.ClientId
+	}
+	return ""
+}
+
 type Challenge struct {
 	SessionId            string   `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	Challenge            []byte   `protobuf:"bytes,2,opt,name=challenge,proto3" json:"challenge,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -95,6 +105,13 @@ func (m *Challenge) GetSessionId() string {
 	return ""
 }
 
+func (m *Challenge) GetChallenge() []byte {
+	if m != nil {
+		return m.Challenge
+	}
+	return nil
+}
+
 type Msg0 struct {
 	Exgid                uint32   `protobuf:"varint,1,opt,name=exgid,proto3" json:"exgid,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -134,6 +151,46 @@ func (m *Msg0) GetExgid() uint32 {
 	return 0
 }
 
+// reply to an explicit msg0; errors are returned as rpc errors
+type Msg0Response struct {
+	Exgid                uint32   `protobuf:"varint,1,opt,name=exgid,proto3" json:"exgid,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Msg0Response) Reset()         { *m = Msg0Response{} }
+func (m *Msg0Response) String() string { return proto.CompactTextString(m) }
+func (*Msg0Response) ProtoMessage()    {}
+func (*Msg0Response) Descriptor() ([]byte, []int) {
+	return fileDescriptor_29e2d0ab30d804d4, []int{3}
+}
+
+func (m *Msg0Response) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Msg0Response.Unmarshal(m, b)
+}
+func (m *Msg0Response) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Msg0Response.Marshal(b, m, deterministic)
+}
+func (m *Msg0Response) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Msg0Response.Merge(m, src)
+}
+func (m *Msg0Response) XXX_Size() int {
+	return xxx_messageInfo_Msg0Response.Size(m)
+}
+func (m *Msg0Response) XXX_DiscardUnknown() {
+	xxx_messageInfo_Msg0Response.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Msg0Response proto.InternalMessageInfo
+
+func (m *Msg0Response) GetExgid() uint32 {
+	if m != nil {
+		return m.Exgid
+	}
+	return 0
+}
+
 type PublicKey struct {
 	X                    []byte   `protobuf:"bytes,1,opt,name=x,proto3" json:"x,omitempty"`
 	Y                    []byte   `protobuf:"bytes,2,opt,name=y,proto3" json:"y,omitempty"`
@@ -146,7 +203,7 @@ func (m *PublicKey) Reset()         { *m = PublicKey{} }
 func (m *PublicKey) String() string { return proto.CompactTextString(m) }
 func (*PublicKey) ProtoMessage()    {}
 func (*PublicKey) Descriptor() ([]byte, []int) {
-	return fileDescriptor_29e2d0ab30d804d4, []int{3}
+	return fileDescriptor_29e2d0ab30d804d4, []int{4}
 }
 
 func (m *PublicKey) XXX_Unmarshal(b []byte) error {
@@ -181,21 +238,28 @@ func (m *PublicKey) GetY() []byte {
 	return nil
 }
 
-// send msg0 and msg1 together, as per intel's suggestion
+// send msg0 and msg1 together, as per intel's suggestion.
+// msg0 may be left out if it was already sent with SendMsg0.
 type Msg1 struct {
-	Msg0                 *Msg0      `protobuf:"bytes,1,opt,name=msg0,proto3" json:"msg0,omitempty"`
-	Ga                   *PublicKey `protobuf:"bytes,2,opt,name=ga,proto3" json:"ga,omitempty"`
-	Gid                  []byte     `protobuf:"bytes,3,opt,name=gid,proto3" json:"gid,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
-	XXX_unrecognized     []byte     `json:"-"`
-	XXX_sizecache        int32      `json:"-"`
+	Msg0 *Msg0      `protobuf:"bytes,1,opt,name=msg0,proto3" json:"msg0,omitempty"`
+	Ga   *PublicKey `protobuf:"bytes,2,opt,name=ga,proto3" json:"ga,omitempty"`
+	Gid  []byte     `protobuf:"bytes,3,opt,name=gid,proto3" json:"gid,omitempty"`
+	// optional SHA-256 of the SP public key (x || y, little endian)
+	// the client expects; the primary key is used if empty
+	SpKeyHash []byte `protobuf:"bytes,4,opt,name=sp_key_hash,json=spKeyHash,proto3" json:"sp_key_hash,omitempty"`
+	// optional random nonce of the client, which must not repeat if
+	// the server requires client nonces
+	ClientNonce          []byte   `protobuf:"bytes,5,opt,name=client_nonce,json=clientNonce,proto3" json:"client_nonce,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Msg1) Reset()         { *m = Msg1{} }
 func (m *Msg1) String() string { return proto.CompactTextString(m) }
 func (*Msg1) ProtoMessage()    {}
 func (*Msg1) Descriptor() ([]byte, []int) {
-	return fileDescriptor_29e2d0ab30d804d4, []int{4}
+	return fileDescriptor_29e2d0ab30d804d4, []int{5}
 }
 
 func (m *Msg1) XXX_Unmarshal(b []byte) error {
@@ -237,6 +301,20 @@ func (m *Msg1) GetGid() []byte {
 	return nil
 }
 
+func (m *Msg1) GetSpKeyHash() []byte {
+	if m != nil {
+		return m.SpKeyHash
+	}
+	return nil
+}
+
+func (m *Msg1) GetClientNonce() []byte {
+	if m != nil {
+		return m.ClientNonce
+	}
+	return nil
+}
+
 type Signature struct {
 	R                    []byte   `protobuf:"bytes,1,opt,name=r,proto3" json:"r,omitempty"`
 	S                    []byte   `protobuf:"bytes,2,opt,name=s,proto3" json:"s,omitempty"`
@@ -249,7 +327,7 @@ func (m *Signature) Reset()         { *m = Signature{} }
 func (m *Signature) String() string { return proto.CompactTextString(m) }
 func (*Signature) ProtoMessage()    {}
 func (*Signature) Descriptor() ([]byte, []int) {
-	return fileDescriptor_29e2d0ab30d804d4, []int{5}
+	return fileDescriptor_29e2d0ab30d804d4, []int{6}
 }
 
 func (m *Signature) XXX_Unmarshal(b []byte) error {
@@ -301,7 +379,7 @@ func (m *A) Reset()         { *m = A{} }
 func (m *A) String() string { return proto.CompactTextString(m) }
 func (*A) ProtoMessage()    {}
 func (*A) Descriptor() ([]byte, []int) {
-	return fileDescriptor_29e2d0ab30d804d4, []int{6}
+	return fileDescriptor_29e2d0ab30d804d4, []int{7}
 }
 
 func (m *A) XXX_Unmarshal(b []byte) error {
@@ -371,7 +449,7 @@ func (m *Msg2) Reset()         { *m = Msg2{} }
 func (m *Msg2) String() string { return proto.CompactTextString(m) }
 func (*Msg2) ProtoMessage()    {}
 func (*Msg2) Descriptor() ([]byte, []int) {
-	return fileDescriptor_29e2d0ab30d804d4, []int{7}
+	return fileDescriptor_29e2d0ab30d804d4, []int{8}
 }
 
 func (m *Msg2) XXX_Unmarshal(b []byte) error {
@@ -433,7 +511,7 @@ func (m *M) Reset()         { *m = M{} }
 func (m *M) String() string { return proto.CompactTextString(m) }
 func (*M) ProtoMessage()    {}
 func (*M) Descriptor() ([]byte, []int) {
-	return fileDescriptor_29e2d0ab30d804d4, []int{8}
+	return fileDescriptor_29e2d0ab30d804d4, []int{9}
 }
 
 func (m *M) XXX_Unmarshal(b []byte) error {
@@ -487,7 +565,7 @@ func (m *Msg3) Reset()         { *m = Msg3{} }
 func (m *Msg3) String() string { return proto.CompactTextString(m) }
 func (*Msg3) ProtoMessage()    {}
 func (*Msg3) Descriptor() ([]byte, []int) {
-	return fileDescriptor_29e2d0ab30d804d4, []int{9}
+	return fileDescriptor_29e2d0ab30d804d4, []int{10}
 }
 
 func (m *Msg3) XXX_Unmarshal(b []byte) error {
@@ -537,7 +615,7 @@ func (m *AttestationResult) Reset()         { *m = AttestationResult{} }
 func (m *AttestationResult) String() string { return proto.CompactTextString(m) }
 func (*AttestationResult) ProtoMessage()    {}
 func (*AttestationResult) Descriptor() ([]byte, []int) {
-	return fileDescriptor_29e2d0ab30d804d4, []int{10}
+	return fileDescriptor_29e2d0ab30d804d4, []int{11}
 }
 
 func (m *AttestationResult) XXX_Unmarshal(b []byte) error {
@@ -588,19 +666,22 @@ func (m *AttestationResult) GetAdvisories() []string {
 
 // TODO: figure out exactly what msg4 looks like
 type Msg4 struct {
-	Result               *AttestationResult `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
-	Secret               []byte             `protobuf:"bytes,2,opt,name=secret,proto3" json:"secret,omitempty"`
-	Cmac                 []byte             `protobuf:"bytes,3,opt,name=cmac,proto3" json:"cmac,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}           `json:"-"`
-	XXX_unrecognized     []byte             `json:"-"`
-	XXX_sizecache        int32              `json:"-"`
+	Result *AttestationResult `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
+	Secret []byte             `protobuf:"bytes,2,opt,name=secret,proto3" json:"secret,omitempty"`
+	Cmac   []byte             `protobuf:"bytes,3,opt,name=cmac,proto3" json:"cmac,omitempty"`
+	// application data sealed with SK like secret, only sent to
+	// authenticated enclaves. at most 4096 bytes before sealing.
+	Payload              []byte   `protobuf:"bytes,4,opt,name=payload,proto3" json:"payload,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Msg4) Reset()         { *m = Msg4{} }
 func (m *Msg4) String() string { return proto.CompactTextString(m) }
 func (*Msg4) ProtoMessage()    {}
 func (*Msg4) Descriptor() ([]byte, []int) {
-	return fileDescriptor_29e2d0ab30d804d4, []int{11}
+	return fileDescriptor_29e2d0ab30d804d4, []int{12}
 }
 
 func (m *Msg4) XXX_Unmarshal(b []byte) error {
@@ -642,10 +723,18 @@ func (m *Msg4) GetCmac() []byte {
 	return nil
 }
 
+func (m *Msg4) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Request)(nil), "sgx_server.Request")
 	proto.RegisterType((*Challenge)(nil), "sgx_server.Challenge")
 	proto.RegisterType((*Msg0)(nil), "sgx_server.Msg0")
+	proto.RegisterType((*Msg0Response)(nil), "sgx_server.Msg0Response")
 	proto.RegisterType((*PublicKey)(nil), "sgx_server.PublicKey")
 	proto.RegisterType((*Msg1)(nil), "sgx_server.Msg1")
 	proto.RegisterType((*Signature)(nil), "sgx_server.Signature")
@@ -660,45 +749,51 @@ func init() {
 func init() { proto.RegisterFile("sgx.proto", fileDescriptor_29e2d0ab30d804d4) }
 
 var fileDescriptor_29e2d0ab30d804d4 = []byte{
-	// 597 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x94, 0xcb, 0x4e, 0x1b, 0x3d,
-	0x14, 0x80, 0x71, 0x6e, 0x3f, 0x73, 0x02, 0xfc, 0xa9, 0x5b, 0xaa, 0x88, 0x16, 0x8a, 0xac, 0x56,
-	0xa0, 0x2e, 0x10, 0x24, 0x74, 0xd3, 0x55, 0xa3, 0xae, 0x50, 0x15, 0x09, 0x39, 0xec, 0x47, 0x4e,
-	0xc6, 0x4c, 0x5d, 0x26, 0x19, 0xe3, 0xe3, 0x41, 0x09, 0x2f, 0xd1, 0xe7, 0xe8, 0xba, 0x2f, 0x58,
-	0xd9, 0xe3, 0x84, 0x09, 0x51, 0xd5, 0x9d, 0xcf, 0xcd, 0xe7, 0x3b, 0x17, 0x1b, 0x22, 0x4c, 0xe7,
-	0x67, 0xda, 0xe4, 0x36, 0xa7, 0x80, 0xe9, 0x3c, 0x46, 0x69, 0x1e, 0xa4, 0x61, 0x11, 0xfc, 0xc7,
-	0xe5, 0x7d, 0x21, 0xd1, 0xb2, 0x8f, 0x10, 0x7d, 0xfd, 0x2e, 0xb2, 0x4c, 0xce, 0x52, 0x49, 0x0f,
-	0x01, 0x50, 0x22, 0xaa, 0x7c, 0x16, 0xab, 0xa4, 0x4b, 0x8e, 0xc9, 0x69, 0xc4, 0xa3, 0xa0, 0xb9,
-	0x4a, 0xd8, 0x5b, 0x68, 0x0c, 0x31, 0x3d, 0xa7, 0xaf, 0xa0, 0x29, 0xe7, 0x69, 0xf0, 0xd8, 0xe5,
-	0xa5, 0xc0, 0x4e, 0x20, 0xba, 0x2e, 0xc6, 0x99, 0x9a, 0x7c, 0x93, 0x0b, 0xba, 0x03, 0x64, 0xee,
-	0xcd, 0x3b, 0x9c, 0xcc, 0x9d, 0xb4, 0xe8, 0xd6, 0x4a, 0x69, 0xc1, 0xa4, 0xbf, 0xe6, 0x82, 0xbe,
-	0x87, 0xc6, 0x14, 0xd3, 0x73, 0xef, 0xd6, 0xee, 0x75, 0xce, 0x9e, 0x00, 0xcf, 0x5c, 0x1a, 0xee,
-	0xad, 0xf4, 0x03, 0xd4, 0x52, 0xe1, 0x83, 0xdb, 0xbd, 0xfd, 0xaa, 0xcf, 0x2a, 0x19, 0xaf, 0xa5,
-	0x82, 0x76, 0xa0, 0xee, 0x88, 0xea, 0x3e, 0x49, 0x3d, 0xf0, 0x8c, 0x54, 0x3a, 0x13, 0xb6, 0x30,
-	0xd2, 0x11, 0x98, 0x25, 0x8f, 0x71, 0x12, 0x2e, 0x79, 0x90, 0xfd, 0x22, 0x40, 0x06, 0x3e, 0xcf,
-	0x38, 0xb0, 0xfc, 0x35, 0xcf, 0x98, 0x52, 0x68, 0xa0, 0x56, 0x49, 0x88, 0xf6, 0x67, 0xd7, 0xb6,
-	0xfb, 0x22, 0xb7, 0x32, 0xb6, 0x0b, 0x2d, 0x03, 0x42, 0xe4, 0x35, 0x37, 0x0b, 0x2d, 0xe9, 0x3e,
-	0xb4, 0xee, 0x92, 0x5b, 0xd7, 0xd1, 0x86, 0x37, 0x35, 0xef, 0x92, 0xdb, 0xab, 0x84, 0xf6, 0x21,
-	0xc2, 0x25, 0x5f, 0xb7, 0xb9, 0x99, 0x77, 0x05, 0xcf, 0x9f, 0xfc, 0xd8, 0xbd, 0xef, 0x5d, 0x8f,
-	0xbe, 0x01, 0x22, 0x02, 0xec, 0x6e, 0x35, 0x68, 0xc0, 0x89, 0x70, 0x09, 0x27, 0x53, 0x31, 0x89,
-	0x45, 0xa0, 0x6c, 0x3a, 0x69, 0x40, 0x8f, 0xa0, 0x8d, 0x2a, 0x8d, 0x4d, 0x16, 0xa3, 0x7a, 0x2c,
-	0x39, 0x77, 0xfd, 0xdd, 0x3c, 0x1b, 0xa9, 0x47, 0xcf, 0x59, 0xda, 0x97, 0x9c, 0xde, 0xc4, 0x7e,
-	0x00, 0x19, 0x86, 0x29, 0x90, 0x7f, 0x4d, 0xe1, 0x14, 0x3a, 0x1a, 0x63, 0x94, 0x93, 0xc2, 0x28,
-	0xbb, 0x88, 0xb5, 0xc9, 0x75, 0x60, 0xd8, 0xd3, 0x38, 0x0a, 0xea, 0x6b, 0x93, 0x6b, 0xb7, 0x43,
-	0xbe, 0x43, 0xa1, 0x5d, 0xa5, 0xc0, 0x3e, 0xfb, 0xf2, 0xfa, 0xab, 0x0a, 0xa6, 0x61, 0x66, 0xbe,
-	0x82, 0xa1, 0xab, 0x7a, 0x1a, 0x56, 0x61, 0xad, 0xea, 0x21, 0x27, 0x53, 0xf6, 0x93, 0xc0, 0x8b,
-	0x81, 0xb5, 0x12, 0xad, 0xb0, 0x2a, 0x9f, 0x71, 0x89, 0x45, 0x66, 0xe9, 0x09, 0xfc, 0x2f, 0x67,
-	0x93, 0x4c, 0x3c, 0xc8, 0xd8, 0x9a, 0x02, 0xad, 0x2c, 0xb7, 0x76, 0x9b, 0xef, 0x05, 0xf5, 0x4d,
-	0xa9, 0xa5, 0xef, 0xa0, 0xad, 0xf1, 0xc9, 0xa9, 0xe6, 0x9d, 0x40, 0xe3, 0xca, 0xa1, 0x03, 0x75,
-	0xad, 0xc6, 0xcb, 0x0d, 0xd3, 0x6a, 0x4c, 0x8f, 0x00, 0x44, 0xf2, 0xa0, 0x30, 0x37, 0x4a, 0x62,
-	0xb7, 0x71, 0x5c, 0x3f, 0x8d, 0x78, 0x45, 0xc3, 0x94, 0xaf, 0xe6, 0x92, 0x7e, 0x82, 0x96, 0xf1,
-	0x34, 0xa1, 0x81, 0x87, 0x6b, 0x13, 0x7b, 0x8e, 0xcc, 0x83, 0x33, 0x7d, 0x0d, 0x2d, 0x94, 0x13,
-	0x23, 0x6d, 0x68, 0x61, 0x90, 0xdc, 0x0a, 0xba, 0x76, 0x04, 0x12, 0x7f, 0xee, 0xfd, 0x26, 0xd0,
-	0xae, 0xdc, 0x44, 0xbf, 0x40, 0x67, 0x64, 0x85, 0xb1, 0x55, 0xdd, 0xcb, 0x6a, 0xda, 0xf0, 0xfe,
-	0x0f, 0xd6, 0x86, 0xb9, 0xfa, 0x09, 0xd8, 0x16, 0x3d, 0x87, 0xed, 0x91, 0x9c, 0x25, 0xfe, 0xa5,
-	0x3e, 0x7f, 0x9b, 0x17, 0x07, 0xcf, 0x35, 0xbd, 0xb5, 0x88, 0xfe, 0x46, 0x44, 0x7f, 0x23, 0xe2,
-	0x92, 0x6d, 0x8d, 0x5b, 0xfe, 0x6b, 0xea, 0xff, 0x09, 0x00, 0x00, 0xff, 0xff, 0x59, 0x58, 0xbb,
-	0x14, 0xa7, 0x04, 0x00, 0x00,
+	// 701 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x54, 0xdd, 0x4e, 0xdb, 0x4c,
+	0x10, 0x65, 0xf3, 0x07, 0x9e, 0x04, 0xbe, 0x7c, 0xdb, 0x52, 0x59, 0xfc, 0x95, 0x5a, 0xb4, 0xe4,
+	0x0a, 0x41, 0x42, 0xa5, 0xaa, 0x57, 0x8d, 0x7a, 0x03, 0x42, 0xa9, 0x90, 0xc3, 0xbd, 0xb5, 0xb1,
+	0x17, 0xc7, 0xc5, 0xb1, 0x17, 0xcf, 0x06, 0xc5, 0xdc, 0xf6, 0x01, 0xfa, 0x1a, 0xed, 0xc3, 0xf5,
+	0x1d, 0xaa, 0x5d, 0xaf, 0x93, 0x40, 0xd4, 0xf6, 0x6e, 0xe7, 0xec, 0x19, 0xcf, 0x39, 0x33, 0xeb,
+	0x01, 0x0b, 0xc3, 0xd9, 0x89, 0xc8, 0x52, 0x99, 0x52, 0xc0, 0x70, 0xe6, 0x21, 0xcf, 0x1e, 0x78,
+	0xe6, 0xbc, 0x83, 0x75, 0x97, 0xdf, 0x4f, 0x39, 0x4a, 0xba, 0x0b, 0x96, 0x1f, 0x47, 0x3c, 0x91,
+	0x5e, 0x14, 0xd8, 0xe4, 0x90, 0x74, 0x2c, 0x77, 0xa3, 0x00, 0x2e, 0x03, 0xe7, 0x02, 0xac, 0xcf,
+	0x63, 0x16, 0xc7, 0x3c, 0x09, 0x39, 0xdd, 0x07, 0x40, 0x8e, 0x18, 0xa5, 0xc9, 0x82, 0x6a, 0x19,
+	0xe4, 0x32, 0xa0, 0x7b, 0x60, 0xf9, 0x25, 0xd7, 0xae, 0x1c, 0x92, 0x4e, 0xcb, 0x5d, 0x00, 0xce,
+	0x1e, 0xd4, 0x06, 0x18, 0x9e, 0xd2, 0x97, 0x50, 0xe7, 0xb3, 0xd0, 0xe4, 0x6f, 0xba, 0x45, 0xe0,
+	0x1c, 0x41, 0x4b, 0xdd, 0xba, 0x1c, 0x45, 0x9a, 0x20, 0xff, 0x03, 0xeb, 0x18, 0xac, 0xeb, 0xe9,
+	0x28, 0x8e, 0xfc, 0x2b, 0x9e, 0xd3, 0x16, 0x90, 0x99, 0xbe, 0x6e, 0xb9, 0x64, 0xa6, 0xa2, 0xdc,
+	0x14, 0x25, 0xb9, 0xf3, 0x83, 0xe8, 0x6a, 0x67, 0xf4, 0x08, 0x6a, 0x13, 0x0c, 0x4f, 0x35, 0xaf,
+	0xd9, 0x6d, 0x9f, 0x2c, 0x5a, 0x70, 0xa2, 0xeb, 0xe9, 0x5b, 0xfa, 0x16, 0x2a, 0x21, 0xd3, 0xd9,
+	0xcd, 0xee, 0xf6, 0x32, 0x67, 0x5e, 0xcd, 0xad, 0x84, 0x8c, 0xb6, 0xa1, 0xaa, 0x24, 0x55, 0x75,
+	0x15, 0x75, 0xa4, 0x07, 0xd0, 0x44, 0xe1, 0xdd, 0xf1, 0xdc, 0x1b, 0x33, 0x1c, 0xdb, 0xb5, 0xc2,
+	0x34, 0x8a, 0x2b, 0x9e, 0x5f, 0x30, 0x1c, 0xd3, 0x37, 0xd0, 0x32, 0xbd, 0x4d, 0xd2, 0xc4, 0xe7,
+	0x76, 0x5d, 0x13, 0x9a, 0x05, 0xf6, 0x45, 0x41, 0xca, 0xd3, 0x30, 0x0a, 0x13, 0x26, 0xa7, 0x19,
+	0x57, 0x2e, 0xb2, 0xd2, 0x53, 0xa6, 0x22, 0x2c, 0x3d, 0xa1, 0xf3, 0x93, 0x00, 0xe9, 0x6b, 0xa9,
+	0x23, 0x9b, 0xfc, 0x5d, 0xea, 0x88, 0x52, 0xa8, 0xa1, 0x88, 0x02, 0x93, 0xad, 0xcf, 0x6a, 0x7c,
+	0xf7, 0xd3, 0x54, 0x72, 0x4f, 0xe6, 0x82, 0x1b, 0x17, 0x96, 0x46, 0x6e, 0x72, 0xc1, 0xe9, 0x36,
+	0x34, 0xee, 0x82, 0x5b, 0x35, 0xd9, 0xc2, 0x46, 0xfd, 0x2e, 0xb8, 0xbd, 0x0c, 0x68, 0x0f, 0x2c,
+	0x2c, 0xf5, 0xd9, 0xf5, 0xd5, 0xba, 0x73, 0xf1, 0xee, 0x82, 0xe7, 0xdc, 0xeb, 0xf6, 0x77, 0xe9,
+	0x2e, 0x10, 0x66, 0xc4, 0x6e, 0x2e, 0x27, 0xf5, 0x5d, 0xc2, 0x54, 0x41, 0x7f, 0xc2, 0x7c, 0x8f,
+	0x19, 0x95, 0x75, 0x15, 0xf5, 0x75, 0x4f, 0xa3, 0xd0, 0xcb, 0x62, 0x0f, 0xa3, 0xc7, 0x42, 0xe7,
+	0xa6, 0xfe, 0xb6, 0x1b, 0x0f, 0xa3, 0x47, 0xad, 0xb3, 0xb8, 0x2f, 0x75, 0xea, 0x2b, 0xe7, 0x2b,
+	0x90, 0x81, 0x19, 0x24, 0xf9, 0xd7, 0x20, 0x3b, 0xd0, 0x16, 0xe8, 0x21, 0xf7, 0xa7, 0x59, 0x24,
+	0x73, 0x4f, 0x64, 0xa9, 0x30, 0x1a, 0xb6, 0x04, 0x0e, 0x0d, 0x7c, 0x9d, 0xa5, 0x42, 0xbd, 0x43,
+	0xdd, 0x21, 0xd3, 0xae, 0x22, 0x70, 0x3e, 0x6a, 0x7b, 0xbd, 0xb9, 0x83, 0x89, 0x4d, 0x16, 0x0e,
+	0x06, 0xca, 0xf5, 0xc4, 0xae, 0xac, 0xba, 0x1e, 0xb8, 0x64, 0xe2, 0x7c, 0x27, 0xf0, 0x7f, 0x5f,
+	0x4a, 0x8e, 0x92, 0xc9, 0x28, 0x4d, 0x5c, 0x8e, 0xd3, 0x58, 0xd2, 0x63, 0xf8, 0x8f, 0x27, 0x7e,
+	0xcc, 0x1e, 0xb8, 0x27, 0xb3, 0x29, 0x4a, 0x5e, 0xbc, 0xfc, 0x0d, 0x77, 0xcb, 0xc0, 0x37, 0x05,
+	0x4a, 0x5f, 0x43, 0x53, 0xe0, 0x82, 0x54, 0xd1, 0x24, 0x10, 0x38, 0x27, 0xb4, 0xa1, 0x2a, 0xa2,
+	0x51, 0xf9, 0x48, 0x45, 0x34, 0xa2, 0x07, 0x00, 0x2c, 0x78, 0x88, 0x30, 0xcd, 0x22, 0x8e, 0x76,
+	0xed, 0xb0, 0xda, 0xb1, 0xdc, 0x25, 0xc4, 0xf9, 0x56, 0xfc, 0x2c, 0xe7, 0xf4, 0x3d, 0x34, 0x32,
+	0x2d, 0xc7, 0x74, 0x70, 0xff, 0xc9, 0xc8, 0x9e, 0x6b, 0x76, 0x0d, 0x99, 0xbe, 0x82, 0x06, 0x72,
+	0x3f, 0xe3, 0xd2, 0xf4, 0xd0, 0x44, 0xea, 0x0d, 0xaa, 0x7e, 0x18, 0x29, 0xfa, 0x4c, 0x6d, 0x58,
+	0x17, 0x2c, 0x8f, 0x53, 0x56, 0xbe, 0xb2, 0x32, 0xec, 0xfe, 0x22, 0xd0, 0x5c, 0xaa, 0x41, 0x3f,
+	0x41, 0x7b, 0x28, 0x59, 0x26, 0x97, 0xb1, 0x17, 0xcb, 0x82, 0xcc, 0xfe, 0xda, 0x79, 0x32, 0xe7,
+	0xf9, 0xb2, 0x72, 0xd6, 0xe8, 0x07, 0xd8, 0x18, 0xf2, 0x24, 0xd0, 0x5b, 0x67, 0xe5, 0xcf, 0xdf,
+	0xb1, 0x9f, 0x23, 0xe5, 0xee, 0x71, 0xd6, 0xe8, 0xe9, 0x3c, 0xf3, 0x6c, 0x25, 0xf3, 0x6c, 0xe7,
+	0x39, 0xd2, 0x7d, 0x92, 0xd1, 0x5b, 0xc9, 0xe8, 0xad, 0x64, 0x9c, 0x3b, 0x6b, 0xa3, 0x86, 0x5e,
+	0xca, 0xbd, 0xdf, 0x03, 0x00, 0xeb, 0x11, 0x32, 0xb8, 0xa1, 0x05, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -714,6 +809,7 @@ const _ = grpc.SupportPackageIsVersion4
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
 type AttestationClient interface {
 	StartAttestation(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Challenge, error)
+	SendMsg0(ctx context.Context, in *Msg0, opts ...grpc.CallOption) (*Msg0Response, error)
 	SendMsg1(ctx context.Context, in *Msg1, opts ...grpc.CallOption) (*Msg2, error)
 	SendMsg3(ctx context.Context, in *Msg3, opts ...grpc.CallOption) (*Msg4, error)
 }
@@ -735,6 +831,15 @@ func (c *attestationClient) StartAttestation(ctx context.Context, in *Request, o
 	return out, nil
 }
 
+func (c *attestationClient) SendMsg0(ctx context.Context, in *Msg0, opts ...grpc.CallOption) (*Msg0Response, error) {
+	out := new(Msg0Response)
+	err := c.cc.Invoke(ctx, "/sgx_server.Attestation/SendMsg0", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *attestationClient) SendMsg1(ctx context.Context, in *Msg1, opts ...grpc.CallOption) (*Msg2, error) {
 	out := new(Msg2)
 	err := c.cc.Invoke(ctx, "/sgx_server.Attestation/SendMsg1", in, out, opts...)
@@ -756,6 +861,7 @@ func (c *attestationClient) SendMsg3(ctx context.Context, in *Msg3, opts ...grpc
 // AttestationServer is the server API for Attestation service.
 type AttestationServer interface {
 	StartAttestation(context.Context, *Request) (*Challenge, error)
+	SendMsg0(context.Context, *Msg0) (*Msg0Response, error)
 	SendMsg1(context.Context, *Msg1) (*Msg2, error)
 	SendMsg3(context.Context, *Msg3) (*Msg4, error)
 }
@@ -767,6 +873,9 @@ type UnimplementedAttestationServer struct {
 func (*UnimplementedAttestationServer) StartAttestation(ctx context.Context, req *Request) (*Challenge, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method StartAttestation not implemented")
 }
+func (*UnimplementedAttestationServer) SendMsg0(ctx context.Context, req *Msg0) (*Msg0Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendMsg0 not implemented")
+}
 func (*UnimplementedAttestationServer) SendMsg1(ctx context.Context, req *Msg1) (*Msg2, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SendMsg1 not implemented")
 }
@@ -796,6 +905,24 @@ func _Attestation_StartAttestation_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Attestation_SendMsg0_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Msg0)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AttestationServer).SendMsg0(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/sgx_server.Attestation/SendMsg0",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AttestationServer).SendMsg0(ctx, req.(*Msg0))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Attestation_SendMsg1_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(Msg1)
 	if err := dec(in); err != nil {
@@ -840,6 +967,10 @@ var _Attestation_serviceDesc = grpc.ServiceDesc{
 			MethodName: "StartAttestation",
 			Handler:    _Attestation_StartAttestation_Handler,
 		},
+		{
+			MethodName: "SendMsg0",
+			Handler:    _Attestation_SendMsg0_Handler,
+		},
 		{
 			MethodName: "SendMsg1",
 			Handler:    _Attestation_SendMsg1_Handler,
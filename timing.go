@@ -0,0 +1,88 @@
+package sgx_server
+
+import (
+	"sort"
+	"time"
+)
+
+// HandshakeTiming is how long the handshake of an authenticated
+// session took. Total is from NewSession to message 4, including the
+// time the client spent between the messages. Msg1ToMsg2 is from
+// receiving message 1 to sending message 2, which includes fetching
+// the SigRL, and Msg3ToMsg4 is from receiving message 3 to sending
+// message 4, which is mostly the call to IAS.
+type HandshakeTiming struct {
+	Total      time.Duration
+	Msg1ToMsg2 time.Duration
+	Msg3ToMsg4 time.Duration
+}
+
+// The upper bounds of the buckets of the histograms in Stats. The
+// durations above the last bound are counted in one more bucket.
+var HANDSHAKE_BUCKETS = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// Histogram is a distribution of durations over HANDSHAKE_BUCKETS,
+// e.g., to export to a metrics system. Counts[i] is the number of
+// durations at most HANDSHAKE_BUCKETS[i] and above the bound before
+// it, and the last count is for the durations above every bound. Sum
+// is the total of all the Count durations.
+type Histogram struct {
+	Counts []int
+	Count  int
+	Sum    time.Duration
+}
+
+func newHistogram() Histogram {
+	return Histogram{Counts: make([]int, len(HANDSHAKE_BUCKETS)+1)}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := sort.Search(len(HANDSHAKE_BUCKETS), func(i int) bool {
+		return d <= HANDSHAKE_BUCKETS[i]
+	})
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (h Histogram) copy() Histogram {
+	h.Counts = append([]int(nil), h.Counts...)
+	return h
+}
+
+// handshakeTiming returns the timing of the handshake of sn, or nil
+// if sn did not send a message 4 to an authenticated enclave.
+func handshakeTiming(sn Session) *HandshakeTiming {
+	s, ok := sn.(*session)
+	if !ok || s.msg4 == nil {
+		return nil
+	}
+	return &HandshakeTiming{
+		Total:      s.msg4At.Sub(s.created),
+		Msg1ToMsg2: s.msg2At.Sub(s.msg1At),
+		Msg3ToMsg4: s.msg4At.Sub(s.msg3At),
+	}
+}
+
+// recordTiming adds timing, if not nil, to the histograms in Stats.
+func (sm *sessionManager) recordTiming(timing *HandshakeTiming) {
+	if timing == nil {
+		return
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.handshakeTimes.observe(timing.Total)
+	sm.msg1ToMsg2Times.observe(timing.Msg1ToMsg2)
+	sm.msg3ToMsg4Times.observe(timing.Msg3ToMsg4)
+}
@@ -0,0 +1,262 @@
+package sgx_server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// The signature algorithms of the tokens issued by Session.IssueToken,
+// named as in JWS (RFC 7518): ECDSA P-256 with SHA-256, Ed25519, and
+// RSA PKCS #1 v1.5 with SHA-256. The algorithm follows from the key.
+const (
+	TOKEN_ALG_ES256 = "ES256"
+	TOKEN_ALG_EDDSA = "EdDSA"
+	TOKEN_ALG_RS256 = "RS256"
+)
+
+// TokenClaims is what a verified-session token says about the client,
+// as returned by VerifyToken.
+type TokenClaims struct {
+	// SessionID is the id of the attested session.
+	SessionID string
+	// Enclave is the identity of the verified enclave, as returned
+	// by Session.Peer.
+	Enclave EnclaveIdentity
+	// VerifiedAt is when IAS last accepted the quote of the
+	// session.
+	VerifiedAt time.Time
+	// The token is valid from IssuedAt until Expires.
+	IssuedAt time.Time
+	Expires  time.Time
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// tokenPayload is the JSON encoding of TokenClaims. The times are in
+// seconds since the epoch, and the measurements in hex.
+type tokenPayload struct {
+	SessionID  string `json:"sid"`
+	VerifiedAt int64  `json:"auth_time"`
+	IssuedAt   int64  `json:"iat"`
+	Expires    int64  `json:"exp"`
+	MREnclave  string `json:"mrenclave"`
+	MRSigner   string `json:"mrsigner"`
+	ProdID     uint16 `json:"isv_prod_id"`
+	SVN        uint16 `json:"isv_svn"`
+	FamilyID   string `json:"isv_family_id,omitempty"`
+	ConfigID   string `json:"config_id,omitempty"`
+	ConfigSVN  uint16 `json:"config_svn,omitempty"`
+}
+
+func (sn *session) IssueToken(signer crypto.Signer, ttl time.Duration) (string, error) {
+	peer, verifiedAt, ok := sn.verifiedIdentity()
+	if !ok {
+		return "", ErrNotAuthenticated
+	}
+	if ttl <= 0 {
+		return "", errors.New(fmt.Sprintf("Token lifetime %v is not positive.", ttl))
+	}
+
+	now := sn.now()
+	payload := tokenPayload{
+		SessionID:  sn.id,
+		VerifiedAt: verifiedAt.Unix(),
+		IssuedAt:   now.Unix(),
+		Expires:    now.Add(ttl).Unix(),
+		MREnclave:  hex.EncodeToString(peer.MREnclave[:]),
+		MRSigner:   hex.EncodeToString(peer.MRSigner[:]),
+		ProdID:     peer.ProdID,
+		SVN:        peer.SVN,
+		ConfigSVN:  peer.ConfigSVN,
+	}
+	if !isZero(peer.FamilyID[:]) {
+		payload.FamilyID = hex.EncodeToString(peer.FamilyID[:])
+	}
+	if !isZero(peer.ConfigID[:]) {
+		payload.ConfigID = hex.EncodeToString(peer.ConfigID[:])
+	}
+	return signToken(signer, &payload)
+}
+
+// signToken encodes payload as a compact JWS signed by signer.
+func signToken(signer crypto.Signer, payload *tokenPayload) (string, error) {
+	alg, err := tokenAlg(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(&tokenHeader{Alg: alg, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	var sig []byte
+	switch alg {
+	case TOKEN_ALG_EDDSA:
+		sig, err = signer.Sign(rand.Reader, []byte(signed), crypto.Hash(0))
+	default:
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Could not sign the token: %w", err)
+	}
+	if alg == TOKEN_ALG_ES256 {
+		// JWS wants r || s rather than the ASN.1 encoding.
+		var rs struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+			return "", fmt.Errorf("Could not parse the token signature: %w", err)
+		}
+		sig = append(fixedBigEndian(rs.R), fixedBigEndian(rs.S)...)
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// tokenAlg picks the signature algorithm for pub.
+func tokenAlg(pub crypto.PublicKey) (string, error) {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return "", errors.New("Only P-256 ECDSA keys can sign tokens.")
+		}
+		return TOKEN_ALG_ES256, nil
+	case ed25519.PublicKey:
+		return TOKEN_ALG_EDDSA, nil
+	case *rsa.PublicKey:
+		return TOKEN_ALG_RS256, nil
+	}
+	return "", errors.New(fmt.Sprintf("Unsupported token key type %T.", pub))
+}
+
+// fixedBigEndian encodes x in EC_COORD_SIZE bytes, big endian.
+func fixedBigEndian(x *big.Int) []byte {
+	b := make([]byte, EC_COORD_SIZE)
+	return x.FillBytes(b)
+}
+
+// VerifyToken checks a token issued by Session.IssueToken with the
+// public key of its signer, so that services other than the one that
+// attested the client can trust the claims without attesting it
+// again. Returns ErrInvalidToken if the token is malformed, was not
+// signed by pub, or was signed with an algorithm other than the one
+// of pub, and ErrTokenExpired once it expires.
+func VerifyToken(token string, pub crypto.PublicKey) (*TokenClaims, error) {
+	return verifyToken(token, pub, time.Now())
+}
+
+func verifyToken(token string, pub crypto.PublicKey, now time.Time) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w The token has %d parts instead of 3.", ErrInvalidToken, len(parts))
+	}
+	enc := base64.RawURLEncoding
+	header, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w Could not decode the header: %v", ErrInvalidToken, err)
+	}
+	claims, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w Could not decode the claims: %v", ErrInvalidToken, err)
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w Could not decode the signature: %v", ErrInvalidToken, err)
+	}
+
+	// The algorithm must be the one of pub, so that a token cannot
+	// pick a weaker check for itself.
+	alg, err := tokenAlg(pub)
+	if err != nil {
+		return nil, err
+	}
+	var h tokenHeader
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, fmt.Errorf("%w Could not parse the header: %v", ErrInvalidToken, err)
+	} else if h.Alg != alg {
+		return nil, fmt.Errorf("%w Algorithm %s instead of %s.", ErrInvalidToken, h.Alg, alg)
+	}
+	if !verifyTokenSignature(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, fmt.Errorf("%w Invalid signature.", ErrInvalidToken)
+	}
+
+	var payload tokenPayload
+	dec := json.NewDecoder(bytes.NewReader(claims))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&payload); err != nil {
+		return nil, fmt.Errorf("%w Could not parse the claims: %v", ErrInvalidToken, err)
+	}
+	c := &TokenClaims{
+		SessionID:  payload.SessionID,
+		VerifiedAt: time.Unix(payload.VerifiedAt, 0),
+		IssuedAt:   time.Unix(payload.IssuedAt, 0),
+		Expires:    time.Unix(payload.Expires, 0),
+	}
+	c.Enclave.ProdID = payload.ProdID
+	c.Enclave.SVN = payload.SVN
+	c.Enclave.ConfigSVN = payload.ConfigSVN
+	for _, field := range []struct {
+		name  string
+		value string
+		dst   []byte
+	}{
+		{"mrenclave", payload.MREnclave, c.Enclave.MREnclave[:]},
+		{"mrsigner", payload.MRSigner, c.Enclave.MRSigner[:]},
+		{"isv_family_id", payload.FamilyID, c.Enclave.FamilyID[:]},
+		{"config_id", payload.ConfigID, c.Enclave.ConfigID[:]},
+	} {
+		if field.value == "" && field.name != "mrenclave" && field.name != "mrsigner" {
+			continue
+		}
+		b, err := hex.DecodeString(field.value)
+		if err != nil || len(b) != len(field.dst) {
+			return nil, fmt.Errorf("%w Invalid %s claim.", ErrInvalidToken, field.name)
+		}
+		copy(field.dst, b)
+	}
+
+	if !now.Before(c.Expires) {
+		return nil, fmt.Errorf("%w The token expired at %v.", ErrTokenExpired, c.Expires)
+	}
+	return c, nil
+}
+
+func verifyTokenSignature(pub crypto.PublicKey, signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		if len(sig) != 2*EC_COORD_SIZE {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:EC_COORD_SIZE])
+		s := new(big.Int).SetBytes(sig[EC_COORD_SIZE:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signed, sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package sgx_server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssueToken(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	sm := newSessionManager(*authConfiguration(), &fakeIAS{}, WithClock(func() time.Time { return now }))
+
+	pending, err := sm.NewSession(&Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn, _ := sm.GetSession(pending.SessionId)
+	ecKey := generateKey()
+	if _, err := sn.IssueToken(ecKey, time.Minute); !errors.Is(err, ErrNotAuthenticated) {
+		t.Fatal("Only authenticated sessions should get a token, got:", err)
+	}
+
+	id, _, err := managerHandshake(t, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn, _ = sm.GetSession(id)
+	peer, err := sn.Peer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sn.IssueToken(ecKey, 0); err == nil {
+		t.Fatal("A token should not be issued with a lifetime of 0.")
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &TokenClaims{
+		SessionID:  id,
+		Enclave:    *peer,
+		VerifiedAt: now,
+		IssuedAt:   now,
+		Expires:    now.Add(time.Hour),
+	}
+	for _, signer := range []crypto.Signer{ecKey, edKey, rsaKey} {
+		token, err := sn.IssueToken(signer, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		} else if strings.Count(token, ".") != 2 {
+			t.Fatal("The token should be a compact JWS:", token)
+		}
+
+		claims, err := verifyToken(token, signer.Public(), now.Add(time.Hour-time.Second))
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(claims, expected) {
+			t.Fatalf("Incorrect claims:\n%+v\n%+v", claims, expected)
+		}
+		if _, err := verifyToken(token, signer.Public(), now.Add(time.Hour)); !errors.Is(err, ErrTokenExpired) {
+			t.Fatal("The token should expire after its lifetime, got:", err)
+		}
+	}
+
+	// Tokens must be signed by the expected key, and cannot be
+	// changed without it.
+	token, err := sn.IssueToken(ecKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	other, err := sn.IssueToken(ecKey, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		token string
+		pub   crypto.PublicKey
+	}{
+		{"other key", token, &generateKey().PublicKey},
+		{"other algorithm", token, edKey.Public()},
+		{"swapped claims", parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2], &ecKey.PublicKey},
+		{"no signature", parts[0] + "." + parts[1] + ".", &ecKey.PublicKey},
+		{"truncated", parts[0] + "." + parts[1], &ecKey.PublicKey},
+		{"not base64", parts[0] + ".!." + parts[2], &ecKey.PublicKey},
+	}
+	for _, test := range tests {
+		if _, err := verifyToken(test.token, test.pub, now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected an invalid token, got: %v", test.name, err)
+		}
+	}
+	if _, err := VerifyToken(token, ecKey.Public().(*ecdsa.PublicKey)); !errors.Is(err, ErrTokenExpired) {
+		t.Fatal("The token issued in 2020 should be expired by now, got:", err)
+	}
+}
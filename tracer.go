@@ -0,0 +1,94 @@
+package sgx_server
+
+import "errors"
+
+// Tracer starts spans for the attestations handled by a
+// SessionManager. It is a small subset of what tracing libraries such
+// as OpenTelemetry provide, so that users can bridge to them without
+// this package depending on any of them.
+type Tracer interface {
+	// StartSpan starts a new span called name.
+	StartSpan(name string) Span
+}
+
+// Span is a single traced operation started by a Tracer.
+type Span interface {
+	// SetAttribute records key and value on the span.
+	SetAttribute(key string, value interface{})
+
+	// RecordError records err as an event on the span.
+	RecordError(err error)
+
+	// End finishes the span. No methods are called on the span
+	// after End.
+	End()
+}
+
+// The span started for each message 3, and the attributes recorded on
+// it.
+const (
+	SPAN_MSG3 = "sgx_server.Msg3ToMsg4"
+
+	// The session id.
+	SPAN_SESSION_ID = "sgx.session_id"
+	// How long IAS took to verify the quote, as a time.Duration.
+	// Not set if IAS was not contacted.
+	SPAN_IAS_LATENCY = "sgx.ias_latency"
+	// The quote status, if IAS rejected the quote because of it.
+	SPAN_QUOTE_STATUS = "sgx.quote_status"
+	// The advisories IAS returned for the quote.
+	SPAN_ADVISORIES = "sgx.advisories"
+	// The enclave security version number, as a uint16. Only set
+	// once the session is authenticated.
+	SPAN_ISV_SVN = "sgx.isv_svn"
+	// Either SPAN_AUTHENTICATED or SPAN_REJECTED.
+	SPAN_OUTCOME = "sgx.outcome"
+
+	SPAN_AUTHENTICATED = "authenticated"
+	SPAN_REJECTED      = "rejected"
+)
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// startSpan starts a span using the tracer of the session manager, if
+// there is one.
+func (sm *sessionManager) startSpan(name string) Span {
+	if sm.tracer == nil {
+		return noopSpan{}
+	}
+	return sm.tracer.StartSpan(name)
+}
+
+// endMsg3Span records the result of processing message 3 in sn (which
+// may be nil if there is no such session) on span, and ends it.
+func endMsg3Span(span Span, sn Session, err error) {
+	if s, ok := sn.(*session); ok {
+		if s.iasCalled {
+			span.SetAttribute(SPAN_IAS_LATENCY, s.iasLatency)
+		}
+		if s.advisories != nil {
+			span.SetAttribute(SPAN_ADVISORIES, s.advisories)
+		}
+	}
+	var statusErr *QuoteStatusError
+	if errors.As(err, &statusErr) {
+		span.SetAttribute(SPAN_QUOTE_STATUS, statusErr.Status)
+	}
+
+	if err == nil && sn != nil && sn.Authenticated() {
+		if s, ok := sn.(*session); ok {
+			span.SetAttribute(SPAN_ISV_SVN, s.isvSVN)
+		}
+		span.SetAttribute(SPAN_OUTCOME, SPAN_AUTHENTICATED)
+	} else {
+		span.SetAttribute(SPAN_OUTCOME, SPAN_REJECTED)
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}